@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 
+	"github.com/elliot40404/mailc/internal/diag"
+	"github.com/elliot40404/mailc/internal/diff"
 	"github.com/elliot40404/mailc/internal/generator"
 	"github.com/elliot40404/mailc/internal/parser"
 )
@@ -21,6 +29,10 @@ Usage:
 
 Commands:
   generate   Parse HTML templates and generate Go code
+  watch      Regenerate Go code whenever templates change
+  preview    Serve rendered templates with sample data and live reload
+  render     Render one template with JSON data
+  smtp-sink  Run a local SMTP server that captures mail, with a web inbox
   help       Show this help message
   version    Show the current mailc version
 
@@ -28,13 +40,213 @@ Flags (for generate command):
   -input     Directory containing HTML email templates (default: ./emails)
   -output    Directory to write generated Go code (default: ./internal/emails)
   -package   Package name for generated Go code (default: emails)
+  -eager     Parse templates at package init instead of lazily on first use
+  -inline-css  Move <style> rules into style attributes of matching elements
+  -check     Exit with status 1 and print a diff if generated files are out of date
+  -include   Only generate templates matching these comma-separated glob patterns
+  -exclude   Skip templates matching these comma-separated glob patterns
+
+Templates in subdirectories of -input, such as billing/, generate into the
+same subdirectory of -output, as a package named after it.
+
+Flags (for watch command):
+  -input, -output, -package, -eager, -inline-css, -include, -exclude   Same as generate
+  -debounce  Wait this long after the last change before regenerating (default: 300ms)
+
+Flags (for preview command):
+  -input     Directory containing HTML email templates (default: ./emails)
+  -addr      Address to serve the preview on (default: localhost:8025)
+
+Flags (for render command):
+  -input     Directory containing HTML email templates (default: ./emails)
+  -template  Template to render, by path relative to -input, with or without .html or .md
+  -data      JSON file with the template data, or - for stdin
+  -out       Write the email as an .eml file instead of printing it
+  -from, -to Headers for the .eml file (-to takes a comma-separated list)
+  -text      Print the plain-text part instead of the HTML
+
+Flags (for smtp-sink command):
+  -smtp      Address to accept SMTP connections on (default: localhost:1025)
+  -http      Address to serve the web inbox and JSON API on (default: localhost:8026)
+  -dir       Store messages as .eml files in this directory instead of in memory
 
 Examples:
   mailc generate -input ./emails -output ./internal/emails
   mailc generate -input ./templates -output ./pkg/emails -package myemails
+  mailc generate -check -input ./emails -output ./internal/emails
+  mailc generate -input ./emails -output ./internal/emails -exclude 'drafts,*_old.html'
+  mailc watch -input ./emails -output ./internal/emails
+  mailc preview -input ./emails
+  mailc render -input ./emails -template order_confirmation -data payload.json
+  mailc smtp-sink -dir ./tmp/mail
   mailc version`)
 }
 
+// loadTemplates parses every file and runs the generator's checks on the
+// templates among them that filter selects, by their path relative to
+// inputDir, collecting diagnostics for all of them rather than stopping at
+// the first problem. Files other templates include as partials are not
+// templates themselves.
+func loadTemplates(files []string, inputDir string, filter parser.Filter) ([]*parser.ParsedTemplate, diag.List) {
+	var templates []*parser.ParsedTemplate
+	var diags diag.List
+	for _, file := range files {
+		pt, err := parser.ParseFile(file)
+		if err != nil {
+			if selected(file, inputDir, filter) {
+				diags.Errorf(file, diag.Pos{}, "%v", err)
+			}
+			continue
+		}
+		templates = append(templates, pt)
+	}
+	partials := make(map[string]bool)
+	for _, pt := range templates {
+		for _, p := range pt.Partials {
+			partials[p.Template.FilePath] = true
+		}
+	}
+	templates = slices.DeleteFunc(templates, func(pt *parser.ParsedTemplate) bool {
+		return partials[pt.FilePath] || !selected(pt.FilePath, inputDir, filter)
+	})
+	return templates, append(diags, checkTemplates(templates)...)
+}
+
+// checkTemplates returns the diagnostics of templates and of the generator's
+// checks, deduplicated and sorted.
+func checkTemplates(templates []*parser.ParsedTemplate) diag.List {
+	var diags diag.List
+	for _, pt := range templates {
+		diags = append(diags, pt.Diagnostics...)
+	}
+	diags = append(diags, generator.Check(templates)...)
+	diags = diags.Compact()
+	diags.Sort()
+	return diags
+}
+
+// selected reports whether filter selects the template at path in inputDir.
+func selected(path, inputDir string, filter parser.Filter) bool {
+	rel, err := filepath.Rel(inputDir, path)
+	if err != nil {
+		rel = path
+	}
+	return filter.Match(rel)
+}
+
+// reportDiagnostics prints diagnostics to stderr and reports whether any of
+// them is an error.
+func reportDiagnostics(diags diag.List) bool {
+	errCount := 0
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d)
+		if d.Severity == diag.Error {
+			errCount++
+		}
+	}
+	if errCount > 0 {
+		fmt.Fprintf(os.Stderr, "%d error(s) found; no code generated\n", errCount)
+	}
+	return errCount > 0
+}
+
+// checkGenerated generates code in memory and compares it byte for byte with
+// the files in outputDir, printing to w a unified diff for every file that
+// is missing or differs, and for every generated file in outputDir or its
+// subdirectories that would no longer be generated, such as the code of a
+// deleted template. It returns the number of stale files and how many of
+// them would no longer be generated. When orphans is false, as when
+// -include or -exclude leave templates out, files that would no longer be
+// generated are not reported.
+func checkGenerated(w io.Writer, pkgs []generator.Package, outputDir string, opts generator.Options, orphans bool) (stale, orphaned int, err error) {
+	files := make(map[string][]byte)
+	for _, pkg := range pkgs {
+		pkgFiles := generator.MemWriter{}
+		opts.PackageName = pkg.Name
+		if err := generator.Generate(pkg.Templates, pkgFiles, opts); err != nil {
+			return 0, 0, err
+		}
+		for name, data := range pkgFiles {
+			files[filepath.Join(pkg.Dir, name)] = data
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	if orphans {
+		existing, err := generatedFiles(outputDir)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, name := range existing {
+			if _, ok := files[name]; !ok {
+				names = append(names, name)
+				orphaned++
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(outputDir, name)
+		oldName, newName := path, path
+		current, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			oldName = "/dev/null"
+		} else if err != nil {
+			return 0, 0, err
+		}
+		want, ok := files[name]
+		if !ok {
+			newName = "/dev/null"
+		}
+		if ok && bytes.Equal(current, want) {
+			continue
+		}
+		stale++
+		fmt.Fprint(w, diff.Unified(oldName, newName, current, want))
+	}
+	return stale, orphaned, nil
+}
+
+// generatedHeader starts every file mailc generates.
+const generatedHeader = "// Code generated by mailc. DO NOT EDIT.\n"
+
+// generatedFiles lists the files in outputDir and its subdirectories that
+// mailc generated, relative to outputDir: those named like its output that
+// start with its header.
+func generatedFiles(outputDir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && path == outputDir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if !strings.HasSuffix(name, ".email.go") && !strings.HasSuffix(name, ".partial.go") &&
+			name != "partials.go" && name != "types.go" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(data, []byte(generatedHeader)) {
+			return nil
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	return files, err
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		printHelp()
@@ -56,43 +268,90 @@ func main() {
 		outputDir := fs.String("output", "./internal/emails", "Directory to write generated Go code")
 		packageName := fs.String("package", "emails", "Package name for generated Go code")
 		version := fs.String("version", VERSION, "Version string to embed in generated files")
+		eager := fs.Bool("eager", false, "Parse templates at package init with template.Must instead of lazily on first use")
+		inlineCSS := fs.Bool("inline-css", false, "Move <style> rules into style attributes, as if every template declared @inline-css")
+		check := fs.Bool("check", false, "Report generated files that are out of date instead of writing them")
+		include := fs.String("include", "", "Only generate templates matching these comma-separated glob patterns")
+		exclude := fs.String("exclude", "", "Skip templates matching these comma-separated glob patterns")
 		err := fs.Parse(os.Args[2:])
 		if err != nil {
 			log.Fatalf("Error parsing cli flags")
 		}
+		filter, err := parser.ParseFilter(*include, *exclude)
+		if err != nil {
+			log.Fatalf("Invalid -include or -exclude: %v", err)
+		}
 
 		if _, err := os.Stat(*inputDir); os.IsNotExist(err) {
 			log.Fatalf("Input directory does not exist: %s", *inputDir)
 		}
 
-		if err := os.MkdirAll(*outputDir, 0o755); err != nil {
-			log.Fatalf("Failed to create output directory: %v", err)
-		}
-
-		files, err := filepath.Glob(filepath.Join(*inputDir, "*.html"))
+		files, err := parser.WalkTemplates(*inputDir)
 		if err != nil {
 			log.Fatalf("Failed to list template files: %v", err)
 		}
-		if len(files) == 0 {
-			log.Fatalf("No .html files found in input directory: %s", *inputDir)
+
+		// Parse and check all templates, reporting every problem before exiting
+		templates, diags := loadTemplates(files, *inputDir, filter)
+		if reportDiagnostics(diags) {
+			os.Exit(1)
 		}
+		if len(templates) == 0 {
+			log.Fatalf("No .html or .md templates found in input directory: %s", *inputDir)
+		}
+		pkgs := generator.Packages(templates, *inputDir, *packageName)
 
-		// Parse all templates
-		var templates []*parser.ParsedTemplate
-		for _, file := range files {
-			pt, err := parser.ParseFile(file)
+		// Generate code
+		opts := generator.Options{
+			PackageName: *packageName,
+			Version:     *version,
+			EagerParse:  *eager,
+			InlineCSS:   *inlineCSS,
+		}
+		if *check {
+			stale, orphaned, err := checkGenerated(os.Stdout, pkgs, *outputDir, opts, len(filter.Include)+len(filter.Exclude) == 0)
 			if err != nil {
-				log.Fatalf("Failed to parse %s: %v", file, err)
+				log.Fatalf("Code generation failed: %v", err)
+			}
+			if stale > 0 {
+				fmt.Fprintf(os.Stderr, "%d generated file(s) out of date; run mailc generate\n", stale)
+				if orphaned > 0 {
+					fmt.Fprintf(os.Stderr, "%d of them are no longer generated; delete them\n", orphaned)
+				}
+				os.Exit(1)
 			}
-			templates = append(templates, pt)
+			fmt.Printf("✅ Generated code in %s is up to date\n", *outputDir)
+			return
 		}
 
-		// Generate code
-		if err := generator.GenerateCode(templates, *outputDir, *packageName, *version); err != nil {
-			log.Fatalf("Code generation failed: %v", err)
+		for _, pkg := range pkgs {
+			dir := filepath.Join(*outputDir, pkg.Dir)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				log.Fatalf("Failed to create output directory: %v", err)
+			}
+			opts.PackageName = pkg.Name
+			if err := generator.GenerateCode(pkg.Templates, dir, opts); err != nil {
+				log.Fatalf("Code generation failed: %v", err)
+			}
+		}
+
+		if len(pkgs) > 1 {
+			fmt.Printf("✅ Generated %d email templates in %d packages into %s\n", len(templates), len(pkgs), *outputDir)
+		} else {
+			fmt.Printf("✅ Generated %d email templates into %s\n", len(templates), *outputDir)
 		}
 
-		fmt.Printf("✅ Generated %d email templates into %s\n", len(templates), *outputDir)
+	case "watch":
+		runWatch(os.Args[2:])
+
+	case "preview":
+		runPreview(os.Args[2:])
+
+	case "render":
+		runRender(os.Args[2:])
+
+	case "smtp-sink":
+		runSMTPSink(os.Args[2:])
 
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", os.Args[1])
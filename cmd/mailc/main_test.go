@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elliot40404/mailc/internal/generator"
+	"github.com/elliot40404/mailc/internal/parser"
+)
+
+func TestCheckGenerated(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	for name, body := range map[string]string{
+		"welcome.html":         `<p>Hi {{name}}</p>`,
+		"billing/invoice.html": `<p>Invoice {{number}}</p>`,
+	} {
+		path := filepath.Join(in, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	pts, err := parser.ParseDir(in)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	opts := generator.Options{PackageName: "emails", Version: "TEST"}
+	pkgs := generator.Packages(pts, in, opts.PackageName)
+	for _, pkg := range pkgs {
+		dir := filepath.Join(out, pkg.Dir)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		opts := opts
+		opts.PackageName = pkg.Name
+		if err := generator.GenerateCode(pkg.Templates, dir, opts); err != nil {
+			t.Fatalf("GenerateCode: %v", err)
+		}
+	}
+	check := func(wantStale, wantOrphaned int, wantDiff ...string) {
+		t.Helper()
+		var buf bytes.Buffer
+		stale, orphaned, err := checkGenerated(&buf, pkgs, out, opts, true)
+		if err != nil {
+			t.Fatalf("checkGenerated: %v", err)
+		}
+		if stale != wantStale || orphaned != wantOrphaned {
+			t.Fatalf("got %d stale files, %d orphaned, want %d, %d; diff:\n%s", stale, orphaned, wantStale, wantOrphaned, buf.String())
+		}
+		for _, want := range wantDiff {
+			if !strings.Contains(buf.String(), want) {
+				t.Fatalf("expected the diff to contain %q, got:\n%s", want, buf.String())
+			}
+		}
+	}
+
+	// Up to date
+	check(0, 0)
+
+	// Changed
+	welcome := filepath.Join(out, "welcome.email.go")
+	src, err := os.ReadFile(welcome)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := os.WriteFile(welcome, bytes.Replace(src, []byte("Hi"), []byte("Hello"), 1), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	check(1, 0, "--- "+welcome, "+++ "+welcome, "-const welcomeEmailHTMLTemplate = `<p>Hello")
+	if err := os.WriteFile(welcome, src, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// Missing
+	invoice := filepath.Join(out, "billing", "invoice.email.go")
+	if err := os.Remove(invoice); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	check(1, 0, "--- /dev/null\n+++ "+invoice)
+	if err := generator.GenerateCode(pkgs[1].Templates, filepath.Join(out, "billing"), generator.Options{PackageName: "billing", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	check(0, 0)
+
+	// Orphaned, including a whole subpackage; other files, and files named
+	// like mailc's output without its header, are left alone
+	for name, body := range map[string]string{
+		"old.email.go":        generatedHeader + "package x\n",
+		"legacy/types.go":     generatedHeader + "package legacy\n",
+		"legacy/old.email.go": generatedHeader + "package legacy\n",
+		"legacy/doc.go":       "package legacy\n",
+		"models/types.go":     "package models\n",
+	} {
+		path := filepath.Join(out, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	check(3, 3,
+		"--- "+filepath.Join(out, "old.email.go")+"\n+++ /dev/null",
+		"--- "+filepath.Join(out, "legacy", "types.go")+"\n+++ /dev/null",
+		"--- "+filepath.Join(out, "legacy", "old.email.go")+"\n+++ /dev/null",
+	)
+	if err := os.Remove(filepath.Join(out, "old.email.go")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(out, "legacy")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	check(0, 0)
+
+	// With -include, the files of the templates left out are not orphaned
+	filter, err := parser.ParseFilter("billing/*", "")
+	if err != nil {
+		t.Fatalf("ParseFilter: %v", err)
+	}
+	files, err := parser.WalkTemplates(in)
+	if err != nil {
+		t.Fatalf("WalkTemplates: %v", err)
+	}
+	templates, diags := loadTemplates(files, in, filter)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	pkgs = generator.Packages(templates, in, opts.PackageName)
+	if len(pkgs) != 1 || pkgs[0].Dir != "billing" {
+		t.Fatalf("expected only the billing package, got %+v", pkgs)
+	}
+	var buf bytes.Buffer
+	stale, orphaned, err := checkGenerated(&buf, pkgs, out, opts, len(filter.Include)+len(filter.Exclude) == 0)
+	if err != nil {
+		t.Fatalf("checkGenerated: %v", err)
+	}
+	if stale != 0 || orphaned != 0 {
+		t.Fatalf("got %d stale files, %d orphaned with -include, want none; diff:\n%s", stale, orphaned, buf.String())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/elliot40404/mailc/internal/preview"
+)
+
+func runPreview(args []string) {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	inputDir := fs.String("input", "./emails", "Directory containing HTML email templates")
+	addr := fs.String("addr", "localhost:8025", "Address to serve the preview on")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Error parsing cli flags")
+	}
+
+	if _, err := os.Stat(*inputDir); os.IsNotExist(err) {
+		log.Fatalf("Input directory does not exist: %s", *inputDir)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	srv := preview.New(*inputDir)
+	go srv.Watch(ctx, func(err error) {
+		fmt.Fprintf(os.Stderr, "watch: %v\n", err)
+	})
+
+	httpSrv := &http.Server{Addr: *addr, Handler: srv.Handler()}
+	go func() {
+		<-ctx.Done()
+		_ = httpSrv.Close()
+	}()
+	fmt.Printf("🔎 Previewing %s at http://%s (Ctrl+C to stop)\n", *inputDir, *addr)
+	if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Preview server failed: %v", err)
+	}
+}
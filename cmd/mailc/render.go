@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/generator"
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/mailer"
+)
+
+func runRender(args []string) {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	inputDir := fs.String("input", "./emails", "Directory containing HTML email templates")
+	name := fs.String("template", "", "Template to render, by path relative to -input, with or without .html or .md")
+	dataFile := fs.String("data", "", "JSON file with the template data, or - for stdin")
+	out := fs.String("out", "", "Write the email as an .eml file instead of printing it")
+	from := fs.String("from", "", "From header for -out")
+	to := fs.String("to", "", "Comma-separated To addresses for -out")
+	text := fs.Bool("text", false, "Print the plain-text part instead of the HTML")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Error parsing cli flags")
+	}
+	if *name == "" || *dataFile == "" {
+		log.Fatalf("render needs -template and -data")
+	}
+
+	path := filepath.Join(*inputDir, *name)
+	if !parser.IsTemplateFile(path) {
+		path += ".html"
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = strings.TrimSuffix(path, ".html") + ".md"
+		}
+	}
+	if parser.IsShared(path) {
+		log.Fatalf("%s is a layout or partial; render a template that uses it", path)
+	}
+	templates, diags := loadTemplates([]string{path}, *inputDir, parser.Filter{})
+	if reportDiagnostics(diags) {
+		os.Exit(1)
+	}
+	pt := templates[0]
+
+	var src []byte
+	var err error
+	if *dataFile == "-" {
+		src, err = io.ReadAll(os.Stdin)
+	} else {
+		src, err = os.ReadFile(*dataFile)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read data: %v", err)
+	}
+	data, err := generator.DecodeData(pt, src)
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *dataFile, line)
+		}
+		os.Exit(1)
+	}
+
+	res, err := generator.Render(pt, data)
+	if err != nil {
+		log.Fatalf("Render failed: %v", err)
+	}
+
+	if *out == "" {
+		body := res.HTML
+		if *text {
+			body = res.Text
+		}
+		fmt.Printf("Subject: %s\n\n%s\n", res.Subject, body)
+		return
+	}
+	msg := &mailer.Message{From: *from, Subject: res.Subject, HTML: res.HTML, Text: res.Text}
+	if *to != "" {
+		msg.To = strings.Split(*to, ",")
+	}
+	eml, err := msg.Bytes()
+	if err != nil {
+		log.Fatalf("Failed to build %s: %v", *out, err)
+	}
+	if err := os.WriteFile(*out, eml, 0o644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+	fmt.Printf("✅ Wrote %s\n", *out)
+}
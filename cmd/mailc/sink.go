@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/elliot40404/mailc/smtpsink"
+)
+
+func runSMTPSink(args []string) {
+	fs := flag.NewFlagSet("smtp-sink", flag.ExitOnError)
+	smtpAddr := fs.String("smtp", "localhost:1025", "Address to accept SMTP connections on")
+	httpAddr := fs.String("http", "localhost:8026", "Address to serve the web inbox and JSON API on")
+	dir := fs.String("dir", "", "Store messages as .eml files in this directory instead of in memory")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Error parsing cli flags")
+	}
+
+	var store smtpsink.Store = &smtpsink.MemoryStore{}
+	if *dir != "" {
+		store = &smtpsink.DirStore{Dir: *dir}
+	}
+	sink := smtpsink.New(store)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	httpSrv := &http.Server{Addr: *httpAddr, Handler: sink.Handler()}
+	go func() {
+		<-ctx.Done()
+		_ = sink.Close()
+		_ = httpSrv.Close()
+	}()
+	go func() {
+		if err := sink.ListenAndServe(*smtpAddr); err != nil {
+			log.Fatalf("SMTP server failed: %v", err)
+		}
+	}()
+
+	fmt.Printf("📬 Accepting mail on smtp://%s, inbox at http://%s (Ctrl+C to stop)\n", *smtpAddr, *httpAddr)
+	if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Web server failed: %v", err)
+	}
+}
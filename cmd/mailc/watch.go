@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/elliot40404/mailc/internal/generator"
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/watch"
+)
+
+// changedWriter writes generated files into a directory, skipping files whose
+// content is already up to date so that unaffected files keep their mtime.
+type changedWriter string
+
+func (dir changedWriter) WriteFile(name string, data []byte) error {
+	path := filepath.Join(string(dir), name)
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	return generator.DirWriter(dir).WriteFile(name, data)
+}
+
+// skipWriter writes generated files through w, except those named in skip.
+type skipWriter struct {
+	w    generator.Writer
+	skip map[string]bool
+}
+
+func (s skipWriter) WriteFile(name string, data []byte) error {
+	if s.skip[name] {
+		return nil
+	}
+	return s.w.WriteFile(name, data)
+}
+
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	inputDir := fs.String("input", "./emails", "Directory containing HTML email templates")
+	outputDir := fs.String("output", "./internal/emails", "Directory to write generated Go code")
+	packageName := fs.String("package", "emails", "Package name for generated Go code")
+	version := fs.String("version", VERSION, "Version string to embed in generated files")
+	eager := fs.Bool("eager", false, "Parse templates at package init with template.Must instead of lazily on first use")
+	inlineCSS := fs.Bool("inline-css", false, "Move <style> rules into style attributes, as if every template declared @inline-css")
+	include := fs.String("include", "", "Only generate templates matching these comma-separated glob patterns")
+	exclude := fs.String("exclude", "", "Skip templates matching these comma-separated glob patterns")
+	debounce := fs.Duration("debounce", 300*time.Millisecond, "Wait this long after the last change before regenerating")
+	if err := fs.Parse(args); err != nil {
+		log.Fatalf("Error parsing cli flags")
+	}
+	filter, err := parser.ParseFilter(*include, *exclude)
+	if err != nil {
+		log.Fatalf("Invalid -include or -exclude: %v", err)
+	}
+
+	if _, err := os.Stat(*inputDir); os.IsNotExist(err) {
+		log.Fatalf("Input directory does not exist: %s", *inputDir)
+	}
+	if err := os.MkdirAll(*outputDir, 0o755); err != nil {
+		log.Fatalf("Failed to create output directory: %v", err)
+	}
+
+	g := &regenerator{
+		inputDir:  *inputDir,
+		outputDir: *outputDir,
+		opts: generator.Options{
+			PackageName: *packageName,
+			Version:     *version,
+			EagerParse:  *eager,
+			InlineCSS:   *inlineCSS,
+		},
+		filter:    filter,
+		includes:  make(map[string][]string),
+		templates: make(map[string]*parser.ParsedTemplate),
+	}
+	w := watch.New(*inputDir, func(name string) bool {
+		return parser.IsTemplateFile(name) || strings.HasSuffix(name, ".txt") ||
+			strings.HasSuffix(name, fixturesSuffix)
+	})
+	w.Recursive = true // subpackages and partials live in subdirectories
+	w.Debounce = *debounce
+
+	// Generate everything once, then only what changes
+	initial, err := w.Poll()
+	if err != nil {
+		log.Fatalf("Failed to list template files: %v", err)
+	}
+	g.update(initial)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("👀 Watching %s for changes (Ctrl+C to stop)\n", *inputDir)
+	w.Run(ctx, g.update, func(err error) {
+		fmt.Fprintf(os.Stderr, "watch: %v\n", err)
+	})
+}
+
+const fixturesSuffix = ".fixtures.json"
+
+// regenerator keeps generated code up to date as files change. A file in a
+// subdirectory is a template of a subpackage unless a template includes it
+// as a partial, so it remembers what every template includes. The files
+// shared by a package, such as types.go, depend on all of its templates, so
+// it also keeps the last parse without errors of every generated template.
+type regenerator struct {
+	inputDir, outputDir string
+	opts                generator.Options
+	filter              parser.Filter
+	includes            map[string][]string               // template -> partial files
+	templates           map[string]*parser.ParsedTemplate // template -> last good parse
+}
+
+// partials returns the files some template includes.
+func (g *regenerator) partials() map[string]bool {
+	partials := make(map[string]bool)
+	for _, files := range g.includes {
+		for _, file := range files {
+			partials[file] = true
+		}
+	}
+	return partials
+}
+
+// update regenerates the files affected by ev. Templates with errors are
+// reported and keep their previously generated code.
+func (g *regenerator) update(ev watch.Event) {
+	// A changed or removed fixtures or text file affects the template next
+	// to it
+	changed := make(map[string]bool)
+	for _, path := range append(ev.Changed, ev.Removed...) {
+		tmpl, ok := strings.CutSuffix(path, fixturesSuffix)
+		if !ok {
+			tmpl, ok = strings.CutSuffix(path, ".txt")
+		}
+		if !ok {
+			continue
+		}
+		for _, ext := range []string{".html", ".md"} {
+			if _, err := os.Stat(tmpl + ext); err == nil && !parser.IsShared(tmpl+ext) {
+				changed[tmpl+ext] = true
+			}
+		}
+	}
+	for _, path := range ev.Changed {
+		if parser.IsTemplateFile(path) && !parser.IsShared(path) {
+			changed[path] = true
+		}
+	}
+
+	dirty := make(map[string]bool) // package directories to regenerate
+	forget := func(path string) {
+		if g.templates[path] != nil {
+			delete(g.templates, path)
+			dirty[g.packageDir(path)] = true
+		}
+	}
+	wasPartial := g.partials()
+	for _, path := range ev.Removed {
+		if !parser.IsTemplateFile(path) || parser.IsShared(path) {
+			continue
+		}
+		delete(g.includes, path)
+		forget(path)
+		if !wasPartial[path] {
+			g.remove(path)
+		}
+	}
+
+	loaded := make(map[string]*parser.ParsedTemplate)
+	load := func(path string) {
+		pt, err := parser.ParseFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %s: %v\n", path, err)
+			delete(g.includes, path)
+			return
+		}
+		loaded[path] = pt
+		g.includes[path] = nil
+		for _, p := range pt.Partials {
+			g.includes[path] = append(g.includes[path], p.Template.FilePath)
+		}
+	}
+	for path := range changed {
+		load(path)
+	}
+	partials := g.partials()
+	// A layout or partial may be used by any template
+	for _, path := range append(ev.Changed, ev.Removed...) {
+		if parser.IsTemplateFile(path) && (parser.IsShared(path) || partials[path] || wasPartial[path]) {
+			for _, file := range slices.Sorted(maps.Keys(g.includes)) {
+				if loaded[file] == nil {
+					load(file)
+				}
+			}
+			partials = g.partials()
+			break
+		}
+	}
+
+	regenerated := make(map[string]bool)
+	for _, path := range slices.Sorted(maps.Keys(loaded)) {
+		if partials[path] {
+			// It may have been generated before a template included it
+			if !wasPartial[path] {
+				g.remove(path)
+			}
+			forget(path)
+			continue
+		}
+		if !selected(path, g.inputDir, g.filter) {
+			continue
+		}
+		pt := loaded[path]
+		diags := checkTemplates([]*parser.ParsedTemplate{pt})
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		if diags.HasErrors() {
+			fmt.Fprintf(os.Stderr, "❌ %s has errors; generated code left unchanged\n", path)
+			continue
+		}
+		g.templates[path] = pt
+		regenerated[path] = true
+		dirty[g.packageDir(path)] = true
+	}
+
+	// Generate every affected package from all of its templates, writing the
+	// code of the regenerated ones and the files the package shares
+	var templates []*parser.ParsedTemplate
+	for _, path := range slices.Sorted(maps.Keys(g.templates)) {
+		templates = append(templates, g.templates[path])
+	}
+	for _, pkg := range generator.Packages(templates, g.inputDir, g.opts.PackageName) {
+		if !dirty[pkg.Dir] {
+			continue
+		}
+		dir := filepath.Join(g.outputDir, pkg.Dir)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Code generation failed for %s: %v\n", dir, err)
+			continue
+		}
+		skip := make(map[string]bool)
+		for _, pt := range pkg.Templates {
+			if !regenerated[pt.FilePath] {
+				skip[generator.OutputFileName(pt)] = true
+			}
+		}
+		opts := g.opts
+		opts.PackageName = pkg.Name
+		if err := generator.Generate(pkg.Templates, skipWriter{changedWriter(dir), skip}, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Code generation failed for %s: %v\n", dir, err)
+			continue
+		}
+		for _, pt := range pkg.Templates {
+			if regenerated[pt.FilePath] {
+				fmt.Printf("✅ Regenerated %s\n", generator.OutputPath(pt, g.inputDir))
+			}
+		}
+	}
+}
+
+// packageDir returns the directory of the package generated for the
+// template at path, relative to the output directory.
+func (g *regenerator) packageDir(path string) string {
+	return filepath.Dir(generator.OutputPath(&parser.ParsedTemplate{FilePath: path}, g.inputDir))
+}
+
+// remove deletes the file generated for the template at path.
+func (g *regenerator) remove(path string) {
+	name := generator.OutputPath(&parser.ParsedTemplate{FilePath: path}, g.inputDir)
+	if err := os.Remove(filepath.Join(g.outputDir, name)); err == nil {
+		fmt.Printf("🗑  Removed %s\n", name)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elliot40404/mailc/internal/generator"
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/watch"
+)
+
+func TestRegenerator_SharedTypes(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(in, name)
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+	write(parser.TypesFile, `<!-- @type User.Name string -->`)
+	order := write("order.html", `<!-- @shared User -->
+<!-- @type buyer User -->
+<p>Thanks {{buyer.Name}}</p>`)
+	welcome := write("welcome.html", `<!-- @type name string -->
+<p>Hi {{name}}</p>`)
+
+	opts := generator.Options{PackageName: "emails", Version: "TEST"}
+	g := &regenerator{
+		inputDir:  in,
+		outputDir: out,
+		opts:      opts,
+		includes:  make(map[string][]string),
+		templates: make(map[string]*parser.ParsedTemplate),
+	}
+	// upToDate reports a difference with the code mailc generate writes.
+	upToDate := func() {
+		t.Helper()
+		pts, err := parser.ParseDir(in)
+		if err != nil {
+			t.Fatalf("ParseDir: %v", err)
+		}
+		var buf bytes.Buffer
+		stale, _, err := checkGenerated(&buf, generator.Packages(pts, in, opts.PackageName), out, opts, true)
+		if err != nil {
+			t.Fatalf("checkGenerated: %v", err)
+		}
+		if stale > 0 {
+			t.Fatalf("watch output differs from generate:\n%s", buf.String())
+		}
+	}
+
+	g.update(watch.Event{Changed: []string{filepath.Join(in, parser.TypesFile), order, welcome}})
+	upToDate()
+
+	// Regenerating the template without @shared keeps the shared struct of
+	// the other, and leaves the code of the other alone
+	orderGo := filepath.Join(out, "order.email.go")
+	if err := os.WriteFile(orderGo, []byte("// edited\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	write("welcome.html", `<!-- @type name string -->
+<p>Hello {{name}}</p>`)
+	g.update(watch.Event{Changed: []string{welcome}})
+	types, err := os.ReadFile(filepath.Join(out, "types.go"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(types), "type User struct") {
+		t.Fatalf("types.go lost the shared User struct:\n%s", types)
+	}
+	if src, err := os.ReadFile(orderGo); err != nil || string(src) != "// edited\n" {
+		t.Fatalf("order.email.go was rewritten: %q, %v", src, err)
+	}
+
+	// Once the other template changes too, everything matches generate
+	g.update(watch.Event{Changed: []string{order}})
+	upToDate()
+
+	// Removing the template using the shared struct drops it from types.go
+	if err := os.Remove(order); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	g.update(watch.Event{Removed: []string{order}})
+	upToDate()
+}
@@ -7,7 +7,10 @@ import (
 	"bytes"
 	"fmt"
 	htmltemplate "html/template"
+	"sync"
 	texttemplate "text/template"
+
+	"github.com/elliot40404/mailc/htmltext"
 )
 
 type AccountInviteLinkEmailData struct {
@@ -18,7 +21,7 @@ const accountInviteLinkEmailHTMLTemplate = `<html>
 
 <head>
     <meta charset="UTF-8">
-    <title>Sign In</title>
+    <title>{{template "title" .}}</title>
     <style>
         table {
             border-collapse: collapse;
@@ -35,41 +38,68 @@ const accountInviteLinkEmailHTMLTemplate = `<html>
             background-color: #f2f2f2;
         }
     </style>
+    {{htmlComment "<!--[if mso]>"}}
+    <style>
+        table, td {
+            font-family: Arial, sans-serif;
+        }
+    </style>
+    {{htmlComment "<![endif]-->"}}
 </head>
 
 <body>
+    {{- template "content" .}}
+    {{- template "footer" .}}
+</body>
+
+</html>
+{{define "title"}}Sign In{{end}}{{define "content"}}
     <h1>Welcome to ACME!</h1>
     <p>Use the link below to sign in:</p>
-    <a href="{{ .InviteLink}}">Sign in</a>
+    {{template "partials/button.html" (params "Label" "Sign in" "URL" .InviteLink)}}
+{{- end}}{{define "footer"}}
     <p>Thanks for choosing us!</p>
-</body>
-
-</html>`
+    {{- end}}`
 const accountInviteLinkEmailSubjectTemplate = `Your ACME sign-in link`
 
-func AccountInviteLinkEmail(data *AccountInviteLinkEmailData) (result RenderedEmail, err error) {
-	bodyTmpl, err := htmltemplate.New("account_invite_link").Parse(accountInviteLinkEmailHTMLTemplate)
+var (
+	accountInviteLinkEmailParseOnce   sync.Once
+	accountInviteLinkEmailParseErr    error
+	accountInviteLinkEmailBodyTmpl    *htmltemplate.Template
+	accountInviteLinkEmailSubjectTmpl *texttemplate.Template
+)
+
+func parseAccountInviteLinkEmailTemplates() (err error) {
+	accountInviteLinkEmailBodyTmpl, err = parseWithPartials(htmltemplate.New("account_invite_link"), accountInviteLinkEmailHTMLTemplate, partialsButtonPartial)
+	if err != nil {
+		return fmt.Errorf("parse body template: %w", err)
+	}
+	accountInviteLinkEmailSubjectTmpl, err = texttemplate.New("account_invite_link_subject").Parse(accountInviteLinkEmailSubjectTemplate)
 	if err != nil {
-		return result, fmt.Errorf("parse body template: %w", err)
+		return fmt.Errorf("parse subject template: %w", err)
+	}
+	return nil
+}
+
+func AccountInviteLinkEmail(data *AccountInviteLinkEmailData) (result RenderedEmail, err error) {
+	accountInviteLinkEmailParseOnce.Do(func() { accountInviteLinkEmailParseErr = parseAccountInviteLinkEmailTemplates() })
+	if accountInviteLinkEmailParseErr != nil {
+		return result, accountInviteLinkEmailParseErr
 	}
 
 	var bodyBuf bytes.Buffer
-	if err := bodyTmpl.Execute(&bodyBuf, data); err != nil {
+	if err := accountInviteLinkEmailBodyTmpl.Execute(&bodyBuf, data); err != nil {
 		return result, fmt.Errorf("render body: %w", err)
 	}
 
 	result.HTML = bodyBuf.String()
 
-	subjTmpl, err := texttemplate.New("account_invite_link_subject").Parse(accountInviteLinkEmailSubjectTemplate)
-	if err != nil {
-		return result, fmt.Errorf("parse subject template: %w", err)
-	}
-
 	var subjBuf bytes.Buffer
-	if err := subjTmpl.Execute(&subjBuf, data); err != nil {
+	if err := accountInviteLinkEmailSubjectTmpl.Execute(&subjBuf, data); err != nil {
 		return result, fmt.Errorf("render subject: %w", err)
 	}
 
 	result.Subject = subjBuf.String()
+	result.Text = htmltext.FromHTML(result.HTML)
 	return result, nil
 }
@@ -7,94 +7,124 @@ import (
 	"bytes"
 	"fmt"
 	htmltemplate "html/template"
+	"sync"
 	texttemplate "text/template"
+
+	"github.com/elliot40404/mailc/htmltext"
 )
 
+type OrderConfirmationEmailItem struct {
+	Name string
+	Qty  int
+}
+
 type OrderConfirmationEmailOrder struct {
 	ID        int
-	Name      string
-	Qty       int
 	CreatedAt string
-}
-
-type OrderConfirmationEmailUser struct {
-	Name string
+	Items     []OrderConfirmationEmailItem
 }
 
 type OrderConfirmationEmailData struct {
 	Order OrderConfirmationEmailOrder
-	User  OrderConfirmationEmailUser
+	User  User
 }
 
 const orderConfirmationEmailHTMLTemplate = `<html>
 
 <head>
     <meta charset="UTF-8">
-    <title>Order Confirmation</title>
+    <title>{{template "title" .}}</title>
+    {{htmlComment "<!--[if mso]>"}}
     <style>
-        table {
-            border-collapse: collapse;
-            width: 100%;
-        }
-
-        th,
-        td {
-            border: 1px solid #ddd;
-            padding: 8px;
-        }
-
-        th {
-            background-color: #f2f2f2;
+        table, td {
+            font-family: Arial, sans-serif;
         }
     </style>
+    {{htmlComment "<![endif]-->"}}
 </head>
 
 <body>
+    {{- template "content" .}}
+    {{- template "footer" .}}
+</body>
+
+</html>
+{{define "title"}}Order Confirmation{{end}}{{define "content"}}
     <h1>Welcome, {{ .User.Name}}!</h1>
     <p>Your recent order details are below:</p>
-    <table>
+    <table style="border-collapse: collapse; width: 100%">
         <tr>
-            <th>Order ID</th>
-            <th>Product Name</th>
-            <th>Qty</th>
-            <th>Placed At</th>
+            <th style="border: 1px solid #ddd; padding: 8px; background-color: #f2f2f2">Order ID</th>
+            <th style="border: 1px solid #ddd; padding: 8px; background-color: #f2f2f2">Product Name</th>
+            <th style="border: 1px solid #ddd; padding: 8px; background-color: #f2f2f2">Qty</th>
+            <th style="border: 1px solid #ddd; padding: 8px; background-color: #f2f2f2">Placed At</th>
         </tr>
+        {{range .Order.Items}}
         <tr>
-            <td>{{ .Order.ID}}</td>
-            <td>{{ .Order.Name}}</td>
-            <td>{{ .Order.Qty}}</td>
-            <td>{{ .Order.CreatedAt}}</td>
+            <td style="border: 1px solid #ddd; padding: 8px">{{ $.Order.ID}}</td>
+            <td style="border: 1px solid #ddd; padding: 8px">{{.Name}}</td>
+            <td style="border: 1px solid #ddd; padding: 8px">{{.Qty}}</td>
+            <td style="border: 1px solid #ddd; padding: 8px">{{ $.Order.CreatedAt}}</td>
         </tr>
+        {{end}}
     </table>
+{{- end}}{{define "footer"}}
     <p>Thanks for choosing us!</p>
-</body>
-
-</html>`
+    {{- end}}`
 const orderConfirmationEmailSubjectTemplate = `Welcome {{ .User.Name}} – Order #{{ .Order.ID}} placed {{ .Order.CreatedAt}}`
 
-func OrderConfirmationEmail(data *OrderConfirmationEmailData) (result RenderedEmail, err error) {
-	bodyTmpl, err := htmltemplate.New("order_confirmation").Parse(orderConfirmationEmailHTMLTemplate)
+var (
+	orderConfirmationEmailParseOnce   sync.Once
+	orderConfirmationEmailParseErr    error
+	orderConfirmationEmailBodyTmpl    *htmltemplate.Template
+	orderConfirmationEmailSubjectTmpl *texttemplate.Template
+)
+
+func parseOrderConfirmationEmailTemplates() (err error) {
+	orderConfirmationEmailBodyTmpl, err = parseWithPartials(htmltemplate.New("order_confirmation"), orderConfirmationEmailHTMLTemplate)
+	if err != nil {
+		return fmt.Errorf("parse body template: %w", err)
+	}
+	orderConfirmationEmailSubjectTmpl, err = texttemplate.New("order_confirmation_subject").Parse(orderConfirmationEmailSubjectTemplate)
 	if err != nil {
-		return result, fmt.Errorf("parse body template: %w", err)
+		return fmt.Errorf("parse subject template: %w", err)
+	}
+	return nil
+}
+
+func OrderConfirmationEmail(data *OrderConfirmationEmailData) (result RenderedEmail, err error) {
+	orderConfirmationEmailParseOnce.Do(func() { orderConfirmationEmailParseErr = parseOrderConfirmationEmailTemplates() })
+	if orderConfirmationEmailParseErr != nil {
+		return result, orderConfirmationEmailParseErr
 	}
 
 	var bodyBuf bytes.Buffer
-	if err := bodyTmpl.Execute(&bodyBuf, data); err != nil {
+	if err := orderConfirmationEmailBodyTmpl.Execute(&bodyBuf, data); err != nil {
 		return result, fmt.Errorf("render body: %w", err)
 	}
 
 	result.HTML = bodyBuf.String()
 
-	subjTmpl, err := texttemplate.New("order_confirmation_subject").Parse(orderConfirmationEmailSubjectTemplate)
-	if err != nil {
-		return result, fmt.Errorf("parse subject template: %w", err)
-	}
-
 	var subjBuf bytes.Buffer
-	if err := subjTmpl.Execute(&subjBuf, data); err != nil {
+	if err := orderConfirmationEmailSubjectTmpl.Execute(&subjBuf, data); err != nil {
 		return result, fmt.Errorf("render subject: %w", err)
 	}
 
 	result.Subject = subjBuf.String()
+	result.Text = htmltext.FromHTML(result.HTML)
 	return result, nil
 }
+
+func OrderConfirmationEmailSampleDataSingleItem() *OrderConfirmationEmailData {
+	return &OrderConfirmationEmailData{
+		Order: OrderConfirmationEmailOrder{ID: 1001, CreatedAt: "2025-03-04", Items: []OrderConfirmationEmailItem{{Name: "Coffee mug", Qty: 1}}},
+		User:  User{Name: "Jane Doe"},
+	}
+}
+
+func OrderConfirmationEmailSampleDataBulkOrder() *OrderConfirmationEmailData {
+	return &OrderConfirmationEmailData{
+		Order: OrderConfirmationEmailOrder{ID: 1002, CreatedAt: "2025-03-05", Items: []OrderConfirmationEmailItem{{Name: "Notebook", Qty: 10}, {Name: "Pencil", Qty: 25}}},
+		User:  User{Name: "Ada Lovelace"},
+	}
+}
@@ -3,8 +3,24 @@
 
 package generated
 
+import "github.com/elliot40404/mailc/mailer"
+
 // RenderedEmail is the common return type for all generated email renderers.
 type RenderedEmail struct {
 	Subject string
 	HTML    string
+	// Text is the plain-text alternative to HTML.
+	Text string
+}
+
+// Message returns a MIME message with the rendered subject, HTML and text,
+// ready to be written with WriteTo or sent.
+func (r RenderedEmail) Message(from string, to ...string) *mailer.Message {
+	return &mailer.Message{From: from, To: to, Subject: r.Subject, HTML: r.HTML, Text: r.Text}
+}
+
+// User is declared in _types.html.
+type User struct {
+	Name  string
+	Email string
 }
@@ -7,6 +7,9 @@ import (
 	"bytes"
 	"fmt"
 	htmltemplate "html/template"
+	"sync"
+
+	"github.com/elliot40404/mailc/htmltext"
 )
 
 type WelcomeNoSubjectEmailData struct {
@@ -17,7 +20,7 @@ const welcomeNoSubjectEmailHTMLTemplate = `<html>
 
 <head>
     <meta charset="UTF-8">
-    <title>Welcome</title>
+    <title>{{template "title" .}}</title>
     <style>
         table {
             border-collapse: collapse;
@@ -34,27 +37,56 @@ const welcomeNoSubjectEmailHTMLTemplate = `<html>
             background-color: #f2f2f2;
         }
     </style>
+    {{htmlComment "<!--[if mso]>"}}
+    <style>
+        table, td {
+            font-family: Arial, sans-serif;
+        }
+    </style>
+    {{htmlComment "<![endif]-->"}}
 </head>
 
 <body>
+    {{- template "content" .}}
+    {{- template "footer" .}}
+</body>
+
+</html>
+{{define "title"}}Welcome{{end}}{{define "content"}}
+
     <h1>Welcome to ACME! {{ .FirstName}}</h1>
     <p>We're excited to have you join ACME.</p>
-</body>
+{{end}}{{define "footer"}}
+    <p>Thanks for choosing us!</p>
+    {{- end}}`
 
-</html>`
+var (
+	welcomeNoSubjectEmailParseOnce sync.Once
+	welcomeNoSubjectEmailParseErr  error
+	welcomeNoSubjectEmailBodyTmpl  *htmltemplate.Template
+)
 
-func WelcomeNoSubjectEmail(data *WelcomeNoSubjectEmailData) (result RenderedEmail, err error) {
-	bodyTmpl, err := htmltemplate.New("welcome_no_subject").Parse(welcomeNoSubjectEmailHTMLTemplate)
+func parseWelcomeNoSubjectEmailTemplates() (err error) {
+	welcomeNoSubjectEmailBodyTmpl, err = parseWithPartials(htmltemplate.New("welcome_no_subject"), welcomeNoSubjectEmailHTMLTemplate)
 	if err != nil {
-		return result, fmt.Errorf("parse body template: %w", err)
+		return fmt.Errorf("parse body template: %w", err)
+	}
+	return nil
+}
+
+func WelcomeNoSubjectEmail(data *WelcomeNoSubjectEmailData) (result RenderedEmail, err error) {
+	welcomeNoSubjectEmailParseOnce.Do(func() { welcomeNoSubjectEmailParseErr = parseWelcomeNoSubjectEmailTemplates() })
+	if welcomeNoSubjectEmailParseErr != nil {
+		return result, welcomeNoSubjectEmailParseErr
 	}
 
 	var bodyBuf bytes.Buffer
-	if err := bodyTmpl.Execute(&bodyBuf, data); err != nil {
+	if err := welcomeNoSubjectEmailBodyTmpl.Execute(&bodyBuf, data); err != nil {
 		return result, fmt.Errorf("render body: %w", err)
 	}
 
 	result.HTML = bodyBuf.String()
 
+	result.Text = htmltext.FromHTML(result.HTML)
 	return result, nil
 }
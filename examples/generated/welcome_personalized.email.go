@@ -7,19 +7,22 @@ import (
 	"bytes"
 	"fmt"
 	htmltemplate "html/template"
+	"sync"
 	texttemplate "text/template"
+
+	"github.com/elliot40404/mailc/htmltext"
 )
 
 type WelcomePersonalizedEmailData struct {
-	FirstName string
 	Username  string
+	FirstName string
 }
 
 const welcomePersonalizedEmailHTMLTemplate = `<html>
 
 <head>
     <meta charset="UTF-8">
-    <title>Welcome Email</title>
+    <title>{{template "title" .}}</title>
     <style>
         table {
             border-collapse: collapse;
@@ -36,39 +39,74 @@ const welcomePersonalizedEmailHTMLTemplate = `<html>
             background-color: #f2f2f2;
         }
     </style>
+    {{htmlComment "<!--[if mso]>"}}
+    <style>
+        table, td {
+            font-family: Arial, sans-serif;
+        }
+    </style>
+    {{htmlComment "<![endif]-->"}}
 </head>
 
 <body>
-    <h1>Welcome to ACME! {{ .FirstName}}</h1>
-    <p>We're excited to have you join ACME.</p>
+    {{- template "content" .}}
+    {{- template "footer" .}}
 </body>
 
-</html>`
+</html>
+{{define "title"}}Welcome Email{{end}}{{define "content"}}
+    <h1>Welcome to ACME! {{ .FirstName}}</h1>
+    <p>We're excited to have you join ACME.</p>
+{{- end}}{{define "footer"}}
+    <p>Thanks for choosing us!</p>
+    {{- end}}`
 const welcomePersonalizedEmailSubjectTemplate = `Welcome to ACME {{ .Username}}.`
 
-func WelcomePersonalizedEmail(data *WelcomePersonalizedEmailData) (result RenderedEmail, err error) {
-	bodyTmpl, err := htmltemplate.New("welcome_personalized").Parse(welcomePersonalizedEmailHTMLTemplate)
+var (
+	welcomePersonalizedEmailParseOnce   sync.Once
+	welcomePersonalizedEmailParseErr    error
+	welcomePersonalizedEmailBodyTmpl    *htmltemplate.Template
+	welcomePersonalizedEmailSubjectTmpl *texttemplate.Template
+)
+
+func parseWelcomePersonalizedEmailTemplates() (err error) {
+	welcomePersonalizedEmailBodyTmpl, err = parseWithPartials(htmltemplate.New("welcome_personalized"), welcomePersonalizedEmailHTMLTemplate)
 	if err != nil {
-		return result, fmt.Errorf("parse body template: %w", err)
+		return fmt.Errorf("parse body template: %w", err)
+	}
+	welcomePersonalizedEmailSubjectTmpl, err = texttemplate.New("welcome_personalized_subject").Parse(welcomePersonalizedEmailSubjectTemplate)
+	if err != nil {
+		return fmt.Errorf("parse subject template: %w", err)
+	}
+	return nil
+}
+
+func WelcomePersonalizedEmail(data *WelcomePersonalizedEmailData) (result RenderedEmail, err error) {
+	welcomePersonalizedEmailParseOnce.Do(func() { welcomePersonalizedEmailParseErr = parseWelcomePersonalizedEmailTemplates() })
+	if welcomePersonalizedEmailParseErr != nil {
+		return result, welcomePersonalizedEmailParseErr
 	}
 
 	var bodyBuf bytes.Buffer
-	if err := bodyTmpl.Execute(&bodyBuf, data); err != nil {
+	if err := welcomePersonalizedEmailBodyTmpl.Execute(&bodyBuf, data); err != nil {
 		return result, fmt.Errorf("render body: %w", err)
 	}
 
 	result.HTML = bodyBuf.String()
 
-	subjTmpl, err := texttemplate.New("welcome_personalized_subject").Parse(welcomePersonalizedEmailSubjectTemplate)
-	if err != nil {
-		return result, fmt.Errorf("parse subject template: %w", err)
-	}
-
 	var subjBuf bytes.Buffer
-	if err := subjTmpl.Execute(&subjBuf, data); err != nil {
+	if err := welcomePersonalizedEmailSubjectTmpl.Execute(&subjBuf, data); err != nil {
 		return result, fmt.Errorf("render subject: %w", err)
 	}
 
 	result.Subject = subjBuf.String()
+	result.Text = htmltext.FromHTML(result.HTML)
 	return result, nil
 }
+
+func WelcomePersonalizedEmailSampleData() *WelcomePersonalizedEmailData {
+	return &WelcomePersonalizedEmailData{
+		Username:  "jane@example.com",
+		FirstName: "Jane",
+	}
+}
@@ -0,0 +1,401 @@
+// Package htmltext derives a plain-text version of an HTML email.
+//
+// It is used by code generated by mailc to fill RenderedEmail.Text for
+// templates without a plain-text template of their own. The conversion is
+// tuned for emails rather than arbitrary web pages: links become
+// "text (url)", list items become bullets, headings are underlined, and the
+// contents of <head>, <style> and <script> are dropped.
+package htmltext
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FromHTML converts an HTML document or fragment to plain text.
+func FromHTML(src string) string {
+	c := &converter{}
+	c.run(src)
+	return c.finish()
+}
+
+// skipElements are elements whose content never appears in the text.
+var skipElements = map[string]bool{
+	"head": true, "style": true, "script": true, "title": true, "template": true, "noscript": true,
+}
+
+// paragraphElements are separated from surrounding content by a blank line.
+var paragraphElements = map[string]bool{
+	"p": true, "table": true, "blockquote": true, "pre": true, "dl": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// blockElements start and end on their own line.
+var blockElements = map[string]bool{
+	"div": true, "tr": true, "li": true, "ul": true, "ol": true, "section": true,
+	"article": true, "header": true, "footer": true, "nav": true, "main": true,
+	"aside": true, "center": true, "address": true, "figure": true, "form": true,
+	"dt": true, "dd": true, "tbody": true, "thead": true, "tfoot": true, "body": true,
+}
+
+type list struct {
+	ordered bool
+	n       int
+}
+
+type link struct {
+	href string
+	line int // index of the line the link text started on
+	col  int // byte offset in that line
+}
+
+type converter struct {
+	lines   []string
+	cur     strings.Builder
+	space   bool // a space is pending before the next word
+	blank   bool // a blank line is pending before the next content
+	pre     int
+	lists   []list
+	links   []link
+	heading struct {
+		level int
+		line  int
+		col   int
+	}
+}
+
+func (c *converter) run(src string) {
+	for len(src) > 0 {
+		lt := strings.IndexByte(src, '<')
+		if lt < 0 {
+			c.text(html.UnescapeString(src))
+			return
+		}
+		if lt > 0 {
+			c.text(html.UnescapeString(src[:lt]))
+			src = src[lt:]
+		}
+		switch {
+		case strings.HasPrefix(src, "<!--"):
+			end := strings.Index(src, "-->")
+			if end < 0 {
+				return
+			}
+			src = src[end+3:]
+		case strings.HasPrefix(src, "<!") || strings.HasPrefix(src, "<?"):
+			end := strings.IndexByte(src, '>')
+			if end < 0 {
+				return
+			}
+			src = src[end+1:]
+		default:
+			name, attrs, closing, n := parseTag(src)
+			if n == 0 {
+				// Not a tag; keep the "<" as text
+				c.text("<")
+				src = src[1:]
+				continue
+			}
+			src = src[n:]
+			if !closing && skipElements[name] {
+				src = skipPast(src, name)
+				continue
+			}
+			if closing {
+				c.end(name)
+			} else {
+				c.start(name, attrs)
+			}
+		}
+	}
+}
+
+// skipPast returns src after the closing tag of element name.
+func skipPast(src, name string) string {
+	lower := strings.ToLower(src)
+	end := strings.Index(lower, "</"+name)
+	if end < 0 {
+		return ""
+	}
+	gt := strings.IndexByte(src[end:], '>')
+	if gt < 0 {
+		return ""
+	}
+	return src[end+gt+1:]
+}
+
+// parseTag parses the tag at the start of src and returns its lowercase
+// name, its attributes, whether it is a closing tag and its length. The
+// length is zero when src does not start with a tag.
+func parseTag(src string) (name string, attrs map[string]string, closing bool, n int) {
+	i := 1
+	if i < len(src) && src[i] == '/' {
+		closing = true
+		i++
+	}
+	start := i
+	for i < len(src) && (isAlnum(src[i]) || src[i] == '-' || src[i] == ':') {
+		i++
+	}
+	if i == start {
+		return "", nil, false, 0
+	}
+	name = strings.ToLower(src[start:i])
+	attrs = make(map[string]string)
+	for i < len(src) {
+		for i < len(src) && (isSpace(src[i]) || src[i] == '/') {
+			i++
+		}
+		if i >= len(src) {
+			break
+		}
+		if src[i] == '>' {
+			return name, attrs, closing, i + 1
+		}
+		keyStart := i
+		for i < len(src) && !isSpace(src[i]) && src[i] != '=' && src[i] != '>' && src[i] != '/' {
+			i++
+		}
+		key := strings.ToLower(src[keyStart:i])
+		for i < len(src) && isSpace(src[i]) {
+			i++
+		}
+		val := ""
+		if i < len(src) && src[i] == '=' {
+			i++
+			for i < len(src) && isSpace(src[i]) {
+				i++
+			}
+			if i < len(src) && (src[i] == '"' || src[i] == '\'') {
+				q := src[i]
+				end := strings.IndexByte(src[i+1:], q)
+				if end < 0 {
+					return "", nil, false, 0
+				}
+				val = src[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				valStart := i
+				for i < len(src) && !isSpace(src[i]) && src[i] != '>' {
+					i++
+				}
+				val = src[valStart:i]
+			}
+		}
+		if key != "" {
+			attrs[key] = html.UnescapeString(val)
+		}
+	}
+	return "", nil, false, 0
+}
+
+func isAlnum(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+func (c *converter) start(name string, attrs map[string]string) {
+	switch {
+	case name == "br":
+		c.endLine(true)
+		return
+	case name == "hr":
+		c.paragraph()
+		c.write("----------")
+		c.paragraph()
+		return
+	case name == "a":
+		c.flushBlank()
+		c.links = append(c.links, link{href: attrs["href"], line: len(c.lines), col: c.cur.Len()})
+		return
+	case name == "img":
+		return
+	case name == "td" || name == "th":
+		c.space = true
+		return
+	}
+	if paragraphElements[name] {
+		c.paragraph()
+	} else if blockElements[name] {
+		c.endLine(false)
+	}
+	switch name {
+	case "pre":
+		c.pre++
+	case "ul", "ol":
+		if len(c.lists) == 0 {
+			c.paragraph()
+		}
+		c.lists = append(c.lists, list{ordered: name == "ol"})
+	case "li":
+		bullet := "- "
+		indent := 0
+		if len(c.lists) > 0 {
+			l := &c.lists[len(c.lists)-1]
+			indent = len(c.lists) - 1
+			if l.ordered {
+				l.n++
+				bullet = strconv.Itoa(l.n) + ". "
+			}
+		}
+		c.write(strings.Repeat("  ", indent) + bullet)
+		c.space = false
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		c.flushBlank()
+		c.heading.level = int(name[1] - '0')
+		c.heading.line = len(c.lines)
+		c.heading.col = c.cur.Len()
+	}
+}
+
+func (c *converter) end(name string) {
+	switch name {
+	case "a":
+		if len(c.links) == 0 {
+			return
+		}
+		l := c.links[len(c.links)-1]
+		c.links = c.links[:len(c.links)-1]
+		href := strings.TrimSpace(l.href)
+		if href == "" || strings.HasPrefix(href, "#") {
+			return
+		}
+		text := ""
+		if l.line == len(c.lines) && l.col <= c.cur.Len() {
+			text = strings.TrimSpace(c.cur.String()[l.col:])
+		}
+		switch {
+		case text == "":
+			c.write(href)
+		case text == href || "mailto:"+text == href || "tel:"+text == href:
+		default:
+			c.space = true
+			c.write("(" + href + ")")
+		}
+		return
+	case "td", "th":
+		c.space = true
+		return
+	case "ul", "ol":
+		if len(c.lists) > 0 {
+			c.lists = c.lists[:len(c.lists)-1]
+		}
+		if len(c.lists) == 0 {
+			c.paragraph()
+		} else {
+			c.endLine(false)
+		}
+		return
+	case "pre":
+		if c.pre > 0 {
+			c.pre--
+		}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		if c.heading.level != 0 && c.heading.line == len(c.lines) {
+			text := strings.TrimSpace(c.cur.String()[c.heading.col:])
+			underline := "-"
+			if c.heading.level == 1 {
+				underline = "="
+			}
+			c.endLine(false)
+			if n := utf8.RuneCountInString(text); n > 0 {
+				c.lines = append(c.lines, strings.Repeat(underline, n))
+			}
+		}
+		c.heading.level = 0
+	}
+	if paragraphElements[name] {
+		c.paragraph()
+	} else if blockElements[name] {
+		c.endLine(false)
+	}
+}
+
+// text writes character data, collapsing whitespace outside <pre>.
+func (c *converter) text(s string) {
+	if c.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				c.endLine(true)
+			}
+			if line != "" {
+				c.write(line)
+			}
+		}
+		return
+	}
+	if s != "" && unicode.IsSpace(rune(s[0])) {
+		c.space = true
+	}
+	words := strings.Fields(s)
+	for i, w := range words {
+		if i > 0 {
+			c.space = true
+		}
+		c.write(w)
+	}
+	if len(words) > 0 && unicode.IsSpace(rune(s[len(s)-1])) {
+		c.space = true
+	}
+}
+
+// flushBlank emits a pending blank line, so that the current line is the
+// one the next content will be written to.
+func (c *converter) flushBlank() {
+	if c.blank && (len(c.lines) > 0 || c.cur.Len() > 0) {
+		c.endLine(false)
+		if len(c.lines) > 0 && c.lines[len(c.lines)-1] != "" {
+			c.lines = append(c.lines, "")
+		}
+	}
+	c.blank = false
+}
+
+// write appends s to the current line, inserting any pending separator.
+func (c *converter) write(s string) {
+	c.flushBlank()
+	if c.space && c.cur.Len() > 0 && !strings.HasSuffix(c.cur.String(), " ") {
+		c.cur.WriteByte(' ')
+	}
+	c.space = false
+	c.cur.WriteString(s)
+}
+
+// endLine finishes the current line. Empty lines are only kept when force
+// is set, as for <br>.
+func (c *converter) endLine(force bool) {
+	if c.cur.Len() > 0 || force {
+		c.lines = append(c.lines, strings.TrimRight(c.cur.String(), " "))
+		c.cur.Reset()
+	}
+	c.space = false
+}
+
+// paragraph ends the current line and requests a blank line before the
+// next content.
+func (c *converter) paragraph() {
+	c.endLine(false)
+	c.blank = true
+}
+
+func (c *converter) finish() string {
+	c.endLine(false)
+	var out []string
+	for _, l := range c.lines {
+		l = strings.TrimRight(l, " \t")
+		if l == "" && (len(out) == 0 || out[len(out)-1] == "") {
+			continue
+		}
+		out = append(out, l)
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return strings.Join(out, "\n")
+}
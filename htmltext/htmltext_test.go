@@ -0,0 +1,74 @@
+package htmltext
+
+import "testing"
+
+func TestFromHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "document",
+			in: `<html>
+<head><title>Welcome</title><style>p { color: red; }</style></head>
+<body>
+  <h1>Welcome, Jane!</h1>
+  <p>Thanks for   signing
+     up. <a href="https://example.com/start">Get started</a> today.</p>
+  <h2>Next steps</h2>
+  <ul>
+    <li>Verify your email</li>
+    <li>Invite your team
+      <ol><li>Open settings</li><li>Click invite</li></ol>
+    </li>
+  </ul>
+  <p>Questions? Write to <a href="mailto:help@example.com">help@example.com</a>.</p>
+  <script>alert("x")</script>
+</body>
+</html>`,
+			want: `Welcome, Jane!
+==============
+
+Thanks for signing up. Get started (https://example.com/start) today.
+
+Next steps
+----------
+
+- Verify your email
+- Invite your team
+  1. Open settings
+  2. Click invite
+
+Questions? Write to help@example.com.`,
+		},
+		{
+			name: "tables and line breaks",
+			in: `<table><tr><th>Item</th><th>Qty</th></tr><tr><td>Mug</td><td>2</td></tr></table>
+<p>Line one<br>Line two<br/>Line&nbsp;three &amp; more</p><!-- hidden --><hr><p>Bye</p>`,
+			want: "Item Qty\nMug 2\n\nLine one\nLine two\nLine three & more\n\n----------\n\nBye",
+		},
+		{
+			name: "links",
+			in:   `<p><a href="https://x.test/a">https://x.test/a</a> <a href="https://x.test/logo"><img src="logo.png"></a> <a href="#top">Top</a></p>`,
+			want: "https://x.test/a https://x.test/logo Top",
+		},
+		{
+			name: "pre",
+			in:   "<pre>  indented\n    code</pre><p>after</p>",
+			want: "  indented\n    code\n\nafter",
+		},
+		{
+			name: "plain text",
+			in:   "a < b and 1<2",
+			want: "a < b and 1<2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FromHTML(tt.in); got != tt.want {
+				t.Fatalf("FromHTML:\n got: %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Package css parses the subset of CSS mailc needs to move <style> rules
+// into style attributes: style rules with their selectors and declarations,
+// and at-rules such as @media, which are kept as written.
+package css
+
+import (
+	"strings"
+)
+
+// Rule is a style rule or an at-rule of a stylesheet.
+type Rule struct {
+	// Selectors is the selector list of a style rule, split at commas.
+	Selectors    []string
+	Declarations []Declaration
+	// At is the source of an at-rule, such as an @media block, kept
+	// verbatim. Selectors and Declarations are empty then.
+	At string
+	// Start and End delimit the rule in the parsed source.
+	Start, End int
+}
+
+// Declaration is a property with its value, as in color: red !important.
+type Declaration struct {
+	Property  string // lower case
+	Value     string
+	Important bool
+}
+
+func (d Declaration) String() string {
+	if d.Important {
+		return d.Property + ": " + d.Value + " !important"
+	}
+	return d.Property + ": " + d.Value
+}
+
+// String formats r on one line.
+func (r Rule) String() string {
+	if r.At != "" {
+		return r.At
+	}
+	return strings.Join(r.Selectors, ", ") + " { " + FormatDeclarations(r.Declarations) + " }"
+}
+
+// FormatDeclarations formats decls as the value of a style attribute.
+func FormatDeclarations(decls []Declaration) string {
+	parts := make([]string, len(decls))
+	for i, d := range decls {
+		parts[i] = d.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Parse splits a stylesheet into rules. Parsing is lenient: text that is
+// not a complete rule, such as an unterminated block, becomes an at-rule so
+// that it is kept as written.
+func Parse(src string) []Rule {
+	var rules []Rule
+	i := 0
+	for {
+		i = skipSpace(src, i)
+		if i >= len(src) {
+			return rules
+		}
+		start := i
+		if src[i] == '@' {
+			end := scan(src, i, ";{")
+			if end < len(src) && src[end] == '{' {
+				end = closeBlock(src, end)
+			} else if end < len(src) {
+				end++
+			}
+			rules = append(rules, Rule{At: strings.TrimSpace(src[start:end]), Start: start, End: end})
+			i = end
+			continue
+		}
+		open := scan(src, i, "{")
+		if open >= len(src) {
+			rules = append(rules, Rule{At: strings.TrimSpace(src[start:]), Start: start, End: len(src)})
+			return rules
+		}
+		end := closeBlock(src, open)
+		if end > len(src) || src[end-1] != '}' {
+			rules = append(rules, Rule{At: strings.TrimSpace(src[start:]), Start: start, End: len(src)})
+			return rules
+		}
+		var selectors []string
+		for _, s := range split(src[start:open], ',') {
+			if s = strings.Join(strings.Fields(stripComments(s)), " "); s != "" {
+				selectors = append(selectors, s)
+			}
+		}
+		rules = append(rules, Rule{
+			Selectors:    selectors,
+			Declarations: ParseDeclarations(src[open+1 : end-1]),
+			Start:        start,
+			End:          end,
+		})
+		i = end
+	}
+}
+
+// ParseDeclarations parses a declaration block or the value of a style
+// attribute. Declarations without a property or a value are skipped.
+func ParseDeclarations(src string) []Declaration {
+	var decls []Declaration
+	for _, part := range split(stripComments(src), ';') {
+		prop, value, ok := strings.Cut(part, ":")
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		value = strings.TrimSpace(value)
+		if !ok || prop == "" || value == "" {
+			continue
+		}
+		d := Declaration{Property: prop, Value: value}
+		if n := strings.LastIndexByte(value, '!'); n >= 0 && strings.EqualFold(strings.TrimSpace(value[n+1:]), "important") {
+			d.Value = strings.TrimSpace(value[:n])
+			d.Important = true
+		}
+		decls = append(decls, d)
+	}
+	return decls
+}
+
+// skipSpace returns the offset of the first byte at or after i that is
+// neither white space nor part of a comment.
+func skipSpace(src string, i int) int {
+	for i < len(src) {
+		switch {
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return len(src)
+			}
+			i += 2 + end + 2
+		case strings.HasPrefix(src[i:], "<!--"):
+			i += len("<!--")
+		case strings.HasPrefix(src[i:], "-->"):
+			i += len("-->")
+		case src[i] == ' ' || src[i] == '\t' || src[i] == '\n' || src[i] == '\r' || src[i] == '\f':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// scan returns the offset of the first byte of stop at or after i outside
+// strings, comments, brackets and parentheses, or len(src).
+func scan(src string, i int, stop string) int {
+	depth := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'':
+			i = skipString(src, i)
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return len(src)
+			}
+			i += 2 + end + 2
+			continue
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case depth <= 0 && strings.IndexByte(stop, c) >= 0:
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// closeBlock returns the offset just past the brace closing the block that
+// opens at src[open], or len(src) when it is not closed.
+func closeBlock(src string, open int) int {
+	depth := 0
+	for i := open; i < len(src); {
+		switch c := src[i]; {
+		case c == '"' || c == '\'':
+			i = skipString(src, i)
+			continue
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return len(src)
+			}
+			i += 2 + end + 2
+			continue
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(src)
+}
+
+// skipString returns the offset just past the string starting at src[i].
+func skipString(src string, i int) int {
+	quote := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+// split splits src at sep outside strings, brackets and parentheses.
+func split(src string, sep byte) []string {
+	var parts []string
+	for {
+		i := scan(src, 0, string(sep))
+		parts = append(parts, src[:i])
+		if i >= len(src) {
+			return parts
+		}
+		src = src[i+1:]
+	}
+}
+
+// stripComments removes /* */ comments from src.
+func stripComments(src string) string {
+	for {
+		start := strings.Index(src, "/*")
+		if start < 0 {
+			return src
+		}
+		end := strings.Index(src[start+2:], "*/")
+		if end < 0 {
+			return src[:start]
+		}
+		src = src[:start] + " " + src[start+2+end+2:]
+	}
+}
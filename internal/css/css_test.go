@@ -0,0 +1,85 @@
+package css
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	src := `/* base */
+td, th.wide { padding: 8px; font-family: "A; B", serif }
+@media (max-width: 600px) { td { padding: 4px } }
+a:hover{color:red!important;;bad}
+p { color: blue`
+	rules := Parse(src)
+	var got []string
+	for _, r := range rules {
+		got = append(got, r.String())
+	}
+	want := []string{
+		`td, th.wide { padding: 8px; font-family: "A; B", serif }`,
+		`@media (max-width: 600px) { td { padding: 4px } }`,
+		`a:hover { color: red !important }`,
+		`p { color: blue`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected rules:\n%q\nwant:\n%q", got, want)
+	}
+	if r := rules[1]; src[r.Start:r.End] != r.At {
+		t.Fatalf("expected the span of the at-rule, got %q", src[r.Start:r.End])
+	}
+}
+
+func TestParseDeclarations(t *testing.T) {
+	got := ParseDeclarations(`COLOR: red; background: url("a;b.png") ! important; /* x: y */ margin:0`)
+	want := []Declaration{
+		{Property: "color", Value: "red"},
+		{Property: "background", Value: `url("a;b.png")`, Important: true},
+		{Property: "margin", Value: "0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected declarations %+v, want %+v", got, want)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	table := &Element{Tag: "table", Attrs: map[string]string{"class": "main wide", "id": "t"}}
+	tr := &Element{Tag: "tr", Attrs: map[string]string{}, Parent: table}
+	td := &Element{Tag: "td", Attrs: map[string]string{"align": "right", "lang": "en-GB"}, Parent: tr}
+	tests := []struct {
+		selector string
+		match    bool
+		spec     Specificity
+	}{
+		{"td", true, Specificity{0, 0, 1}},
+		{"*", true, Specificity{0, 0, 0}},
+		{"table td", true, Specificity{0, 0, 2}},
+		{"table > td", false, Specificity{0, 0, 2}},
+		{"table>tr>td", true, Specificity{0, 0, 3}},
+		{"#t.main td[align=right]", true, Specificity{1, 2, 1}},
+		{".wide.main tr td", true, Specificity{0, 2, 2}},
+		{".narrow td", false, Specificity{0, 1, 1}},
+		{`td[lang|="en"]`, true, Specificity{0, 1, 1}},
+		{"td[align^=ri][align$=ht][align*=gh]", true, Specificity{0, 3, 1}},
+		{"TD[ALIGN]", true, Specificity{0, 1, 1}},
+		{"th", false, Specificity{0, 0, 1}},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q): %v", tt.selector, err)
+		}
+		if got := sel.Match(td); got != tt.match {
+			t.Errorf("%q matches td: got %v, want %v", tt.selector, got, tt.match)
+		}
+		if got := sel.Specificity(); got != tt.spec {
+			t.Errorf("%q specificity: got %v, want %v", tt.selector, got, tt.spec)
+		}
+	}
+
+	for _, s := range []string{"a:hover", "p::first-line", "h1 + p", "li ~ li", "> td", "td >", "td[", "td[a=b c]", "#"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("expected %q to be unsupported", s)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package css
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Element is an HTML element selectors are matched against.
+type Element struct {
+	Tag    string            // lower case
+	Attrs  map[string]string // by lower-case name
+	Parent *Element
+}
+
+// Selector is a parsed complex selector: compound selectors joined by
+// descendant or child combinators, as in "table.main > tr td".
+type Selector struct {
+	compounds   []compound
+	combinators []byte // combinators[i] joins compounds[i] and compounds[i+1]
+}
+
+// compound is a sequence of simple selectors without combinators, such as
+// td.price[align=right].
+type compound struct {
+	tag     string // "" or "*" for any element
+	ids     []string
+	classes []string
+	attrs   []attrSelector
+}
+
+// attrSelector is an attribute selector such as [align] or [lang|=en].
+type attrSelector struct {
+	name  string
+	op    string // "", "=", "~=", "|=", "^=", "$=" or "*="
+	value string
+}
+
+// Specificity is the (id, class, type) specificity of a selector. Larger
+// values take precedence.
+type Specificity [3]int
+
+// Compare returns -1, 0 or +1 as s is lower than, equal to or higher than t.
+func (s Specificity) Compare(t Specificity) int {
+	for i := range s {
+		if s[i] != t[i] {
+			if s[i] < t[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// ParseSelector parses a single selector. Only selectors whose match can
+// be decided from the markup alone are supported: type, universal, class,
+// ID and attribute selectors, joined by descendant and child combinators.
+// Pseudo-classes, pseudo-elements and sibling combinators are errors.
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{}
+	i := 0
+	combinator := byte(0)
+	for {
+		// Combinator, if any, before the next compound
+		space := false
+		for i < len(s) && isSpace(s[i]) {
+			i++
+			space = true
+		}
+		if i >= len(s) {
+			break
+		}
+		switch s[i] {
+		case '>':
+			combinator = '>'
+			i++
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+		case '+', '~':
+			return nil, fmt.Errorf("sibling combinator %q is not supported", s[i])
+		default:
+			if space && len(sel.compounds) > 0 {
+				combinator = ' '
+			}
+		}
+		if len(sel.compounds) > 0 {
+			if combinator == 0 {
+				return nil, fmt.Errorf("invalid selector %q", s)
+			}
+			sel.combinators = append(sel.combinators, combinator)
+		} else if combinator != 0 {
+			return nil, fmt.Errorf("selector %q starts with a combinator", s)
+		}
+		combinator = 0
+
+		c, n, err := parseCompound(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		sel.compounds = append(sel.compounds, c)
+		i += n
+	}
+	if len(sel.compounds) == 0 || len(sel.combinators) != len(sel.compounds)-1 {
+		return nil, fmt.Errorf("invalid selector %q", s)
+	}
+	return sel, nil
+}
+
+// parseCompound parses the compound selector at the start of s and returns
+// it with its length.
+func parseCompound(s string) (compound, int, error) {
+	var c compound
+	i := 0
+	if i < len(s) && s[i] == '*' {
+		c.tag = "*"
+		i++
+	} else if n := identLen(s[i:]); n > 0 {
+		c.tag = strings.ToLower(s[i : i+n])
+		i += n
+	}
+	for i < len(s) && !isSpace(s[i]) && s[i] != '>' && s[i] != '+' && s[i] != '~' {
+		switch s[i] {
+		case '#', '.':
+			n := identLen(s[i+1:])
+			if n == 0 {
+				return c, 0, fmt.Errorf("invalid selector %q", s)
+			}
+			if s[i] == '#' {
+				c.ids = append(c.ids, s[i+1:i+1+n])
+			} else {
+				c.classes = append(c.classes, s[i+1:i+1+n])
+			}
+			i += 1 + n
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return c, 0, fmt.Errorf("unterminated attribute selector in %q", s)
+			}
+			a, err := parseAttr(s[i+1 : i+end])
+			if err != nil {
+				return c, 0, err
+			}
+			c.attrs = append(c.attrs, a)
+			i += end + 1
+		case ':':
+			return c, 0, fmt.Errorf("pseudo-class or pseudo-element %q is not supported", s[i:])
+		default:
+			return c, 0, fmt.Errorf("invalid selector %q", s)
+		}
+	}
+	if i == 0 {
+		return c, 0, fmt.Errorf("invalid selector %q", s)
+	}
+	return c, i, nil
+}
+
+// parseAttr parses the inside of an attribute selector, such as
+// align=right or lang|="en".
+func parseAttr(s string) (attrSelector, error) {
+	s = strings.TrimSpace(s)
+	n := identLen(s)
+	if n == 0 {
+		return attrSelector{}, fmt.Errorf("invalid attribute selector [%s]", s)
+	}
+	a := attrSelector{name: strings.ToLower(s[:n])}
+	rest := strings.TrimSpace(s[n:])
+	if rest == "" {
+		return a, nil
+	}
+	for _, op := range []string{"~=", "|=", "^=", "$=", "*=", "="} {
+		if strings.HasPrefix(rest, op) {
+			a.op = op
+			rest = strings.TrimSpace(rest[len(op):])
+			break
+		}
+	}
+	if a.op == "" || rest == "" {
+		return attrSelector{}, fmt.Errorf("invalid attribute selector [%s]", s)
+	}
+	if q := rest[0]; (q == '"' || q == '\'') && len(rest) >= 2 && rest[len(rest)-1] == q {
+		rest = rest[1 : len(rest)-1]
+	} else if strings.ContainsAny(rest, " \t\"'") {
+		return attrSelector{}, fmt.Errorf("invalid attribute selector [%s]", s)
+	}
+	a.value = rest
+	return a, nil
+}
+
+// Specificity returns the specificity of s.
+func (s *Selector) Specificity() Specificity {
+	var sp Specificity
+	for _, c := range s.compounds {
+		sp[0] += len(c.ids)
+		sp[1] += len(c.classes) + len(c.attrs)
+		if c.tag != "" && c.tag != "*" {
+			sp[2]++
+		}
+	}
+	return sp
+}
+
+// Match reports whether s matches e.
+func (s *Selector) Match(e *Element) bool {
+	return s.matchAt(len(s.compounds)-1, e)
+}
+
+// matchAt reports whether the selector ending with compounds[i] matches e.
+func (s *Selector) matchAt(i int, e *Element) bool {
+	if !s.compounds[i].match(e) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	if s.combinators[i-1] == '>' {
+		return e.Parent != nil && s.matchAt(i-1, e.Parent)
+	}
+	for p := e.Parent; p != nil; p = p.Parent {
+		if s.matchAt(i-1, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c compound) match(e *Element) bool {
+	if c.tag != "" && c.tag != "*" && c.tag != e.Tag {
+		return false
+	}
+	for _, id := range c.ids {
+		if e.Attrs["id"] != id {
+			return false
+		}
+	}
+	classes := strings.Fields(e.Attrs["class"])
+	for _, class := range c.classes {
+		if !slices.Contains(classes, class) {
+			return false
+		}
+	}
+	for _, a := range c.attrs {
+		if !a.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a attrSelector) match(e *Element) bool {
+	v, ok := e.Attrs[a.name]
+	if !ok {
+		return false
+	}
+	switch a.op {
+	case "":
+		return true
+	case "=":
+		return v == a.value
+	case "~=":
+		return slices.Contains(strings.Fields(v), a.value)
+	case "|=":
+		return v == a.value || strings.HasPrefix(v, a.value+"-")
+	case "^=":
+		return a.value != "" && strings.HasPrefix(v, a.value)
+	case "$=":
+		return a.value != "" && strings.HasSuffix(v, a.value)
+	case "*=":
+		return a.value != "" && strings.Contains(v, a.value)
+	}
+	return false
+}
+
+// identLen returns the length of the CSS identifier at the start of s.
+func identLen(s string) int {
+	n := 0
+	for n < len(s) {
+		c := s[n]
+		if c == '-' || c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (n > 0 && c >= '0' && c <= '9') {
+			n++
+			continue
+		}
+		break
+	}
+	return n
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,58 @@
+package diff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	updated := "a\nb\nc\nd\nE\nf\ng\nh\ni\nj\nk\n"
+	got := Unified("a/x.go", "b/x.go", []byte(old), []byte(updated))
+	want := `--- a/x.go
++++ b/x.go
+@@ -2,9 +2,10 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+ i
+ j
++k
+`
+	if got != want {
+		t.Fatalf("unexpected diff:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnified_SeparateHunksAndNewFile(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	updated := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"
+	got := Unified("old", "new", []byte(old), []byte(updated))
+	want := `--- old
++++ new
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+`
+	if got != want {
+		t.Fatalf("unexpected diff:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got := Unified("/dev/null", "new", nil, []byte("x\n")); got != "--- /dev/null\n+++ new\n@@ -0,0 +1,1 @@\n+x\n" {
+		t.Fatalf("unexpected diff for new file:\n%s", got)
+	}
+	if got := Unified("a", "b", []byte("same\n"), []byte("same\n")); got != "" {
+		t.Fatalf("expected no diff for identical input, got:\n%s", got)
+	}
+}
@@ -0,0 +1,558 @@
+package generator
+
+import (
+	"errors"
+	"go/types"
+	htmltemplate "html/template"
+	"io"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+	"unicode"
+
+	"github.com/elliot40404/mailc/internal/diag"
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// reParseErr extracts the line and message from text/template parse errors
+// such as "template: body:3: unexpected EOF".
+var reParseErr = regexp.MustCompile(`^template: [^:]*:(\d+):\s*(.*)$`)
+
+// Check parses the processed subject and body of every template the same
+// way the generated code will, and checks every field reference against the
+// data model declared in the template, along with its sample data. Templates
+// that already have parse errors are skipped, since their data model is
+// incomplete. Partials are checked once, against the parameters they declare.
+// Templates in the same directory that would generate the same function,
+// such as welcome.html and welcome.md, are reported as well.
+func Check(templates []*parser.ParsedTemplate) diag.List {
+	var diags diag.List
+	checked := make(map[string]bool) // partial files
+	pkgs := newPackageLoader()
+	type generated struct{ dir, name string }
+	funcs := make(map[generated]string) // generated function -> template
+	for _, pt := range templates {
+		fn := generated{filepath.Dir(pt.FilePath), util.MakeExportedName(templateBaseName(pt)) + "Email"}
+		if other, ok := funcs[fn]; ok {
+			diags.Errorf(pt.FilePath, diag.Pos{}, "%s generates %s too; rename one of them", other, fn.name)
+			continue
+		}
+		funcs[fn] = pt.FilePath
+	}
+	for _, pt := range templates {
+		if pt.Diagnostics.HasErrors() {
+			continue
+		}
+		diags = append(diags, checkTemplate(pt, pkgs)...)
+		diags = append(diags, checkScenarios(pt)...)
+		for _, p := range pt.Partials {
+			if !checked[p.Template.FilePath] {
+				checked[p.Template.FilePath] = true
+				diags = append(diags, checkPartial(p, pkgs)...)
+			}
+		}
+	}
+	return diags
+}
+
+// locator maps a byte offset in processed template text to a file and a
+// position in it.
+type locator func(off int) (string, diag.Pos)
+
+func checkTemplate(pt *parser.ParsedTemplate, pkgs *packageLoader) diag.List {
+	model := newTypeModel(pt, util.MakeExportedName(templateBaseName(pt))+"EmailData", pkgs)
+	diags := checkImports(pt, pkgs)
+	checkBody(&diags, pt, model, pkgs)
+
+	if subject := strings.TrimSpace(pt.Subject); subject != "" {
+		checkTextTemplate(&diags, pt, model, "subject", subject, func(off int) (string, diag.Pos) {
+			pos := pt.SubjectPos
+			if nl := strings.LastIndexByte(subject[:off], '\n'); nl >= 0 {
+				pos.Line += strings.Count(subject[:off], "\n")
+				pos.Col = off - nl
+			} else {
+				pos.Col += off
+			}
+			return pt.FilePath, pos
+		})
+	}
+	if text := strings.TrimSpace(pt.Text); text != "" {
+		checkTextTemplate(&diags, pt, model, "text", text, pt.TextSourcePos)
+	}
+	return diags
+}
+
+// checkPartial checks a partial on its own, against the parameters it
+// declares. Its callers are checked against the same parameters.
+func checkPartial(p *parser.Partial, pkgs *packageLoader) diag.List {
+	diags := checkImports(p.Template, pkgs)
+	checkBody(&diags, p.Template, newTypeModel(p.Template, partialTypeName(p), pkgs), pkgs)
+	return diags
+}
+
+// partialTypeName names the parameters of p in diagnostics.
+func partialTypeName(p *parser.Partial) string {
+	return util.MakeExportedName(strings.TrimSuffix(p.Name, ".html")) + "Params"
+}
+
+// checkBody checks the HTML body of pt together with the calls it makes to
+// partials.
+func checkBody(diags *diag.List, pt *parser.ParsedTemplate, model *typeModel, pkgs *packageLoader) {
+	body, start := bodySource(pt)
+	processedHTML, bodyIns := rewriteDots(pt, body)
+	bodyPos := func(off int) (string, diag.Pos) { return pt.SourcePos(start + originalOffset(off, bodyIns)) }
+	bodyTmpl, err := htmltemplate.New("body").Funcs(templateFuncs).Parse(processedHTML)
+	if err != nil {
+		reportParseErr(diags, err, processedHTML, bodyPos)
+		return
+	}
+	// Partials are checked on their own; broken ones are reported there
+	partials := make(map[string]*tmplType, len(pt.Partials))
+	escape := true
+	for _, p := range pt.Partials {
+		partials[p.Name] = newTypeModel(p.Template, partialTypeName(p), pkgs).root
+		if _, err := bodyTmpl.Parse(partialSource(p)); err != nil {
+			escape = false
+		}
+	}
+	var defined []*parse.Tree
+	for _, t := range bodyTmpl.Templates() {
+		if _, ok := partials[t.Name()]; !ok {
+			defined = append(defined, t.Tree)
+		}
+	}
+	checkTree(diags, bodyTmpl.Tree, defined, model, partials, bodyPos)
+	if !escape {
+		return
+	}
+	// Escaping runs on first execution; executing without data is enough
+	// to surface context errors such as unterminated attributes.
+	var escErr *htmltemplate.Error
+	if err := bodyTmpl.Execute(io.Discard, nil); errors.As(err, &escErr) && partials[escErr.Name] == nil {
+		file, pos := bodyPos(lineOffset(processedHTML, escErr.Line))
+		diags.Errorf(file, pos, "%s", escErr.Description)
+	}
+}
+
+// checkTextTemplate checks a text/template source located by loc, such as
+// the subject or the plain-text body.
+func checkTextTemplate(diags *diag.List, pt *parser.ParsedTemplate, model *typeModel, name, src string, loc locator) {
+	processed, ins := rewriteDots(pt, src)
+	pos := func(off int) (string, diag.Pos) { return loc(originalOffset(off, ins)) }
+	tmpl, err := texttemplate.New(name).Parse(processed)
+	if err != nil {
+		reportParseErr(diags, err, processed, pos)
+		return
+	}
+	var defined []*parse.Tree
+	for _, t := range tmpl.Templates() {
+		defined = append(defined, t.Tree)
+	}
+	checkTree(diags, tmpl.Tree, defined, model, nil, pos)
+}
+
+// bodySource returns the body exactly as it is embedded in generated code
+// together with its byte offset in pt.HTML.
+func bodySource(pt *parser.ParsedTemplate) (string, int) {
+	trimmed := strings.TrimLeftFunc(pt.HTML, unicode.IsSpace)
+	return strings.TrimRightFunc(trimmed, unicode.IsSpace), len(pt.HTML) - len(trimmed)
+}
+
+// lineOffset returns the byte offset of the given 1-based line in text.
+func lineOffset(text string, line int) int {
+	off := 0
+	for ; line > 1; line-- {
+		nl := strings.IndexByte(text[off:], '\n')
+		if nl < 0 {
+			break
+		}
+		off += nl + 1
+	}
+	return off
+}
+
+func reportParseErr(diags *diag.List, err error, text string, pos locator) {
+	if m := reParseErr.FindStringSubmatch(err.Error()); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		file, p := pos(lineOffset(text, n))
+		diags.Errorf(file, p, "%s", m[2])
+		return
+	}
+	file, p := pos(0)
+	diags.Errorf(file, p, "%v", err)
+}
+
+// checkTree walks the main template tree with dot bound to the root data,
+// then every associated {{define}} with dot bound to the type it was
+// invoked with (or unchecked if it never is). Calls to partials are checked
+// against their parameters, keyed by partial name.
+func checkTree(diags *diag.List, main *parse.Tree, defined []*parse.Tree, model *typeModel, partials map[string]*tmplType, pos locator) {
+	c := &checker{
+		report: func(n parse.Node, format string, args ...any) {
+			file, p := pos(int(n.Position()))
+			diags.Errorf(file, p, format, args...)
+		},
+		calls:    make(map[string]*tmplType),
+		partials: partials,
+	}
+	vars := map[string]*tmplType{"$": model.root}
+	c.walk(main.Root, model.root, vars)
+	for _, t := range defined {
+		if t == nil || t == main || t.Root == nil {
+			continue
+		}
+		dot := c.calls[t.Name]
+		if dot == nil {
+			dot = unknownType
+		}
+		c.walk(t.Root, dot, map[string]*tmplType{"$": dot})
+	}
+}
+
+type typeKind int
+
+const (
+	kindUnknown typeKind = iota // not modeled (e.g. time.Time); never checked
+	kindBasic                   // string, int, bool, ...
+	kindStruct
+	kindSlice
+	kindMap
+)
+
+// tmplType is the subset of the Go type system needed to check templates.
+type tmplType struct {
+	kind   typeKind
+	name   string
+	fields map[string]*tmplType
+	elem   *tmplType
+}
+
+var unknownType = &tmplType{kind: kindUnknown}
+
+// typeModel resolves the type expressions declared in a template.
+type typeModel struct {
+	structs  map[string]parser.ParsedStruct
+	resolved map[string]*tmplType
+	root     *tmplType
+
+	pt    *parser.ParsedTemplate
+	pkgs  *packageLoader // nil leaves imported types unchecked
+	named map[*types.Named]*tmplType
+}
+
+func newTypeModel(pt *parser.ParsedTemplate, rootName string, pkgs *packageLoader) *typeModel {
+	m := &typeModel{
+		structs:  make(map[string]parser.ParsedStruct, len(pt.Structs)),
+		resolved: make(map[string]*tmplType),
+		pt:       pt,
+		pkgs:     pkgs,
+		named:    make(map[*types.Named]*tmplType),
+	}
+	for _, s := range pt.Structs {
+		m.structs[s.Name] = s
+	}
+	m.root = &tmplType{kind: kindStruct, name: rootName, fields: make(map[string]*tmplType)}
+	for _, s := range pt.Structs {
+		if !s.TypeOnly {
+			m.root.fields[s.Name] = m.resolve(s.Name)
+		}
+	}
+	for _, v := range pt.Variables {
+		m.root.fields[util.UpperFirst(v.Name)] = m.resolve(v.Type)
+	}
+	return m
+}
+
+func (m *typeModel) resolve(typ string) *tmplType {
+	switch {
+	case strings.HasPrefix(typ, "[]"):
+		return &tmplType{kind: kindSlice, name: typ, elem: m.resolve(typ[2:])}
+	case strings.HasPrefix(typ, "*"):
+		// Templates dereference pointers transparently
+		return m.resolve(typ[1:])
+	case strings.HasPrefix(typ, "map["):
+		end := strings.Index(typ, "]")
+		if end < 0 {
+			return unknownType
+		}
+		return &tmplType{kind: kindMap, name: typ, elem: m.resolve(typ[end+1:])}
+	case typ == "any":
+		return unknownType
+	case parser.IsBuiltinType(typ):
+		return &tmplType{kind: kindBasic, name: typ}
+	}
+	if t, ok := m.resolved[typ]; ok {
+		return t
+	}
+	if strings.Contains(typ, ".") {
+		t := unknownType
+		if m.pkgs != nil {
+			if gt, err := m.pkgs.lookup(m.pt, typ); err == nil && gt != nil {
+				t = m.fromGo(gt)
+			}
+		}
+		m.resolved[typ] = t
+		return t
+	}
+	s, ok := m.structs[typ]
+	if !ok {
+		return unknownType
+	}
+	t := &tmplType{kind: kindStruct, name: typ, fields: make(map[string]*tmplType, len(s.Fields))}
+	m.resolved[typ] = t // registered before fields to allow recursive types
+	for _, f := range s.Fields {
+		t.fields[f.Name] = m.resolve(f.Type)
+	}
+	return t
+}
+
+type checker struct {
+	report   func(n parse.Node, format string, args ...any)
+	calls    map[string]*tmplType // dot type each {{template}} is invoked with
+	partials map[string]*tmplType // parameters of each partial
+}
+
+func (c *checker) walk(node parse.Node, dot *tmplType, vars map[string]*tmplType) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			c.walk(child, dot, vars)
+		}
+	case *parse.ActionNode:
+		c.pipe(n.Pipe, dot, vars)
+	case *parse.IfNode:
+		c.pipe(n.Pipe, dot, vars)
+		c.walk(n.List, dot, maps.Clone(vars))
+		c.walk(n.ElseList, dot, maps.Clone(vars))
+	case *parse.WithNode:
+		inner := maps.Clone(vars)
+		t := c.pipe(n.Pipe, dot, inner)
+		c.walk(n.List, t, inner)
+		c.walk(n.ElseList, dot, maps.Clone(vars))
+	case *parse.RangeNode:
+		inner := maps.Clone(vars)
+		t := c.pipeType(n.Pipe, dot, inner)
+		elem := unknownType
+		switch t.kind {
+		case kindSlice, kindMap:
+			elem = t.elem
+		case kindBasic:
+			if !strings.HasPrefix(t.name, "int") {
+				c.report(n, "range can't iterate over %s", t.name)
+			}
+		case kindStruct:
+			c.report(n, "range can't iterate over %s", t.name)
+		}
+		switch len(n.Pipe.Decl) {
+		case 1:
+			inner[n.Pipe.Decl[0].Ident[0]] = elem
+		case 2:
+			inner[n.Pipe.Decl[0].Ident[0]] = unknownType
+			inner[n.Pipe.Decl[1].Ident[0]] = elem
+		}
+		c.walk(n.List, elem, inner)
+		c.walk(n.ElseList, dot, maps.Clone(vars))
+	case *parse.TemplateNode:
+		t := dot
+		if n.Pipe != nil {
+			t = c.pipe(n.Pipe, dot, vars)
+		}
+		if want, ok := c.partials[n.Name]; ok {
+			c.include(n, t, want)
+			return
+		}
+		if _, seen := c.calls[n.Name]; !seen {
+			c.calls[n.Name] = t
+		}
+	}
+}
+
+// pipe checks a pipeline, records any variables it declares and returns the
+// type it evaluates to.
+func (c *checker) pipe(p *parse.PipeNode, dot *tmplType, vars map[string]*tmplType) *tmplType {
+	t := c.pipeType(p, dot, vars)
+	if !p.IsAssign {
+		for _, v := range p.Decl {
+			vars[v.Ident[0]] = t
+		}
+	}
+	return t
+}
+
+func (c *checker) pipeType(p *parse.PipeNode, dot *tmplType, vars map[string]*tmplType) *tmplType {
+	if p == nil {
+		return dot
+	}
+	t := unknownType
+	for _, cmd := range p.Cmds {
+		t = c.command(cmd, dot, vars)
+	}
+	return t
+}
+
+func (c *checker) command(cmd *parse.CommandNode, dot *tmplType, vars map[string]*tmplType) *tmplType {
+	if id, ok := cmd.Args[0].(*parse.IdentifierNode); ok && id.Ident == parser.ParamsFunc && c.partials != nil {
+		return c.params(cmd, dot, vars)
+	}
+	var t *tmplType
+	for _, arg := range cmd.Args {
+		at := c.arg(arg, dot, vars)
+		if t == nil {
+			t = at
+		}
+	}
+	// Function and method calls are not modeled
+	if t == nil || len(cmd.Args) > 1 {
+		return unknownType
+	}
+	return t
+}
+
+// params returns the type of a params call: a struct with one field per
+// parameter name.
+func (c *checker) params(cmd *parse.CommandNode, dot *tmplType, vars map[string]*tmplType) *tmplType {
+	t := &tmplType{kind: kindStruct, name: parser.ParamsFunc, fields: make(map[string]*tmplType)}
+	args := cmd.Args[1:]
+	if len(args)%2 != 0 {
+		c.report(cmd, "%s needs pairs of parameter names and values", parser.ParamsFunc)
+		return unknownType
+	}
+	for i := 0; i < len(args); i += 2 {
+		value := c.arg(args[i+1], dot, vars)
+		name, ok := args[i].(*parse.StringNode)
+		if !ok {
+			c.report(cmd, "%s parameter names must be quoted strings", parser.ParamsFunc)
+			return unknownType
+		}
+		t.fields[name.Text] = value
+	}
+	return t
+}
+
+// include checks the data passed to the partial n.Name against the
+// parameters it declares.
+func (c *checker) include(n *parse.TemplateNode, t, want *tmplType) {
+	if t.kind != kindStruct {
+		if msg := assignable(t, want); msg != "" {
+			c.report(n, "partial %s: %s", n.Name, msg)
+		}
+		return
+	}
+	if t.name == parser.ParamsFunc {
+		for _, name := range slices.Sorted(maps.Keys(t.fields)) {
+			if _, ok := want.fields[name]; !ok {
+				c.report(n, "partial %s has no parameter %s", n.Name, name)
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(want.fields)) {
+		ft, ok := t.fields[name]
+		if !ok {
+			c.report(n, "partial %s: missing parameter %s", n.Name, name)
+			continue
+		}
+		if msg := assignable(ft, want.fields[name]); msg != "" {
+			c.report(n, "partial %s: parameter %s: %s", n.Name, name, msg)
+		}
+	}
+}
+
+// assignable reports why a value of type t cannot be used where want is
+// expected, or "" if it can. Types compare by structure, since partials and
+// their callers declare their types separately.
+func assignable(t, want *tmplType) string {
+	return assignableSeen(t, want, make(map[[2]*tmplType]bool))
+}
+
+func assignableSeen(t, want *tmplType, seen map[[2]*tmplType]bool) string {
+	// Maps are indexed like structs in templates
+	if t.kind == kindUnknown || want.kind == kindUnknown || t.kind == kindMap && want.kind == kindStruct {
+		return ""
+	}
+	if seen[[2]*tmplType{t, want}] {
+		return ""
+	}
+	seen[[2]*tmplType{t, want}] = true
+	mismatch := "cannot use " + t.name + " as " + want.name
+	if t.kind != want.kind {
+		return mismatch
+	}
+	switch want.kind {
+	case kindBasic:
+		if t.name != want.name {
+			return mismatch
+		}
+	case kindSlice, kindMap:
+		if assignableSeen(t.elem, want.elem, seen) != "" {
+			return mismatch
+		}
+	case kindStruct:
+		for _, name := range slices.Sorted(maps.Keys(want.fields)) {
+			ft, ok := t.fields[name]
+			if !ok {
+				return t.name + " has no field " + name
+			}
+			if msg := assignableSeen(ft, want.fields[name], seen); msg != "" {
+				return msg
+			}
+		}
+	}
+	return ""
+}
+
+func (c *checker) arg(arg parse.Node, dot *tmplType, vars map[string]*tmplType) *tmplType {
+	switch a := arg.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return c.fields(a, dot, a.Ident)
+	case *parse.VariableNode:
+		t, ok := vars[a.Ident[0]]
+		if !ok {
+			return unknownType
+		}
+		return c.fields(a, t, a.Ident[1:])
+	case *parse.ChainNode:
+		return c.fields(a, c.arg(a.Node, dot, vars), a.Field)
+	case *parse.PipeNode:
+		return c.pipeType(a, dot, vars)
+	case *parse.StringNode:
+		return &tmplType{kind: kindBasic, name: "string"}
+	case *parse.BoolNode:
+		return &tmplType{kind: kindBasic, name: "bool"}
+	}
+	return unknownType
+}
+
+// fields resolves a chain of field names starting at t, reporting the first
+// field that does not exist.
+func (c *checker) fields(n parse.Node, t *tmplType, chain []string) *tmplType {
+	for _, name := range chain {
+		switch t.kind {
+		case kindUnknown:
+			return unknownType
+		case kindMap:
+			t = t.elem
+		case kindStruct:
+			ft, ok := t.fields[name]
+			if !ok {
+				c.report(n, "%s has no field %s", t.name, name)
+				return unknownType
+			}
+			t = ft
+		default:
+			c.report(n, "can't evaluate field %s on type %s", name, t.name)
+			return unknownType
+		}
+	}
+	return t
+}
@@ -0,0 +1,221 @@
+package generator
+
+import (
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// scopeKind describes how a block action affects dot.
+type scopeKind int
+
+const (
+	scopeKeep   scopeKind = iota // if/else: dot is unchanged
+	scopeRebind                  // range/with: dot is rebound to the pipeline value
+	scopeDefine                  // define/block: dot is the template argument
+)
+
+// insertLeadingDots rewrites references to declared data such as
+// {{User.Name}} into field accesses on the template data ({{ .User.Name}}).
+// Inside {{range}} and {{with}} blocks, where dot is rebound, root references
+// are rewritten relative to $ instead so they keep pointing at the data root.
+func insertLeadingDots(pt *parser.ParsedTemplate, s string) string {
+	out, _ := rewriteDots(pt, s)
+	return out
+}
+
+// insertion records n bytes inserted at offset at of rewritten text.
+type insertion struct {
+	at int
+	n  int
+}
+
+// originalOffset maps an offset in text rewritten with the given insertions
+// back to the corresponding offset in the original text.
+func originalOffset(off int, ins []insertion) int {
+	orig := off
+	for _, in := range ins {
+		if in.at >= off {
+			break
+		}
+		orig -= min(in.n, off-in.at)
+	}
+	return orig
+}
+
+// rewriteDots implements insertLeadingDots and also returns where text was
+// inserted, so that positions can be mapped back to the template source.
+func rewriteDots(pt *parser.ParsedTemplate, s string) (string, []insertion) {
+	if s == "" {
+		return s, nil
+	}
+	roots := make(map[string]string, len(pt.Structs)+len(pt.Variables))
+	for _, st := range pt.Structs {
+		if !st.TypeOnly {
+			roots[st.Name] = st.Name
+			if st.Root != "" {
+				roots[st.Root] = st.Name
+			}
+		}
+	}
+	for _, v := range pt.Variables {
+		roots[v.Name] = util.UpperFirst(v.Name)
+	}
+	if len(roots) == 0 {
+		return s, nil
+	}
+
+	var out strings.Builder
+	var inserted []insertion
+	var stack []scopeKind
+	rootPrefix := func() string {
+		for i := len(stack) - 1; i >= 0; i-- {
+			switch stack[i] {
+			case scopeDefine:
+				return "."
+			case scopeRebind:
+				return "$."
+			}
+		}
+		return "."
+	}
+
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			out.WriteString(s)
+			break
+		}
+		end := parser.ActionEnd(s, start+2)
+		if end < 0 {
+			out.WriteString(s)
+			break
+		}
+		out.WriteString(s[:start])
+		action := s[start:end]
+		s = s[end:]
+
+		inner := strings.TrimPrefix(action[2:len(action)-2], "-")
+		inner = strings.TrimSuffix(inner, "-")
+		keyword := firstWord(inner)
+
+		// The pipeline of an {{else ...}} is evaluated in the enclosing scope.
+		if keyword == "else" && len(stack) > 0 {
+			stack = stack[:len(stack)-1]
+		}
+		rewritten, ins := rewriteAction(action, roots, rootPrefix())
+		for _, in := range ins {
+			inserted = append(inserted, insertion{at: out.Len() + in.at, n: in.n})
+		}
+		out.WriteString(rewritten)
+
+		switch keyword {
+		case "range", "with":
+			stack = append(stack, scopeRebind)
+		case "if":
+			stack = append(stack, scopeKeep)
+		case "define", "block":
+			stack = append(stack, scopeDefine)
+		case "else":
+			switch firstWord(strings.TrimSpace(inner)[len("else"):]) {
+			case "with", "range":
+				stack = append(stack, scopeRebind)
+			default:
+				stack = append(stack, scopeKeep)
+			}
+		case "end":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return out.String(), inserted
+}
+
+// rewriteAction prefixes bare identifiers naming a root field with prefix,
+// leaving strings, comments, variables and field chains untouched.
+func rewriteAction(action string, roots map[string]string, prefix string) (string, []insertion) {
+	var out strings.Builder
+	var inserted []insertion
+	i := 2
+	out.WriteString("{{")
+	if strings.HasPrefix(action[i:], "-") {
+		out.WriteString("-")
+		i++
+	}
+	body := action[:len(action)-2]
+	afterDelim := true
+	for i < len(body) {
+		c := body[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(body) && body[j] != c {
+				if body[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if j < len(body) {
+				j++
+			}
+			out.WriteString(body[i:j])
+			i = j
+		case strings.HasPrefix(body[i:], "/*"):
+			j := strings.Index(body[i+2:], "*/")
+			if j < 0 {
+				out.WriteString(body[i:])
+				i = len(body)
+				continue
+			}
+			out.WriteString(body[i : i+j+4])
+			i += j + 4
+		case isIdentStart(c):
+			j := i
+			for j < len(body) && isIdentChar(body[j]) {
+				j++
+			}
+			name := body[i:j]
+			prev := byte(' ')
+			if i > 0 {
+				prev = body[i-1]
+			}
+			if field, ok := roots[name]; ok && prev != '.' && prev != '$' && !isIdentChar(prev) {
+				at := out.Len()
+				if afterDelim {
+					out.WriteString(" ")
+				}
+				out.WriteString(prefix + field)
+				// field may differ from name only in the case of its first letter
+				inserted = append(inserted, insertion{at: at, n: out.Len() - at - len(name)})
+			} else {
+				out.WriteString(name)
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+		afterDelim = false
+	}
+	out.WriteString("}}")
+	return out.String(), inserted
+}
+
+func firstWord(s string) string {
+	s = strings.TrimSpace(s)
+	i := 0
+	for i < len(s) && isIdentChar(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,587 @@
+package generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elliot40404/mailc/internal/diag"
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// defaultScenario names the sample data declared with @example annotations.
+const defaultScenario = "default"
+
+// scenario is a named set of sample data decoded into the runtime shape of
+// the template data (see valueDecoder).
+type scenario struct {
+	Name string
+	Data map[string]any
+}
+
+// Scenarios returns the names of the sample data scenarios of pt: "default"
+// for @example annotations, followed by the fixtures file scenarios.
+func Scenarios(pt *parser.ParsedTemplate) []string {
+	var names []string
+	for _, sc := range scenarios(pt) {
+		names = append(names, sc.Name)
+	}
+	return names
+}
+
+// ScenarioData returns the sample data of the named scenario in the form
+// expected by Render. Fields the scenario does not set hold zero values,
+// exactly as in the struct returned by the generated constructor.
+func ScenarioData(pt *parser.ParsedTemplate, name string) (map[string]any, bool) {
+	for _, sc := range scenarios(pt) {
+		if sc.Name == name {
+			return sc.Data, true
+		}
+	}
+	return nil, false
+}
+
+// DecodeData decodes JSON data keyed by the names used in the template (e.g.
+// {"User": {"Name": "Jane"}}) into the form expected by Render, checking every
+// value against its declared type. Every mismatch is reported, one per line
+// of the returned error.
+func DecodeData(pt *parser.ParsedTemplate, src []byte) (map[string]any, error) {
+	dec := json.NewDecoder(strings.NewReader(string(src)))
+	dec.UseNumber()
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decoding JSON: %w", err)
+	}
+	d := newValueDecoder(pt)
+	data := d.root(raw)
+	if len(d.errs) > 0 {
+		errs := make([]error, len(d.errs))
+		for i, msg := range d.errs {
+			errs[i] = errors.New(msg)
+		}
+		return nil, errors.Join(errs...)
+	}
+	return data, nil
+}
+
+// scenarios decodes the sample data of pt, ignoring invalid values; they are
+// reported by checkScenarios.
+func scenarios(pt *parser.ParsedTemplate) []scenario {
+	var out []scenario
+	if len(pt.Examples) > 0 {
+		tree := make(map[string]any)
+		for _, ex := range pt.Examples {
+			mergeTree(tree, exampleTree(ex))
+		}
+		out = append(out, scenario{Name: defaultScenario, Data: newValueDecoder(pt).root(tree)})
+	}
+	for _, fx := range pt.Fixtures {
+		if fx.Name == defaultScenario && len(pt.Examples) > 0 {
+			continue
+		}
+		out = append(out, scenario{Name: fx.Name, Data: newValueDecoder(pt).root(fx.Data)})
+	}
+	return out
+}
+
+// checkScenarios reports sample values that do not match the declared types.
+func checkScenarios(pt *parser.ParsedTemplate) diag.List {
+	var diags diag.List
+	seen := make(map[string]diag.Pos)
+	for _, ex := range pt.Examples {
+		if prev, ok := seen[ex.Path]; ok {
+			diags.Errorf(ex.File, ex.Pos, "duplicate @example for %s (first at %s)", ex.Path, prev)
+			continue
+		}
+		seen[ex.Path] = ex.Pos
+		d := newValueDecoder(pt)
+		d.root(exampleTree(ex))
+		for _, msg := range d.errs {
+			diags.Errorf(ex.File, ex.Pos, "@example %s", msg)
+		}
+	}
+
+	funcs := make(map[string]string)
+	if len(pt.Examples) > 0 {
+		funcs[sampleFuncSuffix(defaultScenario)] = "@example annotations"
+	}
+	for _, fx := range pt.Fixtures {
+		if fx.Name == defaultScenario && len(pt.Examples) > 0 {
+			diags.Errorf(pt.FixturesFile, diag.Pos{}, "scenario %q is already defined by @example annotations in %s", fx.Name, pt.FilePath)
+			continue
+		}
+		suffix := sampleFuncSuffix(fx.Name)
+		if other, ok := funcs[suffix]; ok {
+			diags.Errorf(pt.FixturesFile, diag.Pos{}, "scenario %q has the same function name as %s", fx.Name, other)
+			continue
+		}
+		funcs[suffix] = fmt.Sprintf("scenario %q", fx.Name)
+		d := newValueDecoder(pt)
+		d.root(fx.Data)
+		for _, msg := range d.errs {
+			diags.Errorf(pt.FixturesFile, diag.Pos{}, "scenario %q: %s", fx.Name, msg)
+		}
+	}
+	return diags
+}
+
+// sampleFuncSuffix returns the suffix of the generated constructor for a
+// scenario: none for the default scenario, e.g. "Vip" for "vip".
+func sampleFuncSuffix(name string) string {
+	if name == defaultScenario {
+		return ""
+	}
+	return util.MakeExportedName(name)
+}
+
+// exampleTree turns @example User.Name "Jane" into {"User": {"Name": "Jane"}}.
+func exampleTree(ex parser.Example) map[string]any {
+	parts := strings.Split(ex.Path, ".")
+	var v any = ex.Value
+	for i := len(parts) - 1; i > 0; i-- {
+		v = map[string]any{parts[i]: v}
+	}
+	return map[string]any{parts[0]: v}
+}
+
+// mergeTree merges src into dst, recursing into objects present in both.
+func mergeTree(dst, src map[string]any) {
+	for k, v := range src {
+		dm, ok1 := dst[k].(map[string]any)
+		sm, ok2 := v.(map[string]any)
+		if ok1 && ok2 {
+			mergeTree(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// valueDecoder converts decoded JSON into the values Render executes
+// templates with, checking them against the declared types: structs become
+// maps keyed by field name holding every field, numbers get their declared
+// Go type and time.Time values are parsed from RFC 3339 strings.
+type valueDecoder struct {
+	pt      *parser.ParsedTemplate
+	structs map[string]parser.ParsedStruct
+	errs    []string
+}
+
+func newValueDecoder(pt *parser.ParsedTemplate) *valueDecoder {
+	d := &valueDecoder{pt: pt, structs: make(map[string]parser.ParsedStruct, len(pt.Structs))}
+	for _, s := range pt.Structs {
+		d.structs[s.Name] = s
+	}
+	return d
+}
+
+// rootFields returns the fields of the generated data struct with their
+// declared types, in declaration order.
+func rootFields(pt *parser.ParsedTemplate) []parser.ParsedField {
+	var fields []parser.ParsedField
+	for _, s := range pt.Structs {
+		if !s.TypeOnly {
+			fields = append(fields, parser.ParsedField{Name: s.Name, Type: s.Name})
+		}
+	}
+	for _, v := range pt.Variables {
+		fields = append(fields, parser.ParsedField{Name: util.UpperFirst(v.Name), Type: v.Type})
+	}
+	return fields
+}
+
+func (d *valueDecoder) errorf(path, format string, args ...any) {
+	d.errs = append(d.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+// root decodes data for the generated data struct.
+func (d *valueDecoder) root(data map[string]any) map[string]any {
+	return d.fields(rootFields(d.pt), data, "", util.MakeExportedName(templateBaseName(d.pt))+"EmailData")
+}
+
+// fields decodes a JSON object into a struct with the given fields. Keys may
+// be written with a lowercase first letter, as in the template.
+func (d *valueDecoder) fields(fields []parser.ParsedField, obj map[string]any, path, typeName string) map[string]any {
+	out := make(map[string]any, len(fields))
+	byName := make(map[string]parser.ParsedField, len(fields))
+	for _, f := range fields {
+		byName[f.Name] = f
+		out[f.Name] = d.zero(f.Type, 0)
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := util.UpperFirst(k)
+		f, ok := byName[name]
+		if !ok {
+			d.errorf(join(path, k), "%s has no field %s", typeName, name)
+			continue
+		}
+		out[name] = d.decode(f.Type, obj[k], join(path, name))
+	}
+	return out
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// decode converts v to the runtime value of type typ.
+func (d *valueDecoder) decode(typ string, v any, path string) any {
+	if v == nil {
+		return d.zero(typ, 0)
+	}
+	switch {
+	case strings.HasPrefix(typ, "[]"):
+		arr, ok := v.([]any)
+		if !ok {
+			d.errorf(path, "cannot use %s as %s", describeJSON(v), typ)
+			return d.zero(typ, 0)
+		}
+		out := make([]any, len(arr))
+		for i, el := range arr {
+			out[i] = d.decode(typ[2:], el, fmt.Sprintf("%s[%d]", path, i))
+		}
+		return out
+	case strings.HasPrefix(typ, "*"):
+		return d.decode(typ[1:], v, path)
+	case strings.HasPrefix(typ, "map["):
+		end := strings.Index(typ, "]")
+		obj, ok := v.(map[string]any)
+		if end < 0 || !ok {
+			d.errorf(path, "cannot use %s as %s", describeJSON(v), typ)
+			return d.zero(typ, 0)
+		}
+		if key := typ[len("map["):end]; key != "string" {
+			d.errorf(path, "sample data for %s is not supported; map keys must be strings", typ)
+			return d.zero(typ, 0)
+		}
+		out := make(map[string]any, len(obj))
+		for k, el := range obj {
+			out[k] = d.decode(typ[end+1:], el, path+"["+strconv.Quote(k)+"]")
+		}
+		return out
+	case typ == "any":
+		return plainJSON(v)
+	case typ == "string":
+		if s, ok := v.(string); ok {
+			return s
+		}
+	case typ == "time.Time":
+		if s, ok := v.(string); ok {
+			if t, err := parseTime(s); err == nil {
+				return t
+			}
+			d.errorf(path, "cannot parse %q as time.Time; want RFC 3339 such as 2025-01-02T15:04:05Z", s)
+			return time.Time{}
+		}
+	case typ == "bool":
+		if b, ok := v.(bool); ok {
+			return b
+		}
+	}
+	if t, ok := basicKinds[typ]; ok && t.Kind() != reflect.Bool {
+		n, ok := v.(json.Number)
+		if !ok {
+			d.errorf(path, "cannot use %s as %s", describeJSON(v), typ)
+			return d.zero(typ, 0)
+		}
+		val, err := convertNumber(n, t)
+		if err != nil {
+			d.errorf(path, "cannot use %s as %s", n, typ)
+			return d.zero(typ, 0)
+		}
+		return val
+	}
+	if s, ok := d.structs[typ]; ok {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			d.errorf(path, "cannot use %s as %s", describeJSON(v), typ)
+			return d.zero(typ, 0)
+		}
+		return d.fields(s.Fields, obj, path, typ)
+	}
+	if parser.IsBuiltinType(typ) || typ == "time.Time" {
+		d.errorf(path, "cannot use %s as %s", describeJSON(v), typ)
+	} else {
+		d.errorf(path, "sample data for type %s is not supported", typ)
+	}
+	return d.zero(typ, 0)
+}
+
+// zero returns the runtime zero value of typ.
+func (d *valueDecoder) zero(typ string, depth int) any {
+	switch {
+	case strings.HasPrefix(typ, "[]"), strings.HasPrefix(typ, "map["), strings.HasPrefix(typ, "*"):
+		return nil
+	case typ == "string":
+		return ""
+	case typ == "time.Time":
+		return time.Time{}
+	}
+	if t, ok := basicKinds[typ]; ok {
+		return reflect.Zero(t).Interface()
+	}
+	if s, ok := d.structs[typ]; ok && depth < 16 {
+		out := make(map[string]any, len(s.Fields))
+		for _, f := range s.Fields {
+			out[f.Name] = d.zero(f.Type, depth+1)
+		}
+		return out
+	}
+	return nil
+}
+
+// parseTime accepts RFC 3339 timestamps and plain dates.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// convertNumber parses n as a number of type t.
+func convertNumber(n json.Number, t reflect.Type) (any, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(n.String(), 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(n.String(), 10, t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(n.String(), t.Bits())
+		if err != nil {
+			return nil, err
+		}
+		v.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		f, err := strconv.ParseFloat(n.String(), t.Bits()/2)
+		if err != nil {
+			return nil, err
+		}
+		v.SetComplex(complex(f, 0))
+	}
+	return v.Interface(), nil
+}
+
+// plainJSON converts json.Number values inside v to int or float64, the
+// types Go gives untyped constants of the same form.
+func plainJSON(v any) any {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := strconv.Atoi(x.String()); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []any:
+		out := make([]any, len(x))
+		for i, el := range x {
+			out[i] = plainJSON(el)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, el := range x {
+			out[k] = plainJSON(el)
+		}
+		return out
+	}
+	return v
+}
+
+// describeJSON describes a decoded JSON value for error messages.
+func describeJSON(v any) string {
+	switch x := v.(type) {
+	case string:
+		return strconv.Quote(x)
+	case json.Number:
+		return "number " + x.String()
+	case bool:
+		return strconv.FormatBool(x)
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprint(v)
+}
+
+// samplesUseTime reports whether the sample data functions of pt construct
+// a time.Time.
+func samplesUseTime(pt *parser.ParsedTemplate) bool {
+	structs := make(map[string]parser.ParsedStruct, len(pt.Structs))
+	for _, s := range pt.Structs {
+		structs[s.Name] = s
+	}
+	for _, sc := range scenarios(pt) {
+		for _, f := range rootFields(pt) {
+			if v := sc.Data[f.Name]; !isZeroValue(v) && strings.Contains(goLiteral(f.Type, v, nil, structs), "time.Date(") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// goLiteral returns a Go expression of type typ for the runtime value v, as
+// produced by valueDecoder. Struct fields holding zero values are omitted.
+func goLiteral(typ string, v any, prefixed map[string]string, structs map[string]parser.ParsedStruct) string {
+	switch {
+	case strings.HasPrefix(typ, "[]"):
+		arr, _ := v.([]any)
+		if arr == nil {
+			return "nil"
+		}
+		elems := make([]string, len(arr))
+		for i, el := range arr {
+			elems[i] = elemLiteral(typ[2:], el, prefixed, structs)
+		}
+		return resolveType(typ, prefixed) + "{" + strings.Join(elems, ", ") + "}"
+	case strings.HasPrefix(typ, "*"):
+		if v == nil {
+			return "nil"
+		}
+		elem := typ[1:]
+		if _, ok := structs[elem]; ok {
+			return "&" + goLiteral(elem, v, prefixed, structs)
+		}
+		return fmt.Sprintf("func() %s { v := %s(%s); return &v }()", resolveType(typ, prefixed), resolveType(elem, prefixed), goLiteral(elem, v, prefixed, structs))
+	case strings.HasPrefix(typ, "map["):
+		obj, _ := v.(map[string]any)
+		if obj == nil {
+			return "nil"
+		}
+		elem := typ[strings.Index(typ, "]")+1:]
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString(resolveType(typ, prefixed) + "{")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(strconv.Quote(k) + ": " + elemLiteral(elem, obj[k], prefixed, structs))
+		}
+		b.WriteString("}")
+		return b.String()
+	case typ == "time.Time":
+		t, _ := v.(time.Time)
+		t = t.UTC()
+		return fmt.Sprintf("time.Date(%d, time.%s, %d, %d, %d, %d, %d, time.UTC)",
+			t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond())
+	}
+	if s, ok := structs[typ]; ok {
+		obj, _ := v.(map[string]any)
+		var b strings.Builder
+		b.WriteString(resolveType(typ, prefixed) + "{")
+		n := 0
+		for _, f := range s.Fields {
+			fv, ok := obj[f.Name]
+			if !ok || isZeroValue(fv) {
+				continue
+			}
+			if n > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(f.Name + ": " + goLiteral(f.Type, fv, prefixed, structs))
+			n++
+		}
+		b.WriteString("}")
+		return b.String()
+	}
+	return plainLiteral(v)
+}
+
+// elemLiteral returns goLiteral for an element of a slice or map literal,
+// without the element type gofmt -s would elide, as in []Item{{Name: "x"}}.
+func elemLiteral(typ string, v any, prefixed map[string]string, structs map[string]parser.ParsedStruct) string {
+	lit := goLiteral(typ, v, prefixed, structs)
+	prefix := resolveType(typ, prefixed)
+	if elem, ok := strings.CutPrefix(typ, "*"); ok {
+		prefix = "&" + resolveType(elem, prefixed)
+	}
+	if rest, ok := strings.CutPrefix(lit, prefix+"{"); ok {
+		return "{" + rest
+	}
+	return lit
+}
+
+// plainLiteral formats basic values and the values of fields typed any.
+func plainLiteral(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(x)
+	case float32:
+		return strconv.FormatFloat(float64(x), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case complex64, complex128:
+		return fmt.Sprintf("%v", x)
+	case []any:
+		elems := make([]string, len(x))
+		for i, el := range x {
+			elems[i] = plainLiteral(el)
+		}
+		return "[]any{" + strings.Join(elems, ", ") + "}"
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		elems := make([]string, len(keys))
+		for i, k := range keys {
+			elems[i] = strconv.Quote(k) + ": " + plainLiteral(x[k])
+		}
+		return "map[string]any{" + strings.Join(elems, ", ") + "}"
+	}
+	return fmt.Sprint(v)
+}
+
+// isZeroValue reports whether a runtime value equals the zero value of its
+// field, so that it can be left out of a composite literal.
+func isZeroValue(v any) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case map[string]any:
+		// Struct values hold every field; a nil map is a nil map field
+		for _, fv := range x {
+			if !isZeroValue(fv) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		return x == nil
+	case time.Time:
+		return x.IsZero()
+	}
+	return reflect.ValueOf(v).IsZero()
+}
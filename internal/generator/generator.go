@@ -5,62 +5,143 @@ import (
 	"fmt"
 	"go/format"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 
+	"github.com/elliot40404/mailc/internal/diag"
 	"github.com/elliot40404/mailc/internal/parser"
 	"github.com/elliot40404/mailc/internal/util"
 )
 
-func GenerateCode(templates []*parser.ParsedTemplate, outputDir, packageName, version string) error {
-	// Emit shared type used by all generated functions
-	if err := writeCommonTypes(outputDir, packageName, version); err != nil {
+// Options controls how Go code is generated.
+type Options struct {
+	PackageName string // package name of the generated code
+	Version     string // version string embedded in file headers
+	// EagerParse parses every template at package initialization using
+	// template.Must. By default templates are parsed lazily, exactly once,
+	// on first use and parse errors are returned from the render function.
+	EagerParse bool
+	// InlineCSS moves the <style> rules of every template into style
+	// attributes, as if each declared @inline-css.
+	InlineCSS bool
+}
+
+// Writer receives generated files by name (e.g. "welcome.email.go").
+type Writer interface {
+	WriteFile(name string, data []byte) error
+}
+
+// DirWriter writes generated files into a directory on disk.
+type DirWriter string
+
+func (d DirWriter) WriteFile(name string, data []byte) error {
+	return os.WriteFile(filepath.Join(string(d), name), data, 0o600)
+}
+
+// MemWriter collects generated files in memory, keyed by file name.
+type MemWriter map[string][]byte
+
+func (m MemWriter) WriteFile(name string, data []byte) error {
+	m[name] = bytes.Clone(data)
+	return nil
+}
+
+// GenerateCode generates Go code for templates into outputDir.
+func GenerateCode(templates []*parser.ParsedTemplate, outputDir string, opts Options) error {
+	return Generate(templates, DirWriter(outputDir), opts)
+}
+
+// Generate generates Go code for templates, emitting every file through w.
+func Generate(templates []*parser.ParsedTemplate, w Writer, opts Options) error {
+	// Reject broken templates before writing anything
+	var diags diag.List
+	for _, pt := range templates {
+		diags = append(diags, pt.Diagnostics...)
+	}
+	diags = append(diags, Check(templates)...)
+	if err := diags.Compact().Err(); err != nil {
+		return err
+	}
+
+	partials, err := collectPartials(templates)
+	if err != nil {
+		return err
+	}
+	shared, err := collectShared(templates)
+	if err != nil {
+		return err
+	}
+
+	// Emit shared types used by all generated functions
+	if err := writeCommonTypes(w, opts.PackageName, opts.Version, shared); err != nil {
+		return err
+	}
+	if err := writePartials(partials, slices.ContainsFunc(templates, usesFuncs), w, opts); err != nil {
 		return err
 	}
 	for _, pt := range templates {
-		if err := generateTemplateCode(pt, outputDir, packageName, version); err != nil {
+		if err := generateTemplateCode(pt, w, opts); err != nil {
 			return fmt.Errorf("generating code for %s: %w", pt.FilePath, err)
 		}
 	}
 	return nil
 }
 
-func generateTemplateCode(pt *parser.ParsedTemplate, outputDir, packageName, version string) error {
+// rawString returns a Go expression for s made of raw string literals,
+// joined with "`" wherever s contains a backtick.
+func rawString(s string) string {
+	return "`" + strings.ReplaceAll(s, "`", "` + \"`\" + `") + "`"
+}
+
+func generateTemplateCode(pt *parser.ParsedTemplate, w Writer, opts Options) error {
 	var buf bytes.Buffer
 
 	buf.WriteString("// Code generated by mailc. DO NOT EDIT.\n")
-	buf.WriteString(fmt.Sprintf("// Version: mailc %v\n\n", version))
+	buf.WriteString(fmt.Sprintf("// Version: mailc %v\n\n", opts.Version))
 
-	buf.WriteString(fmt.Sprintf("package %s\n\n", packageName))
+	buf.WriteString(fmt.Sprintf("package %s\n\n", opts.PackageName))
 
-	imports := collectImports(pt)
+	imports := collectImports(pt, opts)
 	if len(imports) > 0 {
 		buf.WriteString("import (\n")
-		for _, imp := range imports {
+		for i, imp := range imports {
+			if i > 0 && isStdImport(imports[i-1]) && !isStdImport(imp) {
+				buf.WriteString("\n")
+			}
 			switch imp {
 			case "html/template":
 				buf.WriteString("\thtmltemplate \"html/template\"\n")
 			case "text/template":
 				buf.WriteString("\ttexttemplate \"text/template\"\n")
 			default:
-				buf.WriteString(fmt.Sprintf("\t%q\n", imp))
+				buf.WriteString(fmt.Sprintf("\t%s%q\n", importAlias(pt, imp), imp))
 			}
 		}
 		buf.WriteString(")\n\n")
 	}
 
 	prefixedTypeName := make(map[string]string)
-	baseName := strings.TrimSuffix(filepath.Base(pt.FilePath), filepath.Ext(pt.FilePath))
+	baseName := templateBaseName(pt)
 	// Build a safe exported function/type prefix from filename
 	funcPrefix := util.MakeExportedName(baseName)
 	funcName := funcPrefix + "Email"
 	for _, s := range pt.Structs {
-		typeName := funcName + s.Name
-		prefixedTypeName[s.Name] = typeName
-		buf.WriteString(fmt.Sprintf("type %s struct {\n", typeName))
+		prefixedTypeName[s.Name] = funcName + s.Name
+		if s.Shared {
+			// Emitted once into types.go
+			prefixedTypeName[s.Name] = s.Name
+		}
+	}
+	for _, s := range orderStructs(pt.Structs) {
+		if s.Shared {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("type %s struct {\n", prefixedTypeName[s.Name]))
 		for _, f := range s.Fields {
-			buf.WriteString(fmt.Sprintf("\t%s %s\n", f.Name, f.Type))
+			buf.WriteString(fmt.Sprintf("\t%s %s\n", f.Name, resolveType(f.Type, prefixedTypeName)))
 		}
 		buf.WriteString("}\n\n")
 	}
@@ -68,129 +149,315 @@ func generateTemplateCode(pt *parser.ParsedTemplate, outputDir, packageName, ver
 	mainStructName := funcName + "Data"
 	constName := util.LowerFirst(funcName) + "HTMLTemplate"
 	subjectConstName := util.LowerFirst(funcName) + "SubjectTemplate"
+	textConstName := util.LowerFirst(funcName) + "TextTemplate"
 
 	buf.WriteString(fmt.Sprintf("type %s struct {\n", mainStructName))
 	for _, s := range pt.Structs {
+		if s.TypeOnly {
+			continue
+		}
 		buf.WriteString(fmt.Sprintf("\t%s %s\n", s.Name, prefixedTypeName[s.Name]))
 	}
 	for _, v := range pt.Variables {
 		fieldName := util.UpperFirst(v.Name)
-		buf.WriteString(fmt.Sprintf("\t%s %s\n", fieldName, v.Type))
+		buf.WriteString(fmt.Sprintf("\t%s %s\n", fieldName, resolveType(v.Type, prefixedTypeName)))
 	}
 	buf.WriteString("}\n\n")
 
-	processedHTML := insertLeadingDots(pt, strings.TrimSpace(pt.HTML))
-	buf.WriteString(fmt.Sprintf("const %s = `%s`\n", constName, processedHTML))
-	subjectTrimmed := strings.TrimSpace(pt.Subject)
-	if subjectTrimmed != "" {
-		processedSubject := insertLeadingDots(pt, subjectTrimmed)
-		buf.WriteString(fmt.Sprintf("const %s = `%s`\n\n", subjectConstName, processedSubject))
-	} else {
-		buf.WriteString("\n")
+	processedHTML, processedSubject, processedText := sources(pt, opts.InlineCSS)
+	buf.WriteString(fmt.Sprintf("const %s = %s\n", constName, rawString(processedHTML)))
+	hasSubject := processedSubject != ""
+	if hasSubject {
+		buf.WriteString(fmt.Sprintf("const %s = %s\n", subjectConstName, rawString(processedSubject)))
+	}
+	hasText := processedText != ""
+	if hasText {
+		buf.WriteString(fmt.Sprintf("const %s = %s\n", textConstName, rawString(processedText)))
 	}
+	buf.WriteString("\n")
 
-	buf.WriteString(fmt.Sprintf("func %s(data *%s) (result RenderedEmail, err error) {\n", funcName, mainStructName))
-	buf.WriteString(fmt.Sprintf("\tbodyTmpl, err := htmltemplate.New(\"%s\").Parse(%s)\n", baseName, constName))
-	buf.WriteString("\tif err != nil {\n")
-	buf.WriteString("\t\treturn result, fmt.Errorf(\"parse body template: %w\", err)\n")
-	buf.WriteString("\t}\n\n")
+	bodyVar := util.LowerFirst(funcName) + "BodyTmpl"
+	subjectVar := util.LowerFirst(funcName) + "SubjectTmpl"
+	bodyExpr := fmt.Sprintf("htmltemplate.New(%q).Parse(%s)", baseName, constName)
+	if usesFuncs(pt) {
+		args := []string{fmt.Sprintf("htmltemplate.New(%q)", baseName), constName}
+		for _, p := range pt.Partials {
+			args = append(args, partialConstName(p.Name))
+		}
+		bodyExpr = fmt.Sprintf("parseWithPartials(%s)", strings.Join(args, ", "))
+	}
+	subjectExpr := fmt.Sprintf("texttemplate.New(%q).Parse(%s)", baseName+"_subject", subjectConstName)
+	textVar := util.LowerFirst(funcName) + "TextTmpl"
+	textExpr := fmt.Sprintf("texttemplate.New(%q).Parse(%s)", baseName+"_text", textConstName)
+
+	if opts.EagerParse {
+		// Parse once at package initialization; syntax errors panic at startup.
+		buf.WriteString("var (\n")
+		buf.WriteString(fmt.Sprintf("\t%s = htmltemplate.Must(%s)\n", bodyVar, bodyExpr))
+		if hasSubject {
+			buf.WriteString(fmt.Sprintf("\t%s = texttemplate.Must(%s)\n", subjectVar, subjectExpr))
+		}
+		if hasText {
+			buf.WriteString(fmt.Sprintf("\t%s = texttemplate.Must(%s)\n", textVar, textExpr))
+		}
+		buf.WriteString(")\n\n")
+
+		buf.WriteString(fmt.Sprintf("func %s(data *%s) (result RenderedEmail, err error) {\n", funcName, mainStructName))
+	} else {
+		// Parse lazily, exactly once; errors are returned on every call.
+		onceVar := util.LowerFirst(funcName) + "ParseOnce"
+		errVar := util.LowerFirst(funcName) + "ParseErr"
+		parseFunc := "parse" + funcName + "Templates"
+
+		buf.WriteString("var (\n")
+		buf.WriteString(fmt.Sprintf("\t%s sync.Once\n", onceVar))
+		buf.WriteString(fmt.Sprintf("\t%s error\n", errVar))
+		buf.WriteString(fmt.Sprintf("\t%s *htmltemplate.Template\n", bodyVar))
+		if hasSubject {
+			buf.WriteString(fmt.Sprintf("\t%s *texttemplate.Template\n", subjectVar))
+		}
+		if hasText {
+			buf.WriteString(fmt.Sprintf("\t%s *texttemplate.Template\n", textVar))
+		}
+		buf.WriteString(")\n\n")
+
+		buf.WriteString(fmt.Sprintf("func %s() (err error) {\n", parseFunc))
+		buf.WriteString(fmt.Sprintf("\t%s, err = %s\n", bodyVar, bodyExpr))
+		buf.WriteString("\tif err != nil {\n")
+		buf.WriteString("\t\treturn fmt.Errorf(\"parse body template: %w\", err)\n")
+		buf.WriteString("\t}\n")
+		if hasSubject {
+			buf.WriteString(fmt.Sprintf("\t%s, err = %s\n", subjectVar, subjectExpr))
+			buf.WriteString("\tif err != nil {\n")
+			buf.WriteString("\t\treturn fmt.Errorf(\"parse subject template: %w\", err)\n")
+			buf.WriteString("\t}\n")
+		}
+		if hasText {
+			buf.WriteString(fmt.Sprintf("\t%s, err = %s\n", textVar, textExpr))
+			buf.WriteString("\tif err != nil {\n")
+			buf.WriteString("\t\treturn fmt.Errorf(\"parse text template: %w\", err)\n")
+			buf.WriteString("\t}\n")
+		}
+		buf.WriteString("\treturn nil\n")
+		buf.WriteString("}\n\n")
+
+		buf.WriteString(fmt.Sprintf("func %s(data *%s) (result RenderedEmail, err error) {\n", funcName, mainStructName))
+		buf.WriteString(fmt.Sprintf("\t%s.Do(func() { %s = %s() })\n", onceVar, errVar, parseFunc))
+		buf.WriteString(fmt.Sprintf("\tif %s != nil {\n", errVar))
+		buf.WriteString(fmt.Sprintf("\t\treturn result, %s\n", errVar))
+		buf.WriteString("\t}\n\n")
+	}
 	buf.WriteString("\tvar bodyBuf bytes.Buffer\n")
-	buf.WriteString("\tif err := bodyTmpl.Execute(&bodyBuf, data); err != nil {\n")
+	buf.WriteString(fmt.Sprintf("\tif err := %s.Execute(&bodyBuf, data); err != nil {\n", bodyVar))
 	buf.WriteString("\t\treturn result, fmt.Errorf(\"render body: %w\", err)\n")
 	buf.WriteString("\t}\n\n")
 	buf.WriteString("\tresult.HTML = bodyBuf.String()\n\n")
 
-	if subjectTrimmed != "" {
-		buf.WriteString(fmt.Sprintf("\tsubjTmpl, err := texttemplate.New(\"%s_subject\").Parse(%s)\n", baseName, subjectConstName))
-		buf.WriteString("\tif err != nil {\n")
-		buf.WriteString("\t\treturn result, fmt.Errorf(\"parse subject template: %w\", err)\n")
-		buf.WriteString("\t}\n\n")
+	if hasSubject {
 		buf.WriteString("\tvar subjBuf bytes.Buffer\n")
-		buf.WriteString("\tif err := subjTmpl.Execute(&subjBuf, data); err != nil {\n")
+		buf.WriteString(fmt.Sprintf("\tif err := %s.Execute(&subjBuf, data); err != nil {\n", subjectVar))
 		buf.WriteString("\t\treturn result, fmt.Errorf(\"render subject: %w\", err)\n")
 		buf.WriteString("\t}\n\n")
 		buf.WriteString("\tresult.Subject = subjBuf.String()\n")
 	}
 
+	if hasText {
+		buf.WriteString("\n\tvar textBuf bytes.Buffer\n")
+		buf.WriteString(fmt.Sprintf("\tif err := %s.Execute(&textBuf, data); err != nil {\n", textVar))
+		buf.WriteString("\t\treturn result, fmt.Errorf(\"render text: %w\", err)\n")
+		buf.WriteString("\t}\n\n")
+		buf.WriteString("\tresult.Text = textBuf.String()\n")
+	} else {
+		// Derive the plain-text part from the rendered HTML
+		buf.WriteString("\tresult.Text = htmltext.FromHTML(result.HTML)\n")
+	}
+
 	buf.WriteString("\treturn result, nil\n")
 	buf.WriteString("}\n")
 
+	structs := make(map[string]parser.ParsedStruct, len(pt.Structs))
+	for _, s := range pt.Structs {
+		structs[s.Name] = s
+	}
+	for _, sc := range scenarios(pt) {
+		buf.WriteString(fmt.Sprintf("\nfunc %sSampleData%s() *%s {\n", funcName, sampleFuncSuffix(sc.Name), mainStructName))
+		buf.WriteString(fmt.Sprintf("\treturn &%s{\n", mainStructName))
+		for _, f := range rootFields(pt) {
+			if v := sc.Data[f.Name]; !isZeroValue(v) {
+				buf.WriteString(fmt.Sprintf("\t\t%s: %s,\n", f.Name, goLiteral(f.Type, v, prefixedTypeName, structs)))
+			}
+		}
+		buf.WriteString("\t}\n")
+		buf.WriteString("}\n")
+	}
+
 	formatted, err := format.Source(buf.Bytes())
 	if err != nil {
 		return fmt.Errorf("formatting generated code: %w", err)
 	}
 
-	outFile := filepath.Join(outputDir, strings.ToLower(baseName)+".email.go")
-	if err := os.WriteFile(outFile, formatted, 0o600); err != nil {
+	if err := w.WriteFile(OutputFileName(pt), formatted); err != nil {
 		return fmt.Errorf("writing file: %w", err)
 	}
 
 	return nil
 }
 
-func collectImports(pt *parser.ParsedTemplate) []string {
+// OutputFileName returns the name of the file generated for pt.
+func OutputFileName(pt *parser.ParsedTemplate) string {
+	return strings.ToLower(templateBaseName(pt)) + ".email.go"
+}
+
+// templateBaseName returns the template file name without its extension.
+func templateBaseName(pt *parser.ParsedTemplate) string {
+	return strings.TrimSuffix(filepath.Base(pt.FilePath), filepath.Ext(pt.FilePath))
+}
+
+// orderStructs returns structs in dependency order: every struct is preceded
+// by the structs its fields refer to, so nested types such as UserAddressGeo
+// are emitted before UserAddress and User.
+func orderStructs(structs []parser.ParsedStruct) []parser.ParsedStruct {
+	byName := make(map[string]parser.ParsedStruct, len(structs))
+	for _, s := range structs {
+		byName[s.Name] = s
+	}
+	ordered := make([]parser.ParsedStruct, 0, len(structs))
+	visited := make(map[string]bool, len(structs))
+	var visit func(s parser.ParsedStruct)
+	visit = func(s parser.ParsedStruct) {
+		if visited[s.Name] {
+			return
+		}
+		visited[s.Name] = true
+		for _, f := range s.Fields {
+			if dep, ok := byName[parser.BaseType(f.Type)]; ok {
+				visit(dep)
+			}
+		}
+		ordered = append(ordered, s)
+	}
+	for _, s := range structs {
+		visit(s)
+	}
+	return ordered
+}
+
+// resolveType rewrites a type expression so that references to structs
+// declared in the template (e.g. "[]Item") use their prefixed Go names
+// (e.g. "[]OrderConfirmationEmailItem").
+func resolveType(typ string, prefixed map[string]string) string {
+	base := parser.BaseType(typ)
+	name, ok := prefixed[base]
+	if !ok {
+		return typ
+	}
+	return typ[:len(typ)-len(base)] + name
+}
+
+func collectImports(pt *parser.ParsedTemplate, opts Options) []string {
 	importSet := map[string]struct{}{
 		"bytes":         {},
 		"fmt":           {},
 		"html/template": {},
 	}
-	// Only include text/template when a subject is present
-	if strings.TrimSpace(pt.Subject) != "" {
+	// Lazy parsing guards the templates with a sync.Once
+	if !opts.EagerParse {
+		importSet["sync"] = struct{}{}
+	}
+	// Only include text/template when a subject or text template is present
+	if strings.TrimSpace(pt.Subject) != "" || strings.TrimSpace(pt.Text) != "" {
 		importSet["text/template"] = struct{}{}
 	}
+	if strings.TrimSpace(pt.Text) == "" {
+		importSet[htmltextImport] = struct{}{}
+	}
 	for _, typ := range pt.Types {
-		if typ.Type == "time.Time" {
+		base := parser.BaseType(typ.Type)
+		if base == "time.Time" {
 			importSet["time"] = struct{}{}
 		}
+		alias, _, _ := strings.Cut(base, ".")
+		for _, imp := range pt.Imports {
+			if imp.Alias == alias && strings.Contains(base, ".") {
+				importSet[imp.Path] = struct{}{}
+			}
+		}
+	}
+	// Sample data may set times in shared structs declared elsewhere
+	if samplesUseTime(pt) {
+		importSet["time"] = struct{}{}
 	}
 	imports := make([]string, 0, len(importSet))
 	for imp := range importSet {
 		imports = append(imports, imp)
 	}
-	sort.Strings(imports)
+	// Standard library first, then everything else
+	sort.Slice(imports, func(i, j int) bool {
+		if si, sj := isStdImport(imports[i]), isStdImport(imports[j]); si != sj {
+			return si
+		}
+		return imports[i] < imports[j]
+	})
 	return imports
 }
 
-func insertLeadingDots(pt *parser.ParsedTemplate, s string) string {
-	if s == "" {
-		return s
-	}
-	oldnew := make([]string, 0, len(pt.Structs)+len(pt.Variables))
-	for _, st := range pt.Structs {
-		name := st.Name
-		oldnew = append(oldnew, "{{"+name, "{{ ."+name)
-		oldnew = append(oldnew, "{{ "+name, "{{ ."+name)
-		oldnew = append(oldnew, "{{-"+name, "{{- ."+name)
-		oldnew = append(oldnew, "{{- "+name, "{{- ."+name)
-	}
-	for _, v := range pt.Variables {
-		capName := util.UpperFirst(v.Name)
-		oldnew = append(oldnew, "{{"+v.Name, "{{ ."+capName)
-		oldnew = append(oldnew, "{{ "+v.Name, "{{ ."+capName)
-		oldnew = append(oldnew, "{{-"+v.Name, "{{- ."+capName)
-		oldnew = append(oldnew, "{{- "+v.Name, "{{- ."+capName)
-	}
-	if len(oldnew) == 0 {
-		return s
+// importAlias returns the name to import path as, followed by a space, when
+// an @import gives it an alias other than the last element of the path.
+func importAlias(pt *parser.ParsedTemplate, importPath string) string {
+	for _, imp := range pt.Imports {
+		if imp.Path == importPath && imp.Alias != path.Base(importPath) {
+			return imp.Alias + " "
+		}
 	}
-	r := strings.NewReplacer(oldnew...)
-	return r.Replace(s)
+	return ""
+}
+
+// htmltextImport is the runtime package deriving plain text from HTML.
+const htmltextImport = "github.com/elliot40404/mailc/htmltext"
+
+// mailerImport is the runtime package building MIME messages.
+const mailerImport = "github.com/elliot40404/mailc/mailer"
+
+// isStdImport reports whether path belongs to the standard library.
+func isStdImport(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
 }
 
-func writeCommonTypes(outputDir, packageName, version string) error {
+func writeCommonTypes(w Writer, packageName, version string, shared []parser.ParsedStruct) error {
 	var buf bytes.Buffer
 	buf.WriteString("// Code generated by mailc. DO NOT EDIT.\n")
 	buf.WriteString(fmt.Sprintf("// Version: mailc %v\n\n", version))
 	buf.WriteString(fmt.Sprintf("package %s\n\n", packageName))
+	usesTime := slices.ContainsFunc(shared, func(s parser.ParsedStruct) bool {
+		return slices.ContainsFunc(s.Fields, func(f parser.ParsedField) bool { return parser.BaseType(f.Type) == "time.Time" })
+	})
+	if usesTime {
+		buf.WriteString(fmt.Sprintf("import (\n\t\"time\"\n\n\t%q\n)\n\n", mailerImport))
+	} else {
+		buf.WriteString(fmt.Sprintf("import %q\n\n", mailerImport))
+	}
 	buf.WriteString("// RenderedEmail is the common return type for all generated email renderers.\n")
-	buf.WriteString("type RenderedEmail struct {\n\tSubject string\n\tHTML string\n}\n")
+	buf.WriteString("type RenderedEmail struct {\n\tSubject string\n\tHTML string\n")
+	buf.WriteString("\t// Text is the plain-text alternative to HTML.\n\tText string\n}\n\n")
+	buf.WriteString("// Message returns a MIME message with the rendered subject, HTML and text,\n")
+	buf.WriteString("// ready to be written with WriteTo or sent.\n")
+	buf.WriteString("func (r RenderedEmail) Message(from string, to ...string) *mailer.Message {\n")
+	buf.WriteString("\treturn &mailer.Message{From: from, To: to, Subject: r.Subject, HTML: r.HTML, Text: r.Text}\n}\n")
+	for _, s := range orderStructs(shared) {
+		buf.WriteString(fmt.Sprintf("\n// %s is declared in %s.\n", s.Name, parser.TypesFile))
+		buf.WriteString(fmt.Sprintf("type %s struct {\n", s.Name))
+		for _, f := range s.Fields {
+			buf.WriteString(fmt.Sprintf("\t%s %s\n", f.Name, f.Type))
+		}
+		buf.WriteString("}\n")
+	}
 
 	formatted, err := format.Source(buf.Bytes())
 	if err != nil {
 		return fmt.Errorf("formatting common types: %w", err)
 	}
-	outFile := filepath.Join(outputDir, "types.go")
-	if err := os.WriteFile(outFile, formatted, 0o600); err != nil {
+	if err := w.WriteFile("types.go", formatted); err != nil {
 		return fmt.Errorf("writing common types: %w", err)
 	}
 	return nil
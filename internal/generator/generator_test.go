@@ -1,11 +1,15 @@
 package generator
 
 import (
+	"bytes"
 	"go/ast"
 	goparser "go/parser"
 	"go/token"
+	"go/types"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
@@ -38,7 +42,7 @@ Hi {{firstName}}
 		t.Fatalf("ParseDir: %v", err)
 	}
 	out := t.TempDir()
-	if err := GenerateCode(pts, out, "emails", "TEST"); err != nil {
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
 		t.Fatalf("GenerateCode: %v", err)
 	}
 
@@ -116,7 +120,7 @@ func TestGenerateCode_NoSubject_NoTextTemplateImport(t *testing.T) {
 		t.Fatalf("ParseDir: %v", err)
 	}
 	out := t.TempDir()
-	if err := GenerateCode(pts, out, "emails", "TEST"); err != nil {
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
 		t.Fatalf("GenerateCode: %v", err)
 	}
 	genPath := filepath.Join(out, "nosubject.email.go")
@@ -135,8 +139,1262 @@ func TestGenerateCode_NoSubject_NoTextTemplateImport(t *testing.T) {
 	// We no longer generate a per-template result type; a shared RenderedEmail is used.
 }
 
+func TestGenerateCode_SliceFieldsAndRange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "order.html")
+	tpl := `<!-- $Subject: {{range tags}}{{.}} {{end}}-->
+<!-- @type Order -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item -->
+<!-- @type Item.Name string -->
+<!-- @type tags []string -->
+<html><body>
+{{range $i, $item := Order.Items}}{{Order.ID}}-{{$i}} {{$item.Name}}{{end}}
+{{with Order}}{{.ID}}{{else}}{{Order.ID}}{{end}}
+</body></html>`
+	if err := os.WriteFile(path, []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write order: %v", err)
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	out := t.TempDir()
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, filepath.Join(out, "order.email.go"), nil, 0)
+	if err != nil {
+		t.Fatalf("parse generated order: %v", err)
+	}
+	if got := fieldType(file, "OrderEmailOrder", "Items"); got != "[]OrderEmailItem" {
+		t.Fatalf("expected Items []OrderEmailItem, got %q", got)
+	}
+	if got := fieldType(file, "OrderEmailData", "Tags"); got != "[]string" {
+		t.Fatalf("expected Tags []string, got %q", got)
+	}
+	if typeHasField(file, "OrderEmailData", "Item") {
+		t.Fatalf("type-only struct Item must not be a root data field")
+	}
+	body := findConstValue(t, file, "orderEmailHTMLTemplate")
+	for _, want := range []string{
+		"{{range $i, $item := .Order.Items}}{{ $.Order.ID}}-{{$i}} {{$item.Name}}{{end}}",
+		"{{with .Order}}{{.ID}}{{else}}{{ .Order.ID}}{{end}}",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected body to contain %q, got: %q", want, body)
+		}
+	}
+	if subj := findConstValue(t, file, "orderEmailSubjectTemplate"); subj != "{{range .Tags}}{{.}} {{end}}" {
+		t.Fatalf("unexpected subject template: %q", subj)
+	}
+}
+
+func TestGenerateCode_NestedStructsInDependencyOrder(t *testing.T) {
+	dir := t.TempDir()
+	tpl := `<!-- @type Order.ID int -->
+<!-- @type Order.Customer.Name string -->
+<!-- @type Order.Customer.Address.City string -->
+<!-- @type Order.Customer.Address.Geo.Lat float64 -->
+<html><body>{{Order.Customer.Address.City}}</body></html>`
+	if err := os.WriteFile(filepath.Join(dir, "shipping.html"), []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write shipping: %v", err)
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	out := t.TempDir()
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, filepath.Join(out, "shipping.email.go"), nil, 0)
+	if err != nil {
+		t.Fatalf("parse generated shipping: %v", err)
+	}
+	var order []string
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			order = append(order, spec.(*ast.TypeSpec).Name.Name)
+		}
+	}
+	want := []string{
+		"ShippingEmailOrderCustomerAddressGeo",
+		"ShippingEmailOrderCustomerAddress",
+		"ShippingEmailOrderCustomer",
+		"ShippingEmailOrder",
+		"ShippingEmailData",
+	}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected type order:\n got: %v\nwant: %v", order, want)
+	}
+	if got := fieldType(file, "ShippingEmailOrderCustomer", "Address"); got != "ShippingEmailOrderCustomerAddress" {
+		t.Fatalf("expected nested Address field, got %q", got)
+	}
+	if got := fieldType(file, "ShippingEmailData", "Order"); got != "ShippingEmailOrder" {
+		t.Fatalf("expected root Order field, got %q", got)
+	}
+}
+
+func TestGenerateCode_LazyParseReturnsSyntaxErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles generated code")
+	}
+	dir := t.TempDir()
+	// Unterminated {{if}}: must surface as an error, not a panic
+	tpl := `<!-- $Subject: Hi {{name}} -->
+<html><body>{{if name}}Hi</body></html>`
+	if err := os.WriteFile(filepath.Join(dir, "broken.html"), []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write broken: %v", err)
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// GenerateCode rejects the template up front; bypass validation to
+	// exercise the runtime behavior of the generated code itself.
+	opts := Options{PackageName: "emails", Version: "TEST"}
+	if err := writeCommonTypes(DirWriter(out), opts.PackageName, opts.Version, nil); err != nil {
+		t.Fatalf("writeCommonTypes: %v", err)
+	}
+	if err := generateTemplateCode(pts[0], DirWriter(out), opts); err != nil {
+		t.Fatalf("generateTemplateCode: %v", err)
+	}
+	got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	for i := 0; i < 2; i++ {
+		_, err := emails.BrokenEmail(&emails.BrokenEmailData{Name: "x"})
+		fmt.Println(err != nil)
+	}
+}
+`)
+	if got != "true\ntrue\n" {
+		t.Fatalf("expected parse error on every call, got output %q", got)
+	}
+}
+
+func TestGenerateCode_EagerParse(t *testing.T) {
+	dir := t.TempDir()
+	tpl := `<!-- $Subject: Hi {{name}} -->
+<html><body>Hi {{name}}</body></html>`
+	if err := os.WriteFile(filepath.Join(dir, "eager.html"), []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write eager: %v", err)
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	out := t.TempDir()
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST", EagerParse: true}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	src, err := os.ReadFile(filepath.Join(out, "eager.email.go"))
+	if err != nil {
+		t.Fatalf("read generated: %v", err)
+	}
+	for _, want := range []string{
+		`eagerEmailBodyTmpl    = htmltemplate.Must(htmltemplate.New("eager").Parse(eagerEmailHTMLTemplate))`,
+		`eagerEmailSubjectTmpl = texttemplate.Must(texttemplate.New("eager_subject").Parse(eagerEmailSubjectTemplate))`,
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Fatalf("expected generated code to contain %q, got:\n%s", want, src)
+		}
+	}
+	if strings.Contains(string(src), "sync.Once") {
+		t.Fatalf("eager mode must not use sync.Once")
+	}
+}
+
+func TestGenerateCode_ValidatesTemplates(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("unterminated.html", `<!-- $Subject: Hi -->
+<!-- @type name string -->
+<html>
+<body>
+{{if name}}Hi
+</body>
+</html>`)
+	mustWrite("typo.html", `<!-- $Subject: Order {{Order.Nmae}} -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item.Name string -->
+<html>
+<body>
+{{User.Name}}
+{{range Order.Items}}{{.Name}} {{.Price}}{{end}}
+{{Order.ID.Value}}
+</body>
+</html>`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	out := t.TempDir()
+	err = GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"})
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, want := range []string{
+		filepath.Join(dir, "unterminated.html") + ":7:1: error: unexpected EOF",
+		filepath.Join(dir, "typo.html") + `:7:1: error: function "User" not defined`,
+		filepath.Join(dir, "typo.html") + ":1:29: error: Order has no field Nmae",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to contain %q, got:\n%v", want, err)
+		}
+	}
+
+	// Once the parse error is fixed, field references are checked too
+	mustWrite("typo.html", `<!-- @type Order.ID int -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item.Name string -->
+<html>
+<body>
+{{range Order.Items}}{{.Name}} {{.Price}}{{end}}
+{{Order.ID.Value}}
+</body>
+</html>`)
+	if err := os.Remove(filepath.Join(dir, "unterminated.html")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"})
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, want := range []string{
+		"typo.html:6:34: error: Item has no field Price",
+		"typo.html:7:8: error: can't evaluate field Value on type int",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to contain %q, got:\n%v", want, err)
+		}
+	}
+	if _, statErr := os.Stat(filepath.Join(out, "typo.email.go")); !os.IsNotExist(statErr) {
+		t.Fatalf("no code must be written for invalid templates")
+	}
+}
+
+func TestGenerate_Deterministic(t *testing.T) {
+	tpl := `<!-- $Subject: Order {{Order.ID}} for {{username}} -->
+<!-- @type Shop.Name string -->
+<!-- @type User.Address.Geo.Lat float64 -->
+<!-- @type User.Address.City string -->
+<!-- @type User.Name string -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item.Name string -->
+<!-- @type Item.Qty int -->
+<!-- @type Order.PlacedAt time.Time -->
+<!-- @type total float64 -->
+<html><body>
+{{greeting}} {{User.Name}} from {{User.Address.City}} ({{User.Address.Geo.Lat}})
+{{range Order.Items}}{{.Name}} x{{.Qty}}{{end}}
+{{Shop.Name}} {{total}} {{footer}} {{banner}}
+</body></html>`
+
+	generate := func() MemWriter {
+		pt, err := mailparser.Parse("order.html", []byte(tpl))
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		files := MemWriter{}
+		if err := Generate([]*mailparser.ParsedTemplate{pt}, files, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		return files
+	}
+
+	first := generate()
+	for i := range 50 {
+		again := generate()
+		for name, data := range first {
+			if !bytes.Equal(data, again[name]) {
+				t.Fatalf("run %d: %s differs from the first run:\n%s\n---\n%s", i, name, data, again[name])
+			}
+		}
+	}
+
+	// Root fields follow declaration order, then inferred variables in order of first use
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "order.email.go", first["order.email.go"], 0)
+	if err != nil {
+		t.Fatalf("parse generated: %v", err)
+	}
+	var names []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		ts, ok := n.(*ast.TypeSpec)
+		if !ok || ts.Name.Name != "OrderEmailData" {
+			return true
+		}
+		for _, f := range ts.Type.(*ast.StructType).Fields.List {
+			names = append(names, f.Names[0].Name)
+		}
+		return false
+	})
+	want := "Shop User Order Total Username Greeting Footer Banner"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("OrderEmailData fields = %s, want %s", got, want)
+	}
+}
+
+func TestRender_SampleData(t *testing.T) {
+	tpl := `<!-- $Subject: Order {{Order.ID}} for {{User.Name}} -->
+<!-- @type User.Name string -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Paid bool -->
+<!-- @type Order.PlacedAt time.Time -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item.Name string -->
+<!-- @type Item.Qty int -->
+<html><body>
+{{range Order.Items}}<li>{{.Name}} x{{.Qty}} ({{ $.User.Name }})</li>{{end}}
+{{if Order.Paid}}paid{{end}} {{Order.PlacedAt.Format "2006-01-02"}} {{note}}
+</body></html>`
+	pt, err := mailparser.Parse("order.html", []byte(tpl))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	out, err := Render(pt, SampleData(pt))
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if out.Subject != "Order 42 for User.Name" {
+		t.Fatalf("Subject = %q", out.Subject)
+	}
+	want := "<li>Order.Items.Name x42 (User.Name)</li><li>Order.Items.Name x42 (User.Name)</li>\npaid 2025-01-02 note"
+	if !strings.Contains(out.HTML, want) {
+		t.Fatalf("HTML missing %q:\n%s", want, out.HTML)
+	}
+}
+
+func TestGenerateCode_SampleData(t *testing.T) {
+	dir := t.TempDir()
+	tpl := `<!-- $Subject: Order {{Order.ID}} for {{User.Name}} -->
+<!-- @type User.Name string -->
+<!-- @type User.Tags []string -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Total float64 -->
+<!-- @type Order.PlacedAt time.Time -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item.Name string -->
+<!-- @type Item.Qty int -->
+<!-- @example User.Name "Jane Doe" -->
+<!-- @example Order.ID 1001 -->
+<!-- @example Order.PlacedAt "2025-03-04T10:30:00Z" -->
+<!-- @example Order.Items [{"name": "Mug", "qty": 2}] -->
+<!-- @example greeting "Hello" -->
+<html><body>{{greeting}} {{range Order.Items}}{{.Name}}x{{.Qty}} {{end}}{{Order.Total}} {{Order.PlacedAt.Format "2006-01-02"}}</body></html>`
+	fixtures := `{
+  "vip": {"User": {"Name": "Ada", "Tags": ["vip"]}, "Order": {"ID": 7, "Total": 99.5}, "greeting": "Welcome back"},
+  "empty cart": {"User": {"Name": "Bob"}}
+}`
+	if err := os.WriteFile(filepath.Join(dir, "order.html"), []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "order.fixtures.json"), []byte(fixtures), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	if got := strings.Join(Scenarios(pts[0]), ","); got != "default,vip,empty cart" {
+		t.Fatalf("Scenarios = %s", got)
+	}
+
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	src, err := os.ReadFile(filepath.Join(out, "order.email.go"))
+	if err != nil {
+		t.Fatalf("read generated: %v", err)
+	}
+	for _, want := range []string{
+		"func OrderEmailSampleData() *OrderEmailData {",
+		"func OrderEmailSampleDataVip() *OrderEmailData {",
+		"func OrderEmailSampleDataEmptyCart() *OrderEmailData {",
+		`Items: []OrderEmailItem{{Name: "Mug", Qty: 2}}`,
+		"PlacedAt: time.Date(2025, time.March, 4, 10, 30, 0, 0, time.UTC)",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Fatalf("expected generated code to contain %q, got:\n%s", want, src)
+		}
+	}
+
+	// The runtime renderer sees exactly the data of the generated constructors
+	var want strings.Builder
+	for _, name := range Scenarios(pts[0]) {
+		data, _ := ScenarioData(pts[0], name)
+		r, err := Render(pts[0], data)
+		if err != nil {
+			t.Fatalf("Render %s: %v", name, err)
+		}
+		want.WriteString(r.Subject + "|" + r.HTML + "\n")
+	}
+	if testing.Short() {
+		return
+	}
+	got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	for _, data := range []*emails.OrderEmailData{emails.OrderEmailSampleData(), emails.OrderEmailSampleDataVip(), emails.OrderEmailSampleDataEmptyCart()} {
+		r, err := emails.OrderEmail(data)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(r.Subject + "|" + r.HTML)
+	}
+}
+`)
+	if got != want.String() {
+		t.Fatalf("generated constructors rendered\n%s\nwant\n%s", got, want.String())
+	}
+}
+
+func TestGenerateCode_SampleDataErrors(t *testing.T) {
+	dir := t.TempDir()
+	tpl := `<!-- @type User.Name string -->
+<!-- @type User.Age int -->
+<!-- @example User.Age "old" -->
+<!-- @example User.Email "a@b.c" -->
+<!-- @example User.Name "Jane" -->
+<!-- @example User.Name "Joe" -->
+<html><body>{{User.Name}} {{User.Age}}</body></html>`
+	if err := os.WriteFile(filepath.Join(dir, "user.html"), []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "user.fixtures.json"), []byte(`{"teen": {"User": {"Age": 15.5, "Name": 3}}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = GenerateCode(pts, t.TempDir(), Options{PackageName: "emails", Version: "TEST"})
+	if err == nil {
+		t.Fatalf("expected sample data errors")
+	}
+	for _, want := range []string{
+		`user.html:3:6: error: @example User.Age: cannot use "old" as int`,
+		`user.html:4:6: error: @example User.Email: User has no field Email`,
+		`user.html:6:6: error: duplicate @example for User.Name (first at 5:6)`,
+		`user.fixtures.json: error: scenario "teen": User.Age: cannot use 15.5 as int`,
+		`user.fixtures.json: error: scenario "teen": User.Name: cannot use number 3 as string`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to contain %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestDecodeData(t *testing.T) {
+	tpl := `<!-- $Subject: Order {{Order.ID}} -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Note string -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item.Name string -->
+<!-- @type Item.Price float64 -->
+<!-- @type Order.PlacedAt time.Time -->
+<html><body>[{{Order.Note}}]{{range Order.Items}}{{.Name}}={{.Price}};{{end}} {{Order.PlacedAt.Year}} {{name}}</body></html>`
+	pt, err := mailparser.Parse("order.html", []byte(tpl))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	data, err := DecodeData(pt, []byte(`{"Order": {"ID": 12, "Items": [{"name": "Mug", "price": 4.5}], "PlacedAt": "2024-05-06"}, "name": "Jane"}`))
+	if err != nil {
+		t.Fatalf("DecodeData: %v", err)
+	}
+	out, err := Render(pt, data)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	// Fields missing from the JSON render as zero values, as with the generated structs
+	if out.Subject != "Order 12" || out.HTML != "<html><body>[]Mug=4.5; 2024 Jane</body></html>" {
+		t.Fatalf("unexpected render: %q %q", out.Subject, out.HTML)
+	}
+
+	_, err = DecodeData(pt, []byte(`{"Order": {"ID": 1.5, "Items": [{"Name": 1}, {"Price": "free"}], "PlacedAt": "yesterday"}, "Name": true, "Extra": 1}`))
+	if err == nil {
+		t.Fatalf("expected type errors")
+	}
+	want := []string{
+		"Extra: OrderEmailData has no field Extra",
+		"Name: cannot use true as string",
+		"Order.ID: cannot use 1.5 as int",
+		"Order.Items[0].Name: cannot use number 1 as string",
+		`Order.Items[1].Price: cannot use "free" as float64`,
+		`Order.PlacedAt: cannot parse "yesterday" as time.Time; want RFC 3339 such as 2025-01-02T15:04:05Z`,
+	}
+	if err.Error() != strings.Join(want, "\n") {
+		t.Fatalf("unexpected errors:\n%v", err)
+	}
+}
+
+func TestGenerateCode_TextPart(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	// Inline $Text block
+	mustWrite("inline.html", `<!-- $Subject: Hi {{name}} -->
+<!-- $Text:
+Hi {{name}},
+$5 off your next order: {{code}}
+-->
+<html><body><p>Hi {{name}}</p></body></html>`)
+	// Sibling text file
+	mustWrite("sibling.html", `<!-- @type Order.ID int -->
+<html><body><p>Order {{Order.ID}}</p></body></html>`)
+	mustWrite("sibling.txt", "\nOrder #{{Order.ID}} confirmed.\n")
+	// Derived from HTML
+	mustWrite("derived.html", `<html><head><style>p{}</style></head><body><h1>Hello {{name}}</h1><p>Visit <a href="{{url}}">our site</a>.</p></body></html>`)
+
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+
+	src, err := os.ReadFile(filepath.Join(out, "inline.email.go"))
+	if err != nil {
+		t.Fatalf("read generated: %v", err)
+	}
+	if !strings.Contains(string(src), "const inlineEmailTextTemplate = `Hi {{ .Name}},\n$5 off your next order: {{ .Code}}`") {
+		t.Fatalf("expected text template constant, got:\n%s", src)
+	}
+	if strings.Contains(string(src), "htmltext") {
+		t.Fatalf("templates with a text part must not derive it from HTML")
+	}
+	src, err = os.ReadFile(filepath.Join(out, "derived.email.go"))
+	if err != nil {
+		t.Fatalf("read generated: %v", err)
+	}
+	if !strings.Contains(string(src), "\"sync\"\n\n\t\"github.com/elliot40404/mailc/htmltext\"\n)") {
+		t.Fatalf("expected htmltext import after the standard library, got:\n%s", src)
+	}
+
+	if testing.Short() {
+		return
+	}
+	got := runGenerated(t, mod, `package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	a, _ := emails.InlineEmail(&emails.InlineEmailData{Name: "Jane", Code: "SAVE5"})
+	b, _ := emails.SiblingEmail(&emails.SiblingEmailData{Order: emails.SiblingEmailOrder{ID: 7}})
+	c, _ := emails.DerivedEmail(&emails.DerivedEmailData{Name: "Jane", Url: "https://example.com"})
+	fmt.Printf("%s\n--\n%s\n--\n%s\n--\n", a.Text, b.Text, c.Text)
+
+	raw, err := c.Message("shop@example.com", "jane@example.com").Bytes()
+	if err != nil {
+		panic(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		panic(err)
+	}
+	mediaType, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	fmt.Println(msg.Header.Get("To"), mediaType)
+}
+`)
+	want := "Hi Jane,\n$5 off your next order: SAVE5\n--\nOrder #7 confirmed.\n--\nHello Jane\n==========\n\nVisit our site (https://example.com).\n--\n" +
+		"<jane@example.com> multipart/alternative\n"
+	if got != want {
+		t.Fatalf("unexpected text parts:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGenerateCode_ValidatesTextTemplates(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "order.html"), []byte(`<!-- @type Order.ID int -->
+<!-- $Text:
+Order {{Order.ID}}
+Total {{Order.Total}}
+-->
+<p>{{Order.ID}}</p>`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.html"), []byte(`<p>{{name}}</p>`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other.txt"), []byte("Hi {{name}}\n{{if name}}\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = GenerateCode(pts, t.TempDir(), Options{PackageName: "emails", Version: "TEST"})
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, want := range []string{
+		"order.html:4:14: error: Order has no field Total",
+		"other.txt:2:1: error: unexpected EOF",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to contain %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestGenerateCode_Layout(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("_layout.html", `<!-- @type company string -->
+<html><body>
+{{- block "content" .}}{{end}}
+<footer>{{company}}</footer>
+</body></html>`)
+	mustWrite("welcome.html", `<!-- $Subject: Hi {{name}} -->
+<!-- @extends _layout.html -->
+<p>Hi {{name}}</p>`)
+	mustWrite("invite.html", `<!-- @extends _layout.html -->
+{{define "content"}}<a href="{{link}}">Join {{company}}</a>{{end}}`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	files := MemWriter{}
+	if err := Generate(pts, files, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if _, ok := files["_layout.email.go"]; ok || len(files) != 3 {
+		t.Fatalf("expected code for welcome and invite only, got %d files", len(files))
+	}
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "invite.email.go", files["invite.email.go"], 0)
+	if err != nil {
+		t.Fatalf("parse generated code: %v", err)
+	}
+	if !typeHasField(file, "InviteEmailData", "Company") || !typeHasField(file, "InviteEmailData", "Link") {
+		t.Fatalf("expected the layout's fields in InviteEmailData")
+	}
+
+	for _, pt := range pts {
+		res, err := Render(pt, map[string]any{"Company": "ACME", "Name": "Jane", "Link": "https://example.com"})
+		if err != nil {
+			t.Fatalf("Render %s: %v", pt.FilePath, err)
+		}
+		want := map[string]string{
+			"welcome": "<html><body><p>Hi Jane</p>\n<footer>ACME</footer>\n</body></html>",
+			"invite":  "<html><body><a href=\"https://example.com\">Join ACME</a>\n<footer>ACME</footer>\n</body></html>",
+		}[templateBaseName(pt)]
+		if res.HTML != want {
+			t.Fatalf("unexpected HTML for %s:\n%s\nwant:\n%s", pt.FilePath, res.HTML, want)
+		}
+	}
+
+	// Problems in the layout are reported once, in the layout
+	mustWrite("_layout.html", `<html><body>{{block "content" .}}{{end}}{{Company.Name}}</body></html>`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"})
+	want := filepath.Join(dir, "_layout.html") + `:1:1: error: function "Company" not defined`
+	if err == nil || err.Error() != want {
+		t.Fatalf("expected only %q, got:\n%v", want, err)
+	}
+}
+
+func TestGenerateCode_Partials(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("partials/button.html", `<!-- @type Label string -->
+<!-- @type URL string -->
+<a href="{{URL}}">{{Label}}</a>`)
+	mustWrite("welcome.html", `<!-- $Subject: Hi {{name}} -->
+<!-- @type cta.Label string -->
+<!-- @type cta.URL string -->
+<p>Hi {{name}}</p>
+<!-- @include partials/button.html Label=cta.Label URL=cta.URL -->`)
+	mustWrite("invite.html", `<!-- $Subject: Join -->
+<!-- @type link string -->
+{{template "partials/button.html" (params "Label" "Join" "URL" link)}}`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	if len(pts) != 2 {
+		t.Fatalf("expected the partial not to be a template, got %d templates", len(pts))
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	src, err := os.ReadFile(filepath.Join(out, "partials_button.partial.go"))
+	if err != nil {
+		t.Fatalf("read partial: %v", err)
+	}
+	if !strings.Contains(string(src), `const partialsButtonPartial = `+"`"+`{{define "partials/button.html"}}<a href="{{ .URL}}">{{ .Label}}</a>{{end}}`+"`") {
+		t.Fatalf("unexpected partial code:\n%s", src)
+	}
+	welcome, err := os.ReadFile(filepath.Join(out, "welcome.email.go"))
+	if err != nil {
+		t.Fatalf("read welcome: %v", err)
+	}
+	if strings.Contains(string(welcome), "<a href") || !strings.Contains(string(welcome), "partialsButtonPartial") {
+		t.Fatalf("expected welcome to refer to the shared partial, got:\n%s", welcome)
+	}
+
+	for _, pt := range pts {
+		res, err := Render(pt, SampleData(pt))
+		if err != nil {
+			t.Fatalf("Render %s: %v", pt.FilePath, err)
+		}
+		if !strings.Contains(res.HTML, `<a href="`) {
+			t.Fatalf("expected the button in %s, got %s", pt.FilePath, res.HTML)
+		}
+	}
+
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	res, err := emails.WelcomeEmail(&emails.WelcomeEmailData{Name: "Jane", Cta: emails.WelcomeEmailCta{Label: "Go", URL: "https://example.com/?a=1&b=2"}})
+	fmt.Println(res.HTML, err)
+}
+`)
+		want := "<p>Hi Jane</p>\n<a href=\"https://example.com/?a=1&amp;b=2\">Go</a> <nil>\n"
+		if got != want {
+			t.Fatalf("unexpected output %q, want %q", got, want)
+		}
+	}
+
+	// Roots are referred to as written in their @type annotations
+	mustWrite("welcome.html", `<!-- @type cta.Label string -->
+<!-- @type cta.URL string -->
+<a href="{{cta.URL}}">{{with cta}}{{.Label}}{{end}}</a> {{printf "%s!" cta.Label}}`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	if err := Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	for _, pt := range pts {
+		if filepath.Base(pt.FilePath) != "welcome.html" {
+			continue
+		}
+		res, err := Render(pt, map[string]any{"Cta": map[string]any{"Label": "Go", "URL": "https://example.com/"}})
+		if err != nil {
+			t.Fatalf("Render: %v", err)
+		}
+		if want := `<a href="https://example.com/">Go</a> Go!`; res.HTML != want {
+			t.Fatalf("unexpected HTML %q, want %q", res.HTML, want)
+		}
+	}
+
+	// Callers must pass every parameter with a compatible type
+	mustWrite("invite.html", `<!-- @type count int -->
+{{template "partials/button.html" (params "Label" count "Link" "x")}}
+{{template "partials/button.html" (params "Label")}}`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"})
+	invite := filepath.Join(dir, "invite.html")
+	want := []string{
+		invite + ":2:1: error: partial partials/button.html has no parameter Link",
+		invite + ":2:1: error: partial partials/button.html: parameter Label: cannot use int as string",
+		invite + ":2:1: error: partial partials/button.html: missing parameter URL",
+		invite + ":3:1: error: params needs pairs of parameter names and values",
+	}
+	if err == nil || err.Error() != strings.Join(want, "\n") {
+		t.Fatalf("unexpected errors:\n%v\nwant:\n%s", err, strings.Join(want, "\n"))
+	}
+}
+
+func TestGenerateCode_SharedTypes(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("_types.html", `<!-- @type User.Name string -->
+<!-- @type User.Joined time.Time -->`)
+	mustWrite("welcome.html", `<!-- @shared User -->
+<!-- @type user User -->
+<!-- @example user {"Name": "Jane", "Joined": "2024-05-06T07:08:09Z"} -->
+<p>Hi {{user.Name}}</p>`)
+	mustWrite("digest.html", `<!-- @shared User -->
+<!-- @type Team.Members []User -->
+{{range Team.Members}}<p>{{.Name}}</p>{{end}}`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	types, err := os.ReadFile(filepath.Join(out, "types.go"))
+	if err != nil {
+		t.Fatalf("read types.go: %v", err)
+	}
+	if !strings.Contains(string(types), "type User struct {\n\tName   string\n\tJoined time.Time\n}") {
+		t.Fatalf("expected User in types.go, got:\n%s", types)
+	}
+	for _, name := range []string{"welcome.email.go", "digest.email.go"} {
+		src, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if strings.Contains(string(src), "EmailUser") {
+			t.Fatalf("%s declares its own User:\n%s", name, src)
+		}
+	}
+
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	u := emails.User{Name: "Jane"}
+	w, err := emails.WelcomeEmail(&emails.WelcomeEmailData{User: u})
+	fmt.Println(w.HTML, err)
+	d, err := emails.DigestEmail(&emails.DigestEmailData{Team: emails.DigestEmailTeam{Members: []emails.User{u}}})
+	fmt.Println(d.HTML, err)
+	fmt.Println(emails.WelcomeEmailSampleData().User.Joined.Year())
+}
+`)
+		if want := "<p>Hi Jane</p> <nil>\n<p>Jane</p> <nil>\n2024\n"; got != want {
+			t.Fatalf("unexpected output %q, want %q", got, want)
+		}
+	}
+
+	// Templates generated together must agree on shared types
+	mustWrite("sub/_types.html", `<!-- @type User.Name int -->`)
+	mustWrite("sub/other.html", `<!-- @shared User -->
+<!-- @type user User -->`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"})
+	if err == nil || !strings.Contains(err.Error(), "shared type User is declared differently for ") {
+		t.Fatalf("expected conflicting shared types, got %v", err)
+	}
+}
+
+func TestGenerateCode_KeptComments(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("_layout.html", `<html><head><!--[if mso]><style>td{font-family:Arial}</style><![endif]--></head>
+<body>{{block "content" .}}{{end}}</body></html>`)
+	mustWrite("button.html", `<!-- $Subject: Go -->
+<!-- @extends _layout.html -->
+<!-- @type url string -->
+{{define "content"}}<!--[if mso]><v:roundrect href="{{url}}"><center>Go</center></v:roundrect><![endif]-->
+<!--[if !mso]><!--><a href="{{url}}">Go</a><!--<![endif]-->
+<!-- dropped -->
+<!--! sent to {{email}} -->{{end}}`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "partials.go")); err != nil {
+		t.Fatalf("expected the helpers keeping comments: %v", err)
+	}
+
+	want := `<html><head><!--[if mso]><style>td{font-family:Arial}</style><![endif]--></head>
+<body><!--[if mso]><v:roundrect href="https://example.com/?a=1&amp;b=2"><center>Go</center></v:roundrect><![endif]-->
+<!--[if !mso]><!--><a href="https://example.com/?a=1&amp;b=2">Go</a><!--<![endif]-->
+
+<!-- sent to a&lt;b&gt;@example.com --></body></html>`
+	res, err := Render(pts[0], map[string]any{"Url": "https://example.com/?a=1&b=2", "Email": "a<b>@example.com"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if res.HTML != want {
+		t.Fatalf("unexpected HTML:\n%s\nwant:\n%s", res.HTML, want)
+	}
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	res, err := emails.ButtonEmail(&emails.ButtonEmailData{Url: "https://example.com/?a=1&b=2", Email: "a<b>@example.com"})
+	fmt.Println(res.HTML, err)
+}
+`)
+		if got != want+" <nil>\n" {
+			t.Fatalf("unexpected output %q, want %q", got, want+" <nil>\n")
+		}
+	}
+
+	// Markup inside conditional comments is checked like any other
+	mustWrite("button.html", `<!-- @type url string -->
+<!--[if mso]>
+<v:roundrect href="{{url.Host}}"></v:roundrect>
+<![endif]-->`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"})
+	if want := filepath.Join(dir, "button.html") + ":3:25: error: can't evaluate field Host on type string"; err == nil || err.Error() != want {
+		t.Fatalf("expected %q, got:\n%v", want, err)
+	}
+}
+
+func TestGenerateCode_InlineCSS(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("inline.html", `<!-- @inline-css -->
+<!-- @type items []string -->
+<html><head>
+<style>
+  td { padding: 8px; color: black }
+  .price { color: green !important; font-family: "Helvetica Neue", Arial }
+  #total td { font-weight: bold }
+  a, a:hover { color: red }
+  @media (max-width: 600px) { td { padding: 4px } }
+</style>
+<!--[if mso]><style>td { font-family: Arial }</style><![endif]-->
+</head><body>
+<table id="total">{{range items}}<tr><td class="price" style="color: blue; margin: 0">{{.}}</td>{{if .}}<td>x{{else}}<td class=price>y{{end}}</td></tr>{{end}}</table>
+<a href="{{url}}">Go</a>
+</body></html>`)
+	mustWrite("plain.html", `<!-- $Subject: Plain -->
+<html><head>
+  <style>p { margin: 0 }</style>
+</head><body><p>Hi {{name}}</p>{{template "partials/note.html" (params)}}</body></html>`)
+	mustWrite("partials/note.html", `<!-- @inline-css -->
+<p>Note</p>`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	byName := make(map[string]*mailparser.ParsedTemplate)
+	for _, pt := range pts {
+		byName[templateBaseName(pt)] = pt
+	}
+	note := filepath.Join(dir, "partials", "note.html")
+	if want := note + ":1:6: warning: @inline-css in a partial is ignored; partials are shared by templates with different styles, so none are inlined into them"; byName["plain"].Diagnostics.Error() != want {
+		t.Fatalf("expected %q, got %v", want, byName["plain"].Diagnostics)
+	}
+
+	res, err := Render(byName["inline"], map[string]any{"Items": []string{"a"}, "Url": "https://example.com"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	want := `<html><head>
+<style>
+  a:hover { color: red }
+  @media (max-width: 600px) { td { padding: 4px } }
+</style>
+<!--[if mso]><style>td { font-family: Arial }</style><![endif]-->
+</head><body>
+<table id="total"><tr><td class="price" style="padding: 8px; color: green !important; font-family: 'Helvetica Neue', Arial; font-weight: bold; color: blue; margin: 0">a</td><td style="padding: 8px; color: black; font-weight: bold">x</td></tr></table>
+<a style="color: red" href="https://example.com">Go</a>
+</body></html>`
+	if res.HTML != want {
+		t.Fatalf("unexpected HTML:\n%s\nwant:\n%s", res.HTML, want)
+	}
+
+	// Rules depending on an attribute set by a control action stay in <style>
+	mustWrite("cond.html", `<!-- @inline-css -->
+<!-- @type big bool -->
+<html><head><style>
+  p { color: red }
+  .big { font-size: 20px }
+</style></head><body><p class="{{if big}}big{{end}}">Hi</p><p class="big">All</p></body></html>`)
+	cond, err := mailparser.ParseFile(filepath.Join(dir, "cond.html"))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	for _, big := range []bool{false, true} {
+		res, err := Render(cond, map[string]any{"Big": big})
+		if err != nil {
+			t.Fatalf("Render: %v", err)
+		}
+		class := ""
+		if big {
+			class = "big"
+		}
+		want := `<html><head><style>
+  .big { font-size: 20px }
+</style></head><body><p style="color: red" class="` + class + `">Hi</p><p style="color: red; font-size: 20px" class="big">All</p></body></html>`
+		if res.HTML != want {
+			t.Fatalf("unexpected HTML:\n%s\nwant:\n%s", res.HTML, want)
+		}
+	}
+
+	// Without @inline-css, only the generate option inlines styles
+	if body, _, _ := Sources(byName["plain"]); !strings.Contains(body, "<style>") {
+		t.Fatalf("expected the styles of plain to be kept, got:\n%s", body)
+	}
+	files := MemWriter{}
+	if err := Generate(pts, files, Options{PackageName: "emails", Version: "TEST", InlineCSS: true}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	wantConst := "const plainEmailHTMLTemplate = `<html><head>\n</head><body><p style=\"margin: 0\">Hi {{ .Name}}</p>"
+	if !strings.Contains(string(files["plain.email.go"]), wantConst) {
+		t.Fatalf("expected the styles of plain to be inlined, got:\n%s", files["plain.email.go"])
+	}
+	if !strings.Contains(string(files["partials_note.partial.go"]), "<p>Note</p>") {
+		t.Fatalf("expected the partial to be left as it is, got:\n%s", files["partials_note.partial.go"])
+	}
+}
+
+func TestGenerateCode_ImportedTypes(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+	mod := t.TempDir()
+	mustWrite := func(name, body string) {
+		path := filepath.Join(mod, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	// Imported packages resolve from the module the templates live in
+	mustWrite("go.mod", "module example.com/gen\n\ngo 1.24\n")
+	mustWrite("billing/billing.go", `package billing
+
+type Base struct{ ID string }
+
+type Invoice struct {
+	Base
+	Total int
+	Lines []Line
+	note  string
+}
+
+type Line struct{ Name string }
+
+func (i *Invoice) Customer() string { return "ACME" }
+`)
+	mustWrite("templates/invoice.html", `<!-- $Subject: Invoice {{invoice.ID}} -->
+<!-- @import bill example.com/gen/billing -->
+<!-- @type invoice bill.Invoice -->
+<p>{{invoice.Customer}} owes {{invoice.Total}}</p>
+{{range invoice.Lines}}<p>{{.Name}}</p>{{end}}`)
+	dir := filepath.Join(mod, "templates")
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+	src, err := os.ReadFile(filepath.Join(out, "invoice.email.go"))
+	if err != nil {
+		t.Fatalf("read generated: %v", err)
+	}
+	for _, want := range []string{`bill "example.com/gen/billing"`, "Invoice bill.Invoice"} {
+		if !strings.Contains(string(src), want) {
+			t.Fatalf("expected generated code to contain %q, got:\n%s", want, src)
+		}
+	}
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/billing"
+	"example.com/gen/emails"
+)
+
+func main() {
+	inv := billing.Invoice{Base: billing.Base{ID: "7"}, Total: 42, Lines: []billing.Line{{Name: "Tea"}}}
+	res, err := emails.InvoiceEmail(&emails.InvoiceEmailData{Invoice: inv})
+	fmt.Println(res.Subject, res.HTML, err)
+}
+`)
+		if want := "Invoice 7 <p>ACME owes 42</p>\n<p>Tea</p> <nil>\n"; got != want {
+			t.Fatalf("unexpected output %q, want %q", got, want)
+		}
+	}
+
+	// References are checked against the Go type
+	mustWrite("templates/invoice.html", `<!-- @import bill example.com/gen/billing -->
+<!-- @import example.com/gen/missing -->
+<!-- @type invoice bill.Invoice -->
+<!-- @type other bill.Other -->
+<!-- @type gone missing.Thing -->
+{{invoice.Totl}} {{invoice.note}} {{range invoice.Lines}}{{.Price}}{{end}}`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"})
+	file := filepath.Join(dir, "invoice.html")
+	for _, want := range []string{
+		file + ":2:6: error: cannot load package example.com/gen/missing: ",
+		file + ":4:6: error: unknown type bill.Other: package example.com/gen/billing has no exported type Other",
+		file + ":6:10: error: billing.Invoice has no field Totl",
+		file + ":6:27: error: billing.Invoice has no field note",
+		file + ":6:60: error: billing.Line has no field Price",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q, got:\n%v", want, err)
+		}
+	}
+}
+
 // Helpers
 
+// runGenerated runs mainSrc as package main of a throwaway module rooted at
+// mod (module path example.com/gen) and returns its standard output.
+func runGenerated(t *testing.T, mod, mainSrc string) string {
+	t.Helper()
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not available")
+	}
+	// Generated code imports mailc's runtime packages from this checkout
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatalf("abs: %v", err)
+	}
+	goMod := "module example.com/gen\n\ngo 1.24\n\nrequire github.com/elliot40404/mailc v0.0.0\n\nreplace github.com/elliot40404/mailc => " + root + "\n"
+	if err := os.WriteFile(filepath.Join(mod, "go.mod"), []byte(goMod), 0o600); err != nil {
+		t.Fatalf("write go.mod: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(mod, "main.go"), []byte(mainSrc), 0o600); err != nil {
+		t.Fatalf("write main.go: %v", err)
+	}
+	cmd := exec.Command(goBin, "run", ".")
+	cmd.Dir = mod
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("go run: %v\n%s", err, stderr.String())
+	}
+	return string(stdout)
+}
+
 func findConstValue(t *testing.T, f *ast.File, name string) string {
 	t.Helper()
 	for _, decl := range f.Decls {
@@ -189,3 +1447,338 @@ func typeHasField(f *ast.File, typeName, fieldName string) bool {
 	}
 	return false
 }
+
+func fieldType(f *ast.File, typeName, fieldName string) string {
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok || ts.Name.Name != typeName {
+				continue
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			for _, fld := range st.Fields.List {
+				for _, n := range fld.Names {
+					if n.Name == fieldName {
+						return types.ExprString(fld.Type)
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func TestGenerateCode_Components(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("welcome.html", `<!-- $Subject: Welcome -->
+<!-- @type url string -->
+<mc-section><mc-button href="{{url}}" width="180">Sign in</mc-button></mc-section>`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+
+	res, err := Render(pts[0], map[string]any{"Url": "https://example.com/?a=1&b=2"})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	for _, want := range []string{
+		`<!--[if mso]><table role="presentation" border="0" cellpadding="0" cellspacing="0" width="600" align="center"><tr><td><![endif]-->`,
+		`<!--[if mso]><v:roundrect xmlns:v="urn:schemas-microsoft-com:vml" xmlns:w="urn:schemas-microsoft-com:office:word" href="https://example.com/?a=1&amp;b=2" style="height:44px;v-text-anchor:middle;width:180px;"`,
+		`<!--[if !mso]><!--><a href="https://example.com/?a=1&amp;b=2" style="background-color:#1a73e8;`,
+		`>Sign in</a><!--<![endif]-->`,
+	} {
+		if !strings.Contains(res.HTML, want) {
+			t.Errorf("expected HTML to contain %q:\n%s", want, res.HTML)
+		}
+	}
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	res, err := emails.WelcomeEmail(&emails.WelcomeEmailData{Url: "https://example.com/?a=1&b=2"})
+	fmt.Println(res.HTML, err)
+}
+`)
+		if got != res.HTML+" <nil>\n" {
+			t.Fatalf("unexpected output %q, want %q", got, res.HTML+" <nil>\n")
+		}
+	}
+
+	// Actions in attributes are checked at their place in the source
+	mustWrite("welcome.html", `<!-- @type url string -->
+<mc-button href="{{url.Host}}">Go</mc-button>`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"})
+	if want := filepath.Join(dir, "welcome.html") + ":2:23: error: can't evaluate field Host on type string"; err == nil || err.Error() != want {
+		t.Fatalf("expected %q, got:\n%v", want, err)
+	}
+}
+
+func TestGenerateCode_Markdown(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("_markdown.html", `<html><body>{{block "content" .}}{{end}}</body></html>`)
+	mustWrite("partials/sig.html", `<!-- @type Team string --><p>The {{Team}} team</p>`)
+	mustWrite("notice.md", `<!-- $Subject: Notice for {{name}} -->
+<!-- @type url string -->
+Hi **{{name}}**, [read it]({{url}}).
+
+<!-- @include partials/sig.html Team="ACME" -->
+`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+
+	data := map[string]any{"Name": "A&B", "Url": "https://example.com/?a=1&b=2"}
+	want := Rendered{
+		Subject: "Notice for A&B",
+		HTML: `<html><body><p>Hi <strong>A&amp;B</strong>, <a href="https://example.com/?a=1&amp;b=2">read it</a>.</p>
+<p>The ACME team</p></body></html>`,
+		Text: "Hi **A&B**, read it (https://example.com/?a=1&b=2).",
+	}
+	res, err := Render(pts[0], data)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if res.Subject != want.Subject || res.HTML != want.HTML || res.Text != want.Text {
+		t.Fatalf("unexpected result:\n%+v\nwant:\n%+v", res, want)
+	}
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	res, err := emails.NoticeEmail(&emails.NoticeEmailData{Name: "A&B", Url: "https://example.com/?a=1&b=2"})
+	fmt.Printf("%s\n%s\n%s\n%v\n", res.Subject, res.HTML, res.Text, err)
+}
+`)
+		if w := want.Subject + "\n" + want.HTML + "\n" + want.Text + "\n<nil>\n"; got != w {
+			t.Fatalf("unexpected output %q, want %q", got, w)
+		}
+	}
+
+	// A text file replaces the text from the Markdown
+	mustWrite("notice.txt", "Read {{url}}")
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	if res, err := Render(pts[0], data); err != nil || res.Text != "Read https://example.com/?a=1&b=2" {
+		t.Fatalf("expected the text file, got %q, %v", res.Text, err)
+	}
+	if err := os.Remove(filepath.Join(dir, "notice.txt")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	// Problems are reported once, in the Markdown source
+	mustWrite("notice.md", `<!-- @type url string -->
+Hi *{{name}}*, [read it]({{url.Host}}).`)
+	mustWrite("notice.html", `<p>{{name}}</p>`)
+	pts, err = mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	err = Generate(pts, MemWriter{}, Options{PackageName: "emails", Version: "TEST"})
+	md := filepath.Join(dir, "notice.md")
+	if want := md + ": error: " + filepath.Join(dir, "notice.html") + " generates NoticeEmail too; rename one of them\n" +
+		md + ":2:31: error: can't evaluate field Host on type string"; err == nil || err.Error() != want {
+		t.Fatalf("expected:\n%s\ngot:\n%v", want, err)
+	}
+}
+
+func TestGenerateCode_Backticks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "partials"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, body := range map[string]string{
+		"build.md":           "<!-- $Subject: Run `go build` -->\nRun `go build` now.\n",
+		"deploy.html":        "<!-- $Text: Run `make deploy` -->\n<p>Run <code>make deploy</code></p>",
+		"test.html":          "<pre>`go test`</pre><!-- @include partials/tick.html -->",
+		"test.txt":           "Run `go test`",
+		"partials/tick.html": "<kbd>`</kbd>",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	mod := t.TempDir()
+	out := filepath.Join(mod, "emails")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := GenerateCode(pts, out, Options{PackageName: "emails", Version: "TEST"}); err != nil {
+		t.Fatalf("GenerateCode: %v", err)
+	}
+
+	var want strings.Builder
+	for _, pt := range pts {
+		res, err := Render(pt, map[string]any{})
+		if err != nil {
+			t.Fatalf("Render: %v", err)
+		}
+		want.WriteString(res.Subject + "\n" + res.HTML + "\n" + res.Text + "\n")
+	}
+	if !strings.Contains(want.String(), "Run `go build` now.") || !strings.Contains(want.String(), "<pre>`go test`</pre><kbd>`</kbd>") {
+		t.Fatalf("backticks missing from the rendered output:\n%s", want.String())
+	}
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+)
+
+func main() {
+	for _, render := range []func() (emails.RenderedEmail, error){
+		func() (emails.RenderedEmail, error) { return emails.BuildEmail(&emails.BuildEmailData{}) },
+		func() (emails.RenderedEmail, error) { return emails.DeployEmail(&emails.DeployEmailData{}) },
+		func() (emails.RenderedEmail, error) { return emails.TestEmail(&emails.TestEmailData{}) },
+	} {
+		res, _ := render()
+		fmt.Printf("%s\n%s\n%s\n", res.Subject, res.HTML, res.Text)
+	}
+}
+`)
+		if got != want.String() {
+			t.Fatalf("unexpected output %q, want %q", got, want.String())
+		}
+	}
+}
+
+func TestGenerateCode_Packages(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(name, body string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	mustWrite("welcome.html", `<!-- $Subject: Welcome --><p>Hi {{name}}</p>`)
+	mustWrite("billing/welcome.html", `<!-- @include ../partials/sig.html --><p>Billing for {{name}}</p>`)
+	mustWrite("billing/eu-2/welcome.md", `Hi **{{name}}**`)
+	mustWrite("partials/sig.html", `<p>The team</p>`)
+	pts, err := mailparser.ParseDir(dir)
+	if err != nil {
+		t.Fatalf("ParseDir: %v", err)
+	}
+	if diags := Check(pts); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+
+	pkgs := Packages(pts, dir, "emails")
+	var got []string
+	for _, p := range pkgs {
+		got = append(got, filepath.ToSlash(p.Dir)+" "+p.Name+" "+OutputPath(p.Templates[0], dir))
+	}
+	want := []string{
+		". emails welcome.email.go",
+		"billing billing " + filepath.Join("billing", "welcome.email.go"),
+		"billing/eu-2 eu2 " + filepath.Join("billing", "eu-2", "welcome.email.go"),
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected packages %q, want %q", got, want)
+	}
+	for name, want := range map[string]string{"billing": "billing", "Billing-V2": "billingv2", "2024": "x2024", "type": "xtype", "_": "x"} {
+		if got := PackageName(name); got != want {
+			t.Errorf("PackageName(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	mod := t.TempDir()
+	for _, p := range pkgs {
+		out := filepath.Join(mod, "emails", p.Dir)
+		if err := os.MkdirAll(out, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := GenerateCode(p.Templates, out, Options{PackageName: p.Name, Version: "TEST"}); err != nil {
+			t.Fatalf("GenerateCode: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(mod, "emails", "billing", "types.go")); err != nil {
+		t.Fatalf("expected types.go in the subpackage: %v", err)
+	}
+	if !testing.Short() {
+		got := runGenerated(t, mod, `package main
+
+import (
+	"fmt"
+
+	"example.com/gen/emails"
+	"example.com/gen/emails/billing"
+	"example.com/gen/emails/billing/eu-2"
+)
+
+func main() {
+	a, _ := emails.WelcomeEmail(&emails.WelcomeEmailData{Name: "Ann"})
+	b, _ := billing.WelcomeEmail(&billing.WelcomeEmailData{Name: "Ann"})
+	c, _ := eu2.WelcomeEmail(&eu2.WelcomeEmailData{Name: "Ann"})
+	fmt.Println(a.HTML)
+	fmt.Println(b.HTML)
+	fmt.Println(c.Text)
+}
+`)
+		if want := "<p>Hi Ann</p>\n<p>The team</p><p>Billing for Ann</p>\nHi **Ann**\n"; got != want {
+			t.Fatalf("unexpected output %q, want %q", got, want)
+		}
+	}
+}
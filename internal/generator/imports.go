@@ -0,0 +1,304 @@
+package generator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"go/types"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/diag"
+	"github.com/elliot40404/mailc/internal/parser"
+)
+
+// packageLoader type-checks the packages of @import annotations from source,
+// so that references into imported types can be checked like declared ones.
+// Packages are located by running go list in the directory of the importing
+// template, so they resolve exactly as in the module being generated into.
+// Each package is loaded once per Check.
+type packageLoader struct {
+	fset    *token.FileSet
+	checked map[string]*types.Package // by directory and import path
+	loaded  map[string]loadedPackage  // imported packages, likewise
+}
+
+type loadedPackage struct {
+	pkg *types.Package
+	err error
+}
+
+func newPackageLoader() *packageLoader {
+	return &packageLoader{
+		fset:    token.NewFileSet(),
+		checked: make(map[string]*types.Package),
+		loaded:  make(map[string]loadedPackage),
+	}
+}
+
+// listedPackage is the part of go list -json output the loader uses.
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	GoFiles    []string
+	CgoFiles   []string
+	ImportMap  map[string]string
+	Error      *struct{ Err string }
+}
+
+// load returns the package imp refers to from the template at file.
+func (l *packageLoader) load(imp parser.Import, file string) (*types.Package, error) {
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	key := dir + "\x00" + imp.Path
+	if p, ok := l.loaded[key]; ok {
+		return p.pkg, p.err
+	}
+	pkg, err := l.check(dir, imp.Path)
+	l.loaded[key] = loadedPackage{pkg, err}
+	return pkg, err
+}
+
+// check type-checks path and its dependencies, which go list reports
+// dependencies first. Only the declarations of dependencies matter, so
+// function bodies are skipped and their errors ignored.
+func (l *packageLoader) check(dir, path string) (*types.Package, error) {
+	cmd := exec.Command("go", "list", "-e", "-deps", "-json=ImportPath,Dir,GoFiles,CgoFiles,ImportMap,Error", "--", path)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var p listedPackage
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("go list: %w", err)
+		}
+		target := p.ImportPath == path
+		if p.Error != nil && target {
+			return nil, errors.New(p.Error.Err)
+		}
+		key := dir + "\x00" + p.ImportPath
+		if _, ok := l.checked[key]; ok || p.ImportPath == "unsafe" {
+			continue
+		}
+		var files []*ast.File
+		for _, name := range append(p.GoFiles, p.CgoFiles...) {
+			f, err := goparser.ParseFile(l.fset, filepath.Join(p.Dir, name), nil, goparser.SkipObjectResolution)
+			if err != nil && target {
+				return nil, err
+			}
+			if f != nil {
+				files = append(files, f)
+			}
+		}
+		var firstErr error
+		conf := types.Config{
+			Importer: importerFunc(func(imported string) (*types.Package, error) {
+				if mapped, ok := p.ImportMap[imported]; ok {
+					imported = mapped
+				}
+				if imported == "unsafe" {
+					return types.Unsafe, nil
+				}
+				if pkg := l.checked[dir+"\x00"+imported]; pkg != nil {
+					return pkg, nil
+				}
+				return nil, fmt.Errorf("package %s not found", imported)
+			}),
+			IgnoreFuncBodies: true,
+			FakeImportC:      true,
+			Error: func(err error) {
+				if firstErr == nil {
+					firstErr = err
+				}
+			},
+		}
+		pkg, _ := conf.Check(p.ImportPath, l.fset, files, nil)
+		l.checked[key] = pkg
+		if target {
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			return pkg, nil
+		}
+	}
+	return nil, fmt.Errorf("go list did not report package %s", path)
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// lookup returns the exported type of pt named by qualified, such as
+// billing.Invoice. It returns nil for packages pt does not import, such as
+// time, and an error if the package cannot be loaded or lacks the type.
+func (l *packageLoader) lookup(pt *parser.ParsedTemplate, qualified string) (types.Type, error) {
+	alias, name, _ := strings.Cut(qualified, ".")
+	i := slices.IndexFunc(pt.Imports, func(imp parser.Import) bool { return imp.Alias == alias })
+	if i < 0 {
+		return nil, nil
+	}
+	pkg, err := l.load(pt.Imports[i], pt.Imports[i].File)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := pkg.Scope().Lookup(name).(*types.TypeName)
+	if !ok || !obj.Exported() {
+		return nil, fmt.Errorf("package %s has no exported type %s", pkg.Path(), name)
+	}
+	return obj.Type(), nil
+}
+
+// checkImports reports @import annotations of pt that are unused or whose
+// package cannot be loaded, and declared types that the imported packages
+// do not export.
+func checkImports(pt *parser.ParsedTemplate, pkgs *packageLoader) diag.List {
+	var diags diag.List
+	failed := make(map[string]bool)
+	for _, imp := range pt.Imports {
+		used := slices.ContainsFunc(pt.Types, func(t parser.ParsedType) bool {
+			return strings.HasPrefix(parser.BaseType(t.Type), imp.Alias+".")
+		})
+		if !used && imp.File == pt.FilePath {
+			diags.Warnf(imp.File, imp.Pos, "%s is imported but not used by any @type", imp.Path)
+			continue
+		}
+		if _, err := pkgs.load(imp, imp.File); err != nil {
+			diags.Errorf(imp.File, imp.Pos, "cannot load package %s: %v", imp.Path, err)
+			failed[imp.Alias] = true
+		}
+	}
+	check := func(typ string, pos diag.Pos) {
+		base := parser.BaseType(typ)
+		alias, _, ok := strings.Cut(base, ".")
+		if !ok || failed[alias] {
+			return
+		}
+		if _, err := pkgs.lookup(pt, base); err != nil {
+			diags.Errorf(pt.FilePath, pos, "unknown type %s: %v", base, err)
+		}
+	}
+	for _, s := range pt.Structs {
+		for _, f := range s.Fields {
+			check(f.Type, f.Pos)
+		}
+	}
+	for _, v := range pt.Variables {
+		check(v.Type, v.Pos)
+	}
+	return diags
+}
+
+// fromGo converts a Go type from an imported package into the model used
+// to check templates. Fields and methods of named structs become fields;
+// methods with results evaluate to their first result.
+func (m *typeModel) fromGo(t types.Type) *tmplType {
+	switch t := t.(type) {
+	case *types.Alias:
+		return m.fromGo(types.Unalias(t))
+	case *types.Pointer:
+		return m.fromGo(t.Elem())
+	case *types.Basic:
+		return &tmplType{kind: kindBasic, name: t.Name()}
+	case *types.Slice:
+		return &tmplType{kind: kindSlice, name: m.goName(t), elem: m.fromGo(t.Elem())}
+	case *types.Array:
+		return &tmplType{kind: kindSlice, name: m.goName(t), elem: m.fromGo(t.Elem())}
+	case *types.Map:
+		return &tmplType{kind: kindMap, name: m.goName(t), elem: m.fromGo(t.Elem())}
+	case *types.Named:
+		if tt, ok := m.named[t]; ok {
+			return tt
+		}
+		if obj := t.Obj(); obj.Pkg() != nil && obj.Pkg().Path() == "time" && obj.Name() == "Time" {
+			return unknownType
+		}
+		methods := types.NewMethodSet(types.NewPointer(t))
+		st, ok := t.Underlying().(*types.Struct)
+		if !ok {
+			if hasExported(methods) {
+				// Methods are not modeled on basic, slice or map types
+				return unknownType
+			}
+			tt := *m.fromGo(t.Underlying())
+			if tt.kind == kindUnknown {
+				return unknownType
+			}
+			tt.name = m.goName(t)
+			return &tt
+		}
+		tt := &tmplType{kind: kindStruct, name: m.goName(t), fields: make(map[string]*tmplType)}
+		m.named[t] = tt // registered before fields to allow recursive types
+		m.addGoFields(tt, st, 0)
+		for i := range methods.Len() {
+			fn := methods.At(i).Obj()
+			if !fn.Exported() {
+				continue
+			}
+			if _, ok := tt.fields[fn.Name()]; ok {
+				continue
+			}
+			res := unknownType
+			if sig, ok := fn.Type().(*types.Signature); ok && sig.Results().Len() > 0 {
+				res = m.fromGo(sig.Results().At(0).Type())
+			}
+			tt.fields[fn.Name()] = res
+		}
+		return tt
+	}
+	return unknownType
+}
+
+// addGoFields adds the exported fields of st to tt, including the fields
+// promoted from embedded structs; shallower fields win.
+func (m *typeModel) addGoFields(tt *tmplType, st *types.Struct, depth int) {
+	var embedded []*types.Struct
+	for i := range st.NumFields() {
+		f := st.Field(i)
+		if f.Embedded() {
+			typ := f.Type()
+			if p, ok := typ.(*types.Pointer); ok {
+				typ = p.Elem()
+			}
+			if est, ok := typ.Underlying().(*types.Struct); ok && depth < 8 {
+				embedded = append(embedded, est)
+			}
+		}
+		if _, ok := tt.fields[f.Name()]; f.Exported() && !ok {
+			tt.fields[f.Name()] = m.fromGo(f.Type())
+		}
+	}
+	for _, est := range embedded {
+		m.addGoFields(tt, est, depth+1)
+	}
+}
+
+// goName returns t as written in templates, qualified by package names.
+func (m *typeModel) goName(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string { return p.Name() })
+}
+
+func hasExported(methods *types.MethodSet) bool {
+	for i := range methods.Len() {
+		if methods.At(i).Obj().Exported() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,508 @@
+package generator
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/css"
+	"github.com/elliot40404/mailc/internal/parser"
+)
+
+// voidElements have no end tag.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// rawTextElements hold text up to their end tag rather than markup.
+var rawTextElements = map[string]bool{"script": true, "style": true, "textarea": true, "title": true}
+
+// unstyledElements never receive inlined styles.
+var unstyledElements = map[string]bool{
+	"head": true, "title": true, "meta": true, "link": true, "base": true, "style": true, "script": true,
+}
+
+// impliedEnds lists, for an element, the open elements its start tag
+// closes, as in <td>a<td>b. The branches of {{if}} and {{else}} often open
+// the same element twice.
+var impliedEnds = map[string][]string{
+	"td": {"td", "th"}, "th": {"td", "th"}, "tr": {"tr", "td", "th"},
+	"li": {"li"}, "p": {"p"}, "option": {"option"},
+}
+
+// styledElement is an element of template HTML that styles may be inlined
+// into.
+type styledElement struct {
+	css.Element
+	nameEnd int // offset just past the tag name
+	// style is the span of the value of the style attribute, quote is its
+	// quote character (0 when unquoted), and hasStyle whether it is set.
+	styleStart, styleEnd int
+	quote                byte
+	hasStyle             bool
+	matches              []styleMatch
+	// unknown lists the attributes whose value depends on control actions,
+	// as in class="{{if big}}big{{end}}". When it or an ancestor has such
+	// attributes, sure is the element without them: selectors matching it
+	// match whatever the attributes render to.
+	unknown []string
+	sure    *css.Element
+}
+
+// styleMatch is a rule applying to an element.
+type styleMatch struct {
+	spec  css.Specificity
+	order int
+	decls []css.Declaration
+}
+
+// styleBlock is a <style> element whose rules may be inlined.
+type styleBlock struct {
+	start, end int // the whole element
+	content    int // offset of its content, which rules are relative to
+	rules      []css.Rule
+}
+
+// edit replaces html[start:end] with text.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// inlineStyles moves the rules of the <style> elements of a template body
+// into style attributes of the elements they match, following the cascade:
+// rules apply by specificity and then source order, !important declarations
+// win, and declarations already in a style attribute override all but
+// !important rules.
+//
+// Rules that cannot be decided from the markup, such as a:hover, rules in
+// @media blocks and rules that only match depending on an attribute set by
+// {{if}} or {{range}}, stay in their <style> element, as do rules matching
+// no element, which may style partials or markup from data. A <style> element
+// left empty is removed. Style elements with template actions, markup in
+// kept comments (which is meant for some clients only) and the content of
+// partials are left as they are.
+func inlineStyles(html string) string {
+	elements, blocks := scanStyled(html)
+	if len(blocks) == 0 {
+		return html
+	}
+
+	var edits []edit
+	order := 0
+	for _, b := range blocks {
+		inlined := make([]bool, len(b.rules))
+		remaining := make([][]string, len(b.rules))
+		for ri, r := range b.rules {
+			if r.At != "" {
+				continue
+			}
+			for _, text := range r.Selectors {
+				sel, err := css.ParseSelector(text)
+				matched, uncertain := false, err != nil
+				if err == nil {
+					for _, e := range elements {
+						switch {
+						case !sel.Match(&e.Element):
+						case e.sure != nil && !sel.Match(e.sure):
+							uncertain = true
+						default:
+							e.matches = append(e.matches, styleMatch{spec: sel.Specificity(), order: order, decls: r.Declarations})
+							matched = true
+						}
+					}
+				}
+				order++
+				if matched {
+					inlined[ri] = true
+				}
+				if !matched || uncertain {
+					remaining[ri] = append(remaining[ri], text)
+				}
+			}
+		}
+		if !slices.Contains(inlined, true) {
+			continue
+		}
+		if !slices.ContainsFunc(remaining, func(s []string) bool { return len(s) > 0 }) &&
+			!slices.ContainsFunc(b.rules, func(r css.Rule) bool { return r.At != "" }) {
+			start, end := b.start, b.end
+			if lineStart := strings.LastIndexByte(html[:start], '\n') + 1; strings.TrimSpace(html[lineStart:start]) == "" {
+				if nl := strings.IndexByte(html[end:], '\n'); nl >= 0 && strings.TrimSpace(html[end:end+nl]) == "" {
+					start, end = lineStart, end+nl+1
+				}
+			}
+			edits = append(edits, edit{start, end, ""})
+			continue
+		}
+		prev := b.content
+		for ri, r := range b.rules {
+			switch {
+			case !inlined[ri]:
+			case len(remaining[ri]) == 0:
+				edits = append(edits, edit{prev, b.content + r.End, ""})
+			default:
+				r.Selectors = remaining[ri]
+				edits = append(edits, edit{b.content + r.Start, b.content + r.End, r.String()})
+			}
+			prev = b.content + r.End
+		}
+	}
+
+	for _, e := range elements {
+		if len(e.matches) == 0 {
+			continue
+		}
+		slices.SortStableFunc(e.matches, func(a, b styleMatch) int {
+			if c := a.spec.Compare(b.spec); c != 0 {
+				return c
+			}
+			return a.order - b.order
+		})
+		var decls []css.Declaration
+		for _, m := range e.matches {
+			for _, d := range m.decls {
+				i := slices.IndexFunc(decls, func(p css.Declaration) bool { return p.Property == d.Property })
+				switch {
+				case i < 0:
+					decls = append(decls, d)
+				case d.Important || !decls[i].Important:
+					decls[i] = d
+				}
+			}
+		}
+		own := ""
+		if e.hasStyle {
+			own = strings.TrimSpace(html[e.styleStart:e.styleEnd])
+			if !strings.Contains(own, "{{") {
+				// The style attribute overrides all but !important rules
+				for _, d := range css.ParseDeclarations(own) {
+					decls = slices.DeleteFunc(decls, func(p css.Declaration) bool { return p.Property == d.Property && !p.Important })
+				}
+			}
+		}
+		if len(decls) == 0 {
+			continue
+		}
+		quote := e.quote
+		if quote == 0 {
+			if strings.Contains(own, `"`) {
+				continue
+			}
+			quote = '"'
+		}
+		// The style attribute is kept as written, after the rules
+		value := attrEscape(css.FormatDeclarations(decls), quote)
+		if own != "" {
+			value = strings.TrimPrefix(value+"; "+own, "; ")
+		}
+		switch {
+		case !e.hasStyle:
+			edits = append(edits, edit{e.nameEnd, e.nameEnd, ` style="` + value + `"`})
+		case e.quote == 0:
+			edits = append(edits, edit{e.styleStart, e.styleEnd, `"` + value + `"`})
+		default:
+			edits = append(edits, edit{e.styleStart, e.styleEnd, value})
+		}
+	}
+
+	slices.SortStableFunc(edits, func(a, b edit) int { return a.start - b.start })
+	var out strings.Builder
+	last := 0
+	for _, e := range edits {
+		if e.start < last {
+			continue
+		}
+		out.WriteString(html[last:e.start])
+		out.WriteString(e.text)
+		last = e.end
+	}
+	out.WriteString(html[last:])
+	return out.String()
+}
+
+// attrEscape prepares a style attribute value quoted with quote. CSS
+// strings switch to the other quote where possible, as in
+// font-family: 'Helvetica Neue'; otherwise quote is escaped.
+func attrEscape(s string, quote byte) string {
+	other := byte('\'')
+	if quote == '\'' {
+		other = '"'
+	}
+	if !strings.ContainsRune(s, rune(other)) {
+		s = strings.ReplaceAll(s, string(quote), string(other))
+	}
+	return strings.ReplaceAll(s, string(quote), "&#"+strconv.Itoa(int(quote))+";")
+}
+
+// scanStyled finds the elements and <style> elements of template HTML.
+// Template actions are skipped wherever they appear, and so is markup in
+// comments, including those kept with parser.CommentFunc.
+func scanStyled(html string) ([]*styledElement, []styleBlock) {
+	var elements []*styledElement
+	var blocks []styleBlock
+	var open []*styledElement
+	inComment := 0
+	for i := 0; i < len(html); {
+		switch {
+		case strings.HasPrefix(html[i:], "{{"):
+			end := parser.ActionEnd(html, i+2)
+			if end < 0 {
+				return elements, blocks
+			}
+			if text, ok := keptCommentText(html[i:end]); ok {
+				switch {
+				case strings.HasPrefix(text, "<!--") && !strings.HasSuffix(text, "-->"):
+					inComment++
+				case (text == "<![endif]-->" || text == "-->") && inComment > 0:
+					inComment--
+				}
+			}
+			i = end
+		case strings.HasPrefix(html[i:], "<!--"):
+			end := strings.Index(html[i+4:], "-->")
+			if end < 0 {
+				return elements, blocks
+			}
+			i += 4 + end + 3
+		case inComment > 0:
+			i++
+		case strings.HasPrefix(html[i:], "</"):
+			n := tagNameLen(html[i+2:])
+			name := strings.ToLower(html[i+2 : i+2+n])
+			for j := len(open) - 1; n > 0 && j >= 0; j-- {
+				if open[j].Tag == name {
+					open = open[:j]
+					break
+				}
+			}
+			i = skipTag(html, i+2+n)
+		case html[i] == '<' && tagNameLen(html[i+1:]) > 0:
+			start := i
+			e, end, selfClosing := parseStartTag(html, i)
+			for len(open) > 0 && slices.Contains(impliedEnds[e.Tag], open[len(open)-1].Tag) {
+				open = open[:len(open)-1]
+			}
+			if len(open) > 0 {
+				parent := open[len(open)-1]
+				e.Parent = &parent.Element
+				if parent.sure != nil {
+					e.sure = &css.Element{Tag: e.Tag, Attrs: e.Attrs, Parent: parent.sure}
+				}
+			}
+			if len(e.unknown) > 0 {
+				if e.sure == nil {
+					e.sure = &css.Element{Tag: e.Tag, Parent: e.Parent}
+				}
+				e.sure.Attrs = maps.Clone(e.Attrs)
+				for _, name := range e.unknown {
+					delete(e.sure.Attrs, name)
+				}
+			}
+			if !unstyledElements[e.Tag] && !inHead(&e.Element) {
+				elements = append(elements, e)
+			}
+			i = end
+			if rawTextElements[e.Tag] {
+				closeAt := indexFold(html[i:], "</"+e.Tag)
+				if closeAt < 0 {
+					return elements, blocks
+				}
+				closeAt += i
+				closeEnd := skipTag(html, closeAt+2+len(e.Tag))
+				content := html[i:closeAt]
+				_, hasMedia := e.Attrs["media"]
+				if e.Tag == "style" && !hasMedia && !strings.Contains(content, "{{") {
+					blocks = append(blocks, styleBlock{start: start, end: closeEnd, content: i, rules: css.Parse(content)})
+				}
+				i = closeEnd
+			} else if !selfClosing && !voidElements[e.Tag] {
+				open = append(open, e)
+			}
+		default:
+			i++
+		}
+	}
+	return elements, blocks
+}
+
+// keptCommentText returns the comment text of an action emitting a kept
+// comment, as in {{htmlComment "<!--[if mso]>"}}.
+func keptCommentText(action string) (string, bool) {
+	inner := strings.TrimSpace(strings.Trim(action, "{}-"))
+	arg, ok := strings.CutPrefix(inner, parser.CommentFunc+" ")
+	if !ok {
+		return "", false
+	}
+	text, err := strconv.Unquote(strings.TrimSpace(arg))
+	return text, err == nil
+}
+
+// parseStartTag parses the start tag at html[start] and returns the element
+// with the offset just past the tag.
+func parseStartTag(html string, start int) (*styledElement, int, bool) {
+	n := tagNameLen(html[start+1:])
+	e := &styledElement{
+		Element: css.Element{Tag: strings.ToLower(html[start+1 : start+1+n]), Attrs: make(map[string]string)},
+		nameEnd: start + 1 + n,
+	}
+	i := e.nameEnd
+	for i < len(html) {
+		switch c := html[i]; {
+		case c == '>':
+			return e, i + 1, false
+		case strings.HasPrefix(html[i:], "/>"):
+			return e, i + 2, true
+		case strings.HasPrefix(html[i:], "{{"):
+			end := parser.ActionEnd(html, i+2)
+			if end < 0 {
+				return e, len(html), false
+			}
+			i = end
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '/':
+			i++
+		default:
+			nameStart := i
+			for i < len(html) && !strings.ContainsRune(" \t\n\r/>=", rune(html[i])) && !strings.HasPrefix(html[i:], "{{") {
+				i++
+			}
+			name := strings.ToLower(html[nameStart:i])
+			j := i
+			for j < len(html) && (html[j] == ' ' || html[j] == '\t' || html[j] == '\n' || html[j] == '\r') {
+				j++
+			}
+			if j >= len(html) || html[j] != '=' {
+				e.Attrs[name] = ""
+				continue
+			}
+			j++
+			for j < len(html) && (html[j] == ' ' || html[j] == '\t' || html[j] == '\n' || html[j] == '\r') {
+				j++
+			}
+			valueStart, valueEnd, quote := attrValue(html, j)
+			e.Attrs[name] = stripActions(html[valueStart:valueEnd])
+			if hasControlAction(html[valueStart:valueEnd]) {
+				e.unknown = append(e.unknown, name)
+			}
+			if name == "style" {
+				e.styleStart, e.styleEnd, e.quote, e.hasStyle = valueStart, valueEnd, quote, true
+			}
+			i = valueEnd
+			if quote != 0 {
+				i++
+			}
+		}
+	}
+	return e, len(html), false
+}
+
+// attrValue returns the span of the attribute value starting at html[i],
+// without its quotes, and the quote character.
+func attrValue(html string, i int) (start, end int, quote byte) {
+	if i < len(html) && (html[i] == '"' || html[i] == '\'') {
+		quote = html[i]
+		for j := i + 1; j < len(html); {
+			switch {
+			case strings.HasPrefix(html[j:], "{{"):
+				if end := parser.ActionEnd(html, j+2); end >= 0 {
+					j = end
+					continue
+				}
+				return i + 1, len(html), quote
+			case html[j] == quote:
+				return i + 1, j, quote
+			}
+			j++
+		}
+		return i + 1, len(html), quote
+	}
+	j := i
+	for j < len(html) && !strings.ContainsRune(" \t\n\r>", rune(html[j])) {
+		if strings.HasPrefix(html[j:], "{{") {
+			if end := parser.ActionEnd(html, j+2); end >= 0 {
+				j = end
+				continue
+			}
+		}
+		j++
+	}
+	return i, j, 0
+}
+
+// stripActions removes template actions from an attribute value. Unless the
+// value has control actions, what is left is the text that is the same for
+// every execution; otherwise it is the text of every branch.
+func stripActions(s string) string {
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			return s
+		}
+		end := parser.ActionEnd(s, start+2)
+		if end < 0 {
+			return s[:start]
+		}
+		s = s[:start] + " " + s[end:]
+	}
+}
+
+// hasControlAction reports whether s has an action such as {{if}} or
+// {{range}}, which decides what text around it is executed.
+func hasControlAction(s string) bool {
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			return false
+		}
+		end := parser.ActionEnd(s, start+2)
+		if end < 0 {
+			return false
+		}
+		inner := strings.TrimSuffix(strings.TrimPrefix(s[start+2:end-2], "-"), "-")
+		switch firstWord(inner) {
+		case "if", "else", "range", "with", "end", "break", "continue":
+			return true
+		}
+		s = s[end:]
+	}
+}
+
+// skipTag returns the offset just past the ">" ending the tag that
+// continues at html[i].
+func skipTag(html string, i int) int {
+	if end := strings.IndexByte(html[i:], '>'); end >= 0 {
+		return i + end + 1
+	}
+	return len(html)
+}
+
+// tagNameLen returns the length of the tag name at the start of s.
+func tagNameLen(s string) int {
+	n := 0
+	for n < len(s) {
+		c := s[n]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (n > 0 && ((c >= '0' && c <= '9') || c == '-' || c == ':')) {
+			n++
+			continue
+		}
+		break
+	}
+	return n
+}
+
+// inHead reports whether e is inside the <head> element.
+func inHead(e *css.Element) bool {
+	for p := e.Parent; p != nil; p = p.Parent {
+		if p.Tag == "head" {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFold is strings.Index ignoring ASCII case.
+func indexFold(s, substr string) int {
+	return strings.Index(strings.ToLower(s), strings.ToLower(substr))
+}
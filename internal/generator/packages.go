@@ -0,0 +1,82 @@
+package generator
+
+import (
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/elliot40404/mailc/internal/parser"
+)
+
+// Package is a Go package generated from the templates of one directory.
+type Package struct {
+	Dir       string // relative to the output directory; "." for the root package
+	Name      string
+	Templates []*parser.ParsedTemplate
+}
+
+// Packages groups templates by their directory relative to inputDir. The
+// templates directly in inputDir make up the root package, named name; those
+// in a subdirectory such as billing/ make up a package generated into the
+// same subdirectory of the output directory and named after it. Packages
+// are sorted by directory, with the root package first.
+func Packages(templates []*parser.ParsedTemplate, inputDir, name string) []Package {
+	byDir := make(map[string]*Package)
+	var dirs []string
+	for _, pt := range templates {
+		dir := packageDir(pt, inputDir)
+		p, ok := byDir[dir]
+		if !ok {
+			p = &Package{Dir: dir, Name: name}
+			if dir != "." {
+				p.Name = PackageName(filepath.Base(dir))
+			}
+			byDir[dir] = p
+			dirs = append(dirs, dir)
+		}
+		p.Templates = append(p.Templates, pt)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i] == "." || (dirs[j] != "." && filepath.ToSlash(dirs[i]) < filepath.ToSlash(dirs[j]))
+	})
+	pkgs := make([]Package, 0, len(dirs))
+	for _, dir := range dirs {
+		pkgs = append(pkgs, *byDir[dir])
+	}
+	return pkgs
+}
+
+// OutputPath returns the path of the file generated for pt, relative to the
+// output directory, when its templates are in inputDir.
+func OutputPath(pt *parser.ParsedTemplate, inputDir string) string {
+	return filepath.Join(packageDir(pt, inputDir), OutputFileName(pt))
+}
+
+// packageDir returns the directory of pt relative to inputDir, or "." when
+// pt is outside of it.
+func packageDir(pt *parser.ParsedTemplate, inputDir string) string {
+	dir, err := filepath.Rel(filepath.Clean(inputDir), filepath.Dir(pt.FilePath))
+	if err != nil || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return "."
+	}
+	return dir
+}
+
+// PackageName converts a directory name into a Go package name: lower case
+// letters and digits only, as in billingv2 for billing-v2. Names that would
+// start with a digit or be a keyword are prefixed with x.
+func PackageName(dir string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(dir) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	name := b.String()
+	if name == "" || unicode.IsDigit([]rune(name)[0]) || token.IsKeyword(name) {
+		name = "x" + name
+	}
+	return name
+}
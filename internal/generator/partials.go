@@ -0,0 +1,201 @@
+package generator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	htmltemplate "html/template"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// templateFuncs are the functions available to templates calling partials
+// or keeping comments. partialsHelpers emits the same functions into
+// generated packages.
+var templateFuncs = htmltemplate.FuncMap{
+	parser.ParamsFunc:  partialParams,
+	parser.CommentFunc: htmlComment,
+}
+
+// partialParams builds the data passed to a partial from alternating
+// parameter names and values.
+func partialParams(kv ...any) (map[string]any, error) {
+	if len(kv)%2 != 0 {
+		return nil, errors.New("params: odd number of arguments")
+	}
+	m := make(map[string]any, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		name, ok := kv[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("params: parameter name %v is not a string", kv[i])
+		}
+		m[name] = kv[i+1]
+	}
+	return m, nil
+}
+
+// htmlComment marks a comment kept from the template source as trusted
+// HTML.
+func htmlComment(s string) htmltemplate.HTML {
+	return htmltemplate.HTML(s)
+}
+
+// usesFuncs reports whether the body of pt needs templateFuncs.
+func usesFuncs(pt *parser.ParsedTemplate) bool {
+	return len(pt.Partials) > 0 || pt.KeptComments
+}
+
+// partialSource returns the definition of p exactly as it is embedded in
+// generated code.
+func partialSource(p *parser.Partial) string {
+	trimmed, _ := bodySource(p.Template)
+	return "{{define " + strconv.Quote(p.Name) + "}}" + insertLeadingDots(p.Template, trimmed) + "{{end}}"
+}
+
+// parseBody parses the body template of pt named name together with the
+// partials it calls, the same way the generated code does.
+func parseBody(pt *parser.ParsedTemplate, name, body string) (*htmltemplate.Template, error) {
+	if !usesFuncs(pt) {
+		return htmltemplate.New(name).Parse(body)
+	}
+	t, err := htmltemplate.New(name).Funcs(templateFuncs).Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pt.Partials {
+		if _, err := t.Parse(partialSource(p)); err != nil {
+			return nil, fmt.Errorf("partial %s: %w", p.Name, err)
+		}
+	}
+	return t, nil
+}
+
+var nonIdent = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// partialConstName returns the unexported constant holding the definition
+// of the partial named name.
+func partialConstName(name string) string {
+	return util.LowerFirst(util.MakeExportedName(strings.TrimSuffix(name, ".html"))) + "Partial"
+}
+
+// partialFileName returns the file the partial named name is emitted to,
+// e.g. partials_button.partial.go for partials/button.html.
+func partialFileName(name string) string {
+	base := nonIdent.ReplaceAllString(strings.TrimSuffix(name, ".html"), "_")
+	return strings.ToLower(strings.Trim(base, "_")) + ".partial.go"
+}
+
+// collectPartials returns every partial used by templates once, sorted by
+// name. Two different files may not share a name in one package.
+func collectPartials(templates []*parser.ParsedTemplate) ([]*parser.Partial, error) {
+	byName := make(map[string]*parser.Partial)
+	for _, pt := range templates {
+		for _, p := range pt.Partials {
+			if q, ok := byName[p.Name]; ok && q.Template.FilePath != p.Template.FilePath {
+				return nil, fmt.Errorf("partial %s is both %s and %s", p.Name, q.Template.FilePath, p.Template.FilePath)
+			}
+			byName[p.Name] = p
+		}
+	}
+	partials := make([]*parser.Partial, 0, len(byName))
+	for _, p := range byName {
+		partials = append(partials, p)
+	}
+	slices.SortFunc(partials, func(a, b *parser.Partial) int { return strings.Compare(a.Name, b.Name) })
+	return partials, nil
+}
+
+// writePartials emits one file per partial holding its definition, and the
+// helpers parsing templates together with their partials when helpers is
+// set or there are partials.
+func writePartials(partials []*parser.Partial, helpers bool, w Writer, opts Options) error {
+	if len(partials) == 0 && !helpers {
+		return nil
+	}
+	for _, p := range partials {
+		var buf bytes.Buffer
+		buf.WriteString("// Code generated by mailc. DO NOT EDIT.\n")
+		buf.WriteString(fmt.Sprintf("// Version: mailc %v\n\n", opts.Version))
+		buf.WriteString(fmt.Sprintf("package %s\n\n", opts.PackageName))
+		buf.WriteString(fmt.Sprintf("// %s defines the partial %s.\n", partialConstName(p.Name), p.Name))
+		buf.WriteString(fmt.Sprintf("const %s = %s\n", partialConstName(p.Name), rawString(partialSource(p))))
+		if err := writeFormatted(w, partialFileName(p.Name), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by mailc. DO NOT EDIT.\n")
+	buf.WriteString(fmt.Sprintf("// Version: mailc %v\n\n", opts.Version))
+	buf.WriteString(fmt.Sprintf("package %s\n\n", opts.PackageName))
+	buf.WriteString(partialsHelpers)
+	return writeFormatted(w, "partials.go", buf.Bytes())
+}
+
+func writeFormatted(w Writer, name string, src []byte) error {
+	formatted, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("formatting %s: %w", name, err)
+	}
+	if err := w.WriteFile(name, formatted); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	return nil
+}
+
+// partialsHelpers is the body of partials.go. It mirrors parseBody,
+// partialParams and htmlComment.
+const partialsHelpers = `import (
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+)
+
+// parseWithPartials parses src into t together with the definitions of the
+// partials it calls, with the functions calling partials and keeping
+// comments.
+func parseWithPartials(t *htmltemplate.Template, src string, partials ...string) (*htmltemplate.Template, error) {
+	t, err := t.Funcs(htmltemplate.FuncMap{
+		"` + parser.ParamsFunc + `":      partialParams,
+		"` + parser.CommentFunc + `": htmlComment,
+	}).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range partials {
+		if _, err := t.Parse(p); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// partialParams builds the data passed to a partial from alternating
+// parameter names and values.
+func partialParams(kv ...any) (map[string]any, error) {
+	if len(kv)%2 != 0 {
+		return nil, errors.New("params: odd number of arguments")
+	}
+	m := make(map[string]any, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		name, ok := kv[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("params: parameter name %v is not a string", kv[i])
+		}
+		m[name] = kv[i+1]
+	}
+	return m, nil
+}
+
+// htmlComment marks a comment kept from the template source as trusted
+// HTML.
+func htmlComment(s string) htmltemplate.HTML {
+	return htmltemplate.HTML(s)
+}
+`
@@ -0,0 +1,164 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/elliot40404/mailc/htmltext"
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// Rendered is the result of rendering a template at runtime. It mirrors the
+// RenderedEmail type emitted into generated packages.
+type Rendered struct {
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Sources returns the body, subject and plain-text templates of pt exactly
+// as they are embedded in generated code. The subject and text are empty when
+// pt has none.
+func Sources(pt *parser.ParsedTemplate) (body, subject, text string) {
+	return sources(pt, false)
+}
+
+// sources implements Sources, inlining the styles of the body when
+// inlineCSS or pt.InlineCSS is set.
+func sources(pt *parser.ParsedTemplate, inlineCSS bool) (body, subject, text string) {
+	trimmed, _ := bodySource(pt)
+	if inlineCSS || pt.InlineCSS {
+		trimmed = inlineStyles(trimmed)
+	}
+	body = insertLeadingDots(pt, trimmed)
+	if s := strings.TrimSpace(pt.Subject); s != "" {
+		subject = insertLeadingDots(pt, s)
+	}
+	if t := strings.TrimSpace(pt.Text); t != "" {
+		text = insertLeadingDots(pt, t)
+	}
+	return body, subject, text
+}
+
+// Render parses pt the same way the generated code does and executes it with
+// data, without compiling any Go code. Data is usually the map returned by
+// SampleData, or any value with the shape of the generated data struct.
+func Render(pt *parser.ParsedTemplate, data any) (Rendered, error) {
+	var result Rendered
+	base := templateBaseName(pt)
+	body, subject, text := Sources(pt)
+
+	bodyTmpl, err := parseBody(pt, base, body)
+	if err != nil {
+		return result, fmt.Errorf("parse body template: %w", err)
+	}
+	var bodyBuf bytes.Buffer
+	if err := bodyTmpl.Execute(&bodyBuf, data); err != nil {
+		return result, fmt.Errorf("render body: %w", err)
+	}
+	result.HTML = bodyBuf.String()
+
+	if subject != "" {
+		subjTmpl, err := texttemplate.New(base + "_subject").Parse(subject)
+		if err != nil {
+			return result, fmt.Errorf("parse subject template: %w", err)
+		}
+		var subjBuf bytes.Buffer
+		if err := subjTmpl.Execute(&subjBuf, data); err != nil {
+			return result, fmt.Errorf("render subject: %w", err)
+		}
+		result.Subject = subjBuf.String()
+	}
+
+	if text == "" {
+		result.Text = htmltext.FromHTML(result.HTML)
+		return result, nil
+	}
+	textTmpl, err := texttemplate.New(base + "_text").Parse(text)
+	if err != nil {
+		return result, fmt.Errorf("parse text template: %w", err)
+	}
+	var textBuf bytes.Buffer
+	if err := textTmpl.Execute(&textBuf, data); err != nil {
+		return result, fmt.Errorf("render text: %w", err)
+	}
+	result.Text = textBuf.String()
+	return result, nil
+}
+
+// sampleTime is the value used for every time.Time in sample data.
+var sampleTime = time.Date(2025, time.January, 2, 15, 4, 5, 0, time.UTC)
+
+// basicKinds maps predeclared types to their reflect types so that sample
+// numbers have the declared type and compare correctly in templates.
+var basicKinds = map[string]reflect.Type{
+	"bool": reflect.TypeFor[bool](), "byte": reflect.TypeFor[byte](), "rune": reflect.TypeFor[rune](),
+	"int": reflect.TypeFor[int](), "int8": reflect.TypeFor[int8](), "int16": reflect.TypeFor[int16](),
+	"int32": reflect.TypeFor[int32](), "int64": reflect.TypeFor[int64](),
+	"uint": reflect.TypeFor[uint](), "uint8": reflect.TypeFor[uint8](), "uint16": reflect.TypeFor[uint16](),
+	"uint32": reflect.TypeFor[uint32](), "uint64": reflect.TypeFor[uint64](), "uintptr": reflect.TypeFor[uintptr](),
+	"float32": reflect.TypeFor[float32](), "float64": reflect.TypeFor[float64](),
+	"complex64": reflect.TypeFor[complex64](), "complex128": reflect.TypeFor[complex128](),
+}
+
+// SampleData builds placeholder data for pt from its declared types, keyed
+// by the field names of the generated data struct. Strings hold the path of
+// the field they fill (e.g. "User.Name"), numbers are 42, booleans true, and
+// slices have two elements, so every branch of a typical template renders.
+func SampleData(pt *parser.ParsedTemplate) map[string]any {
+	structs := make(map[string]parser.ParsedStruct, len(pt.Structs))
+	for _, s := range pt.Structs {
+		structs[s.Name] = s
+	}
+	var sample func(typ, path string, depth int) any
+	sample = func(typ, path string, depth int) any {
+		switch {
+		case strings.HasPrefix(typ, "[]"):
+			return []any{sample(typ[2:], path, depth), sample(typ[2:], path, depth)}
+		case strings.HasPrefix(typ, "*"):
+			return sample(typ[1:], path, depth)
+		case strings.HasPrefix(typ, "map["):
+			end := strings.Index(typ, "]")
+			if end < 0 {
+				return nil
+			}
+			return map[string]any{"key": sample(typ[end+1:], path+".key", depth)}
+		case typ == "string" || typ == "any":
+			return path
+		case typ == "time.Time":
+			return sampleTime
+		}
+		if t, ok := basicKinds[typ]; ok {
+			if t.Kind() == reflect.Bool {
+				return true
+			}
+			return reflect.ValueOf(42).Convert(t).Interface()
+		}
+		s, ok := structs[typ]
+		if !ok || depth > 8 {
+			// Unknown types and deeply recursive structs are left empty
+			return nil
+		}
+		m := make(map[string]any, len(s.Fields))
+		for _, f := range s.Fields {
+			m[f.Name] = sample(f.Type, path+"."+f.Name, depth+1)
+		}
+		return m
+	}
+
+	data := make(map[string]any)
+	for _, s := range pt.Structs {
+		if !s.TypeOnly {
+			data[s.Name] = sample(s.Name, s.Name, 0)
+		}
+	}
+	for _, v := range pt.Variables {
+		data[util.UpperFirst(v.Name)] = sample(v.Type, v.Name, 0)
+	}
+	return data
+}
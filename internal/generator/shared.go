@@ -0,0 +1,53 @@
+package generator
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// collectShared returns the shared structs used by templates once, in
+// declaration order. The templates of a package must agree on every shared
+// struct, and shared structs may not collide with the types and functions
+// generated for each template.
+func collectShared(templates []*parser.ParsedTemplate) ([]parser.ParsedStruct, error) {
+	var shared []parser.ParsedStruct
+	users := make(map[string]string) // shared struct -> first template using it
+	generated := map[string]string{"RenderedEmail": "types.go"}
+	sameField := func(a, b parser.ParsedField) bool { return a.Name == b.Name && a.Type == b.Type }
+	for _, pt := range templates {
+		funcName := util.MakeExportedName(templateBaseName(pt)) + "Email"
+		generated[funcName] = pt.FilePath
+		generated[funcName+"Data"] = pt.FilePath
+		for _, s := range pt.Structs {
+			if !s.Shared {
+				generated[funcName+s.Name] = pt.FilePath
+				continue
+			}
+			i := slices.IndexFunc(shared, func(prev parser.ParsedStruct) bool { return prev.Name == s.Name })
+			if i < 0 {
+				shared = append(shared, s)
+				users[s.Name] = pt.FilePath
+				continue
+			}
+			if !slices.EqualFunc(shared[i].Fields, s.Fields, sameField) {
+				return nil, fmt.Errorf("shared type %s is declared differently for %s and %s", s.Name, users[s.Name], pt.FilePath)
+			}
+		}
+	}
+	for _, s := range shared {
+		if file, ok := generated[s.Name]; ok {
+			return nil, fmt.Errorf("shared type %s collides with the code generated for %s", s.Name, file)
+		}
+	}
+	slices.SortStableFunc(shared, func(a, b parser.ParsedStruct) int {
+		if c := cmp.Compare(a.Pos.Line, b.Pos.Line); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Pos.Col, b.Pos.Col)
+	})
+	return shared, nil
+}
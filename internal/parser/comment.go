@@ -0,0 +1,102 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CommentFunc is the template function emitting an HTML comment kept from
+// the template source. html/template drops comments from template text, so
+// comments email clients act upon are passed through it as trusted HTML.
+const CommentFunc = "htmlComment"
+
+// keptComment is a comment, or the opening or closing part of one, to be
+// emitted verbatim.
+type keptComment struct {
+	start, end int // span in the HTML
+	text       string
+}
+
+// keepComments replaces the comments in pt.HTML that must survive
+// rendering with calls to CommentFunc:
+//
+//   - Outlook conditional comments: <!--[if mso]> and <![endif]--> around
+//     markup, which stays part of the template, and the <!--[if !mso]><!-->
+//     and <!--<![endif]--> pair hiding markup from Outlook;
+//   - comments marked with "!", such as <!--! sent to {{email}} -->, which
+//     are emitted without the marker.
+//
+// The text between the parts of a comment stays template text, so actions
+// in it are executed and escaped as usual. Other comments are left to
+// html/template, which removes them.
+func keepComments(pt *ParsedTemplate) {
+	var kept []keptComment
+	html := pt.HTML
+	for i := 0; ; {
+		start := strings.Index(html[i:], "<!--")
+		if start < 0 {
+			break
+		}
+		start += i
+		rest := html[start+len("<!--"):]
+		switch {
+		case strings.HasPrefix(rest, "[if "):
+			end := strings.Index(rest, "]>")
+			if end < 0 {
+				file, pos := pt.SourcePos(start)
+				pt.Diagnostics.Errorf(file, pos, "unterminated conditional comment; want <!--[if condition]>")
+				return
+			}
+			end += start + len("<!--") + len("]>")
+			if strings.HasPrefix(html[end:], "<!-->") {
+				// Markup hidden from Outlook follows, up to <!--<![endif]-->
+				end += len("<!-->")
+				kept = append(kept, keptComment{start, end, html[start:end]})
+				i = end
+				continue
+			}
+			kept = append(kept, keptComment{start, end, html[start:end]})
+			closing := strings.Index(html[end:], "<![endif]-->")
+			if closing < 0 {
+				file, pos := pt.SourcePos(start)
+				pt.Diagnostics.Errorf(file, pos, "conditional comment is not closed with <![endif]-->")
+				return
+			}
+			closing += end
+			kept = append(kept, keptComment{closing, closing + len("<![endif]-->"), "<![endif]-->"})
+			i = closing + len("<![endif]-->")
+		case strings.HasPrefix(rest, "<![endif]-->"):
+			end := start + len("<!--<![endif]-->")
+			kept = append(kept, keptComment{start, end, html[start:end]})
+			i = end
+		default:
+			end := strings.Index(rest, "-->")
+			if end < 0 {
+				i = len(html)
+				continue
+			}
+			end += start + len("<!--") + len("-->")
+			if strings.HasPrefix(rest, "!") {
+				kept = append(kept, keptComment{start, start + len("<!--!"), "<!--"},
+					keptComment{end - len("-->"), end, "-->"})
+			}
+			i = end
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+
+	srcMap, htmlMap := pt.srcMap, pt.htmlMap
+	resolve := func(off int) (string, Pos) { return resolveHTML(pt.FilePath, srcMap, htmlMap, off) }
+	var c composer
+	last := 0
+	for _, k := range kept {
+		c.copy(html, last, k.start, resolve)
+		c.synth("{{"+CommentFunc+" "+strconv.Quote(k.text)+"}}", k.start, resolve)
+		last = k.end
+	}
+	c.copy(html, last, len(html), resolve)
+	pt.HTML, pt.htmlMap = c.b.String(), c.segs
+	pt.KeptComments = true
+}
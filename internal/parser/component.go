@@ -0,0 +1,544 @@
+package parser
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ComponentPrefix starts the tag names of the built-in components, which
+// are expanded into table-based markup at generate time:
+//
+//	<mc-section background="#ffffff">
+//	  <mc-column width="50%"><mc-image src="{{logo}}" width="120" alt="ACME"></mc-column>
+//	  <mc-column width="50%"><mc-button href="{{url}}">Sign in</mc-button></mc-column>
+//	</mc-section>
+//	<mc-spacer height="24">
+const ComponentPrefix = "mc-"
+
+// componentSpec describes the attributes of a component. Attributes with a
+// default are optional; numeric ones are pixel sizes that must be static.
+type componentSpec struct {
+	void     bool
+	attrs    []string
+	defaults map[string]string
+	required []string
+	numeric  []string
+}
+
+var components = map[string]componentSpec{
+	"mc-section": {
+		attrs:    []string{"width", "background", "padding"},
+		defaults: map[string]string{"width": "600", "padding": "0"},
+		numeric:  []string{"width"},
+	},
+	"mc-column": {
+		attrs:    []string{"width", "background", "padding", "valign"},
+		defaults: map[string]string{"padding": "0", "valign": "top"},
+	},
+	"mc-button": {
+		attrs: []string{"href", "background", "color", "width", "height", "radius", "align", "font-family", "font-size"},
+		defaults: map[string]string{
+			"background": "#1a73e8", "color": "#ffffff", "width": "200", "height": "44", "radius": "4",
+			"align": "center", "font-family": "Arial, sans-serif", "font-size": "16",
+		},
+		required: []string{"href"},
+		numeric:  []string{"width", "height", "radius", "font-size"},
+	},
+	"mc-image": {
+		void:     true,
+		attrs:    []string{"src", "alt", "width", "href", "align"},
+		defaults: map[string]string{"alt": "", "align": "center"},
+		required: []string{"src", "width"},
+		numeric:  []string{"width"},
+	},
+	"mc-spacer": {
+		void:     true,
+		attrs:    []string{"height"},
+		defaults: map[string]string{"height": "20"},
+		numeric:  []string{"height"},
+	},
+}
+
+// component is a component element in the HTML of a template.
+type component struct {
+	name                string
+	start, end          int // the whole element
+	contentStart, close int // its content; both end for void components
+	attrs               map[string]componentAttr
+	children            []*component
+	parent              *component
+}
+
+// componentAttr is an attribute value and its span in the HTML; the span
+// is empty for defaults.
+type componentAttr struct {
+	value      string
+	start, end int
+}
+
+// static reports whether the value is the same for every execution.
+func (a componentAttr) static() bool {
+	return !strings.Contains(a.value, "{{")
+}
+
+// px returns the value of a static pixel size such as 200 or 200px.
+func (a componentAttr) px() (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(a.value), "px"))
+	return n, err == nil && n >= 0
+}
+
+// expandComponents replaces the components in pt.HTML with the markup they
+// stand for. Attribute values and content are copied from the template, so
+// the actions in them keep their positions.
+func expandComponents(pt *ParsedTemplate) {
+	n := len(pt.Diagnostics)
+	top := scanComponents(pt)
+	if len(top) == 0 || pt.Diagnostics[n:].HasErrors() {
+		// Misplaced components are left as they are; generation stops anyway
+		return
+	}
+	html := pt.HTML
+	srcMap, htmlMap := pt.srcMap, pt.htmlMap
+	x := &expander{pt: pt, html: html}
+	x.resolve = func(off int) (string, Pos) { return resolveHTML(pt.FilePath, srcMap, htmlMap, off) }
+	x.content(0, len(html), top)
+	pt.HTML, pt.htmlMap = x.c.b.String(), x.c.segs
+}
+
+// scanComponents returns the components of pt.HTML as a tree, skipping
+// comments and template actions, and reports misplaced or malformed ones.
+func scanComponents(pt *ParsedTemplate) []*component {
+	html := pt.HTML
+	var top []*component
+	var open *component
+	errorf := func(off int, format string, args ...any) {
+		file, pos := pt.SourcePos(off)
+		pt.Diagnostics.Errorf(file, pos, format, args...)
+	}
+	for i := 0; i < len(html); {
+		switch {
+		case strings.HasPrefix(html[i:], "{{"):
+			end := ActionEnd(html, i+2)
+			if end < 0 {
+				i = len(html)
+				continue
+			}
+			i = end
+		case strings.HasPrefix(html[i:], "<!--"):
+			end := strings.Index(html[i+4:], "-->")
+			if end < 0 {
+				i = len(html)
+				continue
+			}
+			i += 4 + end + 3
+		case strings.HasPrefix(html[i:], "</"+ComponentPrefix):
+			name := html[i+2 : i+2+componentNameLen(html[i+2:])]
+			end := strings.IndexByte(html[i:], '>')
+			if end < 0 {
+				errorf(i, "unterminated </%s> tag", name)
+				return top
+			}
+			end += i + 1
+			switch {
+			case components[name].void:
+				errorf(i, "<%s> has no end tag", name)
+			case open == nil || open.name != name:
+				errorf(i, "unexpected </%s>", name)
+			default:
+				open.close, open.end = i, end
+				open = open.parent
+			}
+			i = end
+		case strings.HasPrefix(html[i:], "<"+ComponentPrefix):
+			c, end, ok := parseComponentTag(pt, i)
+			if !ok {
+				return top
+			}
+			spec, known := components[c.name]
+			if !known {
+				errorf(i, "unknown component <%s>", c.name)
+			}
+			switch {
+			case c.name == "mc-column" && (open == nil || open.name != "mc-section"):
+				errorf(i, "<mc-column> must be directly inside <mc-section>")
+			case c.name == "mc-section" && open != nil:
+				errorf(i, "<mc-section> cannot be inside <%s>", open.name)
+			}
+			c.parent = open
+			if open != nil {
+				open.children = append(open.children, c)
+			} else {
+				top = append(top, c)
+			}
+			i = end
+			if !spec.void {
+				c.contentStart = end
+				open = c
+			} else {
+				c.contentStart, c.close, c.end = end, end, end
+			}
+		default:
+			i++
+		}
+	}
+	for c := open; c != nil; c = c.parent {
+		errorf(c.start, "<%s> is not closed", c.name)
+	}
+	if open != nil {
+		return nil
+	}
+	return top
+}
+
+// parseComponentTag parses the start tag at html[start], checking its
+// attributes against the component's spec.
+func parseComponentTag(pt *ParsedTemplate, start int) (*component, int, bool) {
+	html := pt.HTML
+	errorf := func(off int, format string, args ...any) {
+		file, pos := pt.SourcePos(off)
+		pt.Diagnostics.Errorf(file, pos, format, args...)
+	}
+	n := componentNameLen(html[start+1:])
+	c := &component{name: strings.ToLower(html[start+1 : start+1+n]), start: start, attrs: make(map[string]componentAttr)}
+	spec, known := components[c.name]
+	i := start + 1 + n
+	for {
+		for i < len(html) && strings.IndexByte(" \t\r\n", html[i]) >= 0 {
+			i++
+		}
+		if i >= len(html) {
+			errorf(start, "unterminated <%s> tag", c.name)
+			return nil, 0, false
+		}
+		if html[i] == '>' || strings.HasPrefix(html[i:], "/>") {
+			i = strings.IndexByte(html[i:], '>') + i + 1
+			break
+		}
+		nameStart := i
+		for i < len(html) && strings.IndexByte(" \t\r\n=/>", html[i]) < 0 {
+			i++
+		}
+		if i == nameStart {
+			i++ // a stray "/"
+			continue
+		}
+		name := strings.ToLower(html[nameStart:i])
+		var a componentAttr
+		if i < len(html) && html[i] == '=' {
+			i++
+			if i < len(html) && (html[i] == '"' || html[i] == '\'') {
+				quote := html[i]
+				end := i + 1
+				for end < len(html) && html[end] != quote {
+					if strings.HasPrefix(html[end:], "{{") {
+						if e := ActionEnd(html, end+2); e >= 0 {
+							end = e
+							continue
+						}
+					}
+					end++
+				}
+				if end >= len(html) {
+					errorf(nameStart, "unterminated value of attribute %s", name)
+					return nil, 0, false
+				}
+				a = componentAttr{value: html[i+1 : end], start: i + 1, end: end}
+				i = end + 1
+			} else {
+				end := i
+				for end < len(html) && strings.IndexByte(" \t\r\n>", html[end]) < 0 {
+					end++
+				}
+				a = componentAttr{value: html[i:end], start: i, end: end}
+				i = end
+			}
+		}
+		switch {
+		case !known:
+		case !slices.Contains(spec.attrs, name):
+			errorf(nameStart, "unknown attribute %s of <%s>; want one of %s", name, c.name, strings.Join(spec.attrs, ", "))
+		case slices.Contains(spec.numeric, name):
+			if _, ok := a.px(); !ok {
+				errorf(nameStart, "attribute %s of <%s> must be a number of pixels, got %q", name, c.name, a.value)
+				continue
+			}
+			c.attrs[name] = a
+		default:
+			c.attrs[name] = a
+		}
+	}
+	for _, name := range spec.required {
+		if _, ok := c.attrs[name]; !ok {
+			errorf(start, "<%s> needs a %s attribute", c.name, name)
+		}
+	}
+	for name, value := range spec.defaults {
+		if _, ok := c.attrs[name]; !ok {
+			c.attrs[name] = componentAttr{value: value}
+		}
+	}
+	if w, ok := c.attrs["width"]; ok && c.name == "mc-column" && !validColumnWidth(w.value) {
+		errorf(w.start, "attribute width of <mc-column> must be a percentage or a number of pixels, got %q", w.value)
+		delete(c.attrs, "width")
+	}
+	return c, i, true
+}
+
+// validColumnWidth reports whether s is a static percentage or pixel
+// width.
+func validColumnWidth(s string) bool {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.ParseFloat(p, 64)
+		return err == nil && n > 0 && n <= 100
+	}
+	_, ok := componentAttr{value: s}.px()
+	return ok
+}
+
+func componentNameLen(s string) int {
+	n := 0
+	for n < len(s) && (s[n] == '-' || s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z' || s[n] >= '0' && s[n] <= '9') {
+		n++
+	}
+	return n
+}
+
+// expander writes the expanded HTML of a template, copying text from the
+// template where it can so that positions are preserved.
+type expander struct {
+	pt      *ParsedTemplate
+	html    string
+	c       composer
+	resolve func(int) (string, Pos)
+	at      int // offset generated markup is attributed to
+	// sectionWidth is the content width of the section whose columns are
+	// being expanded.
+	sectionWidth int
+}
+
+// text appends generated markup.
+func (x *expander) text(s string) {
+	if s != "" {
+		x.c.synth(s, x.at, x.resolve)
+	}
+}
+
+// attr appends the value of attribute name of c, copied from the template
+// when it is written there.
+func (x *expander) attr(c *component, name string) {
+	a := c.attrs[name]
+	switch {
+	case a.start == a.end:
+		x.text(strings.ReplaceAll(a.value, `"`, "&#34;"))
+	case strings.Contains(a.value, `"`) && a.static():
+		x.text(strings.ReplaceAll(a.value, `"`, "&#34;"))
+	default:
+		x.c.copy(x.html, a.start, a.end, x.resolve)
+	}
+}
+
+// content appends html[from:to] with the components in it expanded.
+func (x *expander) content(from, to int, children []*component) {
+	for _, c := range children {
+		x.c.copy(x.html, from, c.start, x.resolve)
+		x.expand(c)
+		from = c.end
+	}
+	x.c.copy(x.html, from, to, x.resolve)
+}
+
+// expand appends the markup component c stands for.
+func (x *expander) expand(c *component) {
+	x.at = c.start
+	px := func(name string) int {
+		n, _ := c.attrs[name].px()
+		return n
+	}
+	switch c.name {
+	case "mc-section":
+		width := px("width")
+		x.text(fmt.Sprintf(`<!--[if mso]><table role="presentation" border="0" cellpadding="0" cellspacing="0" width="%d" align="center"><tr><td><![endif]-->`, width))
+		x.text(fmt.Sprintf(`<table role="presentation" border="0" cellpadding="0" cellspacing="0" width="100%%" style="max-width:%dpx;margin:0 auto;`, width))
+		if _, ok := c.attrs["background"]; ok {
+			x.text("background:")
+			x.attr(c, "background")
+			x.text(`;" bgcolor="`)
+			x.attr(c, "background")
+		}
+		x.text(`"><tr><td style="padding:`)
+		x.attr(c, "padding")
+		x.text(`;">`)
+		if !slices.ContainsFunc(c.children, func(k *component) bool { return k.name == "mc-column" }) {
+			x.content(c.contentStart, c.close, c.children)
+		} else {
+			x.text(`<!--[if mso]><table role="presentation" border="0" cellpadding="0" cellspacing="0" width="100%"><tr><![endif]-->`)
+			x.columns(c, width-horizontalPadding(c.attrs["padding"]))
+			x.at = c.start
+			x.text(`<!--[if mso]></tr></table><![endif]-->`)
+		}
+		x.at = c.start
+		x.text(`</td></tr></table><!--[if mso]></td></tr></table><![endif]-->`)
+
+	case "mc-column":
+		width := columnPx(c.attrs["width"].value, c, x.sectionWidth)
+		x.text(fmt.Sprintf(`<!--[if mso]><td width="%d" valign="`, width))
+		x.attr(c, "valign")
+		x.text(fmt.Sprintf(`" style="width:%dpx;"><![endif]-->`, width))
+		x.text(fmt.Sprintf(`<div style="display:inline-block;width:100%%;max-width:%dpx;vertical-align:`, width))
+		x.attr(c, "valign")
+		x.text(`;"><table role="presentation" border="0" cellpadding="0" cellspacing="0" width="100%"`)
+		if _, ok := c.attrs["background"]; ok {
+			x.text(` style="background:`)
+			x.attr(c, "background")
+			x.text(`;" bgcolor="`)
+			x.attr(c, "background")
+			x.text(`"`)
+		}
+		x.text(`><tr><td style="padding:`)
+		x.attr(c, "padding")
+		x.text(`;">`)
+		x.content(c.contentStart, c.close, c.children)
+		x.at = c.start
+		x.text(`</td></tr></table></div><!--[if mso]></td><![endif]-->`)
+
+	case "mc-button":
+		width, height, radius, size := px("width"), px("height"), px("radius"), px("font-size")
+		arc := 0
+		if height > 0 {
+			arc = min(radius*100/height, 50)
+		}
+		x.text(`<table role="presentation" border="0" cellpadding="0" cellspacing="0" align="`)
+		x.attr(c, "align")
+		x.text(`"><tr><td>`)
+		x.text(`<!--[if mso]><v:roundrect xmlns:v="urn:schemas-microsoft-com:vml" xmlns:w="urn:schemas-microsoft-com:office:word" href="`)
+		x.attr(c, "href")
+		x.text(fmt.Sprintf(`" style="height:%dpx;v-text-anchor:middle;width:%dpx;" arcsize="%d%%" stroke="f" fillcolor="`, height, width, arc))
+		x.attr(c, "background")
+		x.text(`"><w:anchorlock/><center style="color:`)
+		x.attr(c, "color")
+		x.text(`;font-family:`)
+		x.attr(c, "font-family")
+		x.text(fmt.Sprintf(`;font-size:%dpx;font-weight:bold;">`, size))
+		x.content(c.contentStart, c.close, c.children)
+		x.at = c.start
+		x.text(`</center></v:roundrect><![endif]-->`)
+		x.text(`<!--[if !mso]><!--><a href="`)
+		x.attr(c, "href")
+		x.text(`" style="background-color:`)
+		x.attr(c, "background")
+		x.text(fmt.Sprintf(`;border-radius:%dpx;color:`, radius))
+		x.attr(c, "color")
+		x.text(`;display:inline-block;font-family:`)
+		x.attr(c, "font-family")
+		x.text(fmt.Sprintf(`;font-size:%dpx;font-weight:bold;line-height:%dpx;text-align:center;text-decoration:none;width:%dpx;-webkit-text-size-adjust:none;">`, size, height, width))
+		x.content(c.contentStart, c.close, c.children)
+		x.at = c.start
+		x.text(`</a><!--<![endif]--></td></tr></table>`)
+
+	case "mc-image":
+		margin := map[string]string{"left": "0", "right": "0 0 0 auto"}[c.attrs["align"].value]
+		if margin == "" {
+			margin = "0 auto"
+		}
+		if _, ok := c.attrs["href"]; ok {
+			x.text(`<a href="`)
+			x.attr(c, "href")
+			x.text(`">`)
+		}
+		x.text(`<img src="`)
+		x.attr(c, "src")
+		x.text(`" alt="`)
+		x.attr(c, "alt")
+		x.text(fmt.Sprintf(`" width="%d" border="0" style="display:block;border:0;outline:none;text-decoration:none;height:auto;width:100%%;max-width:%dpx;margin:%s;">`, px("width"), px("width"), margin))
+		if _, ok := c.attrs["href"]; ok {
+			x.text(`</a>`)
+		}
+
+	case "mc-spacer":
+		h := px("height")
+		x.text(fmt.Sprintf(`<table role="presentation" border="0" cellpadding="0" cellspacing="0" width="100%%"><tr><td height="%d" style="height:%dpx;line-height:%dpx;font-size:0;">&nbsp;</td></tr></table>`, h, h, h))
+
+	default:
+		// Unknown components were reported; keep their content
+		x.content(c.contentStart, c.close, c.children)
+	}
+}
+
+// columns appends the columns of section c, which are sectionWidth pixels
+// wide together. Only white space and actions may separate them.
+func (x *expander) columns(c *component, sectionWidth int) {
+	x.sectionWidth = sectionWidth
+	from := c.contentStart
+	for _, k := range append(slices.Clone(c.children), &component{start: c.close, end: c.close}) {
+		for i := from; i < k.start; {
+			switch {
+			case strings.HasPrefix(x.html[i:], "{{"):
+				end := ActionEnd(x.html, i+2)
+				if end < 0 {
+					end = k.start
+				}
+				x.c.copy(x.html, i, end, x.resolve)
+				i = end
+			case strings.IndexByte(" \t\r\n", x.html[i]) >= 0:
+				i++
+			default:
+				file, pos := x.resolve(i)
+				x.pt.Diagnostics.Errorf(file, pos, "content of a <mc-section> with columns must be inside <mc-column>")
+				i = k.start
+			}
+		}
+		if k.name != "" {
+			x.expand(k)
+		}
+		from = k.end
+	}
+}
+
+// horizontalPadding returns the left plus right padding of a static
+// padding value such as "10px 20px", or 0.
+func horizontalPadding(a componentAttr) int {
+	fields := strings.Fields(a.value)
+	var values []int
+	for _, f := range fields {
+		n, ok := componentAttr{value: f}.px()
+		if !ok {
+			return 0
+		}
+		values = append(values, n)
+	}
+	switch len(values) {
+	case 1, 2, 3:
+		return 2 * values[min(1, len(values)-1)]
+	case 4:
+		return values[1] + values[3]
+	}
+	return 0
+}
+
+// columnPx returns the width of column c in pixels: its width attribute,
+// or an equal share of what the sized columns of the section leave over.
+func columnPx(width string, c *component, sectionWidth int) int {
+	if width != "" {
+		if p, ok := strings.CutSuffix(width, "%"); ok {
+			f, _ := strconv.ParseFloat(p, 64)
+			return int(float64(sectionWidth)*f/100 + 0.5)
+		}
+		if n, ok := (componentAttr{value: width}).px(); ok {
+			return n
+		}
+	}
+	rest, unsized := sectionWidth, 0
+	for _, k := range c.parent.children {
+		if k.name != "mc-column" {
+			continue
+		}
+		if w, ok := k.attrs["width"]; ok && w.value != "" {
+			rest -= columnPx(w.value, k, sectionWidth)
+		} else {
+			unsized++
+		}
+	}
+	return max(rest, 0) / max(unsized, 1)
+}
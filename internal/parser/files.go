@@ -0,0 +1,106 @@
+package parser
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Filter selects templates by glob patterns in the syntax of path.Match,
+// matched against their path relative to the input directory with forward
+// slashes. A pattern with a slash matches that path or a directory leading
+// to it, as in billing/*.html or billing/eu; a pattern without one matches
+// any element of it, as in *_draft.html or legacy.
+//
+// A template is selected when it matches one of Include, or Include is
+// empty, and none of Exclude.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+// ParseFilter returns the Filter for comma-separated lists of include and
+// exclude patterns.
+func ParseFilter(include, exclude string) (Filter, error) {
+	var f Filter
+	for _, list := range []struct {
+		s    string
+		dest *[]string
+	}{{include, &f.Include}, {exclude, &f.Exclude}} {
+		for _, p := range strings.Split(list.s, ",") {
+			p = strings.Trim(strings.TrimSpace(p), "/")
+			if p == "" {
+				continue
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return Filter{}, fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+			*list.dest = append(*list.dest, p)
+		}
+	}
+	return f, nil
+}
+
+// Match reports whether the template at rel, relative to the input
+// directory, is selected.
+func (f Filter) Match(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if matchPattern(p, rel) {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(f.Include) == 0 || matches(f.Include)) && !matches(f.Exclude)
+}
+
+func matchPattern(pattern, rel string) bool {
+	elems := strings.Split(rel, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, e := range elems {
+			if ok, _ := path.Match(pattern, e); ok {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range elems {
+		if ok, _ := path.Match(pattern, strings.Join(elems[:i+1], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkTemplates lists the templates under dir and its subdirectories, HTML
+// and Markdown alike, without layouts and hidden directories. Partials in
+// subdirectories are listed too; they are told apart only by the templates
+// including them.
+func WalkTemplates(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if IsTemplateFile(path) && !IsShared(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// addImport records the package of an @import annotation, given as
+// "alias path" or just "path", in which case the alias is the last element
+// of the path.
+func addImport(pt *ParsedTemplate, ann Annotation) {
+	fields := strings.Fields(ann.Args)
+	if len(fields) == 1 {
+		fields = []string{"", fields[0]}
+	}
+	if len(fields) != 2 {
+		pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "invalid @import annotation %q; want @import [alias] <import path>", ann.Args)
+		return
+	}
+	imp := Import{Alias: fields[0], Path: fields[1], File: pt.FilePath, Pos: ann.Pos}
+	if unquoted, err := strconv.Unquote(imp.Path); err == nil {
+		imp.Path = unquoted
+	}
+	if imp.Alias == "" {
+		imp.Alias = path.Base(imp.Path)
+	}
+	if !isIdent(imp.Alias) || imp.Alias == "_" {
+		pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "invalid @import alias %q; write @import <alias> %s", imp.Alias, imp.Path)
+		return
+	}
+	addImportOnce(pt, imp)
+}
+
+// addImportOnce adds imp to pt.Imports unless its alias is taken: by the
+// same package, which is fine, or by another one, which is an error.
+func addImportOnce(pt *ParsedTemplate, imp Import) {
+	for _, prev := range pt.Imports {
+		if prev.Alias != imp.Alias {
+			continue
+		}
+		if prev.Path != imp.Path {
+			pt.Diagnostics.Errorf(imp.File, imp.Pos, "%s is imported as %s but also as %s at %s:%s", imp.Alias, imp.Path, prev.Path, prev.File, prev.Pos)
+		}
+		return
+	}
+	if path, ok := knownPackages[imp.Alias]; ok && path != imp.Path {
+		pt.Diagnostics.Errorf(imp.File, imp.Pos, "alias %s is reserved for %s", imp.Alias, path)
+		return
+	}
+	pt.Imports = append(pt.Imports, imp)
+}
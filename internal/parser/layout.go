@@ -0,0 +1,454 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// IsShared reports whether path names a layout or partial rather than a
+// template of its own: a file whose name starts with an underscore, such as
+// _layout.html. Shared files are only used through @extends and @include and
+// get no generated function.
+func IsShared(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "_")
+}
+
+// htmlSegment records that the HTML of a template using a layout, from
+// offset html up to the next segment, was copied from offset off of a source
+// located by resolve. Synthesized text is fixed at off.
+type htmlSegment struct {
+	html    int
+	off     int
+	fixed   bool
+	resolve func(off int) (string, Pos)
+}
+
+// composer assembles the HTML of a template using a layout from pieces of
+// the layout and of the template, keeping track of where each piece came
+// from.
+type composer struct {
+	b    strings.Builder
+	segs []htmlSegment
+}
+
+// copy appends src[from:to], where src is located by resolve.
+func (c *composer) copy(src string, from, to int, resolve func(int) (string, Pos)) {
+	if from >= to {
+		return
+	}
+	c.segs = append(c.segs, htmlSegment{html: c.b.Len(), off: from, resolve: resolve})
+	c.b.WriteString(src[from:to])
+}
+
+// synth appends generated text, attributed to offset at of a source located
+// by resolve.
+func (c *composer) synth(text string, at int, resolve func(int) (string, Pos)) {
+	c.segs = append(c.segs, htmlSegment{html: c.b.Len(), off: at, fixed: true, resolve: resolve})
+	c.b.WriteString(text)
+}
+
+// action is a {{...}} action in template text.
+type action struct {
+	start, end int    // offsets of "{{" and just past "}}"
+	keyword    string // first word, e.g. "block" or "end"
+	args       string // the rest of the action, trimmed
+	trimLeft   bool   // "{{-"
+	trimRight  bool   // "-}}"
+}
+
+// ActionEnd returns the index just past the "}}" closing the action whose
+// content starts at i, skipping over quoted strings and comments. It returns
+// -1 when the action is not terminated.
+func ActionEnd(s string, i int) int {
+	for i < len(s) {
+		switch c := s[i]; {
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			i = j + 1
+		case strings.HasPrefix(s[i:], "/*"):
+			j := strings.Index(s[i+2:], "*/")
+			if j < 0 {
+				return -1
+			}
+			i += j + 4
+		case strings.HasPrefix(s[i:], "}}"):
+			return i + 2
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+// scanActions lists the actions in s. It stops at an unterminated action.
+func scanActions(s string) []action {
+	var acts []action
+	for i := 0; ; {
+		start := strings.Index(s[i:], "{{")
+		if start < 0 {
+			return acts
+		}
+		start += i
+		end := ActionEnd(s, start+2)
+		if end < 0 {
+			return acts
+		}
+		a := action{start: start, end: end}
+		inner := s[start+2 : end-2]
+		if strings.HasPrefix(inner, "- ") {
+			a.trimLeft, inner = true, inner[1:]
+		}
+		if strings.HasSuffix(inner, " -") {
+			a.trimRight, inner = true, inner[:len(inner)-1]
+		}
+		inner = strings.TrimSpace(inner)
+		n := 0
+		for n < len(inner) && (inner[n] == '_' || inner[n] >= 'a' && inner[n] <= 'z') {
+			n++
+		}
+		a.keyword, a.args = inner[:n], strings.TrimSpace(inner[n:])
+		acts = append(acts, a)
+		i = end
+	}
+}
+
+// namedBlock is a {{define}} or {{block}} with the actions opening and
+// closing it, and the blocks nested in its body.
+type namedBlock struct {
+	keyword     string
+	name        string
+	pipe        string // pipeline of a block
+	open, close action
+	children    []*namedBlock
+}
+
+// namedBlocks returns the {{define}} and {{block}} actions of s as a tree,
+// together with the names called by {{template}}. It reports false when
+// the actions of s are not balanced, leaving the error to the template
+// parser.
+func namedBlocks(s string) (top []*namedBlock, called map[string]bool, ok bool) {
+	called = make(map[string]bool)
+	// The open blocks, with nil for if, range and with
+	var stack []*namedBlock
+	parent := func() *namedBlock {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i] != nil {
+				return stack[i]
+			}
+		}
+		return nil
+	}
+	for _, a := range scanActions(s) {
+		switch a.keyword {
+		case "if", "range", "with":
+			stack = append(stack, nil)
+		case "define", "block":
+			name, rest, ok := quotedName(a.args)
+			if !ok {
+				return nil, nil, false
+			}
+			b := &namedBlock{keyword: a.keyword, name: name, pipe: rest, open: a}
+			if p := parent(); p != nil {
+				p.children = append(p.children, b)
+			} else {
+				top = append(top, b)
+			}
+			if a.keyword == "block" {
+				called[name] = true
+			}
+			stack = append(stack, b)
+		case "template":
+			if name, _, ok := quotedName(a.args); ok {
+				called[name] = true
+			}
+		case "end":
+			if len(stack) == 0 {
+				return nil, nil, false
+			}
+			if b := stack[len(stack)-1]; b != nil {
+				b.close = a
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return top, called, len(stack) == 0
+}
+
+// quotedName splits the arguments of a define, block or template action into
+// the quoted template name and the rest.
+func quotedName(args string) (name, rest string, ok bool) {
+	q, err := strconv.QuotedPrefix(args)
+	if err != nil {
+		return "", "", false
+	}
+	name, err = strconv.Unquote(q)
+	if err != nil {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args[len(q):]), true
+}
+
+// loadLayout parses the layout named by an @extends annotation of pt.
+func loadLayout(pt *ParsedTemplate, ann Annotation, ctx *parseContext) *ParsedTemplate {
+	name := ann.Args
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "invalid @extends annotation %q; want @extends <file>", ann.Args)
+		return nil
+	}
+	path := filepath.Join(filepath.Dir(pt.FilePath), name)
+	if !IsShared(path) {
+		pt.Diagnostics.Errorf(pt.FilePath, ann.ArgsPos, "layout %s would be generated as a template of its own; name it %s", name, filepath.Join(filepath.Dir(name), "_"+filepath.Base(name)))
+		return nil
+	}
+	if slices.Contains(ctx.stack, path) {
+		chain := append(slices.Clone(ctx.stack), path)
+		pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "layout cycle: %s", strings.Join(chain, " -> "))
+		return nil
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		pt.Diagnostics.Errorf(pt.FilePath, ann.ArgsPos, "cannot read layout: %v", err)
+		return nil
+	}
+	layout := parse(path, src, ctx)
+	warnIgnored(layout, "layout")
+	return layout
+}
+
+// mergeLayout adds the data declared by layout to pt: structs declared in
+// both are merged field by field, and conflicting declarations are reported
+// on the template. Own declarations of pt are in structMap and pt.Variables;
+// inherited ones are recorded in inherited so they are not checked twice.
+func mergeLayout(pt, layout *ParsedTemplate, structMap map[string]*ParsedStruct, inherited map[string]bool) {
+	pt.Diagnostics = append(pt.Diagnostics, layout.Diagnostics...)
+	for _, p := range layout.Partials {
+		if !slices.Contains(pt.Partials, p) {
+			pt.Partials = append(pt.Partials, p)
+		}
+	}
+	in := "layout " + layout.FilePath
+	for _, imp := range layout.Imports {
+		addImportOnce(pt, imp)
+	}
+
+	ownVars := make(map[string]int, len(pt.Variables))
+	for i, v := range pt.Variables {
+		ownVars[util.UpperFirst(v.Name)] = i
+	}
+	for _, ls := range layout.Structs {
+		if i, ok := ownVars[ls.Name]; ok && !ls.TypeOnly {
+			v := pt.Variables[i]
+			pt.Diagnostics.Errorf(pt.FilePath, v.Pos, "%s collides with struct %s declared in %s at %s", v.Name, ls.Name, in, ls.Pos)
+			continue
+		}
+		s, ok := structMap[ls.Name]
+		switch {
+		case ok && s.Shared && !ls.Shared:
+			pt.Diagnostics.Errorf(layout.FilePath, ls.Pos, "%s is declared here but is a shared type in %s", ls.Name, pt.FilePath)
+			continue
+		case ok && !s.Shared && ls.Shared:
+			pt.Diagnostics.Errorf(pt.FilePath, s.Pos, "%s is declared here but is a shared type in %s", ls.Name, in)
+			continue
+		}
+		if ls.Shared {
+			if !ok {
+				shared := ls
+				structMap[ls.Name] = &shared
+			}
+			continue
+		}
+		if !ok {
+			s = &ParsedStruct{Name: ls.Name, Root: ls.Root, Pos: ls.Pos}
+			structMap[ls.Name] = s
+		}
+		// Fields from the layout come first, in the layout's order
+		fields := make([]ParsedField, 0, len(ls.Fields)+len(s.Fields))
+		for _, lf := range ls.Fields {
+			if i := slices.IndexFunc(s.Fields, func(f ParsedField) bool { return f.Name == lf.Name }); i >= 0 {
+				if f := s.Fields[i]; f.Type != lf.Type {
+					pt.Diagnostics.Errorf(pt.FilePath, f.Pos, "%s.%s is declared as %s but as %s in %s at %s", ls.Name, f.Name, f.Type, lf.Type, in, lf.Pos)
+				}
+				continue
+			}
+			fields = append(fields, lf)
+			inherited[ls.Name+"."+lf.Name] = true
+		}
+		for _, f := range s.Fields {
+			if !slices.ContainsFunc(fields, func(lf ParsedField) bool { return lf.Name == f.Name }) {
+				fields = append(fields, f)
+			}
+		}
+		s.Fields = fields
+	}
+
+	for _, lv := range layout.Variables {
+		exported := util.UpperFirst(lv.Name)
+		if s, ok := structMap[exported]; ok && !s.Shared {
+			// Variables inferred from the layout yield to declarations
+			if lv.Pos.Line != 0 {
+				pt.Diagnostics.Errorf(pt.FilePath, s.Pos, "%s is declared as a variable in %s at %s", exported, in, lv.Pos)
+			}
+			continue
+		}
+		if i, ok := ownVars[exported]; ok {
+			if v := pt.Variables[i]; lv.Pos.Line != 0 && v.Type != lv.Type {
+				pt.Diagnostics.Errorf(pt.FilePath, v.Pos, "%s is declared as %s but as %s in %s at %s", v.Name, v.Type, lv.Type, in, lv.Pos)
+			}
+			continue
+		}
+		pt.Variables = append(pt.Variables, lv)
+		inherited[lv.Name] = true
+	}
+
+	// Sample values from the template replace those from the layout
+	var examples []Example
+	for _, ex := range layout.Examples {
+		if !slices.ContainsFunc(pt.Examples, func(own Example) bool { return own.Path == ex.Path }) {
+			examples = append(examples, ex)
+		}
+	}
+	pt.Examples = append(examples, pt.Examples...)
+}
+
+// composeLayout replaces pt.HTML with the layout's HTML in which every
+// {{block}} is filled with the {{define}} of the same name in pt, or keeps
+// its default content. Text of pt outside {{define}} actions, if any,
+// overrides the "content" block. The result parses as a single template.
+func composeLayout(pt, layout *ParsedTemplate) {
+	own := pt.HTML
+	ownMap, ownSegs := pt.srcMap, pt.htmlMap
+	ownPos := func(off int) (string, Pos) { return resolveHTML(pt.FilePath, ownMap, ownSegs, off) }
+	ownLine := func(off int) Pos {
+		_, pos := ownPos(off)
+		return pos
+	}
+
+	var c composer
+	layoutTop, layoutCalls, ok := namedBlocks(layout.HTML)
+	ownTop, ownCalls, ownOK := namedBlocks(own)
+	if !ok || !ownOK {
+		// Keep both parts so that parsing reports the unbalanced action
+		c.copy(layout.HTML, 0, len(layout.HTML), layout.SourcePos)
+		c.copy(own, 0, len(own), ownPos)
+		pt.HTML, pt.htmlMap = c.b.String(), c.segs
+		return
+	}
+
+	overrides := make(map[string]*namedBlock)
+	var order []string
+	var outside []int // spans of own text outside {{define}}, as pairs
+	last := 0
+	for _, b := range ownTop {
+		if b.keyword != "define" {
+			continue
+		}
+		if _, dup := overrides[b.name]; dup {
+			pt.Diagnostics.Errorf(pt.FilePath, ownLine(b.open.start), "duplicate {{define %q}}", b.name)
+		}
+		overrides[b.name] = b
+		order = append(order, b.name)
+		outside = append(outside, last, b.open.start)
+		last = b.close.end
+	}
+	outside = append(outside, last, len(own))
+	var content strings.Builder
+	for i := 0; i < len(outside); i += 2 {
+		content.WriteString(own[outside[i]:outside[i+1]])
+	}
+	hasContent := strings.TrimSpace(content.String()) != ""
+	if hasContent && overrides["content"] != nil {
+		pt.Diagnostics.Errorf(pt.FilePath, ownLine(overrides["content"].open.start), "{{define \"content\"}} conflicts with the content outside {{define}} actions")
+		hasContent = false
+	}
+
+	// emit copies the layout text in [from, to), replacing the nested
+	// blocks by calls and leaving out nested defines
+	var defines []*namedBlock
+	var emit func(from, to int, children []*namedBlock)
+	emit = func(from, to int, children []*namedBlock) {
+		for _, b := range children {
+			c.copy(layout.HTML, from, b.open.start, layout.SourcePos)
+			if b.keyword == "block" {
+				call := "{{" + trim(b.open.trimLeft, "- ") + "template " + strconv.Quote(b.name)
+				if b.pipe != "" {
+					call += " " + b.pipe
+				}
+				c.synth(call+trim(b.close.trimRight, " -")+"}}", b.open.start, layout.SourcePos)
+			}
+			defines = append(defines, b)
+			from = b.close.end
+		}
+		c.copy(layout.HTML, from, to, layout.SourcePos)
+	}
+	emit(0, len(layout.HTML), layoutTop)
+
+	defined := make(map[string]bool)
+	for i := 0; i < len(defines); i++ {
+		b := defines[i]
+		if o := overrides[b.name]; o != nil || (b.name == "content" && hasContent) {
+			// Nested blocks of the replaced default are still defined
+			// so that overrides may call them
+			defines = append(defines, b.children...)
+			if !defined[b.name] {
+				defined[b.name] = true
+				emitOwn(&c, own, b.name, o, outside, ownPos)
+			}
+			continue
+		}
+		if defined[b.name] {
+			continue
+		}
+		defined[b.name] = true
+		c.synth("{{define "+strconv.Quote(b.name)+trim(b.open.trimRight, " -")+"}}", b.open.start, layout.SourcePos)
+		emit(b.open.end, b.close.start, b.children)
+		c.synth("{{"+trim(b.close.trimLeft, "- ")+"end}}", b.close.start, layout.SourcePos)
+	}
+	for _, name := range order {
+		o := overrides[name]
+		if !defined[name] {
+			defined[name] = true
+			emitOwn(&c, own, name, o, outside, ownPos)
+		}
+		if !layoutCalls[name] && !ownCalls[name] {
+			pt.Diagnostics.Warnf(pt.FilePath, ownLine(o.open.start), "%s has no block %q to override", layout.FilePath, name)
+		}
+	}
+	if hasContent && !defined["content"] {
+		emitOwn(&c, own, "content", nil, outside, ownPos)
+		pt.Diagnostics.Warnf(pt.FilePath, Pos{}, "%s has no block \"content\"; text outside {{define}} actions is not rendered", layout.FilePath)
+	}
+	pt.HTML, pt.htmlMap = c.b.String(), c.segs
+}
+
+// emitOwn appends the template's definition of name: the {{define}} b, or
+// the text outside defines when b is nil.
+func emitOwn(c *composer, own, name string, b *namedBlock, outside []int, resolve func(int) (string, Pos)) {
+	if b != nil {
+		c.copy(own, b.open.start, b.close.end, resolve)
+		return
+	}
+	c.synth("{{define "+strconv.Quote(name)+"}}", outside[0], resolve)
+	for i := 0; i < len(outside); i += 2 {
+		c.copy(own, outside[i], outside[i+1], resolve)
+	}
+	c.synth("{{end}}", outside[len(outside)-1], resolve)
+}
+
+// trim returns marker if set, and "" otherwise.
+func trim(set bool, marker string) string {
+	if set {
+		return marker
+	}
+	return ""
+}
@@ -0,0 +1,231 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/diag"
+)
+
+// Pos is a 1-based line:column position in a template source file.
+type Pos = diag.Pos
+
+// Annotation is a single mailc directive found inside an HTML comment, such
+// as "$Subject: Hi {{name}}" or "@type User.Name string".
+type Annotation struct {
+	Directive string // e.g. "$Subject" or "@type"
+	Args      string // everything after the directive, whitespace-trimmed
+	Pos       Pos    // position of the directive itself
+	ArgsPos   Pos    // position of the first byte of Args
+	Offset    int    // byte offset of the enclosing comment in the source
+	End       int    // byte offset just past the enclosing comment
+
+	at int // offset in the HTML where the comment was removed
+}
+
+// directives lists the annotations mailc understands. A comment whose first
+// directive is not listed here is ordinary HTML and is left in the body.
+var directives = map[string]bool{
+	"$Subject":    true,
+	"$Text":       true,
+	"@type":       true,
+	"@example":    true,
+	"@extends":    true,
+	"@include":    true,
+	"@shared":     true,
+	"@import":     true,
+	"@inline-css": true,
+}
+
+// lexed is the result of splitting a template source into annotations and
+// the remaining HTML.
+type lexed struct {
+	html        string
+	annotations []Annotation
+	unknown     []Annotation // comments that look like annotations but are not
+	srcMap      sourceMap
+}
+
+// segment records that html[html:] was copied from src[src:], up to the start
+// of the next segment.
+type segment struct {
+	html int
+	src  int
+}
+
+// sourceMap maps byte offsets in the extracted HTML back to positions in the
+// template source.
+type sourceMap struct {
+	lineStarts []int
+	segments   []segment
+}
+
+// pos returns the source position of byte offset off in the source.
+func (m sourceMap) pos(off int) Pos {
+	line := sort.Search(len(m.lineStarts), func(i int) bool { return m.lineStarts[i] > off })
+	if line == 0 {
+		return Pos{}
+	}
+	return Pos{Line: line, Col: off - m.lineStarts[line-1] + 1}
+}
+
+// htmlPos returns the source position of byte offset off in the HTML.
+func (m sourceMap) htmlPos(off int) Pos {
+	i := sort.Search(len(m.segments), func(i int) bool { return m.segments[i].html > off })
+	if i == 0 {
+		return Pos{}
+	}
+	seg := m.segments[i-1]
+	return m.pos(seg.src + off - seg.html)
+}
+
+// lex extracts annotation comments from src by byte offset. Everything else,
+// including ordinary comments and HTML sharing a line with an annotation, is
+// kept. An annotation comment that occupies whole lines on its own is removed
+// together with its line break so it leaves no blank line behind.
+func lex(src string) lexed {
+	var out lexed
+	out.srcMap.lineStarts = []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			out.srcMap.lineStarts = append(out.srcMap.lineStarts, i+1)
+		}
+	}
+	posOf := out.srcMap.pos
+
+	var html strings.Builder
+	atLineStart := true
+	lineBegin := 0 // offset in html of the current output line
+	emit := func(from, to int) {
+		if from >= to {
+			return
+		}
+		out.srcMap.segments = append(out.srcMap.segments, segment{html: html.Len(), src: from})
+		for i := from; i < to; i++ {
+			if atLineStart {
+				atLineStart = false
+				lineBegin = html.Len()
+			}
+			html.WriteByte(src[i])
+			if src[i] == '\n' {
+				atLineStart = true
+			}
+		}
+	}
+
+	i := 0
+	for i < len(src) {
+		start := strings.Index(src[i:], "<!--")
+		if start < 0 {
+			break
+		}
+		start += i
+		end := strings.Index(src[start+4:], "-->")
+		if end < 0 {
+			break
+		}
+		end += start + 4 + len("-->")
+
+		anns := splitDirectives(src, start+4, end-len("-->"), posOf)
+		if len(anns) == 0 || !directives[anns[0].Directive] {
+			if len(anns) > 0 && strings.HasPrefix(anns[0].Directive, "@") {
+				out.unknown = append(out.unknown, anns[0])
+			}
+			emit(i, end)
+			i = end
+			continue
+		}
+		emit(i, start)
+		inline := false
+		for k := range anns {
+			anns[k].Offset, anns[k].End, anns[k].at = start, end, html.Len()
+			// An @include is replaced where it stands, so its line stays
+			inline = inline || anns[k].Directive == "@include"
+		}
+		out.annotations = append(out.annotations, anns...)
+		i = end
+		if inline {
+			continue
+		}
+		// Drop the whole line when the annotation stands alone on it
+		rest := len(src)
+		if nl := strings.IndexByte(src[end:], '\n'); nl >= 0 {
+			rest = end + nl + 1
+		}
+		current := html.String()
+		if atLineStart {
+			current = ""
+		} else {
+			current = current[lineBegin:]
+		}
+		if strings.TrimSpace(current) == "" && strings.TrimSpace(src[end:rest]) == "" {
+			if !atLineStart {
+				truncated := html.String()[:lineBegin]
+				html.Reset()
+				html.WriteString(truncated)
+				for len(out.srcMap.segments) > 0 && out.srcMap.segments[len(out.srcMap.segments)-1].html >= lineBegin {
+					out.srcMap.segments = out.srcMap.segments[:len(out.srcMap.segments)-1]
+				}
+				atLineStart = true
+			}
+			i = rest
+		}
+	}
+	emit(i, len(src))
+
+	out.html = html.String()
+	return out
+}
+
+// splitDirectives splits the comment content src[from:to] into directives.
+// Each line starting with "@" or "$" begins a new directive; other lines
+// continue the previous one, so long annotations may span several lines.
+func splitDirectives(src string, from, to int, posOf func(int) Pos) []Annotation {
+	var anns []Annotation
+	var args []string
+	flush := func() {
+		if len(anns) > 0 {
+			anns[len(anns)-1].Args = strings.TrimSpace(strings.Join(args, "\n"))
+		}
+		args = args[:0]
+	}
+	for off := from; off < to; {
+		lineEnd := strings.IndexByte(src[off:to], '\n')
+		if lineEnd < 0 {
+			lineEnd = to
+		} else {
+			lineEnd += off + 1
+		}
+		line := strings.TrimRight(src[off:lineEnd], "\r\n")
+		trimmed := strings.TrimLeft(line, " \t")
+		lead := off + len(line) - len(trimmed)
+		// A $Text block runs to the end of the comment, whatever its lines hold
+		inText := len(anns) > 0 && anns[len(anns)-1].Directive == "$Text"
+		switch {
+		case !inText && (strings.HasPrefix(trimmed, "@") || strings.HasPrefix(trimmed, "$")):
+			flush()
+			name := trimmed
+			if n := strings.IndexAny(trimmed, " \t:"); n >= 0 {
+				name = trimmed[:n]
+			}
+			rest := strings.TrimPrefix(trimmed[len(name):], ":")
+			argsLead := lead + len(trimmed) - len(strings.TrimLeft(rest, " \t"))
+			anns = append(anns, Annotation{Directive: name, Pos: posOf(lead), ArgsPos: posOf(argsLead)})
+			args = append(args, rest)
+		case len(anns) == 0:
+			if strings.TrimSpace(line) != "" {
+				// Text before any directive: an ordinary comment
+				return nil
+			}
+		default:
+			if strings.TrimSpace(strings.Join(args, "")) == "" && trimmed != "" {
+				// Arguments starting on a continuation line begin here
+				anns[len(anns)-1].ArgsPos = posOf(lead)
+			}
+			args = append(args, line)
+		}
+		off = lineEnd
+	}
+	flush()
+	return anns
+}
@@ -0,0 +1,1384 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// MarkdownLayout is the layout of Markdown templates without an @extends
+// annotation, looked up next to the template. When there is none, the
+// rendered Markdown is wrapped in a plain built-in page.
+const MarkdownLayout = "_markdown.html"
+
+// IsMarkdown reports whether path names a Markdown template.
+func IsMarkdown(path string) bool {
+	return filepath.Ext(path) == ".md"
+}
+
+// IsTemplateFile reports whether path has the extension of a template
+// source: .html, or .md for Markdown.
+func IsTemplateFile(path string) bool {
+	return filepath.Ext(path) == ".html" || IsMarkdown(path)
+}
+
+// The built-in page of Markdown templates without a layout.
+const (
+	markdownHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+</head>
+<body style="margin:0;padding:0;background:#f4f4f5;">
+<table role="presentation" border="0" cellpadding="0" cellspacing="0" width="100%"><tr><td align="center" style="padding:24px 12px;">
+<table role="presentation" border="0" cellpadding="0" cellspacing="0" width="100%" style="max-width:600px;background:#ffffff;"><tr><td style="padding:24px;font-family:Arial, sans-serif;font-size:16px;line-height:1.5;color:#1f2937;">
+`
+	markdownFoot = `</td></tr></table>
+</td></tr></table>
+</body>
+</html>
+`
+)
+
+// renderMarkdown replaces pt.HTML, the Markdown of a .md template without
+// its annotations, with the rendered HTML. Unless the template has a layout,
+// the HTML is a complete page. Annotations keep their place: an @include
+// between two blocks calls the partial between the rendered blocks.
+func renderMarkdown(pt *ParsedTemplate) {
+	srcMap := pt.srcMap
+	r := &mdRenderer{src: pt.HTML, resolve: func(off int) (string, Pos) { return pt.FilePath, srcMap.htmlPos(off) }}
+	page := !slices.ContainsFunc(pt.Annotations, func(a Annotation) bool { return a.Directive == "@extends" }) &&
+		markdownLayout(pt) == nil
+	if page {
+		r.c.synth(markdownHead, 0, r.resolve)
+	}
+	r.blocks(parseBlocks(mdLines(r.src)), false)
+	end := r.c.b.Len()
+	if page {
+		r.c.synth(markdownFoot, len(r.src), r.resolve)
+	}
+	for i, ann := range pt.Annotations {
+		pt.Annotations[i].at = end
+		if k := slices.IndexFunc(r.anchors, func(a mdAnchor) bool { return a.src >= ann.at }); k >= 0 {
+			pt.Annotations[i].at = r.anchors[k].out
+		}
+	}
+	pt.HTML, pt.htmlMap = r.c.b.String(), r.c.segs
+}
+
+// markdownLayout returns an @extends annotation naming the MarkdownLayout
+// next to pt, or nil when there is none.
+func markdownLayout(pt *ParsedTemplate) *Annotation {
+	if _, err := os.Stat(filepath.Join(filepath.Dir(pt.FilePath), MarkdownLayout)); err != nil {
+		return nil
+	}
+	return &Annotation{Directive: "@extends", Args: MarkdownLayout}
+}
+
+// markdownText makes md, the Markdown of pt without its annotations, the
+// plain-text part of pt. The text is the Markdown as written, except that
+// links read "text (url)", images their alt text, backslash escapes their
+// character, and HTML tags and comments are left out. Fenced code is kept
+// as is.
+func markdownText(pt *ParsedTemplate, md string, srcMap sourceMap) {
+	r := &mdRenderer{src: md, resolve: func(off int) (string, Pos) { return pt.FilePath, srcMap.htmlPos(off) }}
+	all := newMDText([]mdLine{{s: md}})
+	lines := mdLines(md)
+	blank := true // the text so far ends with an empty line
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		cols, _ := indentOf(l.s)
+		if ch, n, ok := mdFence(stripIndent(l, cols).s); ok && cols < 4 {
+			end := i + 1
+			for end < len(lines)-1 && !closesFence(lines[end], ch, n) {
+				end++
+			}
+			end = min(end, len(lines)-1)
+			r.c.copy(md, l.off, lines[end].off+len(lines[end].s), r.resolve)
+			r.synth("\n", lines[end].off+len(lines[end].s))
+			i, blank = end, false
+			continue
+		}
+		// Lines of HTML only read as blank lines, and so do the one-line
+		// defines filling blocks of the layout
+		if isBlank(l.s) || onlyTags(l.s) || isDefineLine(l.s) {
+			if !blank {
+				r.synth("\n", l.off)
+			}
+			blank = true
+			continue
+		}
+		r.plain(all, l.off, l.off+len(l.s))
+		r.synth("\n", l.off+len(l.s))
+		blank = false
+	}
+
+	text := r.c.b.String()
+	lead := len(text) - len(strings.TrimLeftFunc(text, unicode.IsSpace))
+	pt.Text = strings.TrimSpace(text)
+	pt.TextFile = pt.FilePath
+	pt.textMap = shiftSegments(r.c.segs, lead)
+	if len(pt.textMap) > 0 {
+		_, pt.TextPos = pt.TextSourcePos(0)
+	}
+}
+
+// shiftSegments returns the segments of composed text with its first lead
+// bytes removed.
+func shiftSegments(segs []htmlSegment, lead int) []htmlSegment {
+	var out []htmlSegment
+	for k, seg := range segs {
+		if k+1 < len(segs) && segs[k+1].html <= lead {
+			continue
+		}
+		if seg.html < lead {
+			if !seg.fixed {
+				seg.off += lead - seg.html
+			}
+			seg.html = lead
+		}
+		seg.html -= lead
+		out = append(out, seg)
+	}
+	return out
+}
+
+// mdLine is a line of Markdown without its line break, possibly without
+// the indentation or markers of the blocks containing it.
+type mdLine struct {
+	s   string
+	off int // offset of s in the Markdown
+}
+
+// mdLines splits md into lines.
+func mdLines(md string) []mdLine {
+	var lines []mdLine
+	for off := 0; off < len(md); {
+		end := strings.IndexByte(md[off:], '\n')
+		if end < 0 {
+			end = len(md)
+		} else {
+			end += off
+		}
+		lines = append(lines, mdLine{s: strings.TrimSuffix(md[off:end], "\r"), off: off})
+		off = end + 1
+	}
+	return lines
+}
+
+// cut returns l without its first n bytes.
+func (l mdLine) cut(n int) mdLine {
+	return mdLine{s: l.s[n:], off: l.off + n}
+}
+
+func isBlank(s string) bool {
+	return strings.TrimSpace(s) == ""
+}
+
+// indentOf returns the columns and bytes of the indentation of s. Tabs
+// advance to the next multiple of four columns.
+func indentOf(s string) (cols, n int) {
+	for n < len(s) {
+		switch s[n] {
+		case ' ':
+			cols++
+		case '\t':
+			cols += 4 - cols%4
+		default:
+			return cols, n
+		}
+		n++
+	}
+	return cols, n
+}
+
+// stripIndent removes up to cols columns of indentation from l. A tab
+// that reaches past cols is removed as a whole.
+func stripIndent(l mdLine, cols int) mdLine {
+	c, n := 0, 0
+	for n < len(l.s) && c < cols {
+		switch l.s[n] {
+		case ' ':
+			c++
+		case '\t':
+			c += 4 - c%4
+		default:
+			return l.cut(n)
+		}
+		n++
+	}
+	return l.cut(n)
+}
+
+// mdBlockKind is the kind of a Markdown block.
+type mdBlockKind int
+
+const (
+	mdParagraph mdBlockKind = iota
+	mdHeading
+	mdRule
+	mdCode
+	mdHTML
+	mdAction // a line of template actions
+	mdQuote
+	mdList
+	mdItem
+)
+
+// mdBlock is a block of a Markdown document.
+type mdBlock struct {
+	kind     mdBlockKind
+	lines    []mdLine   // content of leaf blocks
+	level    int        // of a heading
+	children []*mdBlock // of a quote, list or list item
+	ordered  bool       // list
+	start    string     // first number of an ordered list
+	loose    bool       // list whose items are separated by blank lines
+}
+
+// parseBlocks splits lines into blocks. Blocks start and end as in
+// CommonMark, except that link reference definitions are not supported and
+// that lines of template actions stand on their own.
+func parseBlocks(lines []mdLine) []*mdBlock {
+	var blocks []*mdBlock
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		if isBlank(l.s) {
+			i++
+			continue
+		}
+		cols, _ := indentOf(l.s)
+		if cols >= 4 {
+			b := &mdBlock{kind: mdCode}
+			for ; i < len(lines); i++ {
+				if c, _ := indentOf(lines[i].s); c < 4 && !isBlank(lines[i].s) {
+					break
+				}
+				b.lines = append(b.lines, stripIndent(lines[i], 4))
+			}
+			for isBlank(b.lines[len(b.lines)-1].s) {
+				b.lines = b.lines[:len(b.lines)-1]
+			}
+			blocks = append(blocks, b)
+			continue
+		}
+		t := stripIndent(l, cols)
+		if ch, n, ok := mdFence(t.s); ok {
+			b := &mdBlock{kind: mdCode}
+			for i++; i < len(lines) && !closesFence(lines[i], ch, n); i++ {
+				b.lines = append(b.lines, stripIndent(lines[i], cols))
+			}
+			i++
+			blocks = append(blocks, b)
+			continue
+		}
+		if isRule(t.s) {
+			blocks = append(blocks, &mdBlock{kind: mdRule, lines: []mdLine{t}})
+			i++
+			continue
+		}
+		if level, content, ok := atxHeading(t); ok {
+			blocks = append(blocks, &mdBlock{kind: mdHeading, level: level, lines: []mdLine{content}})
+			i++
+			continue
+		}
+		if strings.HasPrefix(t.s, ">") {
+			var inner []mdLine
+			for ; i < len(lines); i++ {
+				l := lines[i]
+				c, _ := indentOf(l.s)
+				if q := stripIndent(l, c); c < 4 && strings.HasPrefix(q.s, ">") {
+					q = q.cut(1)
+					if strings.HasPrefix(q.s, " ") || strings.HasPrefix(q.s, "\t") {
+						q = q.cut(1)
+					}
+					inner = append(inner, q)
+					continue
+				}
+				// Lazy continuation of a paragraph
+				if isBlank(l.s) || isBlank(inner[len(inner)-1].s) || startsBlock(stripIndent(l, c), true) {
+					break
+				}
+				inner = append(inner, l)
+			}
+			blocks = append(blocks, &mdBlock{kind: mdQuote, children: parseBlocks(inner)})
+			continue
+		}
+		if end, ok := htmlBlock(t.s, false); ok {
+			b := &mdBlock{kind: mdHTML}
+			for ; i < len(lines); i++ {
+				if end == "" && isBlank(lines[i].s) {
+					break
+				}
+				b.lines = append(b.lines, lines[i])
+				if end != "" && strings.Contains(strings.ToLower(lines[i].s), end) {
+					i++
+					break
+				}
+			}
+			blocks = append(blocks, b)
+			continue
+		}
+		if isActionLine(t.s) {
+			blocks = append(blocks, &mdBlock{kind: mdAction, lines: []mdLine{t}})
+			i++
+			continue
+		}
+		if _, ok := listMarker(t.s); ok {
+			blocks = append(blocks, parseList(lines, &i))
+			continue
+		}
+
+		b := &mdBlock{kind: mdParagraph, lines: []mdLine{t}}
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			if isBlank(l.s) {
+				break
+			}
+			c, _ := indentOf(l.s)
+			t := stripIndent(l, c)
+			if c < 4 {
+				if level := setextLevel(t.s); level > 0 {
+					b.kind, b.level = mdHeading, level
+					i++
+					break
+				}
+			}
+			if c < 4 && startsBlock(t, true) {
+				break
+			}
+			b.lines = append(b.lines, t)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// startsBlock reports whether l, without its indentation, starts a block
+// other than a paragraph. Within a paragraph, only blocks that may
+// interrupt it count.
+func startsBlock(l mdLine, inParagraph bool) bool {
+	if _, _, ok := mdFence(l.s); ok {
+		return true
+	}
+	if _, _, ok := atxHeading(l); ok {
+		return true
+	}
+	if _, ok := htmlBlock(l.s, inParagraph); ok {
+		return true
+	}
+	if isRule(l.s) || strings.HasPrefix(l.s, ">") || isActionLine(l.s) {
+		return true
+	}
+	m, ok := listMarker(l.s)
+	return ok && (!inParagraph || (!isBlank(l.s[m.width:]) && (!m.ordered || m.num == "1")))
+}
+
+// parseList parses the list starting at lines[*i] and advances *i past it.
+func parseList(lines []mdLine, i *int) *mdBlock {
+	first, _ := listMarker(stripIndent(lines[*i], 3).s)
+	list := &mdBlock{kind: mdList, ordered: first.ordered, start: first.num}
+	gap := false // a blank line ended the previous item
+	for *i < len(lines) {
+		l := lines[*i]
+		cols, _ := indentOf(l.s)
+		t := stripIndent(l, cols)
+		m, ok := listMarker(t.s)
+		if cols >= 4 || !ok || isRule(t.s) || m.ordered != first.ordered || m.delim != first.delim {
+			break
+		}
+		if gap {
+			list.loose = true
+		}
+		// Content starts after the marker and one to four spaces
+		content := t.cut(m.width)
+		spaces, n := indentOf(content.s)
+		switch {
+		case isBlank(content.s):
+			spaces, content = 1, content.cut(len(content.s))
+		case spaces > 4:
+			spaces, content = 1, content.cut(1)
+		default:
+			content = content.cut(n)
+		}
+		indent := cols + m.width + spaces
+		inner := []mdLine{content}
+		for *i++; *i < len(lines); *i++ {
+			l := lines[*i]
+			if isBlank(l.s) {
+				inner = append(inner, mdLine{off: l.off})
+				continue
+			}
+			c, _ := indentOf(l.s)
+			if c >= indent {
+				inner = append(inner, stripIndent(l, indent))
+				continue
+			}
+			// The next item of the list, even one that could not interrupt a
+			// paragraph, such as 2.
+			if next, ok := listMarker(stripIndent(l, c).s); ok && c < 4 && next.ordered == first.ordered && next.delim == first.delim {
+				break
+			}
+			// Lazy continuation of a paragraph
+			if isBlank(inner[len(inner)-1].s) || c >= 4 || startsBlock(stripIndent(l, c), true) {
+				break
+			}
+			inner = append(inner, stripIndent(l, c))
+		}
+		n = len(inner)
+		for n > 1 && isBlank(inner[n-1].s) {
+			n--
+		}
+		gap = n < len(inner)
+		item := &mdBlock{kind: mdItem, children: parseBlocks(inner[:n])}
+		if len(item.children) > 1 && slices.ContainsFunc(inner[1:n], func(l mdLine) bool { return isBlank(l.s) }) {
+			list.loose = true
+		}
+		list.children = append(list.children, item)
+	}
+	return list
+}
+
+// mdMarker is a list item marker such as "-" or "2.".
+type mdMarker struct {
+	ordered bool
+	delim   byte   // '-', '+' or '*', or '.' or ')' after the number
+	num     string // number of an ordered item
+	width   int
+}
+
+// listMarker returns the list item marker at the start of s.
+func listMarker(s string) (mdMarker, bool) {
+	var m mdMarker
+	if s != "" && strings.IndexByte("-+*", s[0]) >= 0 {
+		m = mdMarker{delim: s[0], width: 1}
+	} else {
+		n := 0
+		for n < len(s) && n < 9 && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		if n == 0 || n >= len(s) || (s[n] != '.' && s[n] != ')') {
+			return m, false
+		}
+		m = mdMarker{ordered: true, delim: s[n], num: strings.TrimLeft(s[:n], "0"), width: n + 1}
+		if m.num == "" {
+			m.num = "0"
+		}
+	}
+	if m.width < len(s) && s[m.width] != ' ' && s[m.width] != '\t' {
+		return m, false
+	}
+	return m, true
+}
+
+// mdFence returns the character and length of the code fence opening s.
+func mdFence(s string) (byte, int, bool) {
+	if s == "" || (s[0] != '`' && s[0] != '~') {
+		return 0, 0, false
+	}
+	n := 0
+	for n < len(s) && s[n] == s[0] {
+		n++
+	}
+	if n < 3 || (s[0] == '`' && strings.IndexByte(s[n:], '`') >= 0) {
+		return 0, 0, false
+	}
+	return s[0], n, true
+}
+
+// closesFence reports whether l closes a code fence of n characters ch.
+func closesFence(l mdLine, ch byte, n int) bool {
+	cols, _ := indentOf(l.s)
+	if cols >= 4 {
+		return false
+	}
+	s := strings.TrimRight(stripIndent(l, cols).s, " \t")
+	return len(s) >= n && strings.Trim(s, string(ch)) == ""
+}
+
+// isRule reports whether s is a thematic break such as "---" or "* * *".
+func isRule(s string) bool {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.IndexByte("-*_", s[0]) < 0 {
+		return false
+	}
+	n := 0
+	for _, c := range s {
+		switch {
+		case c == rune(s[0]):
+			n++
+		case c != ' ' && c != '\t':
+			return false
+		}
+	}
+	return n >= 3
+}
+
+// atxHeading returns the level and content of the heading "## Title" at l.
+func atxHeading(l mdLine) (int, mdLine, bool) {
+	level := 0
+	for level < len(l.s) && l.s[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || (level < len(l.s) && l.s[level] != ' ' && l.s[level] != '\t') {
+		return 0, l, false
+	}
+	content := l.cut(level)
+	_, n := indentOf(content.s)
+	content = content.cut(n)
+	s := strings.TrimRight(content.s, " \t")
+	// An optional closing sequence of #s after a space
+	if trimmed := strings.TrimRight(s, "#"); trimmed == "" || strings.HasSuffix(trimmed, " ") || strings.HasSuffix(trimmed, "\t") {
+		s = strings.TrimRight(trimmed, " \t")
+	}
+	content.s = s
+	return level, content, true
+}
+
+// setextLevel returns 1 or 2 when s underlines a heading with = or -.
+func setextLevel(s string) int {
+	s = strings.TrimRight(s, " \t")
+	switch {
+	case s == "":
+		return 0
+	case strings.Trim(s, "=") == "":
+		return 1
+	case strings.Trim(s, "-") == "":
+		return 2
+	}
+	return 0
+}
+
+// htmlBlockTags are the elements that start an HTML block even when they
+// interrupt a paragraph, besides the components.
+var htmlBlockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "body": true, "caption": true,
+	"center": true, "col": true, "colgroup": true, "dd": true, "details": true, "div": true, "dl": true,
+	"dt": true, "fieldset": true, "figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "head": true, "header": true,
+	"hr": true, "html": true, "li": true, "link": true, "main": true, "meta": true, "nav": true, "ol": true,
+	"p": true, "section": true, "summary": true, "table": true, "tbody": true, "td": true, "tfoot": true,
+	"th": true, "thead": true, "title": true, "tr": true, "ul": true,
+}
+
+// htmlBlock reports whether s starts an HTML block, and returns the text
+// ending it, or "" for a block ending at a blank line. Within a paragraph
+// only comments and block-level elements start one; elsewhere so does a
+// line holding a single tag.
+func htmlBlock(s string, inParagraph bool) (end string, ok bool) {
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(s, "<!--"):
+		return "-->", true
+	case !strings.HasPrefix(s, "<"):
+		return "", false
+	}
+	for _, tag := range []string{"pre", "script", "style", "textarea"} {
+		if strings.HasPrefix(lower, "<"+tag) && (len(s) == len(tag)+1 || strings.IndexByte(" \t>", s[len(tag)+1]) >= 0) {
+			return "</" + tag + ">", true
+		}
+	}
+	name := strings.TrimPrefix(lower, "<")
+	name = strings.TrimPrefix(name, "/")
+	n := componentNameLen(name)
+	if n == 0 {
+		return "", false
+	}
+	if rest := name[n:]; rest != "" && strings.IndexByte(" \t>/", rest[0]) < 0 {
+		return "", false
+	}
+	if htmlBlockTags[name[:n]] || strings.HasPrefix(name, ComponentPrefix) {
+		return "", true
+	}
+	// Any other tag alone on its line
+	if n := htmlTagLen(s, 0, len(s)); !inParagraph && n > 0 && isBlank(s[n:]) {
+		return "", true
+	}
+	return "", false
+}
+
+// isActionLine reports whether s holds template actions only, such as
+// "{{range .Items}}" or "{{end}}", which stay outside paragraphs. Actions
+// printing a value, as in "{{name}}", are text of a paragraph instead. A
+// one-line "{{define "title"}}...{{end}}" is an action line too.
+func isActionLine(s string) bool {
+	s = strings.TrimSpace(s)
+	acts := scanActions(s)
+	if len(acts) == 0 || acts[0].start != 0 || acts[len(acts)-1].end != len(s) {
+		return false
+	}
+	if isDefineLine(s) {
+		return true
+	}
+	last := 0
+	for _, a := range acts {
+		if !isBlank(s[last:a.start]) {
+			return false
+		}
+		switch a.keyword {
+		case "if", "else", "range", "with", "end", "define", "block", "template", "break", "continue":
+		default:
+			if !strings.HasPrefix(a.args, "/*") {
+				return false
+			}
+		}
+		last = a.end
+	}
+	return true
+}
+
+// isDefineLine reports whether s is a one-line {{define}} or {{block}},
+// such as "{{define "title"}}Welcome{{end}}".
+func isDefineLine(s string) bool {
+	s = strings.TrimSpace(s)
+	acts := scanActions(s)
+	return len(acts) >= 2 && acts[0].start == 0 && acts[len(acts)-1].end == len(s) &&
+		(acts[0].keyword == "define" || acts[0].keyword == "block") && acts[len(acts)-1].keyword == "end"
+}
+
+// mdText is the inline content of a block, gathered from its lines, with
+// the Markdown offset of every byte.
+type mdText struct {
+	s    string
+	offs []int // len(s)+1 offsets
+}
+
+// newMDText joins lines with line breaks.
+func newMDText(lines []mdLine) mdText {
+	var t mdText
+	var b strings.Builder
+	for k, l := range lines {
+		if k > 0 {
+			b.WriteByte('\n')
+			t.offs = append(t.offs, lines[k-1].off+len(lines[k-1].s))
+		}
+		b.WriteString(l.s)
+		for j := range len(l.s) {
+			t.offs = append(t.offs, l.off+j)
+		}
+	}
+	if n := len(lines); n > 0 {
+		t.offs = append(t.offs, lines[n-1].off+len(lines[n-1].s))
+	}
+	t.s = b.String()
+	return t
+}
+
+// mdAnchor records that output from out on was made for Markdown from src
+// on.
+type mdAnchor struct {
+	src, out int
+}
+
+// mdRenderer writes HTML or plain text for Markdown, keeping track of the
+// Markdown each piece comes from.
+type mdRenderer struct {
+	src     string
+	resolve func(off int) (string, Pos) // locates offsets of src
+	c       composer
+	anchors []mdAnchor
+}
+
+// copy appends t.s[from:to].
+func (r *mdRenderer) copy(t mdText, from, to int) {
+	if from >= to {
+		return
+	}
+	r.anchors = append(r.anchors, mdAnchor{src: t.offs[from], out: r.c.b.Len()})
+	r.c.copy(t.s, from, to, func(off int) (string, Pos) { return r.resolve(t.offs[off]) })
+}
+
+// synth appends generated text made for offset at of the Markdown.
+func (r *mdRenderer) synth(text string, at int) {
+	r.anchors = append(r.anchors, mdAnchor{src: at, out: r.c.b.Len()})
+	r.c.synth(text, at, r.resolve)
+}
+
+// blocks renders bs. In tight list items paragraphs are not wrapped in
+// <p> elements.
+func (r *mdRenderer) blocks(bs []*mdBlock, tight bool) {
+	for k, b := range bs {
+		at := r.blockStart(b)
+		switch b.kind {
+		case mdParagraph:
+			t := paragraphText(b.lines)
+			if tight {
+				r.inline(t, 0, len(t.s))
+				if k < len(bs)-1 {
+					r.synth("\n", t.offs[len(t.s)])
+				}
+				continue
+			}
+			r.synth("<p>", at)
+			r.inline(t, 0, len(t.s))
+			r.synth("</p>\n", t.offs[len(t.s)])
+		case mdHeading:
+			t := paragraphText(b.lines)
+			tag := "h" + string(rune('0'+b.level))
+			r.synth("<"+tag+">", at)
+			r.inline(t, 0, len(t.s))
+			r.synth("</"+tag+">\n", t.offs[len(t.s)])
+		case mdRule:
+			r.synth("<hr>\n", at)
+		case mdCode:
+			r.synth("<pre><code>", at)
+			for _, l := range b.lines {
+				t := newMDText([]mdLine{l})
+				r.escaped(t, 0, len(t.s), true)
+				r.synth("\n", t.offs[len(t.s)])
+			}
+			r.synth("</code></pre>\n", at)
+		case mdHTML, mdAction:
+			t := newMDText(b.lines)
+			if b.kind == mdAction {
+				r.inline(t, 0, len(t.s))
+			} else {
+				r.copy(t, 0, len(t.s))
+			}
+			r.synth("\n", t.offs[len(t.s)])
+		case mdQuote:
+			r.synth("<blockquote>\n", at)
+			r.blocks(b.children, false)
+			r.synth("</blockquote>\n", at)
+		case mdList:
+			switch {
+			case !b.ordered:
+				r.synth("<ul>\n", at)
+			case b.start != "1":
+				r.synth(`<ol start="`+b.start+`">`+"\n", at)
+			default:
+				r.synth("<ol>\n", at)
+			}
+			for _, item := range b.children {
+				r.synth("<li>", r.blockStart(item))
+				if len(item.children) > 0 && (b.loose || item.children[0].kind != mdParagraph) {
+					r.synth("\n", r.blockStart(item))
+				}
+				r.blocks(item.children, !b.loose)
+				r.synth("</li>\n", r.blockStart(item))
+			}
+			if b.ordered {
+				r.synth("</ol>\n", at)
+			} else {
+				r.synth("</ul>\n", at)
+			}
+		}
+	}
+}
+
+// blockStart returns the Markdown offset of the first line of b.
+func (r *mdRenderer) blockStart(b *mdBlock) int {
+	for len(b.lines) == 0 && len(b.children) > 0 {
+		b = b.children[0]
+	}
+	if len(b.lines) == 0 {
+		return 0
+	}
+	return b.lines[0].off
+}
+
+// paragraphText returns the inline content of the lines of a paragraph or
+// heading.
+func paragraphText(lines []mdLine) mdText {
+	lines = slices.Clone(lines)
+	last := &lines[len(lines)-1]
+	last.s = strings.TrimRight(last.s, " \t")
+	return newMDText(lines)
+}
+
+// escaped appends t.s[from:to] with the characters special in HTML escaped.
+// Template actions are copied as they are, and so are entity references
+// outside code.
+func (r *mdRenderer) escaped(t mdText, from, to int, code bool) {
+	last := from
+	for i := from; i < to; {
+		var rep string
+		switch c := t.s[i]; {
+		case strings.HasPrefix(t.s[i:to], "{{"):
+			if end := ActionEnd(t.s, i+2); end >= 0 && end <= to {
+				i = end
+				continue
+			}
+		case c == '&':
+			if n := entityLen(t.s[i:to]); n > 0 && !code {
+				i += n
+				continue
+			}
+			rep = "&amp;"
+		case c == '<':
+			rep = "&lt;"
+		case c == '>':
+			rep = "&gt;"
+		case c == '"':
+			rep = "&quot;"
+		}
+		if rep == "" {
+			i++
+			continue
+		}
+		r.copy(t, last, i)
+		r.synth(rep, t.offs[i])
+		i++
+		last = i
+	}
+	r.copy(t, last, to)
+}
+
+// attr appends t.s[from:to] as an attribute value: backslash escapes are
+// resolved and the result escaped.
+func (r *mdRenderer) attr(t mdText, from, to int) {
+	last := from
+	for i := from; i < to; i++ {
+		if t.s[i] == '\\' && i+1 < to && isASCIIPunct(t.s[i+1]) {
+			r.escaped(t, last, i, false)
+			last = i + 1
+			i++
+		}
+	}
+	r.escaped(t, last, to, false)
+}
+
+// inline renders t.s[from:to] as inline Markdown: code spans, emphasis,
+// links, images, autolinks, raw HTML, and hard line breaks. Template
+// actions are copied as they are wherever they appear.
+func (r *mdRenderer) inline(t mdText, from, to int) {
+	s := t.s
+	last := from // start of the text not yet written
+	flush := func(i int) {
+		r.escaped(t, last, i, false)
+	}
+	for i := from; i < to; {
+		c := s[i]
+		switch {
+		case strings.HasPrefix(s[i:to], "{{"):
+			if end := ActionEnd(s, i+2); end >= 0 && end <= to {
+				i = end
+				continue
+			}
+		case c == '\\' && i+1 < to && s[i+1] == '\n':
+			flush(i)
+			r.synth("<br>", t.offs[i])
+			i++
+			last = i
+			continue
+		case c == '\\' && i+1 < to && isASCIIPunct(s[i+1]):
+			flush(i)
+			r.escaped(t, i+1, i+2, true)
+			i += 2
+			last = i
+			continue
+		case c == '\n':
+			// Two or more spaces before a line break make a hard break
+			j := i
+			for j > last && s[j-1] == ' ' {
+				j--
+			}
+			flush(j)
+			if i-j >= 2 {
+				r.synth("<br>", t.offs[j])
+			}
+			last = i
+		case c == '`':
+			n := runLen(s, i, to)
+			end := codeSpanEnd(s, i+n, to, n)
+			if end < 0 {
+				i += n
+				continue
+			}
+			flush(i)
+			a, b := i+n, end
+			if b-a >= 2 && s[a] == ' ' && s[b-1] == ' ' && !isBlank(s[a:b]) {
+				a, b = a+1, b-1
+			}
+			r.synth("<code>", t.offs[i])
+			r.escaped(t, a, b, true)
+			r.synth("</code>", t.offs[end])
+			i = end + n
+			last = i
+			continue
+		case c == '!' && i+1 < to && s[i+1] == '[':
+			if l, ok := parseLink(s, i+1, to); ok {
+				flush(i)
+				r.synth(`<img src="`, t.offs[i])
+				r.attr(t, l.dest[0], l.dest[1])
+				r.synth(`" alt="`, t.offs[l.text[0]])
+				r.attr(t, l.text[0], l.text[1])
+				r.title(t, l)
+				r.synth(`">`, t.offs[l.end-1])
+				i = l.end
+				last = i
+				continue
+			}
+		case c == '[':
+			if l, ok := parseLink(s, i, to); ok {
+				flush(i)
+				r.synth(`<a href="`, t.offs[i])
+				r.attr(t, l.dest[0], l.dest[1])
+				r.title(t, l)
+				r.synth(`">`, t.offs[l.text[0]])
+				r.inline(t, l.text[0], l.text[1])
+				r.synth("</a>", t.offs[l.text[1]])
+				i = l.end
+				last = i
+				continue
+			}
+		case c == '<':
+			if n, mailto := autolinkLen(s[i:to]); n > 0 {
+				flush(i)
+				href := `<a href="`
+				if mailto {
+					href += "mailto:"
+				}
+				r.synth(href, t.offs[i])
+				r.escaped(t, i+1, i+n-1, false)
+				r.synth(`">`, t.offs[i])
+				r.escaped(t, i+1, i+n-1, false)
+				r.synth("</a>", t.offs[i+n-1])
+				i += n
+				last = i
+				continue
+			}
+			if n := htmlTagLen(s, i, to); n > 0 {
+				flush(i)
+				r.copy(t, i, i+n)
+				i += n
+				last = i
+				continue
+			}
+		case c == '*' || c == '_':
+			n := runLen(s, i, to)
+			if open, close, k := emphasis(s, i, to, n); k > 0 {
+				flush(open)
+				tags := [...]string{1: "em", 2: "strong"}
+				if k == 3 {
+					r.synth("<em><strong>", t.offs[open])
+					r.inline(t, open+k, close)
+					r.synth("</strong></em>", t.offs[close])
+				} else {
+					r.synth("<"+tags[k]+">", t.offs[open])
+					r.inline(t, open+k, close)
+					r.synth("</"+tags[k]+">", t.offs[close])
+				}
+				i = close + k
+				last = i
+				continue
+			}
+			i += n
+			continue
+		}
+		i++
+	}
+	flush(to)
+}
+
+// title appends the title attribute of link l, if it has one.
+func (r *mdRenderer) title(t mdText, l mdLink) {
+	if l.title[1] > l.title[0] {
+		r.synth(`" title="`, t.offs[l.title[0]])
+		r.attr(t, l.title[0], l.title[1])
+	}
+}
+
+// plain appends t.s[from:to] as plain text: links become "text (url)",
+// images their alt text, backslash escapes their character, and HTML tags
+// and comments are left out.
+func (r *mdRenderer) plain(t mdText, from, to int) {
+	s := t.s
+	last := from
+	for i := from; i < to; {
+		c := s[i]
+		switch {
+		case strings.HasPrefix(s[i:to], "{{"):
+			if end := ActionEnd(s, i+2); end >= 0 && end <= to {
+				i = end
+				continue
+			}
+		case c == '\\' && i+1 < to && isASCIIPunct(s[i+1]):
+			r.copy(t, last, i)
+			last = i + 1
+			i += 2
+			continue
+		case c == '`':
+			// Code spans are kept as written
+			n := runLen(s, i, to)
+			if end := codeSpanEnd(s, i+n, to, n); end >= 0 {
+				i = end + n
+				continue
+			}
+			i += n
+			continue
+		case c == '!' && i+1 < to && s[i+1] == '[':
+			if l, ok := parseLink(s, i+1, to); ok {
+				r.copy(t, last, i)
+				r.plain(t, l.text[0], l.text[1])
+				i = l.end
+				last = i
+				continue
+			}
+		case c == '[':
+			if l, ok := parseLink(s, i, to); ok {
+				r.copy(t, last, i)
+				r.plain(t, l.text[0], l.text[1])
+				if s[l.text[0]:l.text[1]] != s[l.dest[0]:l.dest[1]] && l.dest[1] > l.dest[0] {
+					r.synth(" (", t.offs[l.dest[0]])
+					r.copy(t, l.dest[0], l.dest[1])
+					r.synth(")", t.offs[l.dest[1]])
+				}
+				i = l.end
+				last = i
+				continue
+			}
+		case c == '<':
+			if n, _ := autolinkLen(s[i:to]); n > 0 {
+				r.copy(t, last, i)
+				r.copy(t, i+1, i+n-1)
+				i += n
+				last = i
+				continue
+			}
+			n := htmlTagLen(s, i, to)
+			if strings.HasPrefix(s[i:to], "<!--") {
+				if end := strings.Index(s[i:to], "-->"); end >= 0 {
+					n = end + len("-->")
+				}
+			}
+			if n > 0 {
+				r.copy(t, last, i)
+				i += n
+				last = i
+				continue
+			}
+		}
+		i++
+	}
+	r.copy(t, last, to)
+}
+
+// mdLink is a parsed inline link or image: [text](dest "title"). The spans
+// are offsets into the text.
+type mdLink struct {
+	text, dest, title [2]int
+	end               int
+}
+
+// parseLink parses the inline link whose text opens with "[" at s[i].
+// Reference links are not supported.
+func parseLink(s string, i, to int) (mdLink, bool) {
+	var l mdLink
+	depth := 0
+	j := i
+	for ; j < to; j++ {
+		switch s[j] {
+		case '\\':
+			j++
+			continue
+		case '`':
+			n := runLen(s, j, to)
+			if end := codeSpanEnd(s, j+n, to, n); end >= 0 {
+				j = end + n - 1
+			} else {
+				j += n - 1
+			}
+			continue
+		case '{':
+			if strings.HasPrefix(s[j:to], "{{") {
+				if end := ActionEnd(s, j+2); end >= 0 && end <= to {
+					j = end - 1
+				}
+			}
+			continue
+		case '[':
+			depth++
+			continue
+		case ']':
+			depth--
+		default:
+			continue
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	if j+1 >= to || s[j+1] != '(' {
+		return l, false
+	}
+	l.text = [2]int{i + 1, j}
+	j = skipLinkSpace(s, j+2, to)
+
+	// Destination, in angle brackets or up to white space
+	if j < to && s[j] == '<' {
+		end := strings.IndexAny(s[j+1:to], ">\n")
+		if end < 0 || s[j+1+end] != '>' {
+			return l, false
+		}
+		l.dest = [2]int{j + 1, j + 1 + end}
+		j += end + 2
+	} else {
+		start, parens := j, 0
+	dest:
+		for j < to {
+			switch c := s[j]; {
+			case strings.HasPrefix(s[j:to], "{{"):
+				end := ActionEnd(s, j+2)
+				if end < 0 || end > to {
+					return l, false
+				}
+				j = end
+				continue
+			case c == '\\' && j+1 < to:
+				j += 2
+				continue
+			case c == '(':
+				parens++
+			case c == ')':
+				if parens == 0 {
+					break dest
+				}
+				parens--
+			case c <= ' ':
+				break dest
+			}
+			j++
+		}
+		l.dest = [2]int{start, j}
+	}
+
+	// Optional title after white space
+	if k := skipLinkSpace(s, j, to); k > j && k < to && strings.IndexByte(`"'(`, s[k]) >= 0 {
+		closer := s[k]
+		if closer == '(' {
+			closer = ')'
+		}
+		end := strings.IndexByte(s[k+1:to], closer)
+		if end < 0 {
+			return l, false
+		}
+		l.title = [2]int{k + 1, k + 1 + end}
+		j = k + end + 2
+	}
+	j = skipLinkSpace(s, j, to)
+	if j >= to || s[j] != ')' {
+		return l, false
+	}
+	l.end = j + 1
+	return l, true
+}
+
+// skipLinkSpace skips white space, including at most one line break.
+func skipLinkSpace(s string, i, to int) int {
+	lines := 0
+	for i < to && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n') {
+		if s[i] == '\n' {
+			if lines++; lines > 1 {
+				break
+			}
+		}
+		i++
+	}
+	return i
+}
+
+// onlyTags reports whether s holds HTML tags and comments only.
+func onlyTags(s string) bool {
+	for i := 0; i < len(s); {
+		if isSpaceByte(s[i]) {
+			i++
+			continue
+		}
+		n := htmlTagLen(s, i, len(s))
+		if n == 0 {
+			return false
+		}
+		i += n
+	}
+	return true
+}
+
+// runLen returns the number of times s[i] repeats from i on.
+func runLen(s string, i, to int) int {
+	n := 1
+	for i+n < to && s[i+n] == s[i] {
+		n++
+	}
+	return n
+}
+
+// codeSpanEnd returns the offset of the run of n backticks closing a code
+// span whose content starts at i, or -1.
+func codeSpanEnd(s string, i, to, n int) int {
+	for i < to {
+		j := strings.IndexByte(s[i:to], '`')
+		if j < 0 {
+			return -1
+		}
+		j += i
+		m := runLen(s, j, to)
+		if m == n {
+			return j
+		}
+		i = j + m
+	}
+	return -1
+}
+
+// emphasis finds the closing delimiter of the run of n emphasis characters
+// at s[i]. It returns the delimiters used, k of them, from open and from
+// close: 1 for <em>, 2 for <strong> and 3 for both. k is 0 when the run
+// does not open emphasis.
+func emphasis(s string, i, to, n int) (open, close, k int) {
+	ch := s[i]
+	after := i + n
+	if after >= to || isSpaceByte(s[after]) || (ch == '_' && i > 0 && isAlnum(s[i-1])) {
+		return 0, 0, 0
+	}
+	for k = min(n, 3); k > 0; k-- {
+		for j := after; j < to; {
+			switch {
+			case strings.HasPrefix(s[j:to], "{{"):
+				if end := ActionEnd(s, j+2); end >= 0 && end <= to {
+					j = end
+					continue
+				}
+			case s[j] == '\\':
+				j += 2
+				continue
+			case s[j] == '`':
+				m := runLen(s, j, to)
+				if end := codeSpanEnd(s, j+m, to, m); end >= 0 {
+					j = end + m
+					continue
+				}
+				j += m
+				continue
+			case s[j] == ch:
+				m := runLen(s, j, to)
+				closing := !isSpaceByte(s[j-1]) && (ch == '*' || j+m >= to || !isAlnum(s[j+m]))
+				// A pair inside single emphasis is strong emphasis, not the end
+				if closing && m >= k && (k != 1 || m != 2) {
+					return i + n - k, j, k
+				}
+				j += m
+				continue
+			}
+			j++
+		}
+	}
+	return 0, 0, 0
+}
+
+// autolinkLen returns the length of the autolink such as
+// <https://example.com> at the start of s, and whether it is an email
+// address.
+func autolinkLen(s string) (int, bool) {
+	end := strings.IndexByte(s, '>')
+	if end < 0 || !strings.HasPrefix(s, "<") {
+		return 0, false
+	}
+	inner := s[1:end]
+	if inner == "" || strings.ContainsAny(inner, " \t\n<") || strings.Contains(inner, "{{") && !strings.Contains(inner, "}}") {
+		return 0, false
+	}
+	if scheme, _, ok := strings.Cut(inner, ":"); ok && len(scheme) >= 2 && len(scheme) <= 32 && isLetter(scheme[0]) &&
+		strings.Trim(scheme, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+.-") == "" {
+		return end + 1, false
+	}
+	if local, domain, ok := strings.Cut(inner, "@"); ok && local != "" && strings.Contains(domain, ".") && !strings.ContainsAny(domain, "@/") {
+		return end + 1, true
+	}
+	return 0, false
+}
+
+// htmlTagLen returns the length of the HTML tag or comment at s[i], or 0.
+func htmlTagLen(s string, i, to int) int {
+	rest := s[i:to]
+	if strings.HasPrefix(rest, "<!--") {
+		if end := strings.Index(rest[4:], "-->"); end >= 0 {
+			return 4 + end + 3
+		}
+		return 0
+	}
+	j := 1
+	if strings.HasPrefix(rest[j:], "/") {
+		j++
+	}
+	if j >= len(rest) || !isLetter(rest[j]) {
+		return 0
+	}
+	for j < len(rest) {
+		switch c := rest[j]; {
+		case c == '>':
+			return j + 1
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(rest[j+1:], c)
+			if end < 0 {
+				return 0
+			}
+			j += end + 2
+		case strings.HasPrefix(rest[j:], "{{"):
+			end := ActionEnd(s, i+j+2)
+			if end < 0 || end > to {
+				return 0
+			}
+			j = end - i
+		case c == '<':
+			return 0
+		default:
+			j++
+		}
+	}
+	return 0
+}
+
+// entityLen returns the length of the entity reference such as &amp; or
+// &#39; at the start of s, or 0.
+func entityLen(s string) int {
+	n := 1
+	switch {
+	case strings.HasPrefix(s, "&#x") || strings.HasPrefix(s, "&#X"):
+		n = 3
+		for n < len(s) && n < 9 && strings.IndexByte("0123456789abcdefABCDEF", s[n]) >= 0 {
+			n++
+		}
+		if n == 3 {
+			return 0
+		}
+	case strings.HasPrefix(s, "&#"):
+		n = 2
+		for n < len(s) && n < 9 && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		if n == 2 {
+			return 0
+		}
+	default:
+		for n < len(s) && n < 33 && isAlnum(s[n]) {
+			n++
+		}
+		if n == 1 {
+			return 0
+		}
+	}
+	if n < len(s) && s[n] == ';' {
+		return n + 1
+	}
+	return 0
+}
+
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isAlnum(c byte) bool {
+	return isLetter(c) || c >= '0' && c <= '9'
+}
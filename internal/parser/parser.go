@@ -1,43 +1,51 @@
 package parser
 
 import (
-	"bufio"
 	"bytes"
+	"cmp"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"unicode"
 
+	"github.com/elliot40404/mailc/internal/diag"
 	"github.com/elliot40404/mailc/internal/util"
 )
 
-// inferSimpleVariables scans the subject and HTML body for simple template
-// variables like {{var}} and, if not already declared via @type, records them
-// as top-level variables of type string.
+// inferSimpleVariables scans the subject, HTML and text bodies for simple
+// template variables like {{var}} and, if not already declared via @type,
+// records them as top-level variables of type string.
 func inferSimpleVariables(pt *ParsedTemplate) {
 	// Build a set of existing variable names for quick lookup
 	existing := map[string]struct{}{}
 	for _, v := range pt.Variables {
 		existing[v.Name] = struct{}{}
 	}
-	// Extract from subject and HTML
-	candidates := make(map[string]struct{})
-	for _, m := range reSimpleVar.FindAllStringSubmatch(pt.Subject, -1) {
-		if len(m) > 1 {
-			candidates[m[1]] = struct{}{}
-		}
-	}
-	for _, m := range reSimpleVar.FindAllStringSubmatch(pt.HTML, -1) {
-		if len(m) > 1 {
-			candidates[m[1]] = struct{}{}
+	// Extract from subject and HTML, in order of first use
+	var candidates []string
+	seen := make(map[string]struct{})
+	for _, text := range []string{pt.Subject, pt.HTML, pt.Text} {
+		for _, m := range reSimpleVar.FindAllStringSubmatch(text, -1) {
+			if _, ok := seen[m[1]]; !ok {
+				seen[m[1]] = struct{}{}
+				candidates = append(candidates, m[1])
+			}
 		}
 	}
 	// Add missing as string-typed variables
-	for name := range candidates {
+	for _, name := range candidates {
 		if _, ok := existing[name]; ok {
 			continue
 		}
+		// Skip bare template keywords such as {{end}} and {{else}}
+		if _, ok := templateKeywords[name]; ok {
+			continue
+		}
 		// Skip names that collide with declared structs (since they would be ambiguous)
 		collision := false
 		for _, s := range pt.Structs {
@@ -61,16 +69,121 @@ type ParsedTemplate struct {
 	Structs   []ParsedStruct
 	Types     []ParsedType
 	Variables []ParsedVariable
+	// SubjectPos is the position of the subject text in FilePath.
+	SubjectPos Pos
+	// Text is the plain-text template, from a $Text annotation, the
+	// sibling text file (name.txt) or the source of a Markdown template. It
+	// is empty when the plain-text part is to be derived from the rendered
+	// HTML.
+	Text string
+	// TextFile is the file Text was read from and TextPos the position of
+	// its first byte there.
+	TextFile string
+	TextPos  Pos
+	// Annotations lists every annotation in source order with its position.
+	Annotations []Annotation
+	// Examples lists the sample values of @example annotations in source
+	// order. Together they form the "default" sample data scenario.
+	Examples []Example
+	// Fixtures lists the named scenarios of the sibling fixtures file
+	// (name.fixtures.json) in file order.
+	Fixtures []Fixture
+	// FixturesFile is the path of the fixtures file, if there is one.
+	FixturesFile string
+	// Layout is the layout named by an @extends annotation, or nil. HTML
+	// then holds the layout with its blocks filled in by the template, and
+	// the data declared in the layout is part of the template's data.
+	Layout *ParsedTemplate
+	// Partials lists the partials called from HTML, directly or through
+	// the layout or other partials, in order of first use.
+	Partials []*Partial
+	// InlineCSS is set by an @inline-css annotation, here or in the layout:
+	// the rules of its <style> elements are moved into style attributes at
+	// generate time.
+	InlineCSS bool
+	// KeptComments is set when HTML calls CommentFunc to emit comments
+	// such as Outlook conditional comments, here or in the layout.
+	KeptComments bool
+	// Imports lists the Go packages of @import annotations, including
+	// those of the layout, whose types fields and variables may use.
+	Imports []Import
+	// Diagnostics holds the problems found while parsing the template.
+	Diagnostics diag.List
+
+	srcMap  sourceMap
+	htmlMap []htmlSegment // set when HTML is rebuilt for a layout or partials
+	textMap []htmlSegment // set when Text is made from Markdown
+}
+
+// SourcePos returns the file and position of byte offset off in HTML. The
+// file is FilePath, or a layout for text that comes from one.
+func (pt *ParsedTemplate) SourcePos(off int) (string, Pos) {
+	return resolveHTML(pt.FilePath, pt.srcMap, pt.htmlMap, off)
+}
+
+// TextSourcePos returns the file and position of byte offset off in Text.
+func (pt *ParsedTemplate) TextSourcePos(off int) (string, Pos) {
+	if pt.textMap != nil {
+		return resolveHTML(pt.TextFile, sourceMap{}, pt.textMap, off)
+	}
+	pos := pt.TextPos
+	if nl := strings.LastIndexByte(pt.Text[:off], '\n'); nl >= 0 {
+		pos.Line += strings.Count(pt.Text[:off], "\n")
+		pos.Col = off - nl
+	} else {
+		pos.Col += off
+	}
+	return pt.TextFile, pos
+}
+
+// resolveHTML locates offset off of HTML extracted from file by srcMap and,
+// if set, rebuilt as recorded by htmlMap.
+func resolveHTML(file string, srcMap sourceMap, htmlMap []htmlSegment, off int) (string, Pos) {
+	if htmlMap == nil {
+		return file, srcMap.htmlPos(off)
+	}
+	i := sort.Search(len(htmlMap), func(i int) bool { return htmlMap[i].html > off })
+	if i == 0 {
+		return file, Pos{}
+	}
+	seg := htmlMap[i-1]
+	if seg.fixed {
+		return seg.resolve(seg.off)
+	}
+	return seg.resolve(seg.off + off - seg.html)
 }
 
 type ParsedStruct struct {
-	Name   string
+	Name string
+	// Root is the name of a struct at the root of the data as written in
+	// its @type annotation, such as cta for @type cta.Label. Templates refer
+	// to the struct by this name; Name is the Go field and type name.
+	Root   string
 	Fields []ParsedField
+	Pos    Pos // first declaration
+	// TypeOnly is set when the struct is only used as the type of another
+	// field or variable (e.g. the element of []Item) and therefore does not
+	// become a field of the template's root data struct.
+	TypeOnly bool
+	// Shared is set for structs declared in the TypesFile and used through
+	// @shared; they are emitted once for all templates, without a prefix.
+	Shared bool
 }
 
 type ParsedField struct {
-	Name string
-	Type string
+	Name    string
+	Type    string // e.g. "string", "[]string", "[]Item"
+	IsSlice bool
+	Pos     Pos
+}
+
+// Import is a Go package imported with @import, as in
+// @import billing github.com/acme/app/billing.
+type Import struct {
+	Alias string // package name types are qualified with
+	Path  string
+	File  string // FilePath, or the layout declaring the import
+	Pos   Pos
 }
 
 type ParsedType struct {
@@ -78,122 +191,601 @@ type ParsedType struct {
 }
 
 type ParsedVariable struct {
+	Name    string
+	Type    string
+	IsSlice bool
+	Pos     Pos // zero for inferred variables
+}
+
+// Example is a sample value from an @example annotation such as
+// @example User.Name "Jane Doe".
+type Example struct {
+	Path  string // dotted path as written, e.g. "User.Name"
+	Value any    // decoded JSON value; numbers are json.Number
+	File  string // FilePath, or the layout declaring the example
+	Pos   Pos
+}
+
+// Fixture is a named sample data scenario. Data holds decoded JSON keyed by
+// the names used in the template, with numbers as json.Number.
+type Fixture struct {
 	Name string
-	Type string
+	Data map[string]any
 }
 
-var (
-	reSubject = regexp.MustCompile(`<!--\s*\$Subject:\s*(.*?)\s*-->`)
-	reTypeDef = regexp.MustCompile(`<!--\s*@type\s+([A-Za-z0-9_.]+)\s*([A-Za-z0-9_.]*)\s*-->`)
-)
+// reTypeDef matches the arguments of an @type annotation: a name or dotted
+// path, optionally followed by a Go type.
+var reTypeDef = regexp.MustCompile(`^([A-Za-z0-9_.]+)(?:\s+([][*A-Za-z0-9_.]+))?$`)
+
+// templateKeywords are identifiers that may appear alone in an action
+// (e.g. {{end}}) and must never be inferred as variables.
+var templateKeywords = map[string]struct{}{
+	"else":     {},
+	"end":      {},
+	"break":    {},
+	"continue": {},
+	"nil":      {},
+	"true":     {},
+	"false":    {},
+}
 
 // Matches simple variables like {{var}} or {{   var   }} (no dots/functions).
 var reSimpleVar = regexp.MustCompile(`\{\{\s*-?\s*([A-Za-z][A-Za-z0-9_]*)\s*-?\s*\}\}`)
 
+// reExample matches the arguments of an @example annotation: a name or
+// dotted path followed by a JSON value.
+var reExample = regexp.MustCompile(`(?s)^([A-Za-z0-9_.]+)\s+(.+)$`)
+
+// ParseFile parses the template at path together with its sibling fixtures
+// file, if any.
 func ParseFile(path string) (*ParsedTemplate, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("reading file: %w", err)
 	}
+	pt, err := Parse(path, data)
+	if err != nil {
+		return nil, err
+	}
+	fixtures := FixturesPath(path)
+	src, err := os.ReadFile(fixtures)
+	switch {
+	case err == nil:
+		ParseFixtures(pt, fixtures, src)
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("reading fixtures: %w", err)
+	}
+	textPath := TextPath(path)
+	src, err = os.ReadFile(textPath)
+	switch {
+	case err == nil:
+		SetTextFile(pt, textPath, src)
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("reading text template: %w", err)
+	}
+	return pt, nil
+}
+
+// TextPath returns the path of the plain-text template belonging to the
+// template at path, e.g. emails/welcome.txt for emails/welcome.html.
+func TextPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".txt"
+}
+
+// SetTextFile uses src, read from path, as the plain-text template of pt.
+func SetTextFile(pt *ParsedTemplate, path string, src []byte) {
+	if pt.TextFile != "" && pt.textMap == nil {
+		pt.Diagnostics.Errorf(pt.FilePath, pt.TextPos, "$Text annotation conflicts with %s; use one or the other", path)
+		return
+	}
+	pt.textMap = nil // a text file replaces the text of a Markdown template
+	text := string(src)
+	lead := len(text) - len(strings.TrimLeftFunc(text, unicode.IsSpace))
+	pos := Pos{Line: 1, Col: 1}
+	for _, c := range text[:lead] {
+		if c == '\n' {
+			pos.Line++
+			pos.Col = 1
+		} else {
+			pos.Col++
+		}
+	}
+	pt.Text = strings.TrimSpace(text)
+	pt.TextFile = path
+	pt.TextPos = pos
+	inferSimpleVariables(pt)
+}
+
+// FixturesPath returns the path of the fixtures file belonging to the
+// template at path, e.g. emails/welcome.fixtures.json for emails/welcome.html.
+func FixturesPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".fixtures.json"
+}
+
+// ParseFixtures parses src, a JSON object mapping scenario names to sample
+// data, into pt.Fixtures. Scenarios keep their order in the file.
+func ParseFixtures(pt *ParsedTemplate, path string, src []byte) {
+	pt.FixturesFile = path
+	dec := json.NewDecoder(bytes.NewReader(src))
+	dec.UseNumber()
+	fail := func(err error) {
+		pt.Diagnostics.Errorf(path, Pos{}, "invalid fixtures file: %v", err)
+	}
+	if tok, err := dec.Token(); err != nil {
+		fail(err)
+		return
+	} else if tok != json.Delim('{') {
+		fail(fmt.Errorf("want an object mapping scenario names to data"))
+		return
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			fail(err)
+			return
+		}
+		name := tok.(string)
+		var data map[string]any
+		if err := dec.Decode(&data); err != nil {
+			fail(fmt.Errorf("scenario %q: %w", name, err))
+			return
+		}
+		if seen[name] {
+			pt.Diagnostics.Errorf(path, Pos{}, "duplicate fixtures scenario %q", name)
+			continue
+		}
+		seen[name] = true
+		pt.Fixtures = append(pt.Fixtures, Fixture{Name: name, Data: data})
+	}
+	if _, err := dec.Token(); err != nil {
+		fail(err)
+	}
+}
 
+// Parse parses template source read from path. Annotation comments are
+// extracted wherever they appear, including mid-line and across lines, and
+// the remaining HTML is kept verbatim. Problems in the template are recorded
+// in pt.Diagnostics rather than returned, so that every problem in every
+// template can be reported in one run. A layout named by @extends is read
+// relative to path.
+func Parse(path string, src []byte) (*ParsedTemplate, error) {
+	ctx := &parseContext{root: filepath.Dir(path), partials: make(map[string]*Partial)}
+	return parse(path, src, ctx), nil
+}
+
+// parse implements Parse for a template, or a layout or partial used by the
+// template ctx was created for.
+func parse(path string, src []byte, ctx *parseContext) *ParsedTemplate {
+	ctx.stack = append(ctx.stack, path)
+	defer func() { ctx.stack = ctx.stack[:len(ctx.stack)-1] }()
 	pt := &ParsedTemplate{
 		FilePath: path,
 	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lx := lex(string(src))
+	pt.HTML = lx.html
+	pt.Annotations = lx.annotations
+	pt.srcMap = lx.srcMap
+	markdown := IsMarkdown(path)
+	if markdown {
+		renderMarkdown(pt)
+	}
+
+	for _, ann := range lx.unknown {
+		pt.Diagnostics.Warnf(path, ann.Pos, "unknown annotation %s; comment kept as HTML", ann.Directive)
+	}
+
 	structMap := make(map[string]*ParsedStruct)
 	typeSet := make(map[string]struct{})
-	htmlBuf := &bytes.Buffer{}
+	var typeOrder []string // typeSet in declaration order
+	addType := func(t string) {
+		if _, ok := typeSet[t]; !ok {
+			typeSet[t] = struct{}{}
+			typeOrder = append(typeOrder, t)
+		}
+	}
+	var fieldDecls []fieldDecl
+	var subjectPos Pos
+	var extends *Annotation
+	var includes, shared []Annotation
+	rootPos := make(map[string]Pos) // exported root field name -> declaration
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	for _, ann := range pt.Annotations {
+		switch ann.Directive {
+		case "$Subject":
+			if subjectPos.Line != 0 {
+				pt.Diagnostics.Errorf(path, ann.Pos, "duplicate $Subject annotation (first at %s)", subjectPos)
+				continue
+			}
+			subjectPos = ann.Pos
+			subject := ann.Args
+			if strings.Contains(subject, "\n") {
+				// Subjects are single header lines; fold multi-line comments
+				subject = strings.Join(strings.Fields(subject), " ")
+			}
+			pt.Subject = subject
+			pt.SubjectPos = ann.ArgsPos
 
-		if m := reSubject.FindStringSubmatch(line); len(m) > 1 {
-			pt.Subject = strings.TrimSpace(m[1])
-			continue
-		}
+		case "$Text":
+			if pt.TextFile != "" {
+				pt.Diagnostics.Errorf(path, ann.Pos, "duplicate $Text annotation (first at %s)", pt.TextPos)
+				continue
+			}
+			pt.Text = ann.Args
+			pt.TextFile = path
+			pt.TextPos = ann.ArgsPos
+
+		case "@extends":
+			if extends != nil {
+				pt.Diagnostics.Errorf(path, ann.Pos, "duplicate @extends annotation (first at %s)", extends.Pos)
+				continue
+			}
+			extends = &ann
+
+		case "@include":
+			includes = append(includes, ann)
+
+		case "@shared":
+			shared = append(shared, ann)
 
-		if m := reTypeDef.FindStringSubmatch(line); len(m) > 0 {
-			fullName := strings.TrimSpace(m[1])
-			fieldType := strings.TrimSpace(m[2])
+		case "@import":
+			addImport(pt, ann)
+
+		case "@inline-css":
+			if ann.Args != "" {
+				pt.Diagnostics.Errorf(path, ann.Pos, "@inline-css takes no arguments")
+			}
+			pt.InlineCSS = true
+
+		case "@example":
+			m := reExample.FindStringSubmatch(ann.Args)
+			if m == nil || slices.Contains(strings.Split(m[1], "."), "") {
+				pt.Diagnostics.Errorf(path, ann.Pos, "invalid @example annotation %q; want @example Name <JSON value>", ann.Args)
+				continue
+			}
+			dec := json.NewDecoder(strings.NewReader(m[2]))
+			dec.UseNumber()
+			var value any
+			if err := dec.Decode(&value); err != nil || dec.More() {
+				pt.Diagnostics.Errorf(path, ann.ArgsPos, "invalid @example value for %s: %s is not a JSON value", m[1], m[2])
+				continue
+			}
+			pt.Examples = append(pt.Examples, Example{Path: m[1], Value: value, File: path, Pos: ann.Pos})
+
+		case "@type":
+			m := reTypeDef.FindStringSubmatch(ann.Args)
+			if m == nil || slices.Contains(strings.Split(m[1], "."), "") {
+				pt.Diagnostics.Errorf(path, ann.Pos, "invalid @type annotation %q; want @type Name [Type]", ann.Args)
+				continue
+			}
+			fullName := m[1]
+			fieldType := m[2]
 
 			if !strings.Contains(fullName, ".") {
 				// No dot: either a struct declaration (no type) or a single variable (has type)
-				if fieldType == "" {
-					structName := util.UpperFirst(fullName)
-					if _, exists := structMap[structName]; !exists {
-						structMap[structName] = &ParsedStruct{Name: structName}
+				exported := util.UpperFirst(fullName)
+				if prev, ok := rootPos[exported]; ok {
+					if _, isStruct := structMap[exported]; isStruct && fieldType == "" {
+						pt.Diagnostics.Warnf(path, ann.Pos, "duplicate declaration of %s (first at %s)", fullName, prev)
+					} else {
+						pt.Diagnostics.Errorf(path, ann.Pos, "%s collides with field %s declared at %s", fullName, exported, prev)
 					}
+					continue
+				}
+				rootPos[exported] = ann.Pos
+				if fieldType == "" {
+					structMap[exported] = &ParsedStruct{Name: exported, Root: fullName, Pos: ann.Pos}
 				} else {
 					// Single top-level variable
 					pt.Variables = append(pt.Variables, ParsedVariable{
-						Name: fullName,
-						Type: fieldType,
+						Name:    fullName,
+						Type:    fieldType,
+						IsSlice: strings.HasPrefix(fieldType, "[]"),
+						Pos:     ann.Pos,
 					})
-					typeSet[fieldType] = struct{}{}
+					addType(fieldType)
 				}
 			} else {
-				parts := strings.SplitN(fullName, ".", 2)
-				structName := util.UpperFirst(parts[0])
-				fieldName := util.UpperFirst(parts[1])
-
-				if _, exists := structMap[structName]; !exists {
-					structMap[structName] = &ParsedStruct{Name: structName}
-				}
-
-				structMap[structName].Fields = append(structMap[structName].Fields, ParsedField{
-					Name: fieldName,
-					Type: fieldType,
+				// Dotted path: a field of a (possibly nested) struct
+				fieldDecls = append(fieldDecls, fieldDecl{
+					path: strings.Split(fullName, "."),
+					typ:  fieldType,
+					pos:  ann.Pos,
 				})
-
 				if fieldType != "" {
-					typeSet[fieldType] = struct{}{}
+					addType(fieldType)
 				}
 			}
-			continue
 		}
+	}
+
+	if markdown {
+		if pt.TextFile == "" {
+			markdownText(pt, lx.html, lx.srcMap)
+		}
+		if extends == nil {
+			extends = markdownLayout(pt)
+		}
+	}
+
+	buildStructTree(pt, structMap, rootPos, fieldDecls)
+	useShared(pt, shared, structMap, ctx)
+	resolveIncludes(pt, includes, ctx)
+	expandComponents(pt)
+	keepComments(pt)
 
-		htmlBuf.WriteString(line + "\n")
+	inherited := make(map[string]bool) // fields and variables from the layout
+	if extends != nil {
+		pt.Layout = loadLayout(pt, *extends, ctx)
+	}
+	if pt.Layout != nil {
+		mergeLayout(pt, pt.Layout, structMap, inherited)
+		for _, t := range pt.Layout.Types {
+			addType(t.Type)
+		}
+		composeLayout(pt, pt.Layout)
+		pt.KeptComments = pt.KeptComments || pt.Layout.KeptComments
+		pt.InlineCSS = pt.InlineCSS || pt.Layout.InlineCSS
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanning file: %w", err)
+	// Structs referenced as the type of a field or variable (e.g. []Item)
+	// are element types rather than root data.
+	for _, s := range structMap {
+		for _, other := range structMap {
+			for _, f := range other.Fields {
+				if BaseType(f.Type) == s.Name {
+					s.TypeOnly = true
+				}
+			}
+		}
+		for _, v := range pt.Variables {
+			if BaseType(v.Type) == s.Name {
+				s.TypeOnly = true
+			}
+		}
 	}
 
+	// Structs are listed in declaration order. The structs created for one
+	// dotted path share its position; parents (shorter names) come first.
 	for _, s := range structMap {
 		pt.Structs = append(pt.Structs, *s)
 	}
+	slices.SortFunc(pt.Structs, func(a, b ParsedStruct) int {
+		if c := cmp.Compare(a.Pos.Line, b.Pos.Line); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Pos.Col, b.Pos.Col); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(len(a.Name), len(b.Name)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if pt.Layout != nil {
+		// Structs from the layout come first, in the layout's order
+		rank := make(map[string]int, len(pt.Layout.Structs))
+		for i, s := range pt.Layout.Structs {
+			rank[s.Name] = i - len(pt.Layout.Structs)
+		}
+		slices.SortStableFunc(pt.Structs, func(a, b ParsedStruct) int {
+			return cmp.Compare(rank[a.Name], rank[b.Name])
+		})
+	}
 
-	for t := range typeSet {
+	for _, t := range typeOrder {
 		pt.Types = append(pt.Types, ParsedType{Type: t})
 	}
 
-	pt.HTML = htmlBuf.String()
+	checkTypes(pt, structMap, inherited)
 
 	// Infer undeclared simple variables from subject and HTML
 	inferSimpleVariables(pt)
-	return pt, nil
+	return pt
 }
 
-func ParseDir(dir string) ([]*ParsedTemplate, error) {
-	var templates []*ParsedTemplate
+// checkTypes reports field and variable types that do not name a builtin,
+// a struct declared in the template or shared with it, or a supported
+// qualified type. Fields
+// and variables inherited from a layout were checked with the layout.
+func checkTypes(pt *ParsedTemplate, structMap map[string]*ParsedStruct, inherited map[string]bool) {
+	check := func(owner, typ string, pos Pos) {
+		base := BaseType(typ)
+		switch {
+		case IsBuiltinType(base):
+		case structMap[base] != nil:
+		case strings.Contains(base, "."):
+			pkg := base[:strings.Index(base, ".")]
+			_, known := knownPackages[pkg]
+			if !known && !slices.ContainsFunc(pt.Imports, func(imp Import) bool { return imp.Alias == pkg }) {
+				pt.Diagnostics.Errorf(pt.FilePath, pos, "unknown package %s in type %s of %s; import it with @import %s <path>", pkg, typ, owner, pkg)
+			}
+		default:
+			pt.Diagnostics.Errorf(pt.FilePath, pos, "unknown type %s for %s", typ, owner)
+		}
+	}
+	for _, s := range pt.Structs {
+		if s.Shared {
+			// Checked in the types file
+			continue
+		}
+		for _, f := range s.Fields {
+			if owner := s.Name + "." + f.Name; f.Type != "" && !inherited[owner] {
+				check(owner, f.Type, f.Pos)
+			}
+		}
+	}
+	for _, v := range pt.Variables {
+		if !inherited[v.Name] {
+			check(v.Name, v.Type, v.Pos)
+		}
+	}
+}
 
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// knownPackages are the packages that qualified types may refer to without
+// an @import, mapped to their import paths.
+var knownPackages = map[string]string{
+	"time": "time",
+}
+
+// builtinTypes are Go's predeclared types usable in @type annotations.
+var builtinTypes = map[string]bool{
+	"string": true, "bool": true, "byte": true, "rune": true, "any": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true, "uintptr": true,
+	"float32": true, "float64": true, "complex64": true, "complex128": true,
+}
+
+// IsBuiltinType reports whether name is a predeclared Go type.
+func IsBuiltinType(name string) bool {
+	return builtinTypes[name]
+}
+
+// fieldDecl is a dotted @type declaration such as User.Address.City string.
+type fieldDecl struct {
+	path []string
+	typ  string
+	pos  Pos
+}
+
+// buildStructTree turns dotted field declarations into a tree of structs.
+// Every proper prefix of a path names a struct: User.Address.City string
+// yields struct User with field Address of type UserAddress, and struct
+// UserAddress with field City string. A type-less declaration of a prefix
+// (e.g. @type User.Address) is just a declaration of that nested struct.
+func buildStructTree(pt *ParsedTemplate, structMap map[string]*ParsedStruct, rootPos map[string]Pos, decls []fieldDecl) {
+	nested := make(map[string]bool)
+	for _, d := range decls {
+		for i := 2; i < len(d.path); i++ {
+			nested[strings.Join(d.path[:i], ".")] = true
 		}
-		if !info.IsDir() && strings.HasSuffix(info.Name(), ".html") {
-			pt, err := ParseFile(path)
-			if err != nil {
-				return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	// origin records which declaration path produced each struct so that
+	// e.g. User.Address and a top-level UserAddress are reported as colliding
+	origin := make(map[string]string)
+	for name := range structMap {
+		origin[name] = name
+	}
+	declared := make(map[string]Pos) // dotted path -> first declaration
+
+	var ensure func(path []string, pos Pos) *ParsedStruct
+	ensure = func(path []string, pos Pos) *ParsedStruct {
+		name := structName(path)
+		dotted := strings.Join(path, ".")
+		if s, ok := structMap[name]; ok {
+			if origin[name] != dotted && !strings.EqualFold(origin[name], dotted) {
+				pt.Diagnostics.Errorf(pt.FilePath, pos, "struct %s for %s collides with %s declared at %s", name, dotted, origin[name], s.Pos)
 			}
-			templates = append(templates, pt)
+			return s
 		}
-		return nil
-	})
+		if len(path) == 1 {
+			if prev, ok := rootPos[name]; ok {
+				pt.Diagnostics.Errorf(pt.FilePath, pos, "%s is used as a struct but declared as a variable at %s", path[0], prev)
+			}
+			rootPos[name] = pos
+		}
+		s := &ParsedStruct{Name: name, Pos: pos}
+		if len(path) == 1 {
+			s.Root = path[0]
+		}
+		structMap[name] = s
+		origin[name] = dotted
+		if len(path) > 1 {
+			parent := ensure(path[:len(path)-1], pos)
+			parent.Fields = append(parent.Fields, ParsedField{
+				Name: util.UpperFirst(path[len(path)-1]),
+				Type: name,
+				Pos:  pos,
+			})
+		}
+		return s
+	}
+
+	for _, d := range decls {
+		dotted := strings.Join(d.path, ".")
+		if nested[dotted] {
+			if d.typ != "" {
+				pt.Diagnostics.Errorf(pt.FilePath, d.pos, "%s is declared as %s but also has fields", dotted, d.typ)
+				continue
+			}
+			ensure(d.path, d.pos)
+			continue
+		}
+		if prev, ok := declared[dotted]; ok {
+			pt.Diagnostics.Errorf(pt.FilePath, d.pos, "duplicate declaration of %s (first at %s)", dotted, prev)
+			continue
+		}
+		declared[dotted] = d.pos
+		if d.typ == "" {
+			pt.Diagnostics.Errorf(pt.FilePath, d.pos, "field %s has no type; want @type %s <type>", dotted, dotted)
+			continue
+		}
+		parent := ensure(d.path[:len(d.path)-1], d.pos)
+		parent.Fields = append(parent.Fields, ParsedField{
+			Name:    util.UpperFirst(d.path[len(d.path)-1]),
+			Type:    d.typ,
+			IsSlice: strings.HasPrefix(d.typ, "[]"),
+			Pos:     d.pos,
+		})
+	}
+}
+
+// structName returns the struct name for a declaration path, e.g.
+// [User Address Geo] -> UserAddressGeo.
+func structName(path []string) string {
+	var b strings.Builder
+	for _, p := range path {
+		b.WriteString(util.UpperFirst(p))
+	}
+	return b.String()
+}
+
+// BaseType strips slice, pointer and map prefixes from a Go type expression,
+// returning the named type at its core (e.g. "[]*Item" -> "Item",
+// "map[string]Item" -> "Item").
+func BaseType(typ string) string {
+	for {
+		switch {
+		case strings.HasPrefix(typ, "[]"):
+			typ = typ[2:]
+		case strings.HasPrefix(typ, "*"):
+			typ = typ[1:]
+		case strings.HasPrefix(typ, "map["):
+			end := strings.Index(typ, "]")
+			if end < 0 {
+				return typ
+			}
+			typ = typ[end+1:]
+		default:
+			return typ
+		}
+	}
+}
+
+// ParseDir parses every template under dir. Layouts and partials, including
+// partials in subdirectories without a leading underscore, are parsed as part
+// of the templates using them rather than on their own.
+func ParseDir(dir string) ([]*ParsedTemplate, error) {
+	files, err := WalkTemplates(dir)
 	if err != nil {
 		return nil, err
 	}
+	var templates []*ParsedTemplate
+	for _, path := range files {
+		pt, err := ParseFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		templates = append(templates, pt)
+	}
 
-	return templates, nil
+	partials := make(map[string]bool)
+	for _, pt := range templates {
+		for _, p := range pt.Partials {
+			partials[p.Template.FilePath] = true
+		}
+	}
+	return slices.DeleteFunc(templates, func(pt *ParsedTemplate) bool { return partials[pt.FilePath] }), nil
 }
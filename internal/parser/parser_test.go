@@ -1,8 +1,11 @@
 package parser
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -98,3 +101,865 @@ func TestParseFile_StructsAndFields(t *testing.T) {
 		}
 	}
 }
+
+func TestParseFile_SliceFieldsAndRange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "order.html")
+	tpl := `<!-- @type Order -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item -->
+<!-- @type Item.Name string -->
+<!-- @type tags []string -->
+<html><body>
+{{range Order.Items}}{{.Name}}{{end}}
+{{range tags}}{{.}}{{else}}none{{end}}
+</body></html>`
+	if err := os.WriteFile(path, []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write temp template: %v", err)
+	}
+	pt, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	for _, s := range pt.Structs {
+		switch s.Name {
+		case "Order":
+			if s.TypeOnly {
+				t.Fatalf("expected Order to be root data")
+			}
+			var items ParsedField
+			for _, f := range s.Fields {
+				if f.Name == "Items" {
+					items = f
+				}
+			}
+			if items.Type != "[]Item" || !items.IsSlice {
+				t.Fatalf("expected Order.Items []Item slice field, got %+v", items)
+			}
+		case "Item":
+			if !s.TypeOnly {
+				t.Fatalf("expected Item to be a type-only struct")
+			}
+		}
+	}
+	for _, v := range pt.Variables {
+		switch v.Name {
+		case "tags":
+			if v.Type != "[]string" || !v.IsSlice {
+				t.Fatalf("expected tags []string slice variable, got %+v", v)
+			}
+		case "end", "else":
+			t.Fatalf("template keyword %q must not be inferred as a variable", v.Name)
+		}
+	}
+}
+
+func TestParseFile_NestedStructPaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "invoice.html")
+	tpl := `<!-- @type User.Name string -->
+<!-- @type User.Address.City string -->
+<!-- @type User.Address.Geo.Lat float64 -->
+<!-- @type User.Address.Geo.Lng float64 -->
+<html><body>{{User.Name}} {{User.Address.City}} {{User.Address.Geo.Lat}}</body></html>`
+	if err := os.WriteFile(path, []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write temp template: %v", err)
+	}
+	pt, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	structs := map[string]ParsedStruct{}
+	for _, s := range pt.Structs {
+		structs[s.Name] = s
+	}
+	want := map[string]map[string]string{
+		"User":           {"Name": "string", "Address": "UserAddress"},
+		"UserAddress":    {"City": "string", "Geo": "UserAddressGeo"},
+		"UserAddressGeo": {"Lat": "float64", "Lng": "float64"},
+	}
+	if len(structs) != len(want) {
+		t.Fatalf("expected %d structs, got %d: %#v", len(want), len(structs), structs)
+	}
+	for name, fields := range want {
+		s, ok := structs[name]
+		if !ok {
+			t.Fatalf("missing struct %s", name)
+		}
+		if len(s.Fields) != len(fields) {
+			t.Fatalf("expected %d fields in %s, got %#v", len(fields), name, s.Fields)
+		}
+		for _, f := range s.Fields {
+			if fields[f.Name] != f.Type {
+				t.Fatalf("unexpected field %s.%s %s", name, f.Name, f.Type)
+			}
+		}
+		if wantTypeOnly := name != "User"; s.TypeOnly != wantTypeOnly {
+			t.Fatalf("expected %s TypeOnly=%v", name, wantTypeOnly)
+		}
+	}
+}
+
+func TestParse_AnnotationsKeepSurroundingHTML(t *testing.T) {
+	src := `<!-- $Subject: Hi {{name}} -->
+<!-- @type name string --><p>Hi {{name}}</p>
+<!-- a regular comment -->
+<!--
+  @type Order.ID int
+  @type Order.Note
+    string
+-->
+<div>{{Order.ID}}</div>`
+	pt, err := Parse("inline.html", []byte(src))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	wantHTML := "<p>Hi {{name}}</p>\n<!-- a regular comment -->\n<div>{{Order.ID}}</div>"
+	if pt.HTML != wantHTML {
+		t.Fatalf("unexpected HTML:\n got: %q\nwant: %q", pt.HTML, wantHTML)
+	}
+	for _, w := range []struct {
+		text string
+		pos  Pos
+	}{
+		{"<p>", Pos{Line: 2, Col: 27}},
+		{"{{name}}", Pos{Line: 2, Col: 33}},
+		{"<!-- a regular", Pos{Line: 3, Col: 1}},
+		{"<div>", Pos{Line: 9, Col: 1}},
+	} {
+		if _, got := pt.SourcePos(strings.Index(pt.HTML, w.text)); got != w.pos {
+			t.Fatalf("expected %q at %s, got %s", w.text, w.pos, got)
+		}
+	}
+	wantPos := []struct {
+		directive string
+		args      string
+		pos       Pos
+	}{
+		{"$Subject", "Hi {{name}}", Pos{Line: 1, Col: 6}},
+		{"@type", "name string", Pos{Line: 2, Col: 6}},
+		{"@type", "Order.ID int", Pos{Line: 5, Col: 3}},
+		{"@type", "Order.Note\n    string", Pos{Line: 6, Col: 3}},
+	}
+	if len(pt.Annotations) != len(wantPos) {
+		t.Fatalf("expected %d annotations, got %#v", len(wantPos), pt.Annotations)
+	}
+	for i, w := range wantPos {
+		a := pt.Annotations[i]
+		if a.Directive != w.directive || a.Args != w.args || a.Pos != w.pos {
+			t.Fatalf("annotation %d: got %s %q at %s, want %s %q at %s", i, a.Directive, a.Args, a.Pos, w.directive, w.args, w.pos)
+		}
+	}
+	var order ParsedStruct
+	for _, s := range pt.Structs {
+		if s.Name == "Order" {
+			order = s
+		}
+	}
+	if len(order.Fields) != 2 || order.Fields[1].Name != "Note" || order.Fields[1].Type != "string" {
+		t.Fatalf("expected multi-line annotation to declare Order.Note string, got %#v", order.Fields)
+	}
+}
+
+func TestParse_LongLines(t *testing.T) {
+	img := strings.Repeat("A", 200*1024)
+	src := "<!-- @type name string -->\n<img src=\"data:image/png;base64," + img + "\"><p>{{name}}</p>\n"
+	pt, err := Parse("long.html", []byte(src))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if !strings.Contains(pt.HTML, img) || !strings.Contains(pt.HTML, "<p>{{name}}</p>") {
+		t.Fatalf("expected long line to be preserved")
+	}
+}
+
+func TestParse_Diagnostics(t *testing.T) {
+	src := `<!-- $Subject: Hi -->
+<!-- $Subject: Hello -->
+<!-- @type User.Name -->
+<!-- @type User.Age int -->
+<!-- @type User.Age int -->
+<!-- @type Order.Items []Itme -->
+<!-- @type Order.Total money.Amount -->
+<!-- @type order string -->
+<!-- @tpye x string -->
+<!-- @type User.Address string -->
+<!-- @type User.Address.City string -->
+<p>{{User.Age}}</p>`
+	pt, err := Parse("bad.html", []byte(src))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	want := []string{
+		"bad.html:2:6: error: duplicate $Subject annotation (first at 1:6)",
+		"bad.html:3:6: error: field User.Name has no type; want @type User.Name <type>",
+		"bad.html:5:6: error: duplicate declaration of User.Age (first at 4:6)",
+		"bad.html:6:6: error: Order is used as a struct but declared as a variable at 8:6",
+		"bad.html:6:6: error: unknown type []Itme for Order.Items",
+		"bad.html:7:6: error: unknown package money in type money.Amount of Order.Total; import it with @import money <path>",
+		"bad.html:9:6: warning: unknown annotation @tpye; comment kept as HTML",
+		"bad.html:10:6: error: User.Address is declared as string but also has fields",
+	}
+	pt.Diagnostics.Sort()
+	got := make([]string, len(pt.Diagnostics))
+	for i, d := range pt.Diagnostics {
+		got[i] = d.String()
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected diagnostics:\n got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !pt.Diagnostics.HasErrors() {
+		t.Fatalf("expected HasErrors")
+	}
+}
+
+func TestParseFile_ExamplesAndFixtures(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "welcome.html")
+	src := `<!-- @type User.Name string -->
+<!-- @type User.Age int -->
+<!-- @example User.Name "Jane Doe" -->
+<!-- @example User.Age 42 -->
+<!-- @example User.Nick -->
+<!-- @example User.Bio "unterminated -->
+<p>{{User.Name}} {{User.Age}}</p>`
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	fixtures := `{"vip": {"User": {"Name": "Ada"}}, "new": {"User": {"Age": 1}}}`
+	if err := os.WriteFile(filepath.Join(dir, "welcome.fixtures.json"), []byte(fixtures), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pt, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+
+	if len(pt.Examples) != 2 {
+		t.Fatalf("expected 2 examples, got %+v", pt.Examples)
+	}
+	if ex := pt.Examples[0]; ex.Path != "User.Name" || ex.Value != "Jane Doe" || ex.Pos != (Pos{Line: 3, Col: 6}) {
+		t.Fatalf("unexpected first example %+v", ex)
+	}
+	if n, ok := pt.Examples[1].Value.(json.Number); !ok || n.String() != "42" {
+		t.Fatalf("expected json.Number 42, got %#v", pt.Examples[1].Value)
+	}
+
+	if pt.FixturesFile != filepath.Join(dir, "welcome.fixtures.json") {
+		t.Fatalf("FixturesFile = %q", pt.FixturesFile)
+	}
+	if len(pt.Fixtures) != 2 || pt.Fixtures[0].Name != "vip" || pt.Fixtures[1].Name != "new" {
+		t.Fatalf("fixtures must keep file order, got %+v", pt.Fixtures)
+	}
+
+	var got []string
+	for _, d := range pt.Diagnostics {
+		got = append(got, d.Message)
+	}
+	want := []string{
+		`invalid @example annotation "User.Nick"; want @example Name <JSON value>`,
+		`invalid @example value for User.Bio: "unterminated is not a JSON value`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected diagnostics:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestParseFile_TextPart(t *testing.T) {
+	src := `<!-- $Subject: Hi -->
+<!-- $Text:
+  Hi {{name}},
+@everyone gets $5 off.
+-->
+<p>Hi {{name}}</p>`
+	pt, err := Parse("inline.html", []byte(src))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if pt.Text != "Hi {{name}},\n@everyone gets $5 off." {
+		t.Fatalf("unexpected Text %q", pt.Text)
+	}
+	if pt.TextFile != "inline.html" || pt.TextPos != (Pos{Line: 3, Col: 3}) {
+		t.Fatalf("unexpected text location %s:%s", pt.TextFile, pt.TextPos)
+	}
+	if len(pt.Diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", pt.Diagnostics)
+	}
+
+	// A sibling .txt file is used as is, and its variables are inferred
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sibling.html")
+	if err := os.WriteFile(path, []byte(`<p>Hi</p>`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sibling.txt"), []byte("\n\nHi {{firstName}}\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pt, err = ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	if pt.Text != "Hi {{firstName}}" || pt.TextPos != (Pos{Line: 3, Col: 1}) {
+		t.Fatalf("unexpected text %q at %s", pt.Text, pt.TextPos)
+	}
+	if len(pt.Variables) != 1 || pt.Variables[0].Name != "firstName" {
+		t.Fatalf("expected firstName inferred from the text file, got %+v", pt.Variables)
+	}
+
+	// Both at once is an error
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	pt, err = ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	if !pt.Diagnostics.HasErrors() || !strings.Contains(pt.Diagnostics[0].Message, "$Text annotation conflicts with") {
+		t.Fatalf("expected a conflict error, got %v", pt.Diagnostics)
+	}
+}
+
+func TestParseFile_Layout(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+	layout := write("_layout.html", `<!-- @type Company.Name string -->
+<!-- @example Company.Name "ACME" -->
+<html><title>{{block "title" .}}{{Company.Name}}{{end}}</title>
+<body>
+{{- block "content" .}}{{end}}
+{{block "footer" .}}<p>{{Company.Name}}</p>{{end}}
+</body></html>`)
+	path := write("welcome.html", `<!-- $Subject: Hi {{name}} -->
+<!-- @extends _layout.html -->
+<!-- @type Company.URL string -->
+<!-- @type name string -->
+{{define "title"}}Welcome{{end}}
+<p>Hello {{name}}</p>`)
+
+	pt, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	if len(pt.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", pt.Diagnostics)
+	}
+	if pt.Layout == nil || pt.Layout.FilePath != layout {
+		t.Fatalf("expected layout %s, got %+v", layout, pt.Layout)
+	}
+	wantHTML := `<html><title>{{template "title" .}}</title>
+<body>
+{{- template "content" .}}
+{{template "footer" .}}
+</body></html>{{define "title"}}Welcome{{end}}{{define "content"}}
+<p>Hello {{name}}</p>{{end}}{{define "footer"}}<p>{{Company.Name}}</p>{{end}}`
+	if pt.HTML != wantHTML {
+		t.Fatalf("unexpected HTML:\n%s\nwant:\n%s", pt.HTML, wantHTML)
+	}
+	if len(pt.Structs) != 1 || len(pt.Structs[0].Fields) != 2 || pt.Structs[0].Fields[0].Name != "Name" || pt.Structs[0].Fields[1].Name != "URL" {
+		t.Fatalf("expected Company{Name, URL} merged from the layout, got %+v", pt.Structs)
+	}
+	if len(pt.Examples) != 1 || pt.Examples[0].File != layout {
+		t.Fatalf("expected the layout's example, got %+v", pt.Examples)
+	}
+	for _, w := range []struct {
+		text string
+		file string
+		pos  Pos
+	}{
+		{"<html>", layout, Pos{Line: 3, Col: 1}},
+		{"<p>{{Company.Name}}", layout, Pos{Line: 6, Col: 21}},
+		{"<p>Hello", path, Pos{Line: 6, Col: 1}},
+		{"Welcome", path, Pos{Line: 5, Col: 19}},
+	} {
+		file, pos := pt.SourcePos(strings.Index(pt.HTML, w.text))
+		if file != w.file || pos != w.pos {
+			t.Fatalf("expected %q at %s:%s, got %s:%s", w.text, w.file, w.pos, file, pos)
+		}
+	}
+
+	// Conflicting declarations are reported on the template
+	path = write("bad.html", `<!-- @extends _layout.html -->
+<!-- @type Company.Name int -->
+{{define "content"}}x{{end}}
+{{define "sidebar"}}y{{end}}
+z`)
+	pt, err = ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	pt.Diagnostics.Sort()
+	want := []string{
+		path + ":2:6: error: Company.Name is declared as int but as string in layout " + layout + " at 1:6",
+		path + `:3:1: error: {{define "content"}} conflicts with the content outside {{define}} actions`,
+		path + `:4:1: warning: ` + layout + ` has no block "sidebar" to override`,
+	}
+	if got := pt.Diagnostics.Error(); got != strings.Join(want, "\n") {
+		t.Fatalf("unexpected diagnostics:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	// Layouts may not extend themselves, directly or not
+	write("_a.html", `<!-- @extends _b.html -->`)
+	write("_b.html", `<!-- @extends _a.html -->`)
+	pt, err = ParseFile(write("c.html", `<!-- @extends _a.html -->`))
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	if !strings.Contains(pt.Diagnostics.Error(), "layout cycle: ") {
+		t.Fatalf("expected a layout cycle, got %v", pt.Diagnostics)
+	}
+
+	// Layouts are named like shared files, so they are not generated
+	write("base.html", `<html>{{block "content" .}}{{end}}</html>`)
+	path = write("d.html", `<!-- @extends base.html -->`)
+	pt, err = ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	if want := path + ":1:15: error: layout base.html would be generated as a template of its own; name it _base.html"; pt.Diagnostics.Error() != want {
+		t.Fatalf("expected %q, got %v", want, pt.Diagnostics)
+	}
+	if !IsShared(layout) || IsShared(path) {
+		t.Fatalf("IsShared misclassifies %s or %s", layout, path)
+	}
+}
+
+func TestParseFile_Partials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+	write("partials/icon.html", `<!-- @type Name string -->
+<i>{{Name}}</i>`)
+	write("partials/button.html", `<!-- $Subject: ignored -->
+<!-- @type Label string -->
+<!-- @type URL string -->
+<a href="{{URL}}">{{template "icon.html" (params "Name" "go")}}{{Label}}</a>`)
+	path := write("welcome.html", `<!-- @type cta.Label string -->
+<!-- @type cta.URL string -->
+<p>
+  <!-- @include partials/button.html label=cta.Label URL=cta.URL -->
+  {{- template "partials/icon.html" (params "Name" "x")}}
+</p>`)
+
+	pt, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	wantHTML := `<p>
+  {{template "partials/button.html" (params "Label" cta.Label "URL" cta.URL)}}
+  {{- template "partials/icon.html" (params "Name" "x")}}
+</p>`
+	if pt.HTML != wantHTML {
+		t.Fatalf("unexpected HTML:\n%s\nwant:\n%s", pt.HTML, wantHTML)
+	}
+	var names []string
+	for _, p := range pt.Partials {
+		names = append(names, p.Name)
+	}
+	if strings.Join(names, ",") != "partials/icon.html,partials/button.html" {
+		t.Fatalf("expected both partials once, got %v", names)
+	}
+	// Partial names are relative to the template, even when nested
+	if !strings.Contains(pt.Partials[1].Template.HTML, `{{template "partials/icon.html" (params "Name" "go")}}`) {
+		t.Fatalf("nested call not renamed: %s", pt.Partials[1].Template.HTML)
+	}
+	_, pos := pt.SourcePos(strings.Index(pt.HTML, "{{template"))
+	if pos != (Pos{Line: 4, Col: 8}) {
+		t.Fatalf("expected the call at the @include, got %s", pos)
+	}
+	want := filepath.Join(dir, "partials", "button.html") + ":1:6: warning: $Subject in a partial is ignored; declare it in the templates using the partial"
+	if got := pt.Diagnostics.Error(); got != want {
+		t.Fatalf("unexpected diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+
+	for src, want := range map[string]string{
+		`<!-- @include -->`:                            "invalid @include annotation",
+		`<!-- @include partials/icon.html Name -->`:    `invalid @include argument "Name"`,
+		`<!-- @include missing.html -->`:               "cannot read partial",
+		`{{template "loop.html" .}}`:                   "include cycle: ",
+		`<!-- @include partials/icon.html Name="x -->`: "invalid @include annotation",
+	} {
+		write("loop.html", `{{template "bad.html" .}}`)
+		pt, err := ParseFile(write("bad.html", src))
+		if err != nil {
+			t.Fatalf("ParseFile error: %v", err)
+		}
+		if !strings.Contains(pt.Diagnostics.Error(), want) {
+			t.Fatalf("%s: expected %q, got %v", src, want, pt.Diagnostics)
+		}
+	}
+}
+
+func TestParseFile_SharedTypes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+	pt, err := ParseFile(write("missing.html", `<!-- @shared User -->`))
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	if !strings.Contains(pt.Diagnostics.Error(), "cannot read shared types: ") {
+		t.Fatalf("expected a missing types file, got %v", pt.Diagnostics)
+	}
+
+	types := write(TypesFile, `<!-- @type User.Name string -->
+<!-- @type User.Address.City string -->
+<!-- @type Item.Name string -->`)
+	path := write("welcome.html", `<!-- @shared User -->
+<!-- @type user User -->
+<!-- @type Order.Buyer User -->
+<p>{{user.Name}} {{user.Address.City}}</p>`)
+	pt, err = ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	if len(pt.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", pt.Diagnostics)
+	}
+	shared := make(map[string]bool)
+	for _, s := range pt.Structs {
+		if s.Shared {
+			if !s.TypeOnly {
+				t.Fatalf("shared struct %s is root data", s.Name)
+			}
+			shared[s.Name] = true
+		}
+	}
+	if len(shared) != 2 || !shared["User"] || !shared["UserAddress"] {
+		t.Fatalf("expected User and UserAddress to be shared, got %+v", pt.Structs)
+	}
+	if len(pt.Variables) != 1 || pt.Variables[0].Type != "User" {
+		t.Fatalf("expected user to be a User, got %+v", pt.Variables)
+	}
+
+	path = write("bad.html", `<!-- @shared User Missing -->
+<!-- @type User.Phone string -->`)
+	pt, err = ParseFile(path)
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	pt.Diagnostics.Sort()
+	want := []string{
+		path + ":1:19: error: unknown shared type Missing; declare it in " + types,
+		path + ":2:6: error: User is declared here but also shared from " + types + " at 1:6; declare its fields in one place",
+	}
+	if got := pt.Diagnostics.Error(); got != strings.Join(want, "\n") {
+		t.Fatalf("unexpected diagnostics:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	write(TypesFile, `<!-- @type user string -->`)
+	pt, err = ParseFile(write("var.html", `<!-- @shared User -->`))
+	if err != nil {
+		t.Fatalf("ParseFile error: %v", err)
+	}
+	if !strings.Contains(pt.Diagnostics.Error(), types+":1:6: error: user declares a variable; "+TypesFile+" only declares structs") {
+		t.Fatalf("expected the variable in %s to be reported, got %v", TypesFile, pt.Diagnostics)
+	}
+}
+
+func TestParseFile_Imports(t *testing.T) {
+	src := `<!-- @import github.com/acme/app/billing -->
+<!-- @import acct "github.com/acme/app/accounts" -->
+<!-- @type invoice billing.Invoice -->
+<!-- @type owner *acct.User -->
+<p>{{invoice.Total}} {{owner.Name}}</p>`
+	pt, err := Parse("imports.html", []byte(src))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(pt.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", pt.Diagnostics)
+	}
+	want := []Import{
+		{Alias: "billing", Path: "github.com/acme/app/billing", File: "imports.html", Pos: Pos{Line: 1, Col: 6}},
+		{Alias: "acct", Path: "github.com/acme/app/accounts", File: "imports.html", Pos: Pos{Line: 2, Col: 6}},
+	}
+	if !slices.Equal(pt.Imports, want) {
+		t.Fatalf("unexpected imports %+v, want %+v", pt.Imports, want)
+	}
+
+	pt, err = Parse("bad.html", []byte(`<!-- @import -->
+<!-- @import my-pkg example.com/x -->
+<!-- @import billing example.com/a -->
+<!-- @import billing example.com/b -->
+<!-- @import time example.com/clock -->
+<!-- @type due clock.Time -->`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	pt.Diagnostics.Sort()
+	wantDiags := []string{
+		`bad.html:1:6: error: invalid @import annotation ""; want @import [alias] <import path>`,
+		`bad.html:2:6: error: invalid @import alias "my-pkg"; write @import <alias> example.com/x`,
+		`bad.html:4:6: error: billing is imported as example.com/b but also as example.com/a at bad.html:3:6`,
+		`bad.html:5:6: error: alias time is reserved for time`,
+		`bad.html:6:6: error: unknown package clock in type clock.Time of due; import it with @import clock <path>`,
+	}
+	if got := pt.Diagnostics.Error(); got != strings.Join(wantDiags, "\n") {
+		t.Fatalf("unexpected diagnostics:\n%s\nwant:\n%s", got, strings.Join(wantDiags, "\n"))
+	}
+}
+
+func TestParse_KeptComments(t *testing.T) {
+	pt, err := Parse("kept.html", []byte(`<!-- @type url string -->
+<!--[if mso]><v:rect href="{{url}}"/><![endif]-->
+<!--[if !mso]><!--><a href="{{url}}">Go</a><!--<![endif]-->
+<!-- dropped --><!--! kept -->`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(pt.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", pt.Diagnostics)
+	}
+	want := `{{htmlComment "<!--[if mso]>"}}<v:rect href="{{url}}"/>{{htmlComment "<![endif]-->"}}
+{{htmlComment "<!--[if !mso]><!-->"}}<a href="{{url}}">Go</a>{{htmlComment "<!--<![endif]-->"}}
+<!-- dropped -->{{htmlComment "<!--"}} kept {{htmlComment "-->"}}`
+	if pt.HTML != want || !pt.KeptComments {
+		t.Fatalf("unexpected HTML:\n%s\nwant:\n%s", pt.HTML, want)
+	}
+	if file, pos := pt.SourcePos(strings.Index(pt.HTML, "<v:rect")); file != "kept.html" || pos != (Pos{Line: 2, Col: 14}) {
+		t.Fatalf("expected the markup at kept.html:2:14, got %s:%s", file, pos)
+	}
+
+	pt, err = Parse("bad.html", []byte("<p>Hi</p>\n<!--[if mso]><table>"))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if want := "bad.html:2:1: error: conditional comment is not closed with <![endif]-->"; pt.Diagnostics.Error() != want {
+		t.Fatalf("expected %q, got %v", want, pt.Diagnostics)
+	}
+}
+
+func TestParse_Components(t *testing.T) {
+	pt, err := Parse("comp.html", []byte(`<!-- @type url string -->
+<mc-section padding="8px 20px">
+  <mc-column width="25%"><mc-image src="logo.png" width="120"></mc-column>
+  <mc-column><mc-button href="{{url}}">Sign in</mc-button></mc-column>
+</mc-section>
+<mc-spacer>`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(pt.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", pt.Diagnostics)
+	}
+	for _, want := range []string{
+		`<td width="140" valign="top" style="width:140px;">`,
+		`<td width="420" valign="top" style="width:420px;">`,
+		`max-width:120px`,
+		`<v:roundrect xmlns:v="urn:schemas-microsoft-com:vml" xmlns:w="urn:schemas-microsoft-com:office:word" href="{{url}}"`,
+		`{{htmlComment "<!--[if !mso]><!-->"}}<a href="{{url}}"`,
+		`style="height:20px;line-height:20px;font-size:0;"`,
+	} {
+		if !strings.Contains(pt.HTML, want) {
+			t.Errorf("expected HTML to contain %q:\n%s", want, pt.HTML)
+		}
+	}
+	if strings.Contains(pt.HTML, "<mc-") || !pt.KeptComments {
+		t.Fatalf("expected every component to be expanded:\n%s", pt.HTML)
+	}
+	if file, pos := pt.SourcePos(strings.LastIndex(pt.HTML, "Sign in")); file != "comp.html" || pos != (Pos{Line: 4, Col: 40}) {
+		t.Fatalf("expected the button text at comp.html:4:40, got %s:%s", file, pos)
+	}
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`<mc-column>x</mc-column>`, "1:1: error: <mc-column> must be directly inside <mc-section>"},
+		{`<mc-section width="wide"></mc-section>`, `1:13: error: attribute width of <mc-section> must be a number of pixels, got "wide"`},
+		{`<mc-button>Go</mc-button>`, "1:1: error: <mc-button> needs a href attribute"},
+		{`<mc-spacer size="3">`, "1:12: error: unknown attribute size of <mc-spacer>; want one of height"},
+		{`<mc-foo>x</mc-foo>`, "1:1: error: unknown component <mc-foo>"},
+		{`<mc-section><p>x</p>`, "1:1: error: <mc-section> is not closed"},
+		{`<mc-section><mc-column>a</mc-column> b </mc-section>`, "1:38: error: content of a <mc-section> with columns must be inside <mc-column>"},
+		// An unterminated action hides the rest of the template
+		{`<mc-section>{{ <mc-column>x</mc-column></mc-section>`, "1:1: error: <mc-section> is not closed"},
+		{`<mc-section><mc-column>a</mc-column>{{ <mc-column>b</mc-column></mc-section>`, "1:1: error: <mc-section> is not closed"},
+	}
+	for _, tt := range tests {
+		pt, err := Parse("bad.html", []byte(tt.src))
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		if want := "bad.html:" + tt.want; pt.Diagnostics.Error() != want {
+			t.Errorf("%s: expected %q, got %v", tt.src, want, pt.Diagnostics)
+		}
+	}
+}
+
+func TestParse_Markdown(t *testing.T) {
+	src := `<!-- $Subject: Hi {{name}} -->
+<!-- @type url string -->
+<!-- @type items []string -->
+# Hello {{name}}
+
+Thanks for *joining* **ACME** & co <3, see ` + "`a<b>`" + `  
+or [sign in]({{url}} "Go") and <https://acme.test>.
+
+{{range items}}
+- ![logo](l.png) \*{{.}}\*
+{{end}}
+
+3. three
+
+   > quoted
+
+` + "```\n<pre>\n```" + `
+
+<div>
+*raw*
+</div>
+`
+	pt, err := Parse("hello.md", []byte(src))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(pt.Diagnostics) > 0 {
+		t.Fatalf("unexpected diagnostics: %v", pt.Diagnostics)
+	}
+	want := markdownHead + `<h1>Hello {{name}}</h1>
+<p>Thanks for <em>joining</em> <strong>ACME</strong> &amp; co &lt;3, see <code>a&lt;b&gt;</code><br>
+or <a href="{{url}}" title="Go">sign in</a> and <a href="https://acme.test">https://acme.test</a>.</p>
+{{range items}}
+<ul>
+<li><img src="l.png" alt="logo"> *{{.}}*</li>
+</ul>
+{{end}}
+<ol start="3">
+<li>
+<p>three</p>
+<blockquote>
+<p>quoted</p>
+</blockquote>
+</li>
+</ol>
+<pre><code>&lt;pre&gt;
+</code></pre>
+<div>
+*raw*
+</div>
+` + markdownFoot
+	if pt.HTML != want {
+		t.Fatalf("unexpected HTML:\n%s\nwant:\n%s", pt.HTML, want)
+	}
+	wantText := "# Hello {{name}}\n\nThanks for *joining* **ACME** & co <3, see `a<b>`  \n" +
+		"or sign in ({{url}}) and https://acme.test.\n\n{{range items}}\n- logo *{{.}}*\n{{end}}\n\n" +
+		"3. three\n\n   > quoted\n\n```\n<pre>\n```\n\n*raw*"
+	if pt.Text != wantText {
+		t.Fatalf("unexpected text:\n%s\nwant:\n%s", pt.Text, wantText)
+	}
+	if file, pos := pt.SourcePos(strings.Index(pt.HTML, "{{url}}")); file != "hello.md" || pos != (Pos{Line: 7, Col: 14}) {
+		t.Fatalf("expected the link at hello.md:7:14, got %s:%s", file, pos)
+	}
+	if file, pos := pt.TextSourcePos(strings.Index(pt.Text, "{{.}}")); file != "hello.md" || pos != (Pos{Line: 10, Col: 20}) {
+		t.Fatalf("expected the item at hello.md:10:20, got %s:%s", file, pos)
+	}
+	if !slices.Equal(pt.Variables, []ParsedVariable{
+		{Name: "url", Type: "string", Pos: Pos{Line: 2, Col: 6}},
+		{Name: "items", Type: "[]string", IsSlice: true, Pos: Pos{Line: 3, Col: 6}},
+		{Name: "name", Type: "string"},
+	}) {
+		t.Fatalf("unexpected variables %+v", pt.Variables)
+	}
+}
+
+func TestParse_MarkdownLists(t *testing.T) {
+	for _, tt := range []struct{ src, want string }{
+		{"1. a\n2. b\n3. c", "<ol>\n<li>a</li>\n<li>b</li>\n<li>c</li>\n</ol>\n"},
+		{"1) a\n2) b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		// Only a list item numbered 1 interrupts a paragraph
+		{"1. a\n2) b", "<ol>\n<li>a\n2) b</li>\n</ol>\n"},
+		{"a\n2. b", "<p>a\n2. b</p>\n"},
+	} {
+		pt, err := Parse("list.md", []byte(tt.src))
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		if want := markdownHead + tt.want + markdownFoot; pt.HTML != want {
+			t.Errorf("%q: unexpected HTML:\n%s\nwant:\n%s", tt.src, pt.HTML, want)
+		}
+	}
+}
+
+func TestWalkTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"welcome.html", "_layout.html", "notes.txt", "billing/invoice.md", "billing/eu/vat.html",
+		"billing/_types.html", "partials/button.html", ".git/x.html",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	files, err := WalkTemplates(dir)
+	if err != nil {
+		t.Fatalf("WalkTemplates: %v", err)
+	}
+	var got []string
+	for _, f := range files {
+		rel, _ := filepath.Rel(dir, f)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	want := []string{"billing/eu/vat.html", "billing/invoice.md", "partials/button.html", "welcome.html"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected files %q, want %q", got, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		include, exclude string
+		rel              string
+		want             bool
+	}{
+		{"", "", "billing/eu/vat.html", true},
+		{"billing", "", "billing/eu/vat.html", true},
+		{"billing/*.html", "", "billing/invoice.html", true},
+		{"billing/*.html", "", "billing/eu/vat.html", false},
+		{"billing/*", "", "billing/eu/vat.html", true},
+		{"eu", "", "billing/eu/vat.html", true},
+		{"*.md, welcome.html", "", "welcome.html", true},
+		{"*.md", "", "welcome.html", false},
+		{"", "*_draft.html", "billing/invoice_draft.html", false},
+		{"", "legacy/", "legacy/old.html", false},
+		{"billing", "billing/eu", "billing/eu/vat.html", false},
+		{"billing", "billing/eu", "billing/invoice.html", true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.include, tt.exclude)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q, %q): %v", tt.include, tt.exclude, err)
+		}
+		if got := f.Match(tt.rel); got != tt.want {
+			t.Errorf("include %q, exclude %q: Match(%q) = %v, want %v", tt.include, tt.exclude, tt.rel, got, tt.want)
+		}
+	}
+	if _, err := ParseFilter("billing/[", ""); err == nil {
+		t.Fatal("expected an error for a malformed pattern")
+	}
+}
@@ -0,0 +1,220 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/elliot40404/mailc/internal/util"
+)
+
+// Partial is a template included by another one with @include or
+// {{template "file.html" ...}}. The data it declares are its parameters,
+// which every caller passes with params:
+//
+//	{{template "partials/button.html" (params "Label" cta.Label "URL" cta.URL)}}
+type Partial struct {
+	// Name is the template name the partial is defined as: its path
+	// relative to the directory of the template being generated, with
+	// forward slashes.
+	Name     string
+	Template *ParsedTemplate
+}
+
+// ParamsFunc is the template function building the data passed to a
+// partial from alternating parameter names and values.
+const ParamsFunc = "params"
+
+// parseContext is shared by a template and the layouts and partials it
+// uses.
+type parseContext struct {
+	root     string              // directory partial names are relative to
+	stack    []string            // files being parsed, to detect cycles
+	partials map[string]*Partial // by file path
+	types    *ParsedTemplate     // TypesFile, once loaded
+}
+
+// includeSite is a partial call in the HTML of a template: either an
+// @include annotation, or a {{template}} action naming a file.
+type includeSite struct {
+	start, end int    // span in the HTML to replace; empty for @include
+	action     string // replacement action
+	pos        Pos
+}
+
+// resolveIncludes loads the partials called from pt and rewrites the calls
+// to use their template names. includes are the @include annotations of pt.
+func resolveIncludes(pt *ParsedTemplate, includes []Annotation, ctx *parseContext) {
+	var sites []includeSite
+	for _, ann := range includes {
+		file, args, ok := parseIncludeArgs(pt, ann)
+		if !ok {
+			continue
+		}
+		p := loadPartial(pt, file, ann.ArgsPos, ctx)
+		if p == nil {
+			continue
+		}
+		sites = append(sites, includeSite{start: ann.at, end: ann.at, pos: ann.Pos,
+			action: "{{template " + strconv.Quote(p.Name) + " (" + strings.Join(append([]string{ParamsFunc}, args...), " ") + ")}}"})
+	}
+	for _, a := range scanActions(pt.HTML) {
+		if a.keyword != "template" {
+			continue
+		}
+		name, rest, ok := quotedName(a.args)
+		if !ok || !strings.HasSuffix(name, ".html") {
+			continue
+		}
+		_, pos := pt.SourcePos(a.start)
+		p := loadPartial(pt, name, pos, ctx)
+		if p == nil {
+			continue
+		}
+		action := "{{" + trim(a.trimLeft, "- ") + "template " + strconv.Quote(p.Name)
+		if rest != "" {
+			action += " " + rest
+		}
+		sites = append(sites, includeSite{start: a.start, end: a.end, pos: pos, action: action + trim(a.trimRight, " -") + "}}"})
+	}
+	if len(sites) == 0 {
+		return
+	}
+	slices.SortStableFunc(sites, func(a, b includeSite) int { return a.start - b.start })
+
+	html, srcMap, htmlMap := pt.HTML, pt.srcMap, pt.htmlMap
+	resolve := func(off int) (string, Pos) { return resolveHTML(pt.FilePath, srcMap, htmlMap, off) }
+	var c composer
+	last := 0
+	for _, s := range sites {
+		c.copy(html, last, s.start, resolve)
+		c.synth(s.action, s.start, func(int) (string, Pos) { return pt.FilePath, s.pos })
+		last = s.end
+	}
+	c.copy(html, last, len(html), resolve)
+	pt.HTML, pt.htmlMap = c.b.String(), c.segs
+}
+
+// parseIncludeArgs splits the arguments of an @include annotation into the
+// partial's file and the arguments of params, as in
+// @include partials/button.html Label=cta.Label URL="https://example.com".
+func parseIncludeArgs(pt *ParsedTemplate, ann Annotation) (file string, args []string, ok bool) {
+	fields, ok := splitArgs(ann.Args)
+	if !ok || len(fields) == 0 {
+		pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "invalid @include annotation %q; want @include <file> [Name=value ...]", ann.Args)
+		return "", nil, false
+	}
+	for _, f := range fields[1:] {
+		name, value, found := strings.Cut(f, "=")
+		if !found || value == "" || !isIdent(name) {
+			pt.Diagnostics.Errorf(pt.FilePath, ann.ArgsPos, "invalid @include argument %q; want Name=value", f)
+			return "", nil, false
+		}
+		args = append(args, strconv.Quote(util.UpperFirst(name)), value)
+	}
+	return fields[0], args, true
+}
+
+// splitArgs splits s at spaces outside quotes and parentheses. It reports
+// false for unbalanced input.
+func splitArgs(s string) ([]string, bool) {
+	var fields []string
+	depth, start := 0, -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '`' || c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, false
+			}
+			if start < 0 {
+				start = i
+			}
+			i = j
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, false
+			}
+		case (c == ' ' || c == '\t' || c == '\n') && depth == 0:
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+	return fields, depth == 0
+}
+
+func isIdent(s string) bool {
+	for i, c := range s {
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// loadPartial parses the partial at name, relative to pt, once per template
+// being generated, and records it together with the partials it includes.
+func loadPartial(pt *ParsedTemplate, name string, pos Pos, ctx *parseContext) *Partial {
+	path := filepath.Join(filepath.Dir(pt.FilePath), name)
+	if slices.Contains(ctx.stack, path) {
+		chain := append(slices.Clone(ctx.stack), path)
+		pt.Diagnostics.Errorf(pt.FilePath, pos, "include cycle: %s", strings.Join(chain, " -> "))
+		return nil
+	}
+	p, ok := ctx.partials[path]
+	if !ok {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			pt.Diagnostics.Errorf(pt.FilePath, pos, "cannot read partial: %v", err)
+			return nil
+		}
+		rel, err := filepath.Rel(ctx.root, path)
+		if err != nil {
+			rel = path
+		}
+		p = &Partial{Name: filepath.ToSlash(rel), Template: parse(path, src, ctx)}
+		warnIgnored(p.Template, "partial")
+		ctx.partials[path] = p
+	}
+	pt.Diagnostics = append(pt.Diagnostics, p.Template.Diagnostics...)
+	for _, q := range append(p.Template.Partials, p) {
+		if !slices.Contains(pt.Partials, q) {
+			pt.Partials = append(pt.Partials, q)
+		}
+	}
+	return p
+}
+
+// warnIgnored reports the annotations of a layout or partial that only
+// templates of their own may use.
+func warnIgnored(pt *ParsedTemplate, kind string) {
+	for _, a := range pt.Annotations {
+		if a.Directive == "$Subject" || a.Directive == "$Text" {
+			pt.Diagnostics.Warnf(pt.FilePath, a.Pos, "%s in a %s is ignored; declare it in the templates using the %s", a.Directive, kind, kind)
+		}
+		if a.Directive == "@inline-css" && kind == "partial" {
+			pt.Diagnostics.Warnf(pt.FilePath, a.Pos, "@inline-css in a partial is ignored; partials are shared by templates with different styles, so none are inlined into them")
+		}
+	}
+}
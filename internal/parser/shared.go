@@ -0,0 +1,120 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// TypesFile declares the structs shared by the templates of its directory.
+// It holds only @type annotations; a template uses its structs with
+// @shared, and they are generated once instead of once per template:
+//
+//	<!-- _types.html -->
+//	<!-- @type User.Name string -->
+//	<!-- @type User.Email string -->
+//
+//	<!-- welcome.html -->
+//	<!-- @shared User -->
+//	<!-- @type user User -->
+const TypesFile = "_types.html"
+
+// reComment matches HTML comments, which may document a TypesFile.
+var reComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+
+// useShared adds the structs named by the @shared annotations of pt to
+// structMap, along with the shared structs their fields refer to.
+func useShared(pt *ParsedTemplate, shared []Annotation, structMap map[string]*ParsedStruct, ctx *parseContext) {
+	if len(shared) == 0 {
+		return
+	}
+	types := loadTypes(pt, shared[0], ctx)
+	if types == nil {
+		return
+	}
+	declared := make(map[string]ParsedStruct, len(types.Structs))
+	for _, s := range types.Structs {
+		declared[s.Name] = s
+	}
+
+	var use func(name string)
+	use = func(name string) {
+		if s, ok := structMap[name]; ok {
+			if !s.Shared {
+				pt.Diagnostics.Errorf(pt.FilePath, s.Pos, "%s is declared here but also shared from %s at %s; declare its fields in one place", name, types.FilePath, declared[name].Pos)
+			}
+			return
+		}
+		s := declared[name]
+		s.Shared, s.TypeOnly = true, true
+		structMap[name] = &s
+		for _, f := range s.Fields {
+			if _, ok := declared[BaseType(f.Type)]; ok {
+				use(BaseType(f.Type))
+			}
+		}
+	}
+	for _, ann := range shared {
+		names := strings.Fields(ann.Args)
+		if len(names) == 0 {
+			pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "invalid @shared annotation %q; want @shared Type...", ann.Args)
+			continue
+		}
+		for _, name := range names {
+			if _, ok := declared[name]; !ok {
+				pos := ann.ArgsPos
+				if i := strings.Index(ann.Args, name); !strings.Contains(ann.Args[:i], "\n") {
+					pos.Col += i
+				}
+				pt.Diagnostics.Errorf(pt.FilePath, pos, "unknown shared type %s; declare it in %s", name, types.FilePath)
+				continue
+			}
+			use(name)
+		}
+	}
+}
+
+// loadTypes parses the TypesFile next to the template being generated, once
+// per template. ann is the first @shared annotation, where problems reading
+// the file are reported.
+func loadTypes(pt *ParsedTemplate, ann Annotation, ctx *parseContext) *ParsedTemplate {
+	path := filepath.Join(ctx.root, TypesFile)
+	if slices.Contains(ctx.stack, path) {
+		pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "@shared is not allowed in %s", TypesFile)
+		return nil
+	}
+	if ctx.types == nil {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			pt.Diagnostics.Errorf(pt.FilePath, ann.Pos, "cannot read shared types: %v", err)
+			return nil
+		}
+		types := parse(path, src, ctx)
+		if strings.TrimSpace(reComment.ReplaceAllString(types.HTML, "")) != "" {
+			types.Diagnostics.Warnf(path, Pos{Line: 1, Col: 1}, "%s only declares types; its HTML is ignored", TypesFile)
+		}
+		for _, a := range types.Annotations {
+			switch a.Directive {
+			case "@type":
+			case "@import":
+				// types.go imports nothing for shared structs
+				types.Diagnostics.Errorf(path, a.Pos, "@import is not supported in %s", TypesFile)
+			default:
+				types.Diagnostics.Warnf(path, a.Pos, "%s in %s is ignored", a.Directive, TypesFile)
+			}
+		}
+		for _, v := range types.Variables {
+			if v.Pos.Line != 0 {
+				types.Diagnostics.Errorf(path, v.Pos, "%s declares a variable; %s only declares structs", v.Name, TypesFile)
+			}
+		}
+		for i := range types.Structs {
+			types.Structs[i].Shared = true
+		}
+		ctx.types = types
+	}
+	pt.Diagnostics = append(pt.Diagnostics, ctx.types.Diagnostics...)
+	return ctx.types
+}
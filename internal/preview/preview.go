@@ -0,0 +1,331 @@
+// Package preview serves rendered templates over HTTP for local development.
+//
+// Templates are parsed from disk on every request and rendered at runtime
+// with generator.Render, so edits show up without regenerating or compiling
+// any Go code. Connected browsers are told to reload through server-sent
+// events whenever a template changes.
+package preview
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/elliot40404/mailc/internal/diag"
+	"github.com/elliot40404/mailc/internal/generator"
+	"github.com/elliot40404/mailc/internal/parser"
+	"github.com/elliot40404/mailc/internal/watch"
+)
+
+// Server renders the templates in Dir.
+type Server struct {
+	Dir string
+
+	mu      sync.Mutex
+	clients map[chan struct{}]struct{}
+}
+
+// New returns a Server for the templates in dir.
+func New(dir string) *Server {
+	return &Server{Dir: dir, clients: make(map[chan struct{}]struct{})}
+}
+
+// Handler returns the HTTP handler serving the preview UI.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /t/{name}", s.handleTemplate)
+	mux.HandleFunc("GET /t/{name}/html", s.handleHTML)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	return mux
+}
+
+// Watch polls Dir until ctx is done and tells connected browsers to reload
+// whenever a file in it or in a subdirectory, such as a partial, changes.
+func (s *Server) Watch(ctx context.Context, onErr func(error)) {
+	w := watch.New(s.Dir, nil)
+	w.Recursive = true
+	w.Run(ctx, func(watch.Event) { s.Reload() }, onErr)
+}
+
+// Reload tells every connected browser to reload.
+func (s *Server) Reload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- struct{}{}:
+		default: // a reload is already pending for this client
+		}
+	}
+}
+
+// entry is a template loaded for display.
+type entry struct {
+	Name        string // path relative to Dir, without extension
+	Path        string
+	Source      string
+	Template    *parser.ParsedTemplate
+	Diagnostics diag.List
+}
+
+// load parses every template in the directory and its subdirectories,
+// leaving out the partials they include.
+func (s *Server) load() ([]entry, error) {
+	files, err := parser.WalkTemplates(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var templates []*parser.ParsedTemplate
+	partials := make(map[string]bool)
+	for _, file := range files {
+		pt, err := parser.ParseFile(file)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, pt)
+		for _, p := range pt.Partials {
+			partials[p.Template.FilePath] = true
+		}
+	}
+	var entries []entry
+	for _, pt := range templates {
+		file := pt.FilePath
+		if partials[file] {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(s.Dir, file)
+		if err != nil {
+			return nil, err
+		}
+		diags := append(diag.List(nil), pt.Diagnostics...)
+		diags = append(diags, generator.Check([]*parser.ParsedTemplate{pt})...)
+		diags = diags.Compact()
+		diags.Sort()
+		entries = append(entries, entry{
+			Name:        filepath.ToSlash(strings.TrimSuffix(rel, filepath.Ext(rel))),
+			Path:        file,
+			Source:      string(src),
+			Template:    pt,
+			Diagnostics: diags,
+		})
+	}
+	return entries, nil
+}
+
+// find loads the template with the given name.
+func (s *Server) find(w http.ResponseWriter, r *http.Request) (entry, bool) {
+	entries, err := s.load()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return entry{}, false
+	}
+	for _, e := range entries {
+		if e.Name == r.PathValue("name") {
+			return e, true
+		}
+	}
+	http.NotFound(w, r)
+	return entry{}, false
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.load()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type row struct {
+		Name    string
+		Link    string
+		Subject string
+		Errors  int
+	}
+	var rows []row
+	for _, e := range entries {
+		errs := 0
+		for _, d := range e.Diagnostics {
+			if d.Severity == diag.Error {
+				errs++
+			}
+		}
+		rows = append(rows, row{Name: e.Name, Link: url.PathEscape(e.Name), Subject: e.Template.Subject, Errors: errs})
+	}
+	render(w, indexPage, map[string]any{"Dir": s.Dir, "Templates": rows})
+}
+
+// sampleData returns the scenario requested with ?scenario=, defaulting to
+// the first one, or placeholder data when the template declares none.
+func sampleData(e entry, r *http.Request) (string, any) {
+	names := generator.Scenarios(e.Template)
+	if len(names) == 0 {
+		return "", generator.SampleData(e.Template)
+	}
+	name := r.URL.Query().Get("scenario")
+	if data, ok := generator.ScenarioData(e.Template, name); ok {
+		return name, data
+	}
+	data, _ := generator.ScenarioData(e.Template, names[0])
+	return names[0], data
+}
+
+func (s *Server) handleTemplate(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	scenario, data := sampleData(e, r)
+	sample, _ := json.MarshalIndent(data, "", "  ")
+	page := map[string]any{
+		"Name":        e.Name,
+		"Link":        url.PathEscape(e.Name),
+		"Path":        e.Path,
+		"Source":      e.Source,
+		"Sample":      string(sample),
+		"Scenario":    scenario,
+		"Scenarios":   generator.Scenarios(e.Template),
+		"Diagnostics": e.Diagnostics,
+	}
+	if !e.Diagnostics.HasErrors() {
+		if out, err := generator.Render(e.Template, data); err != nil {
+			page["Error"] = err.Error()
+		} else {
+			page["Subject"] = out.Subject
+			page["Text"] = out.Text
+		}
+	}
+	render(w, templatePage, page)
+}
+
+// handleHTML serves the rendered body on its own so that it can be shown in
+// an iframe, isolated from the styles of the preview UI.
+func (s *Server) handleHTML(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	if e.Diagnostics.HasErrors() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, d := range e.Diagnostics {
+			fmt.Fprintln(w, d)
+		}
+		return
+	}
+	_, data := sampleData(e, r)
+	out, err := generator.Render(e.Template, data)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, out.HTML)
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.clients[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func render(w http.ResponseWriter, t *template.Template, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const layout = `{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mailc preview</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; color: #222; }
+header { padding: 12px 20px; background: #1f2937; color: #fff; }
+header a { color: #fff; text-decoration: none; }
+main { padding: 20px; }
+table { border-collapse: collapse; }
+td, th { padding: 6px 12px; border-bottom: 1px solid #ddd; text-align: left; }
+.panes { display: grid; grid-template-columns: 1fr 1fr; gap: 16px; height: 75vh; }
+.panes iframe, .panes pre { width: 100%; height: 100%; box-sizing: border-box; border: 1px solid #ccc; margin: 0; }
+pre { overflow: auto; padding: 8px; background: #f8f8f8; font-size: 12px; }
+.subject { font-size: 1.2em; margin: 0 0 12px; }
+.error { color: #b91c1c; }
+.warning { color: #92400e; }
+</style>
+<script>new EventSource("/events").addEventListener("reload", () => location.reload());</script>
+</head>
+<body>
+<header><a href="/">mailc preview</a></header>
+<main>
+{{end}}
+{{define "foot"}}</main>
+</body>
+</html>
+{{end}}`
+
+var indexPage = template.Must(template.Must(template.New("layout").Parse(layout)).New("index").Parse(`{{template "head"}}
+<h1>Templates in {{.Dir}}</h1>
+<table>
+<tr><th>Template</th><th>Subject</th><th></th></tr>
+{{range .Templates}}<tr>
+<td><a href="/t/{{.Link}}">{{.Name}}</a></td>
+<td>{{.Subject}}</td>
+<td>{{if .Errors}}<span class="error">{{.Errors}} error(s)</span>{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="3">No .html or .md templates found.</td></tr>
+{{end}}</table>
+{{template "foot"}}`))
+
+var templatePage = template.Must(template.Must(template.New("layout").Parse(layout)).New("template").Parse(`{{template "head"}}
+<h1>{{.Name}}</h1>
+{{with .Diagnostics}}<ul>{{range .}}<li class="{{.Severity}}">{{.}}</li>{{end}}</ul>{{end}}
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+{{if .Scenarios}}<p>Scenario: {{range .Scenarios}}{{if eq . $.Scenario}}<strong>{{.}}</strong>{{else}}<a href="?scenario={{.}}">{{.}}</a>{{end}} {{end}}</p>{{end}}
+<p class="subject"><strong>Subject:</strong> {{.Subject}}</p>
+<div class="panes">
+<iframe src="/t/{{.Link}}/html?scenario={{.Scenario}}" title="Rendered HTML"></iframe>
+<pre>{{.Source}}</pre>
+</div>
+<h2>Plain text</h2>
+<pre>{{.Text}}</pre>
+<h2>{{if .Scenario}}Sample data ({{.Scenario}}){{else}}Placeholder data (add @example annotations or a fixtures file){{end}}</h2>
+<pre>{{.Sample}}</pre>
+{{template "foot"}}`))
@@ -0,0 +1,138 @@
+package preview
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	tpl := `<!-- $Subject: Order {{Order.ID}} -->
+<!-- @type Order.ID int -->
+<!-- @type Order.Items []Item -->
+<!-- @type Item.Name string -->
+<html><body><ul>{{range Order.Items}}<li>{{.Name}}</li>{{end}}</ul><p>{{footer}}</p></body></html>`
+	if err := os.WriteFile(filepath.Join(dir, "order.html"), []byte(tpl), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.html"), []byte("<p>{{User.Name}</p>"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	srv := New(dir)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	_, index := get("/")
+	for _, want := range []string{`href="/t/order"`, `href="/t/broken"`, "Order {{Order.ID}}", "1 error(s)"} {
+		if !strings.Contains(index, want) {
+			t.Fatalf("index missing %q:\n%s", want, index)
+		}
+	}
+
+	_, page := get("/t/order")
+	for _, want := range []string{"Order 42", `src="/t/order/html?scenario="`, "&lt;!-- @type Order.ID int --&gt;"} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("template page missing %q:\n%s", want, page)
+		}
+	}
+
+	_, html := get("/t/order/html")
+	if want := "<ul><li>Order.Items.Name</li><li>Order.Items.Name</li></ul><p>footer</p>"; !strings.Contains(html, want) {
+		t.Fatalf("rendered HTML missing %q:\n%s", want, html)
+	}
+
+	_, broken := get("/t/broken/html")
+	if !strings.Contains(broken, "broken.html:1:") {
+		t.Fatalf("broken template should show diagnostics, got:\n%s", broken)
+	}
+
+	if code, _ := get("/t/missing"); code != http.StatusNotFound {
+		t.Fatalf("missing template status = %d, want 404", code)
+	}
+
+	// Templates in subdirectories are listed by their path; partials are not
+	for name, body := range map[string]string{
+		"billing/invoice.html": `<!-- @include ../partials/sig.html --><p>Invoice {{number}}</p>`,
+		"partials/sig.html":    `<p>Team</p>`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if _, index := get("/"); !strings.Contains(index, `href="/t/billing%2Finvoice"`) || strings.Contains(index, "sig") {
+		t.Fatalf("unexpected index:\n%s", index)
+	}
+	if _, html := get("/t/billing%2Finvoice/html"); html != "<p>Team</p><p>Invoice number</p>" {
+		t.Fatalf("unexpected HTML of billing/invoice:\n%s", html)
+	}
+
+	// Scenarios from a fixtures file replace the placeholders
+	fixtures := `{"vip": {"Order": {"ID": 7, "Items": [{"Name": "Mug"}]}, "footer": "Thanks"}}`
+	if err := os.WriteFile(filepath.Join(dir, "order.fixtures.json"), []byte(fixtures), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, html := get("/t/order/html?scenario=vip"); !strings.Contains(html, "<ul><li>Mug</li></ul><p>Thanks</p>") {
+		t.Fatalf("scenario not rendered:\n%s", html)
+	}
+
+	// Reload is pushed to connected browsers
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %v", err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, ": connected") {
+		t.Fatalf("unexpected first event line %q", line)
+	}
+	got := make(chan string, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "event:") {
+				got <- strings.TrimSpace(line)
+				return
+			}
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		srv.Reload()
+		select {
+		case line := <-got:
+			if line != "event: reload" {
+				t.Fatalf("got %q, want reload event", line)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("no reload event received")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Package watch detects changes to the files in a directory by polling.
+//
+// It uses only the standard library: file modification times and sizes are
+// compared on every poll, and files whose metadata changed are hashed so that
+// saves which leave the content untouched are not reported.
+package watch
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Event lists the files that changed since the previous event. Paths are
+// joined with the watched directory and sorted.
+type Event struct {
+	Changed []string // created or modified
+	Removed []string
+}
+
+// Empty reports whether the event lists no files.
+func (e Event) Empty() bool {
+	return len(e.Changed) == 0 && len(e.Removed) == 0
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+}
+
+// Watcher polls the regular files directly inside Dir, or anywhere below it
+// if Recursive is set.
+type Watcher struct {
+	Dir       string
+	Recursive bool
+	// Match filters the files to watch by base name. A nil Match watches
+	// every file.
+	Match func(name string) bool
+	// Interval is the time between polls.
+	Interval time.Duration
+	// Debounce is how long the directory must stay unchanged before the
+	// changes seen so far are delivered, so that a burst of saves from an
+	// editor produces a single event.
+	Debounce time.Duration
+
+	files map[string]fileState
+}
+
+// New returns a Watcher for dir with default timings.
+func New(dir string, match func(name string) bool) *Watcher {
+	return &Watcher{
+		Dir:      dir,
+		Match:    match,
+		Interval: 200 * time.Millisecond,
+		Debounce: 300 * time.Millisecond,
+	}
+}
+
+// Poll scans the directory once and returns the files that changed since the
+// previous call. The first call records the current state and reports every
+// file as changed.
+func (w *Watcher) Poll() (Event, error) {
+	entries, err := w.list()
+	if err != nil {
+		return Event{}, err
+	}
+	if w.files == nil {
+		w.files = make(map[string]fileState)
+	}
+
+	var ev Event
+	seen := make(map[string]bool, len(entries))
+	for path, e := range entries {
+		if !e.Type().IsRegular() || (w.Match != nil && !w.Match(e.Name())) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Removed between listing and stat; reported on the next poll
+			continue
+		}
+		seen[path] = true
+		prev, known := w.files[path]
+		if known && prev.modTime.Equal(info.ModTime()) && prev.size == info.Size() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		st := fileState{modTime: info.ModTime(), size: info.Size(), sum: sha256.Sum256(data)}
+		w.files[path] = st
+		if !known || prev.sum != st.sum {
+			ev.Changed = append(ev.Changed, path)
+		}
+	}
+	for path := range w.files {
+		if !seen[path] {
+			delete(w.files, path)
+			ev.Removed = append(ev.Removed, path)
+		}
+	}
+	sort.Strings(ev.Changed)
+	sort.Strings(ev.Removed)
+	return ev, nil
+}
+
+// list returns the entries to poll by path.
+func (w *Watcher) list() (map[string]fs.DirEntry, error) {
+	entries := make(map[string]fs.DirEntry)
+	if !w.Recursive {
+		list, err := os.ReadDir(w.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range list {
+			entries[filepath.Join(w.Dir, e.Name())] = e
+		}
+		return entries, nil
+	}
+	err := filepath.WalkDir(w.Dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			// Directories removed while walking are reported on the next poll
+			if path != w.Dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !e.IsDir() {
+			entries[path] = e
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Run polls until ctx is done, calling fn with the accumulated changes once
+// the directory has been quiet for w.Debounce. If Poll has not been called
+// yet, the files present when Run starts are recorded without being reported.
+// Errors from polling are passed to onErr, if set, and polling continues.
+func (w *Watcher) Run(ctx context.Context, fn func(Event), onErr func(error)) {
+	if w.files == nil {
+		if _, err := w.Poll(); err != nil && onErr != nil {
+			onErr(err)
+		}
+	}
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	pending := make(map[string]bool) // path -> removed
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ev, err := w.Poll()
+			if err != nil {
+				if onErr != nil {
+					onErr(err)
+				}
+				continue
+			}
+			if !ev.Empty() {
+				for _, p := range ev.Changed {
+					pending[p] = false
+				}
+				for _, p := range ev.Removed {
+					pending[p] = true
+				}
+				last = now
+			}
+			if len(pending) > 0 && now.Sub(last) >= w.Debounce {
+				fn(flush(pending))
+			}
+		}
+	}
+}
+
+// flush converts and clears the pending changes.
+func flush(pending map[string]bool) Event {
+	var ev Event
+	for path, removed := range pending {
+		if removed {
+			ev.Removed = append(ev.Removed, path)
+		} else {
+			ev.Changed = append(ev.Changed, path)
+		}
+		delete(pending, path)
+	}
+	sort.Strings(ev.Changed)
+	sort.Strings(ev.Removed)
+	return ev
+}
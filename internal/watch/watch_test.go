@@ -0,0 +1,139 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoll(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(body), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return p
+	}
+	poll := func(w *Watcher) Event {
+		t.Helper()
+		ev, err := w.Poll()
+		if err != nil {
+			t.Fatalf("Poll: %v", err)
+		}
+		return ev
+	}
+
+	a := write("a.html", "a")
+	write("notes.txt", "ignored")
+	w := New(dir, func(name string) bool { return strings.HasSuffix(name, ".html") })
+
+	if ev := poll(w); !reflect.DeepEqual(ev.Changed, []string{a}) {
+		t.Fatalf("first poll = %+v, want %s changed", ev, a)
+	}
+	if ev := poll(w); !ev.Empty() {
+		t.Fatalf("unchanged directory reported %+v", ev)
+	}
+
+	// A save that keeps the content is not a change
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(a, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if ev := poll(w); !ev.Empty() {
+		t.Fatalf("touch reported %+v", ev)
+	}
+
+	write("a.html", "changed")
+	b := write("b.html", "b")
+	if ev := poll(w); !reflect.DeepEqual(ev.Changed, []string{a, b}) {
+		t.Fatalf("poll after edits = %+v, want %s and %s changed", ev, a, b)
+	}
+
+	if err := os.Remove(a); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if ev := poll(w); len(ev.Changed) != 0 || !reflect.DeepEqual(ev.Removed, []string{a}) {
+		t.Fatalf("poll after remove = %+v, want %s removed", ev, a)
+	}
+}
+
+func TestPoll_Recursive(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "partials")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	top := filepath.Join(dir, "a.html")
+	nested := filepath.Join(sub, "button.html")
+	for _, p := range []string{top, nested} {
+		if err := os.WriteFile(p, []byte("x"), 0o600); err != nil {
+			t.Fatalf("write %s: %v", p, err)
+		}
+	}
+
+	flat := New(dir, nil)
+	if ev, err := flat.Poll(); err != nil || !reflect.DeepEqual(ev.Changed, []string{top}) {
+		t.Fatalf("non-recursive Poll = %+v, %v; want only %s", ev, err, top)
+	}
+
+	w := New(dir, nil)
+	w.Recursive = true
+	if ev, err := w.Poll(); err != nil || !reflect.DeepEqual(ev.Changed, []string{top, nested}) {
+		t.Fatalf("recursive Poll = %+v, %v; want %s and %s", ev, err, top, nested)
+	}
+	if err := os.RemoveAll(sub); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if ev, err := w.Poll(); err != nil || !reflect.DeepEqual(ev.Removed, []string{nested}) {
+		t.Fatalf("Poll after removing %s = %+v, %v", sub, ev, err)
+	}
+}
+
+func TestRun_DebouncesBursts(t *testing.T) {
+	dir := t.TempDir()
+	w := New(dir, nil)
+	w.Interval = 10 * time.Millisecond
+	w.Debounce = 100 * time.Millisecond
+	if _, err := w.Poll(); err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+
+	events := make(chan Event, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx, func(ev Event) { events <- ev }, func(err error) { t.Errorf("poll error: %v", err) })
+		close(done)
+	}()
+
+	// Several saves in quick succession, as editors do
+	p := filepath.Join(dir, "a.html")
+	for i := range 5 {
+		if err := os.WriteFile(p, []byte(strings.Repeat("x", i+1)), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case ev := <-events:
+		if !reflect.DeepEqual(ev.Changed, []string{p}) {
+			t.Fatalf("event = %+v, want %s changed", ev, p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event delivered")
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("burst produced a second event %+v", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,386 @@
+// Package mailer builds and sends MIME email messages.
+//
+// Code generated by mailc returns a RenderedEmail whose Message method
+// wraps the rendered subject, HTML and text in a Message. WriteTo formats it
+// as an RFC 5322 message: non-ASCII headers are RFC 2047 encoded, bodies are
+// quoted-printable, and text, HTML, inline images and attachments are nested
+// in multipart/alternative, multipart/related and multipart/mixed parts as
+// needed.
+//
+// A Sender delivers messages. SMTP, Sendmail, Dir and Memory are the
+// built-in transports.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Message is an email message. From and the recipient lists hold addresses
+// as accepted by net/mail.ParseAddress, e.g. "jane@example.com" or
+// "Jane Doe <jane@example.com>".
+type Message struct {
+	From    string
+	ReplyTo string
+	To      []string
+	Cc      []string
+	// Bcc recipients receive the message but are not written to its headers.
+	Bcc     []string
+	Subject string
+
+	// Text and HTML are the bodies. When both are set they are sent as a
+	// multipart/alternative, so clients show the best one they support.
+	Text string
+	HTML string
+
+	// Inline parts are referenced from the HTML by their content ID, e.g.
+	// <img src="cid:logo">, and are sent with it in a multipart/related.
+	Inline []Attachment
+	// Attachments are sent in a multipart/mixed around the body.
+	Attachments []Attachment
+
+	// Date defaults to the time the message is written.
+	Date time.Time
+	// MessageID defaults to a random ID in the domain of From, e.g.
+	// "<1736..@example.com>".
+	MessageID string
+	// Header holds additional headers such as List-Unsubscribe. It must
+	// not set the headers written from the fields above.
+	Header textproto.MIMEHeader
+}
+
+// Attachment is a file attached to or embedded in a message.
+type Attachment struct {
+	Filename string
+	// ContentType defaults to the type registered for the extension of
+	// Filename, or application/octet-stream.
+	ContentType string
+	// ContentID identifies an inline part; it defaults to Filename.
+	ContentID string
+	Data      []byte
+}
+
+// New returns a message from one address to others.
+func New(from string, to ...string) *Message {
+	return &Message{From: from, To: to}
+}
+
+// Attach adds a file attachment and returns m.
+func (m *Message) Attach(filename string, data []byte) *Message {
+	m.Attachments = append(m.Attachments, Attachment{Filename: filename, Data: data})
+	return m
+}
+
+// Embed adds an inline part referenced from the HTML as cid:<contentID>
+// and returns m.
+func (m *Message) Embed(contentID, filename string, data []byte) *Message {
+	m.Inline = append(m.Inline, Attachment{Filename: filename, ContentID: contentID, Data: data})
+	return m
+}
+
+// reservedHeaders are written from the fields of Message.
+var reservedHeaders = []string{
+	"Bcc", "Cc", "Content-Transfer-Encoding", "Content-Type", "Date", "From",
+	"Message-Id", "Mime-Version", "Reply-To", "Subject", "To",
+}
+
+// Bytes returns the formatted message.
+func (m *Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTo writes the message in RFC 5322 format with CRLF line endings.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	h, err := m.headers()
+	if err != nil {
+		return 0, err
+	}
+	body := m.body()
+	for _, f := range append(h, body.header...) {
+		if _, err := io.WriteString(cw, f); err != nil {
+			return cw.n, err
+		}
+	}
+	if _, err := io.WriteString(cw, "\r\n"); err != nil {
+		return cw.n, err
+	}
+	err = body.write(cw)
+	return cw.n, err
+}
+
+// headers returns the formatted top-level header fields, without the
+// content headers of the body.
+func (m *Message) headers() ([]string, error) {
+	var h []string
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	h = append(h, field("Date", date.Format(time.RFC1123Z)))
+
+	for _, f := range []struct {
+		name  string
+		addrs []string
+	}{
+		{"From", nonEmpty(m.From)},
+		{"Reply-To", nonEmpty(m.ReplyTo)},
+		{"To", m.To},
+		{"Cc", m.Cc},
+	} {
+		if len(f.addrs) == 0 {
+			continue
+		}
+		list, err := formatAddresses(f.addrs)
+		if err != nil {
+			return nil, fmt.Errorf("mailer: %s: %w", f.name, err)
+		}
+		h = append(h, field(f.name, list))
+	}
+	if _, err := formatAddresses(m.Bcc); err != nil {
+		return nil, fmt.Errorf("mailer: Bcc: %w", err)
+	}
+
+	if m.Subject != "" {
+		h = append(h, field("Subject", mime.QEncoding.Encode("utf-8", m.Subject)))
+	}
+	id := m.MessageID
+	if id == "" {
+		id = newMessageID(m.From)
+	} else if strings.ContainsAny(id, "\r\n") {
+		return nil, fmt.Errorf("mailer: invalid Message-ID %q", id)
+	}
+	h = append(h, field("Message-ID", id))
+	h = append(h, field("MIME-Version", "1.0"))
+
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if slices.Contains(reservedHeaders, k) {
+			return nil, fmt.Errorf("mailer: header %s is set from the Message fields", k)
+		}
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			h = append(h, field(k, mime.QEncoding.Encode("utf-8", v)))
+		}
+	}
+	return h, nil
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// formatAddresses parses addrs and joins them for an address header,
+// encoding non-ASCII display names.
+func formatAddresses(addrs []string) (string, error) {
+	out := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		addr, err := mail.ParseAddress(a)
+		if err != nil {
+			return "", fmt.Errorf("invalid address %q: %w", a, err)
+		}
+		out = append(out, addr.String())
+	}
+	return strings.Join(out, ", "), nil
+}
+
+// newMessageID returns a unique message ID in the domain of from.
+func newMessageID(from string) string {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if _, d, ok := strings.Cut(addr.Address, "@"); ok && d != "" {
+			domain = d
+		}
+	}
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b[:]), domain)
+}
+
+// field formats a header field, folding it at spaces so that lines stay
+// within the recommended 78 characters where possible.
+func field(name, value string) string {
+	const limit = 78
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(":")
+	n := len(name) + 1
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && n+1+len(word) > limit {
+			b.WriteString("\r\n")
+			n = 0
+		}
+		b.WriteString(" ")
+		b.WriteString(word)
+		n += 1 + len(word)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// entity is a MIME entity: its content header fields and a function writing
+// its body.
+type entity struct {
+	header []string
+	write  func(io.Writer) error
+}
+
+// body returns the body entity of m, nesting the parts in the order
+// mixed(related(alternative(text, html), inline...), attachments...).
+func (m *Message) body() entity {
+	var e entity
+	switch {
+	case m.Text != "" && m.HTML != "":
+		e = multipartEntity("alternative", textEntity("plain", m.Text), textEntity("html", m.HTML))
+	case m.HTML != "":
+		e = textEntity("html", m.HTML)
+	default:
+		e = textEntity("plain", m.Text)
+	}
+	if len(m.Inline) > 0 {
+		parts := []entity{e}
+		for _, a := range m.Inline {
+			parts = append(parts, attachmentEntity(a, true))
+		}
+		e = multipartEntity("related", parts...)
+	}
+	if len(m.Attachments) > 0 {
+		parts := []entity{e}
+		for _, a := range m.Attachments {
+			parts = append(parts, attachmentEntity(a, false))
+		}
+		e = multipartEntity("mixed", parts...)
+	}
+	return e
+}
+
+func textEntity(subtype, text string) entity {
+	return entity{
+		header: []string{
+			field("Content-Type", "text/"+subtype+"; charset=utf-8"),
+			field("Content-Transfer-Encoding", "quoted-printable"),
+		},
+		write: func(w io.Writer) error {
+			qp := quotedprintable.NewWriter(w)
+			if _, err := io.WriteString(qp, text); err != nil {
+				return err
+			}
+			return qp.Close()
+		},
+	}
+}
+
+func attachmentEntity(a Attachment, inline bool) entity {
+	typ := a.ContentType
+	if typ == "" {
+		typ = mime.TypeByExtension(path.Ext(a.Filename))
+	}
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+	params := map[string]string{}
+	if a.Filename != "" {
+		params["filename"] = a.Filename
+	}
+	header := []string{
+		field("Content-Type", typ),
+		field("Content-Transfer-Encoding", "base64"),
+		field("Content-Disposition", mime.FormatMediaType(disposition, params)),
+	}
+	if inline {
+		id := a.ContentID
+		if id == "" {
+			id = a.Filename
+		}
+		header = append(header, field("Content-ID", "<"+strings.Trim(id, "<>")+">"))
+	}
+	return entity{
+		header: header,
+		write: func(w io.Writer) error {
+			// Base64 in lines of 76 characters
+			enc := base64.StdEncoding.EncodeToString(a.Data)
+			for len(enc) > 76 {
+				if _, err := io.WriteString(w, enc[:76]+"\r\n"); err != nil {
+					return err
+				}
+				enc = enc[76:]
+			}
+			_, err := io.WriteString(w, enc)
+			return err
+		},
+	}
+}
+
+func multipartEntity(subtype string, parts ...entity) entity {
+	boundary := newBoundary()
+	return entity{
+		header: []string{field("Content-Type", "multipart/"+subtype+"; boundary="+boundary)},
+		write: func(w io.Writer) error {
+			for _, p := range parts {
+				if _, err := io.WriteString(w, "--"+boundary+"\r\n"); err != nil {
+					return err
+				}
+				for _, f := range p.header {
+					if _, err := io.WriteString(w, f); err != nil {
+						return err
+					}
+				}
+				if _, err := io.WriteString(w, "\r\n"); err != nil {
+					return err
+				}
+				if err := p.write(w); err != nil {
+					return err
+				}
+				if _, err := io.WriteString(w, "\r\n"); err != nil {
+					return err
+				}
+			}
+			_, err := io.WriteString(w, "--"+boundary+"--\r\n")
+			return err
+		},
+	}
+}
+
+func newBoundary() string {
+	var b [15]byte
+	_, _ = rand.Read(b[:])
+	return "mailc-" + hex.EncodeToString(b[:])
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
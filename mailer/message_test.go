@@ -0,0 +1,213 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readMessage parses the formatted message with net/mail.
+func readMessage(t *testing.T, m *Message) *mail.Message {
+	t.Helper()
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes: %v", err)
+	}
+	for i, line := range strings.Split(string(raw), "\r\n") {
+		if strings.Contains(line, "\n") {
+			t.Fatalf("line %d has a bare LF: %q", i+1, line)
+		}
+		if len(line) > 998 {
+			t.Fatalf("line %d is longer than 998 characters", i+1)
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v\n%s", err, raw)
+	}
+	return msg
+}
+
+type part struct {
+	header textproto.MIMEHeader
+	body   string
+}
+
+// readParts reads a multipart body, decoding quoted-printable parts.
+func readParts(t *testing.T, contentType string, r io.Reader) (string, []part) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("ParseMediaType(%q): %v", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		t.Fatalf("expected a multipart type, got %q", mediaType)
+	}
+	mr := multipart.NewReader(r, params["boundary"])
+	var parts []part
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		body, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		parts = append(parts, part{header: p.Header, body: string(body)})
+	}
+	return mediaType, parts
+}
+
+func TestWriteTo_Alternative(t *testing.T) {
+	date := time.Date(2025, time.March, 4, 10, 30, 0, 0, time.UTC)
+	longLine := strings.Repeat("ünïcödé ", 30)
+	m := &Message{
+		From:    "Zoë Example <zoe@example.com>",
+		To:      []string{"jane@example.com", "Bob <bob@example.org>"},
+		Cc:      []string{"team@example.com"},
+		Bcc:     []string{"audit@example.com"},
+		Subject: "Your order – shipped ✓",
+		Text:    "Hi Jane,\nYour order has shipped.\n" + longLine,
+		HTML:    "<p>Hi Jane,</p><p>Your order has shipped.</p><p>" + longLine + "</p>",
+		Date:    date,
+		Header:  textproto.MIMEHeader{"List-Unsubscribe": {"<https://example.com/unsub>"}},
+	}
+	msg := readMessage(t, m)
+
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("decode subject: %v", err)
+	}
+	if subject != m.Subject {
+		t.Fatalf("subject = %q, want %q", subject, m.Subject)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Zoë Example" || from[0].Address != "zoe@example.com" {
+		t.Fatalf("unexpected From %v (%v)", from, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[1].Address != "bob@example.org" {
+		t.Fatalf("unexpected To %v (%v)", to, err)
+	}
+	if got, err := msg.Header.Date(); err != nil || !got.Equal(date) {
+		t.Fatalf("Date = %v (%v), want %v", got, err, date)
+	}
+	if id := msg.Header.Get("Message-Id"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Fatalf("unexpected Message-ID %q", id)
+	}
+	if msg.Header.Get("Mime-Version") != "1.0" {
+		t.Fatalf("missing MIME-Version")
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Fatalf("Bcc must not be written")
+	}
+	if msg.Header.Get("List-Unsubscribe") != "<https://example.com/unsub>" {
+		t.Fatalf("missing extra header")
+	}
+
+	mediaType, parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body)
+	if mediaType != "multipart/alternative" || len(parts) != 2 {
+		t.Fatalf("got %s with %d parts, want multipart/alternative with 2", mediaType, len(parts))
+	}
+	if ct := parts[0].header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Fatalf("first part is %q, want text/plain", ct)
+	}
+	if want := strings.ReplaceAll(m.Text, "\n", "\r\n"); parts[0].body != want {
+		t.Fatalf("text = %q, want %q", parts[0].body, want)
+	}
+	if ct := parts[1].header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("second part is %q, want text/html", ct)
+	}
+	if parts[1].body != m.HTML {
+		t.Fatalf("html = %q, want %q", parts[1].body, m.HTML)
+	}
+}
+
+func TestWriteTo_SinglePart(t *testing.T) {
+	msg := readMessage(t, &Message{From: "a@example.com", To: []string{"b@example.com"}, HTML: "<p>=Hi=</p>"})
+	if ct := msg.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if cte := msg.Header.Get("Content-Transfer-Encoding"); cte != "quoted-printable" {
+		t.Fatalf("Content-Transfer-Encoding = %q", cte)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if string(body) != "<p>=3DHi=3D</p>" {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestWriteTo_RelatedAndMixed(t *testing.T) {
+	logo := bytes.Repeat([]byte{0x89, 'P', 'N', 'G', 0, 1, 2, 3}, 40)
+	m := New("a@example.com", "b@example.com").
+		Embed("logo", "logo.png", logo).
+		Attach("invoice – März.pdf", []byte("%PDF-1.4"))
+	m.Text = "See attached."
+	m.HTML = `<img src="cid:logo"><p>See attached.</p>`
+	msg := readMessage(t, m)
+
+	mediaType, mixed := readParts(t, msg.Header.Get("Content-Type"), msg.Body)
+	if mediaType != "multipart/mixed" || len(mixed) != 2 {
+		t.Fatalf("got %s with %d parts, want multipart/mixed with 2", mediaType, len(mixed))
+	}
+	_, params, err := mime.ParseMediaType(mixed[1].header.Get("Content-Disposition"))
+	if err != nil || params["filename"] != "invoice – März.pdf" {
+		t.Fatalf("attachment filename = %q (%v)", params["filename"], err)
+	}
+	if ct := mixed[1].header.Get("Content-Type"); ct != "application/pdf" {
+		t.Fatalf("attachment type = %q", ct)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(mixed[1].body); string(data) != "%PDF-1.4" {
+		t.Fatalf("attachment data = %q", data)
+	}
+
+	mediaType, related := readParts(t, mixed[0].header.Get("Content-Type"), strings.NewReader(mixed[0].body))
+	if mediaType != "multipart/related" || len(related) != 2 {
+		t.Fatalf("got %s with %d parts, want multipart/related with 2", mediaType, len(related))
+	}
+	if id := related[1].header.Get("Content-Id"); id != "<logo>" {
+		t.Fatalf("Content-ID = %q", id)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(related[1].body, "\r\n", ""))
+	if err != nil || !bytes.Equal(data, logo) {
+		t.Fatalf("inline data mismatch (%v)", err)
+	}
+
+	mediaType, alt := readParts(t, related[0].header.Get("Content-Type"), strings.NewReader(related[0].body))
+	if mediaType != "multipart/alternative" || len(alt) != 2 || alt[1].body != m.HTML {
+		t.Fatalf("unexpected alternative part %s: %+v", mediaType, alt)
+	}
+}
+
+func TestWriteTo_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Message
+		want string
+	}{
+		{"bad to", New("a@example.com", "not an address"), `mailer: To: invalid address "not an address"`},
+		{"bad bcc", &Message{From: "a@example.com", Bcc: []string{"@"}}, `mailer: Bcc: invalid address "@"`},
+		{"bad message id", &Message{MessageID: "<a@b>\r\nBcc: x@example.com"}, "mailer: invalid Message-ID"},
+		{"reserved header", &Message{Header: textproto.MIMEHeader{"subject": {"x"}}}, "mailer: header Subject is set from the Message fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.m.WriteTo(io.Discard)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want prefix %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sender delivers messages. Implementations are safe for concurrent use.
+type Sender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+var (
+	_ Sender = (*SMTP)(nil)
+	_ Sender = (*Sendmail)(nil)
+	_ Sender = (*Dir)(nil)
+	_ Sender = (*Memory)(nil)
+)
+
+// Envelope returns the bare addresses a transport delivers msg from and to:
+// the address of From and those of To, Cc and Bcc.
+func (m *Message) Envelope() (from string, to []string, err error) {
+	if m.From == "" {
+		return "", nil, errors.New("mailer: message has no From address")
+	}
+	addr, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return "", nil, fmt.Errorf("mailer: From: invalid address %q: %w", m.From, err)
+	}
+	from = addr.Address
+	for _, list := range [][]string{m.To, m.Cc, m.Bcc} {
+		for _, a := range list {
+			addr, err := mail.ParseAddress(a)
+			if err != nil {
+				return "", nil, fmt.Errorf("mailer: invalid recipient %q: %w", a, err)
+			}
+			to = append(to, addr.Address)
+		}
+	}
+	if len(to) == 0 {
+		return "", nil, errors.New("mailer: message has no recipients")
+	}
+	return from, to, nil
+}
+
+// Sendmail delivers messages by piping them to a sendmail-compatible
+// binary, as provided by Postfix, Exim or msmtp.
+type Sendmail struct {
+	// Path defaults to /usr/sbin/sendmail.
+	Path string
+	// Args are passed before the envelope flags, which are always
+	// "-i -f <from> -- <recipients>".
+	Args []string
+}
+
+// Send runs the binary once per message.
+func (s *Sendmail) Send(ctx context.Context, msg *Message) error {
+	from, to, err := msg.Envelope()
+	if err != nil {
+		return err
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	path := s.Path
+	if path == "" {
+		path = "/usr/sbin/sendmail"
+	}
+	args := append(append([]string{}, s.Args...), "-i", "-f", from, "--")
+	cmd := exec.CommandContext(ctx, path, append(args, to...)...)
+	cmd.Stdin = bytes.NewReader(raw)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if out := strings.TrimSpace(stderr.String()); out != "" {
+			return fmt.Errorf("mailer: sendmail: %w: %s", err, out)
+		}
+		return fmt.Errorf("mailer: sendmail: %w", err)
+	}
+	return nil
+}
+
+// Dir "delivers" messages by writing each one to an .eml file in a
+// directory, for development and for inspection with a mail client.
+type Dir struct {
+	Path string
+}
+
+// Send writes msg to a new file named after the current time, so that
+// listing the directory shows messages in the order they were sent.
+func (d *Dir) Send(_ context.Context, msg *Message) error {
+	if _, _, err := msg.Envelope(); err != nil {
+		return err
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.Path, 0o755); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(b[:]) + ".eml"
+
+	// Write to a temporary file first so that readers never see a partial
+	// message
+	tmp, err := os.CreateTemp(d.Path, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(d.Path, name)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("mailer: %w", err)
+	}
+	return nil
+}
+
+// Memory keeps sent messages in memory, for tests. The zero value is ready
+// to use.
+type Memory struct {
+	mu   sync.Mutex
+	sent []*Message
+}
+
+// Send validates msg like a real transport would and records a copy of it.
+func (m *Memory) Send(_ context.Context, msg *Message) error {
+	if _, _, err := msg.Envelope(); err != nil {
+		return err
+	}
+	if _, err := msg.Bytes(); err != nil {
+		return err
+	}
+	cp := *msg
+	m.mu.Lock()
+	m.sent = append(m.sent, &cp)
+	m.mu.Unlock()
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first.
+func (m *Memory) Messages() []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Message(nil), m.sent...)
+}
+
+// Reset forgets all sent messages.
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	m.sent = nil
+	m.mu.Unlock()
+}
@@ -0,0 +1,122 @@
+package mailer
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	m := &Message{From: "Shop <shop@example.com>", To: []string{"Jane <jane@example.com>"}, Cc: []string{"cc@example.com"}, Bcc: []string{"bcc@example.com"}}
+	from, to, err := m.Envelope()
+	if err != nil {
+		t.Fatalf("Envelope: %v", err)
+	}
+	if from != "shop@example.com" || strings.Join(to, ",") != "jane@example.com,cc@example.com,bcc@example.com" {
+		t.Fatalf("got %s -> %v", from, to)
+	}
+
+	for _, tt := range []struct {
+		m    *Message
+		want string
+	}{
+		{&Message{To: []string{"a@example.com"}}, "mailer: message has no From address"},
+		{&Message{From: "a@example.com"}, "mailer: message has no recipients"},
+		{&Message{From: "a@example.com", Cc: []string{"nope"}}, `mailer: invalid recipient "nope"`},
+	} {
+		if _, _, err := tt.m.Envelope(); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Fatalf("err = %v, want prefix %q", err, tt.want)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	d := &Dir{Path: dir}
+	for _, subject := range []string{"first", "second"} {
+		if err := d.Send(context.Background(), testMessage(subject)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("got files %v (%v), want 2 .eml files", files, err)
+	}
+	for i, subject := range []string{"first", "second"} {
+		if filepath.Ext(files[i]) != ".eml" {
+			t.Fatalf("unexpected file %s", files[i])
+		}
+		f, err := os.Open(files[i])
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		msg, err := mail.ReadMessage(f)
+		_ = f.Close()
+		if err != nil || msg.Header.Get("Subject") != subject {
+			t.Fatalf("%s: subject %q (%v), want %q", files[i], msg.Header.Get("Subject"), err, subject)
+		}
+	}
+}
+
+func TestMemory(t *testing.T) {
+	var m Memory
+	msg := testMessage("hello")
+	if err := m.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	msg.Subject = "changed later"
+	if err := m.Send(context.Background(), &Message{From: "a@example.com"}); err == nil {
+		t.Fatalf("expected an error for a message without recipients")
+	}
+	sent := m.Messages()
+	if len(sent) != 1 || sent[0].Subject != "hello" {
+		t.Fatalf("unexpected messages %+v", sent)
+	}
+	m.Reset()
+	if len(m.Messages()) != 0 {
+		t.Fatalf("Reset did not clear messages")
+	}
+}
+
+func TestSendmail(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "sendmail")
+	src := "#!/bin/sh\necho \"$@\" > " + out + ".args\ncat > " + out + ".eml\n"
+	if err := os.WriteFile(script, []byte(src), 0o700); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	s := &Sendmail{Path: script, Args: []string{"-oi"}}
+	if err := s.Send(context.Background(), testMessage("piped")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	args, _ := os.ReadFile(out + ".args")
+	if want := "-oi -i -f shop@example.com -- jane@example.com audit@example.com\n"; string(args) != want {
+		t.Fatalf("args = %q, want %q", args, want)
+	}
+	f, err := os.Open(out + ".eml")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil || msg.Header.Get("Subject") != "piped" {
+		t.Fatalf("unexpected message (%v)", err)
+	}
+
+	failing := filepath.Join(dir, "failing")
+	if err := os.WriteFile(failing, []byte("#!/bin/sh\necho 'no route' >&2\nexit 75\n"), 0o700); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	err = (&Sendmail{Path: failing}).Send(context.Background(), testMessage("x"))
+	if err == nil || !strings.Contains(err.Error(), "exit status 75: no route") {
+		t.Fatalf("err = %v", err)
+	}
+}
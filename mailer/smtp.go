@@ -0,0 +1,300 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSMode selects how an SMTP connection is encrypted.
+type TLSMode int
+
+const (
+	// StartTLS upgrades the connection with STARTTLS and fails when the
+	// server does not offer it. It is the default.
+	StartTLS TLSMode = iota
+	// StartTLSOptional upgrades the connection when the server offers
+	// STARTTLS and continues in plain text otherwise.
+	StartTLSOptional
+	// ImplicitTLS connects over TLS from the start, usually on port 465.
+	ImplicitTLS
+	// NoTLS never encrypts the connection. Use it only for local servers.
+	NoTLS
+)
+
+// SMTP delivers messages to an SMTP server. The connection is kept open and
+// reused by later calls to Send until Close is called or the server drops
+// it, in which case the next Send reconnects.
+type SMTP struct {
+	Host string
+	// Port defaults to 465 with ImplicitTLS and 587 otherwise.
+	Port int
+	// Username and Password enable authentication.
+	Username string
+	Password string
+	// Auth is the SASL mechanism: "PLAIN", "LOGIN" or "CRAM-MD5". It
+	// defaults to the first of these the server supports.
+	Auth string
+	TLS  TLSMode
+	// TLSConfig defaults to verifying the certificate of Host with TLS 1.2
+	// or later.
+	TLSConfig *tls.Config
+	// LocalName is sent with EHLO and defaults to "localhost".
+	LocalName string
+	// DialTimeout defaults to 30 seconds.
+	DialTimeout time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	client *smtp.Client
+}
+
+// authPreference is the order in which mechanisms are picked when Auth is
+// empty.
+var authPreference = []string{"PLAIN", "LOGIN", "CRAM-MD5"}
+
+// Send delivers msg, reusing the open connection if there is one. The
+// context bounds connecting as well as the SMTP exchange.
+func (s *SMTP) Send(ctx context.Context, msg *Message) error {
+	from, to, err := msg.Envelope()
+	if err != nil {
+		return err
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.client != nil {
+		// Start a fresh transaction; a connection the server closed while
+		// idle fails here and is replaced
+		if err := s.withContext(ctx, s.client.Reset); err != nil {
+			s.closeLocked()
+		}
+	}
+	if s.client == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+
+	err = s.withContext(ctx, func() error {
+		if err := s.client.Mail(from); err != nil {
+			return fmt.Errorf("MAIL FROM: %w", err)
+		}
+		for _, addr := range to {
+			if err := s.client.Rcpt(addr); err != nil {
+				return fmt.Errorf("RCPT TO %s: %w", addr, err)
+			}
+		}
+		w, err := s.client.Data()
+		if err != nil {
+			return fmt.Errorf("DATA: %w", err)
+		}
+		if _, err := w.Write(raw); err != nil {
+			return fmt.Errorf("DATA: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("DATA: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		// A rejection leaves the connection usable; anything else does not
+		var reply *textproto.Error
+		if !errors.As(err, &reply) {
+			s.closeLocked()
+		}
+		return fmt.Errorf("mailer: smtp: %w", err)
+	}
+	return nil
+}
+
+// Close ends the open connection, if any, with QUIT.
+func (s *SMTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Quit()
+	s.closeLocked()
+	return err
+}
+
+func (s *SMTP) closeLocked() {
+	if s.client != nil {
+		_ = s.client.Close()
+	} else if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.client = nil
+	s.conn = nil
+}
+
+// withContext runs fn, aborting its network I/O when ctx is done. The
+// connection is unusable afterwards in that case.
+func (s *SMTP) withContext(ctx context.Context, fn func() error) error {
+	conn := s.conn
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := fn()
+	if !stop() {
+		s.closeLocked()
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *SMTP) dial(ctx context.Context) error {
+	port := s.Port
+	if port == 0 {
+		port = 587
+		if s.TLS == ImplicitTLS {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(port))
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	cfg := s.TLSConfig
+	if cfg == nil {
+		cfg = &tls.Config{ServerName: s.Host, MinVersion: tls.VersionTLS12}
+	}
+
+	var conn net.Conn
+	var err error
+	if s.TLS == ImplicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: cfg}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("mailer: smtp: %w", err)
+	}
+	s.conn = conn
+
+	err = s.withContext(ctx, func() error {
+		c, err := smtp.NewClient(conn, s.Host)
+		if err != nil {
+			return err
+		}
+		s.client = c
+		localName := s.LocalName
+		if localName == "" {
+			localName = "localhost"
+		}
+		if err := c.Hello(localName); err != nil {
+			return fmt.Errorf("EHLO: %w", err)
+		}
+		if s.TLS == StartTLS || s.TLS == StartTLSOptional {
+			if ok, _ := c.Extension("STARTTLS"); ok {
+				if err := c.StartTLS(cfg); err != nil {
+					return fmt.Errorf("STARTTLS: %w", err)
+				}
+			} else if s.TLS == StartTLS {
+				return fmt.Errorf("%s does not support STARTTLS", addr)
+			}
+		}
+		if s.Username == "" {
+			return nil
+		}
+		auth, err := s.auth(c)
+		if err != nil {
+			return err
+		}
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("AUTH: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		s.closeLocked()
+		return fmt.Errorf("mailer: smtp: %w", err)
+	}
+	return nil
+}
+
+// auth returns the configured mechanism, or the preferred one among those
+// the server supports.
+func (s *SMTP) auth(c *smtp.Client) (smtp.Auth, error) {
+	ok, list := c.Extension("AUTH")
+	if !ok {
+		return nil, errors.New("server does not support AUTH")
+	}
+	offered := strings.Fields(strings.ToUpper(list))
+	mech := strings.ToUpper(s.Auth)
+	if mech == "" {
+		for _, m := range authPreference {
+			if slices.Contains(offered, m) {
+				mech = m
+				break
+			}
+		}
+		if mech == "" {
+			return nil, fmt.Errorf("no supported AUTH mechanism in %q", list)
+		}
+	}
+	switch mech {
+	case "PLAIN":
+		return smtp.PlainAuth("", s.Username, s.Password, s.Host), nil
+	case "LOGIN":
+		return &loginAuth{username: s.Username, password: s.Password, host: s.Host}, nil
+	case "CRAM-MD5":
+		return smtp.CRAMMD5Auth(s.Username, s.Password), nil
+	}
+	return nil, fmt.Errorf("unsupported AUTH mechanism %q", s.Auth)
+}
+
+// loginAuth implements the non-standard but widespread LOGIN mechanism.
+// Like smtp.PlainAuth it refuses to send the password in plain text to
+// anything but localhost.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.Contains(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.Contains(prompt, "password"):
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
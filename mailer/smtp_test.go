@@ -0,0 +1,380 @@
+package mailer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server for tests. It supports STARTTLS (or
+// implicit TLS), AUTH PLAIN, LOGIN and CRAM-MD5, and records what it
+// receives.
+type fakeSMTP struct {
+	t        *testing.T
+	ln       net.Listener
+	tls      *tls.Config // offered with STARTTLS when set and not implicit
+	implicit bool
+	user     string
+	pass     string
+	auth     string // mechanisms offered
+	stall    bool   // never answer the end of DATA
+
+	mu    sync.Mutex
+	conns int
+	mails []fakeMail
+	cmds  []string
+}
+
+type fakeMail struct {
+	from   string
+	to     []string
+	data   string
+	tls    bool
+	authed string
+}
+
+func newFakeSMTP(t *testing.T, configure func(*fakeSMTP)) *fakeSMTP {
+	t.Helper()
+	s := &fakeSMTP{t: t, user: "user", pass: "secret", auth: "PLAIN LOGIN CRAM-MD5"}
+	if configure != nil {
+		configure(s)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if s.implicit {
+		ln = tls.NewListener(ln, s.tls)
+	}
+	s.ln = ln
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	_, isTLS := conn.(*tls.Conn)
+	authed := ""
+	var cur *fakeMail
+	_ = tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		s.mu.Lock()
+		s.cmds = append(s.cmds, verb)
+		s.mu.Unlock()
+		switch verb {
+		case "EHLO":
+			ext := []string{"250-fake"}
+			if s.tls != nil && !s.implicit && !isTLS {
+				ext = append(ext, "250-STARTTLS")
+			}
+			if s.auth != "" {
+				ext = append(ext, "250-AUTH "+s.auth)
+			}
+			ext = append(ext, "250 8BITMIME")
+			for _, l := range ext {
+				_ = tp.PrintfLine("%s", l)
+			}
+		case "STARTTLS":
+			_ = tp.PrintfLine("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn, isTLS = tc, true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			mech, initial, _ := strings.Cut(arg, " ")
+			if ok := s.authenticate(tp, strings.ToUpper(mech), initial); ok {
+				authed = strings.ToUpper(mech)
+				_ = tp.PrintfLine("235 ok")
+			} else {
+				_ = tp.PrintfLine("535 authentication failed")
+			}
+		case "MAIL":
+			from, _, _ := strings.Cut(strings.TrimPrefix(arg, "FROM:"), " ")
+			cur = &fakeMail{from: strings.Trim(from, "<>"), tls: isTLS, authed: authed}
+			_ = tp.PrintfLine("250 ok")
+		case "RCPT":
+			to := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if strings.HasPrefix(to, "reject") {
+				_ = tp.PrintfLine("550 no such user")
+				continue
+			}
+			cur.to = append(cur.to, to)
+			_ = tp.PrintfLine("250 ok")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			if s.stall {
+				time.Sleep(5 * time.Second)
+				return
+			}
+			cur.data = string(data)
+			s.mu.Lock()
+			s.mails = append(s.mails, *cur)
+			s.mu.Unlock()
+			cur = nil
+			_ = tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			cur = nil
+			_ = tp.PrintfLine("250 ok")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) authenticate(tp *textproto.Conn, mech, initial string) bool {
+	challenge := func(prompt string) string {
+		_ = tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, _ := tp.ReadLine()
+		b, _ := base64.StdEncoding.DecodeString(line)
+		return string(b)
+	}
+	switch mech {
+	case "PLAIN":
+		resp := ""
+		if initial != "" {
+			b, _ := base64.StdEncoding.DecodeString(initial)
+			resp = string(b)
+		} else {
+			resp = challenge("")
+		}
+		return resp == "\x00"+s.user+"\x00"+s.pass
+	case "LOGIN":
+		return challenge("Username:") == s.user && challenge("Password:") == s.pass
+	case "CRAM-MD5":
+		nonce := "<12345.67890@fake>"
+		user, digest, _ := strings.Cut(challenge(nonce), " ")
+		mac := hmac.New(md5.New, []byte(s.pass))
+		mac.Write([]byte(nonce))
+		return user == s.user && digest == hex.EncodeToString(mac.Sum(nil))
+	}
+	return false
+}
+
+func (s *fakeSMTP) received() ([]fakeMail, []string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMail(nil), s.mails...), append([]string(nil), s.cmds...), s.conns
+}
+
+// testTLS returns a server config with a self-signed certificate for
+// 127.0.0.1 and a client config trusting it.
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake smtp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", MinVersion: tls.VersionTLS12}
+	return server, client
+}
+
+func testMessage(subject string) *Message {
+	m := New("Shop <shop@example.com>", "jane@example.com")
+	m.Bcc = []string{"audit@example.com"}
+	m.Subject = subject
+	m.Text = "Hello"
+	m.HTML = "<p>Hello</p>\n<p>.leading dot</p>"
+	return m
+}
+
+func TestSMTP_Transports(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	tests := []struct {
+		name      string
+		configure func(*fakeSMTP)
+		smtp      *SMTP
+		wantTLS   bool
+		wantAuth  string
+	}{
+		{
+			name:     "plain text with PLAIN",
+			smtp:     &SMTP{TLS: NoTLS, Username: "user", Password: "secret"},
+			wantAuth: "PLAIN",
+		},
+		{
+			name:      "STARTTLS with LOGIN",
+			configure: func(s *fakeSMTP) { s.tls = serverTLS },
+			smtp:      &SMTP{Username: "user", Password: "secret", Auth: "login", TLSConfig: clientTLS},
+			wantTLS:   true,
+			wantAuth:  "LOGIN",
+		},
+		{
+			name:      "implicit TLS with CRAM-MD5",
+			configure: func(s *fakeSMTP) { s.tls, s.implicit, s.auth = serverTLS, true, "CRAM-MD5" },
+			smtp:      &SMTP{TLS: ImplicitTLS, Username: "user", Password: "secret", TLSConfig: clientTLS},
+			wantTLS:   true,
+			wantAuth:  "CRAM-MD5",
+		},
+		{
+			name:      "optional STARTTLS without auth",
+			configure: func(s *fakeSMTP) { s.auth = "" },
+			smtp:      &SMTP{TLS: StartTLSOptional},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeSMTP(t, tt.configure)
+			sender := tt.smtp
+			sender.Host, sender.Port = "127.0.0.1", srv.port()
+			defer sender.Close()
+
+			for _, subject := range []string{"first", "second"} {
+				if err := sender.Send(context.Background(), testMessage(subject)); err != nil {
+					t.Fatalf("Send %s: %v", subject, err)
+				}
+			}
+			mails, cmds, conns := srv.received()
+			if conns != 1 {
+				t.Fatalf("expected the connection to be reused, got %d connections", conns)
+			}
+			if len(mails) != 2 {
+				t.Fatalf("got %d messages, want 2 (commands %v)", len(mails), cmds)
+			}
+			for _, m := range mails {
+				if m.from != "shop@example.com" || strings.Join(m.to, ",") != "jane@example.com,audit@example.com" {
+					t.Fatalf("unexpected envelope %s -> %v", m.from, m.to)
+				}
+				if m.tls != tt.wantTLS || m.authed != tt.wantAuth {
+					t.Fatalf("tls=%v auth=%q, want tls=%v auth=%q", m.tls, m.authed, tt.wantTLS, tt.wantAuth)
+				}
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(mails[1].data))
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			if msg.Header.Get("Subject") != "second" || msg.Header.Get("Bcc") != "" {
+				t.Fatalf("unexpected headers %v", msg.Header)
+			}
+			if !strings.Contains(mails[1].data, "\n<p>.leading dot</p>") {
+				t.Fatalf("dot-stuffing was not undone:\n%s", mails[1].data)
+			}
+		})
+	}
+}
+
+func TestSMTP_Errors(t *testing.T) {
+	t.Run("STARTTLS required", func(t *testing.T) {
+		srv := newFakeSMTP(t, nil)
+		sender := &SMTP{Host: "127.0.0.1", Port: srv.port()}
+		err := sender.Send(context.Background(), testMessage("x"))
+		if err == nil || !strings.Contains(err.Error(), "does not support STARTTLS") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		srv := newFakeSMTP(t, nil)
+		sender := &SMTP{Host: "127.0.0.1", Port: srv.port(), TLS: NoTLS, Username: "user", Password: "wrong"}
+		err := sender.Send(context.Background(), testMessage("x"))
+		if err == nil || !strings.Contains(err.Error(), "535") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("rejected recipient keeps the connection", func(t *testing.T) {
+		srv := newFakeSMTP(t, nil)
+		sender := &SMTP{Host: "127.0.0.1", Port: srv.port(), TLS: NoTLS}
+		defer sender.Close()
+		bad := testMessage("x")
+		bad.To = []string{"reject@example.com"}
+		err := sender.Send(context.Background(), bad)
+		var reply *textproto.Error
+		if !errors.As(err, &reply) || reply.Code != 550 {
+			t.Fatalf("err = %v, want a 550 reply", err)
+		}
+		if err := sender.Send(context.Background(), testMessage("y")); err != nil {
+			t.Fatalf("Send after rejection: %v", err)
+		}
+		mails, cmds, conns := srv.received()
+		if len(mails) != 1 || conns != 1 || !strings.Contains(strings.Join(cmds, " "), "RSET MAIL") {
+			t.Fatalf("got %d messages over %d connections, commands %v", len(mails), conns, cmds)
+		}
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		srv := newFakeSMTP(t, func(s *fakeSMTP) { s.stall = true })
+		sender := &SMTP{Host: "127.0.0.1", Port: srv.port(), TLS: NoTLS}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := sender.Send(ctx, testMessage("x"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("err = %v, want deadline exceeded", err)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("Send did not return at the deadline")
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package smtpsink
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is a captured message: the SMTP envelope, the raw data, and the
+// parts decoded from it.
+type Message struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Received time.Time `json:"received"`
+	Size     int       `json:"size"`
+
+	Subject     string              `json:"subject"`
+	Header      map[string][]string `json:"headers"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html"`
+	Attachments []Attachment        `json:"attachments"`
+	// Error is set when the data is not a valid MIME message; the fields
+	// above then hold whatever could be decoded.
+	Error string `json:"error,omitempty"`
+
+	Raw []byte `json:"-"`
+}
+
+// Attachment is a non-body part of a message, including inline images.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	ContentID   string `json:"contentId,omitempty"`
+	Size        int    `json:"size"`
+	Data        []byte `json:"-"`
+}
+
+// newMessage decodes raw into a Message.
+func newMessage(from string, to []string, received time.Time, raw []byte) *Message {
+	m := &Message{From: from, To: to, Received: received, Size: len(raw), Raw: raw}
+	if err := m.decode(); err != nil {
+		m.Error = err.Error()
+	}
+	return m
+}
+
+func (m *Message) decode() error {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return err
+	}
+	m.Header = msg.Header
+	var dec mime.WordDecoder
+	if m.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+	return m.decodePart(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+// decodePart walks the MIME tree, keeping the first text/plain and
+// text/html bodies and collecting everything else as attachments.
+func (m *Message) decodePart(h textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := m.decodePart(p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	// multipart.Reader decodes quoted-printable parts itself and removes
+	// the header, so this only sees what is left to decode
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &skipNewlines{r: body})
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if disposition != "attachment" && filename == "" {
+		switch {
+		case mediaType == "text/plain" && m.Text == "":
+			m.Text = string(data)
+			return nil
+		case mediaType == "text/html" && m.HTML == "":
+			m.HTML = string(data)
+			return nil
+		}
+	}
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		ContentID:   strings.Trim(h.Get("Content-Id"), "<>"),
+		Size:        len(data),
+		Data:        data,
+	})
+	return nil
+}
+
+// skipNewlines drops line breaks from base64 data.
+type skipNewlines struct {
+	r io.Reader
+}
+
+func (s *skipNewlines) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	out := p[:0]
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			out = append(out, b)
+		}
+	}
+	return len(out), err
+}
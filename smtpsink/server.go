@@ -0,0 +1,286 @@
+// Package smtpsink is an SMTP server that accepts every message and keeps
+// it for inspection instead of delivering it.
+//
+// It backs the mailc smtp-sink command, a local replacement for tools such
+// as MailHog, and can be started in-process by integration tests that send
+// real email through the SMTP transport of the mailer package:
+//
+//	sink := smtpsink.New(&smtpsink.MemoryStore{})
+//	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+//	go sink.Serve(ln)
+//	sender := &mailer.SMTP{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, TLS: mailer.NoTLS}
+//
+// Captured messages are listed by the Store, and by the web inbox and JSON
+// API served by Handler.
+package smtpsink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server accepts SMTP connections and adds every message it receives to
+// Store.
+type Server struct {
+	Store Store
+	// Hostname is announced in greetings and defaults to "mailc-sink".
+	Hostname string
+	// MaxSize is the largest message accepted, in bytes. It defaults to
+	// 25 MiB.
+	MaxSize int
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	clients   map[chan struct{}]struct{}
+}
+
+// New returns a Server storing messages in store.
+func New(store Store) *Server {
+	return &Server{Store: store}
+}
+
+// idleTimeout is how long a connection may wait for the next command.
+const idleTimeout = 5 * time.Minute
+
+// Serve accepts connections on ln until ln is closed or Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// ListenAndServe listens on addr and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Close stops every listener passed to Serve. Connections in progress are
+// left to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for ln := range s.listeners {
+		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// session is the state of one SMTP connection.
+type session struct {
+	srv  *Server
+	tp   *textproto.Conn
+	from string
+	to   []string
+	mail bool // MAIL FROM has been given
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	ss := &session{srv: s, tp: textproto.NewConn(conn)}
+	ss.reply(220, "%s ESMTP mailc smtp-sink", s.hostname())
+	for {
+		_ = conn.SetDeadline(time.Now().Add(idleTimeout))
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		if !ss.handle(strings.ToUpper(verb), strings.TrimSpace(arg)) {
+			return
+		}
+	}
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return "mailc-sink"
+}
+
+func (s *Server) maxSize() int {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return 25 << 20
+}
+
+func (ss *session) reply(code int, format string, args ...any) {
+	_ = ss.tp.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+// handle runs one command and reports whether the connection stays open.
+func (ss *session) handle(verb, arg string) bool {
+	switch verb {
+	case "HELO":
+		ss.reset()
+		ss.reply(250, "%s", ss.srv.hostname())
+	case "EHLO":
+		ss.reset()
+		_ = ss.tp.PrintfLine("250-%s", ss.srv.hostname())
+		_ = ss.tp.PrintfLine("250-SIZE %d", ss.srv.maxSize())
+		_ = ss.tp.PrintfLine("250-8BITMIME")
+		_ = ss.tp.PrintfLine("250-SMTPUTF8")
+		_ = ss.tp.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5")
+	case "AUTH":
+		ss.auth(arg)
+	case "MAIL":
+		addr, ok := pathArg(arg, "FROM:")
+		if !ok {
+			ss.reply(501, "syntax: MAIL FROM:<address>")
+			break
+		}
+		ss.reset()
+		ss.from, ss.mail = addr, true
+		ss.reply(250, "ok")
+	case "RCPT":
+		addr, ok := pathArg(arg, "TO:")
+		switch {
+		case !ss.mail:
+			ss.reply(503, "need MAIL before RCPT")
+		case !ok || addr == "":
+			ss.reply(501, "syntax: RCPT TO:<address>")
+		default:
+			ss.to = append(ss.to, addr)
+			ss.reply(250, "ok")
+		}
+	case "DATA":
+		if len(ss.to) == 0 {
+			ss.reply(503, "need RCPT before DATA")
+			break
+		}
+		ss.reply(354, "end data with <CR><LF>.<CR><LF>")
+		ss.data()
+	case "RSET":
+		ss.reset()
+		ss.reply(250, "ok")
+	case "NOOP":
+		ss.reply(250, "ok")
+	case "VRFY":
+		ss.reply(252, "cannot verify, but will accept")
+	case "QUIT":
+		ss.reply(221, "bye")
+		return false
+	default:
+		ss.reply(502, "command not implemented")
+	}
+	return true
+}
+
+func (ss *session) reset() {
+	ss.from, ss.to, ss.mail = "", nil, false
+}
+
+// pathArg extracts the address from "FROM:<addr> PARAMS".
+func pathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path, _, _ := strings.Cut(strings.TrimSpace(arg[len(prefix):]), " ")
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+	return path[1 : len(path)-1], true
+}
+
+// auth accepts any credentials for the mechanisms announced with EHLO, so
+// that clients configured for a real server work unchanged.
+func (ss *session) auth(arg string) {
+	mech, initial, _ := strings.Cut(arg, " ")
+	// The base64 challenges still to send before the client is done
+	var prompts []string
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		if initial == "" {
+			prompts = []string{""}
+		}
+	case "LOGIN":
+		prompts = []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"} // Username:, Password:
+		if initial != "" {
+			prompts = prompts[1:]
+		}
+	case "CRAM-MD5":
+		prompts = []string{"PDEyMzQ1QG1haWxjLXNpbms+"} // <12345@mailc-sink>
+	default:
+		ss.reply(504, "unrecognized authentication mechanism")
+		return
+	}
+	for _, p := range prompts {
+		ss.reply(334, "%s", p)
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == "*" {
+			ss.reply(501, "authentication cancelled")
+			return
+		}
+	}
+	ss.reply(235, "authentication successful")
+}
+
+// data reads the message following DATA and stores it.
+func (ss *session) data() {
+	limit := ss.srv.maxSize()
+	dr := ss.tp.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(dr, int64(limit)+1))
+	if err != nil {
+		ss.reply(451, "error reading message: %v", err)
+		return
+	}
+	if len(raw) > limit {
+		// Consume the rest so that the connection stays in sync
+		_, _ = io.Copy(io.Discard, dr)
+		ss.reset()
+		ss.reply(552, "message exceeds %d bytes", limit)
+		return
+	}
+	raw = toCRLF(raw)
+	m := newMessage(ss.from, ss.to, time.Now(), raw)
+	ss.reset()
+	if err := ss.srv.Store.Add(m); err != nil {
+		ss.reply(451, "error storing message: %v", err)
+		return
+	}
+	ss.srv.notify()
+	ss.reply(250, "queued as %s", m.ID)
+}
+
+// toCRLF restores the CRLF line endings that textproto's dot reader turns
+// into LF, so that stored messages are valid .eml files.
+func toCRLF(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
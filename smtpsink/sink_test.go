@@ -0,0 +1,185 @@
+package smtpsink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elliot40404/mailc/mailer"
+)
+
+// startSink runs srv on a random local port and returns an SMTP sender
+// pointed at it.
+func startSink(t *testing.T, srv *Server) *mailer.SMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	sender := &mailer.SMTP{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, TLS: mailer.NoTLS}
+	t.Cleanup(func() { _ = sender.Close() })
+	return sender
+}
+
+func testMessage() *mailer.Message {
+	m := mailer.New("Shop <shop@example.com>", "Jane <jane@example.com>")
+	m.Bcc = []string{"audit@example.com"}
+	m.Subject = "Your order – shipped"
+	m.Text = "Hi Jane,\n.your order shipped."
+	m.HTML = `<p>Hi Jane</p><img src="cid:logo">`
+	m.Embed("logo", "logo.png", []byte("\x89PNG fake"))
+	m.Attach("invoice.pdf", []byte("%PDF-1.4"))
+	return m
+}
+
+func TestSink(t *testing.T) {
+	store := &MemoryStore{}
+	srv := New(store)
+	sender := startSink(t, srv)
+	for _, auth := range []string{"PLAIN", "LOGIN", "CRAM-MD5"} {
+		// Any credentials are accepted
+		sender.Username, sender.Password, sender.Auth = "anyone", "anything", auth
+		if err := sender.Send(context.Background(), testMessage()); err != nil {
+			t.Fatalf("Send with %s: %v", auth, err)
+		}
+		_ = sender.Close()
+	}
+
+	msgs, _ := store.List()
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want 3", len(msgs))
+	}
+	m := msgs[0]
+	if m.ID != "1" || m.From != "shop@example.com" || strings.Join(m.To, ",") != "jane@example.com,audit@example.com" {
+		t.Fatalf("unexpected envelope %s: %s -> %v", m.ID, m.From, m.To)
+	}
+	if m.Error != "" {
+		t.Fatalf("decode error: %s", m.Error)
+	}
+	if m.Subject != "Your order – shipped" || m.Text != "Hi Jane,\r\n.your order shipped." || m.HTML != `<p>Hi Jane</p><img src="cid:logo">` {
+		t.Fatalf("unexpected parts %q %q %q", m.Subject, m.Text, m.HTML)
+	}
+	if len(m.Attachments) != 2 || m.Attachments[0].ContentID != "logo" || string(m.Attachments[1].Data) != "%PDF-1.4" {
+		t.Fatalf("unexpected attachments %+v", m.Attachments)
+	}
+	if !strings.Contains(string(m.Raw), "\r\n") || strings.Contains(strings.ReplaceAll(string(m.Raw), "\r\n", ""), "\n") {
+		t.Fatalf("raw message should use CRLF line endings")
+	}
+
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	do := func(method, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(context.Background(), method, ts.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	_, body := do("GET", "/api/messages")
+	var list []struct {
+		ID      string              `json:"id"`
+		Subject string              `json:"subject"`
+		Text    string              `json:"text"`
+		HTML    string              `json:"html"`
+		Headers map[string][]string `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatalf("decode list: %v\n%s", err, body)
+	}
+	if len(list) != 3 || list[2].ID != "3" || list[0].Subject != m.Subject || list[0].Headers["Mime-Version"][0] != "1.0" {
+		t.Fatalf("unexpected list %s", body)
+	}
+
+	if _, page := do("GET", "/"); !strings.Contains(page, `<a href="/m/3">Your order – shipped</a>`) {
+		t.Fatalf("inbox missing message:\n%s", page)
+	}
+	if _, page := do("GET", "/m/1"); !strings.Contains(page, ".your order shipped.") || !strings.Contains(page, "invoice.pdf") {
+		t.Fatalf("message page missing parts:\n%s", page)
+	}
+	if _, html := do("GET", "/m/1/html"); html != `<p>Hi Jane</p><img src="/m/1/cid/logo">` {
+		t.Fatalf("unexpected html %q", html)
+	}
+	if _, img := do("GET", "/m/1/cid/logo"); img != "\x89PNG fake" {
+		t.Fatalf("unexpected inline part %q", img)
+	}
+
+	if code, _ := do("DELETE", "/api/messages/2"); code != http.StatusNoContent {
+		t.Fatalf("DELETE status %d", code)
+	}
+	if code, _ := do("GET", "/api/messages/2"); code != http.StatusNotFound {
+		t.Fatalf("deleted message status %d", code)
+	}
+	if code, _ := do("DELETE", "/api/messages"); code != http.StatusNoContent {
+		t.Fatalf("DELETE all status %d", code)
+	}
+	if _, body := do("GET", "/api/messages"); strings.TrimSpace(body) != "[]" {
+		t.Fatalf("expected an empty list, got %s", body)
+	}
+}
+
+func TestSink_MaxSize(t *testing.T) {
+	srv := New(&MemoryStore{})
+	srv.MaxSize = 512
+	sender := startSink(t, srv)
+	big := testMessage()
+	big.Text = strings.Repeat("x", 1024)
+	err := sender.Send(context.Background(), big)
+	if err == nil || !strings.Contains(err.Error(), "552") {
+		t.Fatalf("err = %v, want 552", err)
+	}
+	small := mailer.New("a@example.com", "b@example.com")
+	small.Text = "ok"
+	if err := sender.Send(context.Background(), small); err != nil {
+		t.Fatalf("Send after rejection: %v", err)
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	sender := startSink(t, New(&DirStore{Dir: dir}))
+	for range 2 {
+		if err := sender.Send(context.Background(), testMessage()); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	// A new store on the same directory sees the messages and continues
+	// their numbering
+	store := &DirStore{Dir: dir}
+	msgs, err := store.List()
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("List = %d messages (%v), want 2", len(msgs), err)
+	}
+	if msgs[1].ID != "2" || msgs[1].Subject != "Your order – shipped" || msgs[1].From != "shop@example.com" {
+		t.Fatalf("unexpected message %+v", msgs[1])
+	}
+	m := newMessage("a@example.com", []string{"b@example.com"}, msgs[0].Received, []byte("Subject: hi\r\n\r\nbody\r\n"))
+	if err := store.Add(m); err != nil || m.ID != "3" {
+		t.Fatalf("Add: id %q (%v), want 3", m.ID, err)
+	}
+	if err := store.Delete("1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get("1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get deleted = %v, want ErrNotFound", err)
+	}
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if msgs, _ := store.List(); len(msgs) != 0 {
+		t.Fatalf("Clear left %d messages", len(msgs))
+	}
+}
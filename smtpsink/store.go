@@ -0,0 +1,220 @@
+package smtpsink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by a Store for an unknown message ID.
+var ErrNotFound = errors.New("smtpsink: message not found")
+
+// Store keeps captured messages. Add assigns the message its ID. List
+// returns messages oldest first.
+type Store interface {
+	Add(m *Message) error
+	List() ([]*Message, error)
+	Get(id string) (*Message, error)
+	Delete(id string) error
+	Clear() error
+}
+
+// MemoryStore keeps messages in memory. The zero value is ready to use.
+type MemoryStore struct {
+	mu   sync.Mutex
+	next int
+	msgs []*Message
+}
+
+func (s *MemoryStore) Add(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	m.ID = strconv.Itoa(s.next)
+	s.msgs = append(s.msgs, m)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.msgs), nil
+}
+
+func (s *MemoryStore) Get(id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.msgs {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.msgs {
+		if m.ID == id {
+			s.msgs = slices.Delete(s.msgs, i, i+1)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) Clear() error {
+	s.mu.Lock()
+	s.msgs = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// DirStore keeps each message as <id>.eml in Dir, next to an <id>.json file
+// holding its envelope, so that messages survive restarts and can be opened
+// in a mail client.
+type DirStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+// envelope is the content of the .json file next to each message.
+type envelope struct {
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Received time.Time `json:"received"`
+}
+
+func (s *DirStore) Add(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	ids, err := s.ids()
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	id := strconv.Itoa(next)
+	env, err := json.MarshalIndent(envelope{From: m.From, To: m.To, Received: m.Received}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.Dir, id+".eml"), m.Raw, 0o644); err != nil {
+		return err
+	}
+	// The envelope is written last; a message without one is not listed
+	if err := os.WriteFile(filepath.Join(s.Dir, id+".json"), env, 0o644); err != nil {
+		return err
+	}
+	m.ID = id
+	return nil
+}
+
+// ids returns the IDs of the stored messages in ascending order.
+func (s *DirStore) ids() ([]int, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, f := range files {
+		if id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (s *DirStore) List() ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		m, err := s.load(strconv.Itoa(id))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func (s *DirStore) Get(id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+func (s *DirStore) load(id string) (*Message, error) {
+	if _, err := strconv.Atoi(id); err != nil {
+		return nil, ErrNotFound
+	}
+	src, err := os.ReadFile(filepath.Join(s.Dir, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var env envelope
+	if err := json.Unmarshal(src, &env); err != nil {
+		return nil, fmt.Errorf("%s.json: %w", id, err)
+	}
+	raw, err := os.ReadFile(filepath.Join(s.Dir, id+".eml"))
+	if err != nil {
+		return nil, err
+	}
+	m := newMessage(env.From, env.To, env.Received, raw)
+	m.ID = id
+	return m, nil
+}
+
+func (s *DirStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.load(id); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.Dir, id+".json")); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(s.Dir, id+".eml"))
+}
+
+func (s *DirStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.ids()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		name := strconv.Itoa(id)
+		if err := os.Remove(filepath.Join(s.Dir, name+".json")); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(s.Dir, name+".eml")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package smtpsink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Handler returns the HTTP handler serving the web inbox and the JSON API:
+//
+//	GET    /api/messages       all messages, oldest first
+//	GET    /api/messages/{id}  one message
+//	DELETE /api/messages/{id}  delete one message
+//	DELETE /api/messages       delete all messages
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /m/{id}", s.handleMessage)
+	mux.HandleFunc("GET /m/{id}/html", s.handleHTML)
+	mux.HandleFunc("GET /m/{id}/raw", s.handleRaw)
+	mux.HandleFunc("GET /m/{id}/cid/{cid}", s.handleCID)
+	mux.HandleFunc("POST /clear", s.handleClear)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.HandleFunc("GET /api/messages", s.handleAPIList)
+	mux.HandleFunc("GET /api/messages/{id}", s.handleAPIGet)
+	mux.HandleFunc("DELETE /api/messages/{id}", s.handleAPIDelete)
+	mux.HandleFunc("DELETE /api/messages", s.handleAPIClear)
+	return mux
+}
+
+// notify tells connected browsers that the inbox changed.
+func (s *Server) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- struct{}{}:
+		default: // a reload is already pending for this client
+		}
+	}
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, _ *http.Request) {
+	msgs, err := s.Store.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slices.Reverse(msgs)
+	render(w, indexPage, msgs)
+}
+
+// find loads the message named by the request, writing an error response
+// when there is none.
+func (s *Server) find(w http.ResponseWriter, r *http.Request) (*Message, bool) {
+	m, err := s.Store.Get(r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return m, true
+}
+
+func (s *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	type header struct{ Name, Value string }
+	var headers []header
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			headers = append(headers, header{k, v})
+		}
+	}
+	render(w, messagePage, map[string]any{"Message": m, "Headers": headers})
+}
+
+// cidRef matches cid: references in src attributes and CSS urls.
+var cidRef = regexp.MustCompile(`(?i)(["'(])cid:([^"')]+)`)
+
+// handleHTML serves the HTML part for the iframe of the message page, with
+// inline parts linked to their cid URLs and scripts disabled.
+func (s *Server) handleHTML(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	html := cidRef.ReplaceAllStringFunc(m.HTML, func(ref string) string {
+		sub := cidRef.FindStringSubmatch(ref)
+		return sub[1] + "/m/" + url.PathEscape(m.ID) + "/cid/" + url.PathEscape(sub[2])
+	})
+	w.Header().Set("Content-Security-Policy", "sandbox allow-popups allow-popups-to-escape-sandbox")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, html)
+}
+
+func (s *Server) handleCID(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	for _, a := range m.Attachments {
+		if a.ContentID == r.PathValue("cid") {
+			w.Header().Set("Content-Type", a.ContentType)
+			_, _ = w.Write(a.Data)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) handleRaw(w http.ResponseWriter, r *http.Request) {
+	m, ok := s.find(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(m.Raw)
+}
+
+func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
+	if err := s.Store.Clear(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.notify()
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	if s.clients == nil {
+		s.clients = make(map[chan struct{}]struct{})
+	}
+	s.clients[ch] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) handleAPIList(w http.ResponseWriter, _ *http.Request) {
+	msgs, err := s.Store.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if msgs == nil {
+		msgs = []*Message{}
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+func (s *Server) handleAPIGet(w http.ResponseWriter, r *http.Request) {
+	m, err := s.Store.Get(r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (s *Server) handleAPIDelete(w http.ResponseWriter, r *http.Request) {
+	if err := s.Store.Delete(r.PathValue("id")); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	s.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAPIClear(w http.ResponseWriter, _ *http.Request) {
+	if err := s.Store.Clear(); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	s.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrNotFound) {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func render(w http.ResponseWriter, t *template.Template, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var funcs = template.FuncMap{
+	"join": strings.Join,
+}
+
+const layout = `{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mailc smtp-sink</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0; color: #222; }
+header { padding: 12px 20px; background: #1f2937; color: #fff; display: flex; justify-content: space-between; }
+header a { color: #fff; text-decoration: none; }
+header button { background: none; border: 1px solid #fff; color: #fff; cursor: pointer; }
+main { padding: 20px; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 6px 12px; border-bottom: 1px solid #ddd; text-align: left; vertical-align: top; }
+iframe { width: 100%; height: 70vh; border: 1px solid #ccc; }
+pre { overflow: auto; padding: 8px; background: #f8f8f8; font-size: 12px; white-space: pre-wrap; }
+.subject { font-size: 1.2em; margin: 0 0 12px; }
+.error { color: #b91c1c; }
+.muted { color: #6b7280; }
+</style>
+<script>new EventSource("/events").addEventListener("reload", () => location.reload());</script>
+</head>
+<body>
+<header><a href="/">mailc smtp-sink</a><form method="post" action="/clear"><button>Delete all</button></form></header>
+<main>
+{{end}}
+{{define "foot"}}</main>
+</body>
+</html>
+{{end}}`
+
+var indexPage = template.Must(template.Must(template.New("layout").Funcs(funcs).Parse(layout)).New("index").Parse(`{{template "head"}}
+<table>
+<tr><th>Received</th><th>From</th><th>To</th><th>Subject</th></tr>
+{{range .}}<tr>
+<td class="muted">{{.Received.Format "15:04:05"}}</td>
+<td>{{.From}}</td>
+<td>{{join .To ", "}}</td>
+<td><a href="/m/{{.ID}}">{{or .Subject "(no subject)"}}</a></td>
+</tr>
+{{else}}<tr><td colspan="4" class="muted">No messages yet. Point your SMTP client at this server.</td></tr>
+{{end}}</table>
+{{template "foot"}}`))
+
+var messagePage = template.Must(template.Must(template.New("layout").Funcs(funcs).Parse(layout)).New("message").Parse(`{{template "head"}}
+{{with .Message}}
+<p class="subject"><strong>{{or .Subject "(no subject)"}}</strong></p>
+<p class="muted">From {{.From}} to {{join .To ", "}} at {{.Received.Format "2006-01-02 15:04:05"}} · {{.Size}} bytes · <a href="/m/{{.ID}}/raw">raw</a></p>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+{{if .HTML}}<h2>HTML</h2>
+<iframe src="/m/{{.ID}}/html" sandbox="allow-popups allow-popups-to-escape-sandbox" title="HTML part"></iframe>{{end}}
+{{if .Text}}<h2>Text</h2>
+<pre>{{.Text}}</pre>{{end}}
+{{with .Attachments}}<h2>Attachments</h2>
+<ul>{{range .}}<li>{{or .Filename .ContentID}} ({{.ContentType}}, {{.Size}} bytes)</li>{{end}}</ul>{{end}}
+{{end}}
+<h2>Headers</h2>
+<table>{{range .Headers}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+{{template "foot"}}`))